@@ -3,58 +3,54 @@ package main
 import (
 	"apipay/config"
 	"apipay/model"
+	"apipay/oidc/oidctest"
 	"apipay/persistent"
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 const (
 	testTimeOut = time.Second * 10
 )
 
-func createSupportItems(ctx context.Context, dbName string) (persistent.Payments, *zap.Logger, error) {
+// createSupportItems creates what the handlers need. The API tests run against
+// the in-memory store, the Mongo one is tested in the persistent package. They
+// run without authentication, but the ones of the API keys and the JWTs
+func createSupportItems(ctx context.Context) (persistent.Stores, *zap.Logger, error) {
 
 	err := config.Load()
 	if err != nil {
-		return persistent.Payments{}, nil, err
-	}
-
-	client, err := persistent.Connect(ctx,
-		viper.GetString(config.MongoHost),
-		viper.GetInt(config.MongoPort),
-		viper.GetString(config.MongoUser),
-		viper.GetString(config.MongoPassword))
-
-	if err != nil {
-		return persistent.Payments{}, nil, err
-	}
-
-	client.UseDatabase(dbName)
-	paymentsDb, err := persistent.GetPayments(ctx, client)
-	if err != nil {
-		return persistent.Payments{}, nil, err
-	}
-
-	err = client.DropDatabase(ctx) // for the test we want an empty DB every time
-	if err != nil {
-		return persistent.Payments{}, nil, err
+		return persistent.Stores{}, nil, err
 	}
+	viper.Set(config.Auth, config.AuthNone)
 
 	logger, err := zap.NewProduction()
 	if err != nil {
-		return persistent.Payments{}, nil, err
+		return persistent.Stores{}, nil, err
 	}
-	return paymentsDb, logger, nil
+	return persistent.NewMemoryStores(viper.GetDuration(config.IdempotencyTTL)), logger, nil
 }
 
 func testPayment(id model.PaymentID) model.Payment {
@@ -63,44 +59,122 @@ func testPayment(id model.PaymentID) model.Payment {
 		Type:           "Payment",
 		ID:             id,
 		OrganisationID: "testOrg",
+		Attributes: model.Attributes{
+			Amount: model.Money{Value: model.MustParseDecimal("100.21"), Currency: "GBP"},
+		},
 	}
 }
 func TestGetList(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
 	defer cancel()
 
-	db, logger, err := createSupportItems(ctx, "api_list")
+	stores, logger, err := createSupportItems(ctx)
 	assert.NoError(t, err, "We can init the needed deps")
 
-	router := getHandler(logger, db)
+	router := getHandler(logger, stores, newHealth())
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/payments/", nil)
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusOK, w.Code)
-	obj := []model.Payment{}
+	obj := PaymentList{}
 	err = json.Unmarshal(w.Body.Bytes(), &obj)
 	assert.NoError(t, err, "We can unmarshal the json")
 
-	assert.Equal(t, 0, len(obj))
+	assert.Equal(t, 0, len(obj.Data))
+	assert.Empty(t, obj.NextCursor, "There is no next page")
+}
+
+func TestGetListPages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	router := getHandler(logger, stores, newHealth())
+
+	for _, id := range []model.PaymentID{"1", "2", "3"} {
+		_, err = stores.Payments.Save(ctx, testPayment(id))
+		assert.NoError(t, err, "We can save a payment")
+	}
+
+	// first page
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/payments/?limit=2", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	page := PaymentList{}
+	err = json.Unmarshal(w.Body.Bytes(), &page)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.Equal(t, 2, len(page.Data))
+	assert.Equal(t, model.PaymentID("3"), page.Data[0].ID, "Newest first")
+	assert.NotEmpty(t, page.NextCursor, "There is a next page")
+
+	// a new payment does not move the pages
+	_, err = stores.Payments.Save(ctx, testPayment("4"))
+	assert.NoError(t, err, "We can save a payment")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/payments/?limit=2&cursor="+page.NextCursor, nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	page = PaymentList{}
+	err = json.Unmarshal(w.Body.Bytes(), &page)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.Equal(t, 1, len(page.Data))
+	assert.Equal(t, model.PaymentID("1"), page.Data[0].ID, "We got the oldest")
+	assert.Empty(t, page.NextCursor, "It is the last page")
+
+	// filtering and sorting
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/payments/?organisation_id=testOrg&processing_date_to=2019-01-01&sort=processing_date", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	page = PaymentList{}
+	err = json.Unmarshal(w.Body.Bytes(), &page)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.Equal(t, 4, len(page.Data))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/payments/?organisation_id=otherOrg", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	page = PaymentList{}
+	err = json.Unmarshal(w.Body.Bytes(), &page)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.Equal(t, 0, len(page.Data))
+
+	// bad params
+	for _, query := range []string{"limit=0", "limit=abc", "cursor=notacursor", "sort=id",
+		"processing_date_from=18-01-2017", "amount_min=1e5"} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/payments/?"+query, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
 }
 
 func TestGetOneInsertOne(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
 	defer cancel()
 
-	db, logger, err := createSupportItems(ctx, "api_one")
+	stores, logger, err := createSupportItems(ctx)
 	assert.NoError(t, err, "We can init the needed deps")
 
-	router := getHandler(logger, db)
+	router := getHandler(logger, stores, newHealth())
 
 	payment1 := testPayment(model.PaymentID("12345"))
 
 	// get a payment (no payment available)
 	w := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/payments/"+string(payment1.ID), nil)
-	assert.NoError(t, err, "We can can the http request")
+	assert.NoError(t, err, "We can create the http request")
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusNotFound, w.Code)
@@ -110,14 +184,23 @@ func TestGetOneInsertOne(t *testing.T) {
 	assert.NoError(t, err, "We can marshal to json")
 	req, err = http.NewRequest("POST", "/payments/", bytes.NewBuffer(payment1Json))
 	w = httptest.NewRecorder()
-	assert.NoError(t, err, "We can can the http request")
+	assert.NoError(t, err, "We can create the http request")
 	router.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "/payments/12345", w.Header().Get("Location"), "We got where it is")
+
+	created := model.Payment{}
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.Equal(t, model.StatusPending, created.Status, "New payments are pending")
+	assert.Equal(t, 1, len(created.StatusHistory), "The history has the creation")
+	created.Status, created.StatusHistory = "", nil
+	assert.True(t, reflect.DeepEqual(payment1, created), "We got what we created")
 
 	// get payment again, this time it is there
 	req, err = http.NewRequest("GET", "/payments/"+string(payment1.ID), nil)
 	w = httptest.NewRecorder()
-	assert.NoError(t, err, "We can can the http request")
+	assert.NoError(t, err, "We can create the http request")
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusOK, w.Code)
@@ -131,10 +214,10 @@ func TestInsertUpdateGetAll(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
 	defer cancel()
 
-	db, logger, err := createSupportItems(ctx, "api_insertupdategetall")
+	stores, logger, err := createSupportItems(ctx)
 	assert.NoError(t, err, "We can init the needed deps")
 
-	router := getHandler(logger, db)
+	router := getHandler(logger, stores, newHealth())
 
 	payment1 := testPayment(model.PaymentID("12345"))
 
@@ -142,7 +225,7 @@ func TestInsertUpdateGetAll(t *testing.T) {
 	payment1Json, err := json.Marshal(payment1)
 	assert.NoError(t, err, "We can marshal to json")
 	req, err := http.NewRequest("POST", "/payments/", bytes.NewBuffer(payment1Json))
-	assert.NoError(t, err, "We can can the http request")
+	assert.NoError(t, err, "We can create the http request")
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusCreated, w.Code)
@@ -150,7 +233,7 @@ func TestInsertUpdateGetAll(t *testing.T) {
 	// get payment again, this time it is there
 	req, err = http.NewRequest("GET", "/payments/"+string(payment1.ID), nil)
 	w = httptest.NewRecorder()
-	assert.NoError(t, err, "We can can the http request")
+	assert.NoError(t, err, "We can create the http request")
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusOK, w.Code)
@@ -164,33 +247,110 @@ func TestInsertUpdateGetAll(t *testing.T) {
 	assert.NoError(t, err, "We can marshal to json")
 
 	req, err = http.NewRequest("PUT", "/payments/"+string(payment1.ID), bytes.NewBuffer(payment1Json))
-	assert.NoError(t, err, "We can can the http request")
+	assert.NoError(t, err, "We can create the http request")
 	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusOK, w.Code)
 
+	updated := model.Payment{}
+	err = json.Unmarshal(w.Body.Bytes(), &updated)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.Equal(t, uint(1), updated.Version, "We got the new version")
+	assert.Equal(t, "updatedOrg", updated.OrganisationID, "We got what we updated")
+
 	// get payment again, it got updated
 	req, err = http.NewRequest("GET", "/payments/"+string(payment1.ID), nil)
 	w = httptest.NewRecorder()
-	assert.NoError(t, err, "We can can the http request")
+	assert.NoError(t, err, "We can create the http request")
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusOK, w.Code)
 	obj = model.Payment{}
 	err = json.Unmarshal(w.Body.Bytes(), &obj)
 	assert.NoError(t, err, "We can unmarshal the json")
+	payment1.Version++ // the server increments it
+	assert.Equal(t, model.StatusPending, obj.Status, "The update kept the status")
+	obj.Status, obj.StatusHistory = "", nil
 	assert.True(t, reflect.DeepEqual(payment1, obj), "We got what we saved")
 
 }
 
+func TestUpdateVersions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	router := getHandler(logger, stores, newHealth())
+
+	payment1 := testPayment(model.PaymentID("12345"))
+	_, err = stores.Payments.Save(ctx, payment1)
+	assert.NoError(t, err, "We can save a payment")
+
+	// get it, with its ETag
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/payments/"+string(payment1.ID), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	tag := w.Header().Get("ETag")
+	assert.Equal(t, `"0"`, tag)
+
+	// nothing changed since then
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/payments/"+string(payment1.ID), nil)
+	req.Header.Set("If-None-Match", tag)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	put := func(payment model.Payment, ifMatch string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(payment)
+		assert.NoError(t, err, "We can marshal to json")
+		req, _ := http.NewRequest("PUT", "/payments/"+string(payment.ID), bytes.NewBuffer(body))
+		if len(ifMatch) > 0 {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// update with the ETag
+	payment1.OrganisationID = "first"
+	w = put(payment1, tag)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"1"`, w.Header().Get("ETag"), "We got the new version")
+
+	// the same again, it is not the latest version anymore
+	w = put(payment1, tag)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+	// the version in the body is old too
+	w = put(payment1, "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// with the right one
+	payment1.Version = 1
+	w = put(payment1, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// whatever the version is
+	w = put(payment1, "*")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"3"`, w.Header().Get("ETag"), "We got the new version")
+
+	w = put(payment1, "garbage")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
 func TestUpdateInvalid(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
 	defer cancel()
 
-	db, logger, err := createSupportItems(ctx, "api_updateinvalid")
+	stores, logger, err := createSupportItems(ctx)
 	assert.NoError(t, err, "We can init the needed deps")
 
-	router := getHandler(logger, db)
+	router := getHandler(logger, stores, newHealth())
 
 	payment1 := testPayment(model.PaymentID("12345"))
 
@@ -200,26 +360,1182 @@ func TestUpdateInvalid(t *testing.T) {
 
 	//not matching IDs
 	req, err := http.NewRequest("PUT", "/payments/blabla", bytes.NewBuffer(payment1Json))
-	assert.NoError(t, err, "We can can the http request")
+	assert.NoError(t, err, "We can create the http request")
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusBadRequest, w.Code)
 
 	// not found
 	req, err = http.NewRequest("PUT", "/payments/"+string(payment1.ID), bytes.NewBuffer(payment1Json))
-	assert.NoError(t, err, "We can can the http request")
+	assert.NoError(t, err, "We can create the http request")
 	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusNotFound, w.Code)
 
 	// invalid payment
 	payment1.OrganisationID = ""
+	payment1.Attributes.Amount.Currency = "XXX"
 	payment1Json, err = json.Marshal(payment1)
 	assert.NoError(t, err, "We can marshal to json")
 
 	req, err = http.NewRequest("PUT", "/payments/"+string(payment1.ID), bytes.NewBuffer(payment1Json))
-	assert.NoError(t, err, "We can can the http request")
+	assert.NoError(t, err, "We can create the http request")
 	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	obj := APIError{}
+	err = json.Unmarshal(w.Body.Bytes(), &obj)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.Equal(t, "validation_failed", obj.Code)
+	assert.Equal(t, []model.Violation{
+		{Field: "organisation_id", Message: "is required"},
+		{Field: "attributes.currency", Message: "must be an ISO 4217 currency code, like GBP"},
+	}, obj.Details, "We got what is not valid")
+}
+
+func TestCreateMalformedAmount(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	router := getHandler(logger, stores, newHealth())
+
+	body := `{"type": "Payment", "id": "12345", "organisation_id": "testOrg",
+		"attributes": {"amount": "abc", "currency": "GBP", "fx": {"original_amount": "1,5", "original_currency": "EUR"}}}`
+	req, err := http.NewRequest("POST", "/payments/", bytes.NewBufferString(body))
+	assert.NoError(t, err, "We can create the http request")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	obj := APIError{}
+	err = json.Unmarshal(w.Body.Bytes(), &obj)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.Equal(t, "validation_failed", obj.Code, "It is not a json error")
+	assert.Equal(t, []model.Violation{
+		{Field: "attributes.amount", Message: "must be a decimal number, like 100.21"},
+		{Field: "attributes.fx.exchange_rate", Message: "is required"},
+		{Field: "attributes.fx.original_amount", Message: "must be a decimal number, like 100.21"},
+	}, obj.Details, "The amounts are reported in their fields")
+}
+
+func TestErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	router := getHandler(logger, stores, newHealth())
+
+	payment1 := testPayment(model.PaymentID("12345"))
+	payment1Json, err := json.Marshal(payment1)
+	assert.NoError(t, err, "We can marshal to json")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   []byte
+		status int
+		code   string
+	}{
+		{"not found", "GET", "/payments/12345", nil, http.StatusNotFound, "not_found"},
+		{"created", "POST", "/payments/", payment1Json, http.StatusCreated, ""},
+		{"duplicate", "POST", "/payments/", payment1Json, http.StatusConflict, "duplicate"},
+		{"not json", "POST", "/payments/", []byte("{"), http.StatusBadRequest, "invalid_json"},
+		{"id mismatch", "PUT", "/payments/other", payment1Json, http.StatusBadRequest, "id_mismatch"},
+		{"bad param", "GET", "/payments/?sort=id", nil, http.StatusBadRequest, "invalid_parameter"},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.path, bytes.NewBuffer(tt.body))
+		assert.NoError(t, err, "We can create the http request")
+		req.Header.Set("X-Request-ID", "request-"+tt.name)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tt.status, w.Code, tt.name)
+
+		if len(tt.code) == 0 {
+			continue
+		}
+		obj := APIError{}
+		err = json.Unmarshal(w.Body.Bytes(), &obj)
+		assert.NoError(t, err, "We can unmarshal the json")
+		assert.Equal(t, tt.code, obj.Code, tt.name)
+		assert.NotEmpty(t, obj.Message, tt.name)
+		assert.Equal(t, "request-"+tt.name, obj.RequestID, tt.name)
+	}
+}
+
+func TestCreateIdempotent(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	router := getHandler(logger, stores, newHealth())
+
+	post := func(payment model.Payment, key string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(payment)
+		assert.NoError(t, err, "We can marshal to json")
+		req, _ := http.NewRequest("POST", "/payments/", bytes.NewBuffer(body))
+		req.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	payment1 := testPayment(model.PaymentID("12345"))
+
+	w := post(payment1, "key1")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"), "It is the first one")
+
+	// a retry gets the same response, and it is not created twice
+	w = post(payment1, "key1")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"), "It is replayed")
+
+	// the same json formatted in a different way is the same request
+	body, err := json.MarshalIndent(payment1, "", "  ")
+	assert.NoError(t, err, "We can marshal to json")
+	req, _ := http.NewRequest("POST", "/payments/", bytes.NewBuffer(body))
+	req.Header.Set("Idempotency-Key", "key1")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code, "The spaces do not change the request")
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"), "It is replayed")
+
+	// the same key with a different payment
+	payment2 := testPayment(model.PaymentID("67890"))
+	w = post(payment2, "key1")
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// the same key in a different organisation is a different key
+	payment2.OrganisationID = "otherOrg"
+	w = post(payment2, "key1")
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// without a key the duplicate is not replayed
+	req, _ = http.NewRequest("POST", "/payments/", bytes.NewBufferString(`{"type":"Payment","id":"12345","organisation_id":"testOrg"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.NotEqual(t, http.StatusCreated, w.Code)
+
+	// the body is read before it is validated, so it is limited
+	payment3 := testPayment(model.PaymentID("13579"))
+	payment3.Attributes.Reference = strings.Repeat("x", maxPaymentSize)
+	w = post(payment3, "key3")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, "The payment is too large")
+}
+
+// panickingPayments panics when saving while panicking is set
+type panickingPayments struct {
+	persistent.PaymentStore
+	panicking bool
+}
+
+func (p *panickingPayments) Save(ctx context.Context, payment model.Payment) (model.Payment, error) {
+	if p.panicking {
+		panic("saving")
+	}
+	return p.PaymentStore.Save(ctx, payment)
+}
+
+func TestCreateIdempotentPanic(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+	payments := &panickingPayments{PaymentStore: stores.Payments, panicking: true}
+	stores.Payments = payments
+
+	router := getHandler(logger, stores, newHealth())
+
+	body, err := json.Marshal(testPayment(model.PaymentID("12345")))
+	assert.NoError(t, err, "We can marshal to json")
+	post := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/payments/", bytes.NewBuffer(body))
+		req.Header.Set("Idempotency-Key", "key1")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post()
+	assert.Equal(t, http.StatusInternalServerError, w.Code, "The panic is recovered")
+
+	payments.panicking = false
+	w = post()
+	assert.Equal(t, http.StatusCreated, w.Code, "The key is released, it is not in progress")
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"), "It is not a replay")
+}
+
+func TestCreateGeneratedID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	router := getHandler(logger, stores, newHealth())
+
+	payment1 := testPayment(model.PaymentID(""))
+	payment1Json, err := json.Marshal(payment1)
+	assert.NoError(t, err, "We can marshal to json")
+
+	req, err := http.NewRequest("POST", "/payments/", bytes.NewBuffer(payment1Json))
+	assert.NoError(t, err, "We can create the http request")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	created := model.Payment{}
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.Len(t, string(created.ID), 36, "We got a UUID")
+	assert.Equal(t, "/payments/"+string(created.ID), w.Header().Get("Location"), "We got where it is")
+
+	_, err = stores.Payments.Get(ctx, created.ID, persistent.GetOptions{})
+	assert.NoError(t, err, "It is stored with that ID")
+}
+
+func TestInvalidIDs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	router := getHandler(logger, stores, newHealth())
+
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		req, err := http.NewRequest(method, "/payments/not%20valid", nil)
+		assert.NoError(t, err, "We can create the http request")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, method)
+	}
+
+	payment1 := testPayment(model.PaymentID("12345"))
+	payment1.OrganisationID = "not/valid"
+	payment1Json, err := json.Marshal(payment1)
+	assert.NoError(t, err, "We can marshal to json")
+
+	req, err := http.NewRequest("POST", "/payments/", bytes.NewBuffer(payment1Json))
+	assert.NoError(t, err, "We can create the http request")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDeleteRestore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	router := getHandler(logger, stores, newHealth())
+
+	payment1 := testPayment(model.PaymentID("12345"))
+	_, err = stores.Payments.Save(ctx, payment1)
+	assert.NoError(t, err, "We can save a payment")
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, nil)
+		assert.NoError(t, err, "We can create the http request")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/payments/12345").Code)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/payments/12345").Code, "It is already deleted")
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/payments/67890").Code, "It is not there")
+
+	assert.Equal(t, http.StatusNotFound, do("GET", "/payments/12345").Code)
+
+	w := do("GET", "/payments/12345?include_deleted=true")
+	assert.Equal(t, http.StatusOK, w.Code)
+	obj := model.Payment{}
+	err = json.Unmarshal(w.Body.Bytes(), &obj)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.NotNil(t, obj.Deleted, "It is marked as deleted")
+
+	w = do("GET", "/payments/?include_deleted=true")
+	assert.Equal(t, http.StatusOK, w.Code)
+	page := PaymentList{}
+	err = json.Unmarshal(w.Body.Bytes(), &page)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.Equal(t, 1, len(page.Data), "It can be listed")
+
+	assert.Equal(t, http.StatusOK, do("POST", "/payments/12345/restore").Code)
+	assert.Equal(t, http.StatusConflict, do("POST", "/payments/12345/restore").Code, "It is not deleted")
+	assert.Equal(t, http.StatusNotFound, do("POST", "/payments/67890/restore").Code, "It is not there")
+	assert.Equal(t, http.StatusOK, do("GET", "/payments/12345").Code)
+	assert.Equal(t, http.StatusBadRequest, do("GET", "/payments/12345?include_deleted=maybe").Code)
+}
+
+func TestTransitions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	router := getHandler(logger, stores, newHealth())
+
+	_, err = stores.Payments.Save(ctx, testPayment(model.PaymentID("12345")))
+	assert.NoError(t, err, "We can save a payment")
+
+	do := func(path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		assert.NoError(t, err, "We can create the http request")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusConflict, do("/payments/12345/settle", "").Code, "Pending payments cannot be settled")
+	assert.Equal(t, http.StatusNotFound, do("/payments/67890/submit", "").Code, "It is not there")
+	assert.Equal(t, http.StatusBadRequest, do("/payments/12345/submit", "{").Code, "The body is not valid")
+
+	w := do("/payments/12345/submit", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"1"`, w.Header().Get("ETag"), "The version got incremented")
+
+	w = do("/payments/12345/reject", `{"reason": "not enough funds"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	obj := model.Payment{}
+	err = json.Unmarshal(w.Body.Bytes(), &obj)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.Equal(t, model.StatusRejected, obj.Status, "It is rejected")
+	assert.Equal(t, 3, len(obj.StatusHistory), "The history has all the changes")
+
+	w = do("/payments/12345/return", "")
+	assert.Equal(t, http.StatusConflict, w.Code, "Rejected payments cannot be returned")
+	apiErr := APIError{}
+	err = json.Unmarshal(w.Body.Bytes(), &apiErr)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.Equal(t, codeInvalidTransition, apiErr.Code, "We got why")
+}
+
+func TestHistory(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	router := getHandler(logger, stores, newHealth())
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, nil)
+		assert.NoError(t, err, "We can create the http request")
+		req.Header.Set(requestIDHeader, "request-1")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, do("GET", "/payments/12345/history").Code, "It is not there")
+	assert.Equal(t, http.StatusBadRequest, do("GET", "/payments/not valid/history").Code, "The ID is not valid")
+
+	_, err = stores.Payments.Save(ctx, testPayment(model.PaymentID("12345")))
+	assert.NoError(t, err, "We can save a payment")
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/payments/12345").Code)
+
+	w := do("GET", "/payments/12345/history")
+	assert.Equal(t, http.StatusOK, w.Code, "Deleted payments have history")
+	history := PaymentHistory{}
+	err = json.Unmarshal(w.Body.Bytes(), &history)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.Equal(t, 2, len(history.Data), "It was created and deleted")
+	if len(history.Data) == 2 {
+		assert.Equal(t, model.OperationDelete, history.Data[1].Operation, "The last change is the delete")
+		assert.Equal(t, "request-1", history.Data[1].RequestID, "We know the request that deleted it")
+	}
+}
+
+func TestSummary(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	router := getHandler(logger, stores, newHealth())
+
+	for _, id := range []model.PaymentID{"1", "2"} {
+		_, err = stores.Payments.Save(ctx, testPayment(id))
+		assert.NoError(t, err, "We can save a payment")
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/payments/summary?group_by=organisation_id,processing_date", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	summary := PaymentSummary{}
+	err = json.Unmarshal(w.Body.Bytes(), &summary)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.Equal(t, 1, len(summary.Data), "All the payments are in the same group")
+	if len(summary.Data) == 1 {
+		assert.Equal(t, int64(2), summary.Data[0].Count, "Both payments are added")
+		assert.Equal(t, model.MustParseDecimal("200.42"), summary.Data[0].Amount, "The amounts are added")
+		assert.Equal(t, "GBP", summary.Data[0].Currency, "It is the total in GBP")
+	}
+
+	for _, query := range []string{"group_by=id", "processing_date_from=18-01-2017", "amount_max=abc"} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/payments/summary?"+query, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestCreateBatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	defer viper.Set(config.BatchMaxSize, viper.GetInt(config.BatchMaxSize))
+	viper.Set(config.BatchMaxSize, 4)
+	defer viper.Set(config.BatchMaxBodySize, viper.GetString(config.BatchMaxBodySize))
+	viper.Set(config.BatchMaxBodySize, "64KB")
+
+	router := getHandler(logger, stores, newHealth())
+
+	_, err = stores.Payments.Save(ctx, testPayment(model.PaymentID("1")))
+	assert.NoError(t, err, "We can save a payment")
+
+	post := func(contentType string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/payments/batch", bytes.NewBufferString(body))
+		assert.NoError(t, err, "We can create the http request")
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	marshal := func(payment model.Payment) string {
+		body, err := json.Marshal(payment)
+		assert.NoError(t, err, "We can marshal to json")
+		return string(body)
+	}
+
+	invalid := testPayment(model.PaymentID("3"))
+	invalid.Attributes.Amount.Currency = "XXX"
+	generated := testPayment(model.PaymentID(""))
+
+	statuses := func(w *httptest.ResponseRecorder) []int {
+		result := BatchResult{}
+		err := json.Unmarshal(w.Body.Bytes(), &result)
+		assert.NoError(t, err, "We can unmarshal the json")
+		var res []int
+		for i, item := range result.Items {
+			assert.Equal(t, i, item.Index, "They are in order")
+			res = append(res, item.Status)
+		}
+		return res
+	}
+
+	// a json array
+	w := post("application/json", "["+marshal(testPayment("1"))+","+marshal(testPayment("2"))+","+
+		marshal(invalid)+","+marshal(generated)+"]")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []int{http.StatusConflict, http.StatusCreated, http.StatusBadRequest, http.StatusCreated},
+		statuses(w), "Each payment has its own result")
+
+	// NDJSON
+	w = post(ndjsonContentType, marshal(testPayment("5"))+"\n\n{not json\n"+marshal(testPayment("5"))+"\n")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []int{http.StatusCreated, http.StatusBadRequest, http.StatusConflict},
+		statuses(w), "Each line has its own result")
+
+	res, err := stores.Payments.List(ctx, persistent.ListOptions{})
+	assert.NoError(t, err, "We can list the payments")
+	assert.Equal(t, 4, len(res.Items), "Only the valid ones got created")
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(ndjsonContentType, strings.Repeat(marshal(generated)+"\n", 5)).Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post("application/json", "["+strings.Repeat(marshal(generated)+",", 4)+marshal(generated)+"]").Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post("application/json", "["+strings.Repeat(marshal(generated)+",", 5)+"{not json").Code,
+		"The array is read until there are too many payments")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post("application/json", `[{"id": "`+strings.Repeat("1", 64*1024)+`"}]`).Code,
+		"The body is limited")
+	assert.Equal(t, http.StatusBadRequest, post("application/json", "[]").Code, "The batch is empty")
+	assert.Equal(t, http.StatusBadRequest, post("application/json", "").Code, "The batch is empty")
+	assert.Equal(t, http.StatusBadRequest, post("application/json", marshal(generated)).Code, "It is not an array")
+	assert.Equal(t, http.StatusBadRequest, post("application/json", "["+marshal(generated)+"] {}").Code, "There is nothing after the array")
+	assert.Equal(t, http.StatusBadRequest, post("application/json", "["+marshal(generated)+"]]").Code, "There is nothing after the array")
+	assert.Equal(t, http.StatusBadRequest, post("application/json", "["+marshal(generated)).Code, "The array is closed")
+}
+
+// failingAfterSave saves the payments of the batches, but then fails
+type failingAfterSave struct {
+	persistent.PaymentStore
+}
+
+func (f *failingAfterSave) SaveMany(ctx context.Context, objs []model.Payment) ([]model.Payment, []error, error) {
+	saved, errs, _ := f.PaymentStore.SaveMany(ctx, objs)
+	return saved, errs, errors.New("the audit could not be written")
+}
+
+func TestCreateBatchPartial(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+	stores.Payments = &failingAfterSave{PaymentStore: stores.Payments}
+
+	router := getHandler(logger, stores, newHealth())
+
+	body, err := json.Marshal([]model.Payment{testPayment("1"), testPayment("1")})
+	assert.NoError(t, err, "We can marshal to json")
+	req, err := http.NewRequest("POST", "/payments/batch", bytes.NewBuffer(body))
+	assert.NoError(t, err, "We can create the http request")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "Some were saved, so the client gets the results")
+
+	result := BatchResult{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result), "We can unmarshal the json")
+	if assert.Len(t, result.Items, 2) {
+		assert.Equal(t, http.StatusCreated, result.Items[0].Status, "The saved one is created")
+		assert.Equal(t, http.StatusConflict, result.Items[1].Status, "The duplicate is not")
+	}
+}
+
+func TestExport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	router := getHandler(logger, stores, newHealth())
+
+	for _, id := range []model.PaymentID{"1", "2", "3"} {
+		_, err = stores.Payments.Save(ctx, testPayment(id))
+		assert.NoError(t, err, "We can save a payment")
+	}
+
+	get := func(query string, accept string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/payments/export"+query, nil)
+		assert.NoError(t, err, "We can create the http request")
+		if len(accept) > 0 {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// NDJSON by default
+	w := get("?sort=created", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, ndjsonContentType, w.Header().Get("Content-Type"), "We got NDJSON")
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	assert.Equal(t, 3, len(lines), "One line per payment")
+	payment := model.Payment{}
+	err = json.Unmarshal([]byte(lines[0]), &payment)
+	assert.NoError(t, err, "Each line is a payment")
+	assert.Equal(t, model.PaymentID("1"), payment.ID, "In the order asked")
+
+	// CSV
+	w = get("?organisation_id=testOrg", "text/csv")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"), "We got CSV")
+	lines = strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	assert.Equal(t, 4, len(lines), "A header and one line per payment")
+	assert.True(t, strings.HasPrefix(lines[0], "id,type,version,organisation_id,status,amount,currency"), "There is a header")
+	assert.True(t, strings.HasPrefix(lines[1], "3,Payment,0,testOrg,pending,100.21,GBP"), "Newest first")
+
+	// nothing matching
+	w = get("?organisation_id=otherOrg", "text/csv")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, strings.Count(w.Body.String(), "\n"), "There is only the header")
+
+	w = get("?amount_max=abc", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code, "The filters are checked")
+
+	w = get("", "application/xml")
+	assert.Equal(t, http.StatusNotAcceptable, w.Code, "Only NDJSON and CSV")
+}
+
+func TestEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	server := httptest.NewServer(getHandler(logger, stores, newHealth()))
+	defer server.Close()
+
+	// follow returns the events of the feed, after lastID
+	follow := func(lastID string) (*http.Response, *bufio.Reader) {
+		req, err := http.NewRequest("GET", server.URL+"/payments/events", nil)
+		assert.NoError(t, err, "We can create the http request")
+		if len(lastID) > 0 {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		res, err := http.DefaultClient.Do(req.WithContext(ctx))
+		assert.NoError(t, err, "We can do the request")
+		return res, bufio.NewReader(res.Body)
+	}
+	// next reads the next event of a feed
+	next := func(reader *bufio.Reader) (id string, event model.Event) {
+		for {
+			line, err := reader.ReadString('\n')
+			assert.NoError(t, err, "We can read the feed")
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+				assert.NoError(t, err, "The data is an event")
+			case len(line) == 0 && len(id) > 0:
+				return
+			}
+		}
+	}
+
+	res, reader := follow("")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"), "It is a SSE feed")
+
+	for _, id := range []model.PaymentID{"1", "2"} {
+		_, err = stores.Payments.Save(ctx, testPayment(id))
+		assert.NoError(t, err, "We can save a payment")
+	}
+	_, err = stores.Payments.Delete(ctx, "1")
+	assert.NoError(t, err, "We can delete a payment")
+
+	firstID, first := next(reader)
+	assert.Equal(t, firstID, first.ID, "The ID of the event is in the feed")
+	assert.Equal(t, model.EventCreated, first.Type, "The first one was created")
+	assert.Equal(t, model.PaymentID("1"), first.Payment.ID, "It has the payment")
+	res.Body.Close()
+
+	// resuming after the first one
+	res, reader = follow(firstID)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	_, second := next(reader)
+	assert.Equal(t, model.PaymentID("2"), second.PaymentID, "We got the next one")
+	_, third := next(reader)
+	assert.Equal(t, model.EventDeleted, third.Type, "And then the deletion")
+	res.Body.Close()
+
+	res, _ = follow("not an id")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "We cannot resume from what is not an ID")
+	res.Body.Close()
+
+	res, _ = follow("other-1")
+	assert.Equal(t, http.StatusGone, res.StatusCode, "We cannot resume from an event too old")
+	res.Body.Close()
+}
+
+func TestEventsShutdown(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	h := newHealth()
+	server := httptest.NewServer(getHandler(logger, stores, h))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/payments/events", nil)
+	assert.NoError(t, err, "We can create the http request")
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	assert.NoError(t, err, "We can do the request")
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	h.stop()
+	_, err = ioutil.ReadAll(res.Body)
+	assert.NoError(t, err, "The feed ends when the server stops, before the test times out")
+	assert.NoError(t, ctx.Err(), "It did not wait for the timeout")
+}
+
+func TestWebhooks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	router := getHandler(logger, stores, newHealth())
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+		assert.NoError(t, err, "We can create the http request")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/webhooks/", `{"organisation_id": "testOrg", "url": "https://example.com/hooks", "event_types": ["payment.created"]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	created := model.Webhook{}
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.NotEmpty(t, created.ID, "It got an ID")
+	assert.NotEmpty(t, created.Secret, "It got a secret")
+	assert.Equal(t, "/webhooks/"+string(created.ID), w.Header().Get("Location"), "We know where it is")
+
+	w = do("POST", "/webhooks/", `{"organisation_id": "testOrg", "url": "ftp://example.com", "event_types": ["payment.lost"]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "The webhook is validated")
+	assert.Equal(t, 2, strings.Count(w.Body.String(), `"field"`), "Both the URL and the events are wrong")
+
+	w = do("GET", "/webhooks/"+string(created.ID), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	got := model.Webhook{}
+	err = json.Unmarshal(w.Body.Bytes(), &got)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.Empty(t, got.Secret, "The secret is only returned when created")
+
+	w = do("GET", "/webhooks/?organisation_id=otherOrg", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	list := WebhookList{}
+	err = json.Unmarshal(w.Body.Bytes(), &list)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.Equal(t, 0, len(list.Data), "There are none of other organisations")
+
+	w = do("PUT", "/webhooks/"+string(created.ID), `{"organisation_id": "testOrg", "url": "https://example.com/other"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "https://example.com/other", "The URL changed")
+
+	w = do("PUT", "/webhooks/"+string(created.ID), `{"organisation_id": "otherOrg", "url": "https://example.com/other"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "The organisation cannot change")
+
+	// the changes are enqueued
+	_, err = stores.Payments.Save(ctx, testPayment("1"))
+	assert.NoError(t, err, "We can save a payment")
+
+	w = do("GET", "/webhooks/"+string(created.ID)+"/deliveries?status=pending", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	deliveries := DeliveryList{}
+	err = json.Unmarshal(w.Body.Bytes(), &deliveries)
+	assert.NoError(t, err, "We can unmarshal the json")
+	assert.Equal(t, 1, len(deliveries.Data), "The creation is pending")
+	if len(deliveries.Data) == 1 {
+		assert.Equal(t, model.EventCreated, deliveries.Data[0].Event.Type, "It is the creation")
+
+		w = do("POST", "/webhooks/"+string(created.ID)+"/deliveries/"+string(deliveries.Data[0].ID)+"/retry", "")
+		assert.Equal(t, http.StatusConflict, w.Code, "Only dead deliveries can be retried")
+	}
+
+	w = do("GET", "/webhooks/"+string(created.ID)+"/deliveries?status=lost", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code, "The status is checked")
+
+	w = do("DELETE", "/webhooks/"+string(created.ID), "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = do("GET", "/webhooks/"+string(created.ID), "")
+	assert.Equal(t, http.StatusNotFound, w.Code, "It was deleted")
+}
+
+func TestAPIKeys(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+	viper.Set(config.Auth, config.AuthAPIKey)
+	defer viper.Set(config.Auth, config.AuthNone)
+
+	router := getHandler(logger, stores, newHealth())
+
+	// the keys are created with the admin command
+	create := func(org string) (model.APIKeyID, string) {
+		var out bytes.Buffer
+		err := runAPIKeys(ctx, stores.APIKeys, []string{"create", "-name", "partner", "-org", org}, &out)
+		assert.NoError(t, err, "We can create a key")
+		var id, key string
+		_, err = fmt.Sscanf(out.String(), "id: %s\nkey: %s\n", &id, &key)
+		assert.NoError(t, err, "The command prints the ID and the key")
+		return model.APIKeyID(id), key
+	}
+	testID, testKey := create("testOrg")
+	_, otherKey := create("otherOrg")
+
+	err = runAPIKeys(ctx, stores.APIKeys, []string{"create", "-name", "partner"}, &bytes.Buffer{})
+	assert.Error(t, err, "A key needs an organisation")
+
+	do := func(method, url, key, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+		assert.NoError(t, err, "We can create the http request")
+		if len(key) > 0 {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("GET", "/payments/", "", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "A key is required")
+	w = do("GET", "/payments/", "apipay_unknown", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "The key has to be valid")
+
+	body, _ := json.Marshal(testPayment("1"))
+	w = do("POST", "/payments/", testKey, string(body))
+	assert.Equal(t, http.StatusCreated, w.Code, "We can create payments of the organisation of the key")
+	w = do("POST", "/payments/", otherKey, string(body))
+	assert.Equal(t, http.StatusForbidden, w.Code, "But not of other organisations")
+
+	w = do("GET", "/payments/1", otherKey, "")
+	assert.Equal(t, http.StatusNotFound, w.Code, "Other organisations cannot see it")
+	w = do("DELETE", "/payments/1", otherKey, "")
+	assert.Equal(t, http.StatusNotFound, w.Code, "Nor delete it")
+	w = do("GET", "/payments/?organisation_id=testOrg", otherKey, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"data":[]}`, w.Body.String(), "Nor list it")
+
+	w = do("GET", "/payments/1/history", testKey, "")
+	assert.Equal(t, http.StatusOK, w.Code, "The organisation of the key can see it")
+	assert.Contains(t, w.Body.String(), apiKeyActor(testID), "The changes are recorded as done by the key")
+
+	w = do("POST", "/webhooks/", otherKey, `{"organisation_id": "testOrg", "url": "https://example.com/hooks"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code, "Webhooks of other organisations cannot be created")
+
+	var out bytes.Buffer
+	err = runAPIKeys(ctx, stores.APIKeys, []string{"list"}, &out)
+	assert.NoError(t, err, "We can list the keys")
+	assert.Contains(t, out.String(), string(testID), "The key is listed")
+	assert.NotContains(t, out.String(), testKey, "But not the key itself")
+
+	err = runAPIKeys(ctx, stores.APIKeys, []string{"revoke", string(testID)}, &bytes.Buffer{})
+	assert.NoError(t, err, "We can revoke a key")
+	err = runAPIKeys(ctx, stores.APIKeys, []string{"revoke", string(testID)}, &bytes.Buffer{})
+	assert.Error(t, err, "We cannot revoke it twice")
+
+	w = do("GET", "/payments/1", testKey, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "A revoked key cannot be used")
+}
+
+func TestJWT(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	issuer, err := oidctest.NewIssuer()
+	assert.NoError(t, err, "We can create an issuer")
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, ioutil.WriteFile(jwks, issuer.JWKS(), 0600), "We can write the JWKS")
+
+	viper.Set(config.Auth, config.AuthAPIKey+","+config.AuthJWT)
+	viper.Set(config.JWTJWKS, jwks)
+	viper.Set(config.JWTIssuer, "https://idp.example.com/")
+	viper.Set(config.JWTAudience, "apipay")
+	defer viper.Set(config.Auth, config.AuthNone)
+
+	router := getHandler(logger, stores, newHealth())
+
+	token := func(subject string, orgs []string, roles ...string) string {
+		token, err := issuer.Token("ES256", map[string]interface{}{
+			"iss":              "https://idp.example.com/",
+			"aud":              "apipay",
+			"sub":              subject,
+			"exp":              time.Now().Add(time.Hour).Unix(),
+			"organisation_ids": orgs,
+			"roles":            roles,
+		})
+		assert.NoError(t, err, "We can sign a token")
+		return token
+	}
+	writer := token("writer", []string{"testOrg"}, rolePaymentsRead, rolePaymentsWrite)
+	reader := token("reader", []string{"*"}, rolePaymentsRead)
+	other := token("other", []string{"otherOrg"}, rolePaymentsRead, rolePaymentsWrite, rolePaymentsDelete)
+
+	do := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+		assert.NoError(t, err, "We can create the http request")
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("GET", "/payments/", "", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "A token or a key is required")
+	w = do("GET", "/payments/", writer[:len(writer)-4]+"AAAA", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "The token has to be valid")
+
+	body, _ := json.Marshal(testPayment("1"))
+	w = do("POST", "/payments/", writer, string(body))
+	assert.Equal(t, http.StatusCreated, w.Code, "We can create payments with the write role")
+	w = do("POST", "/payments/", reader, string(body))
+	assert.Equal(t, http.StatusForbidden, w.Code, "But not without it")
+	w = do("POST", "/payments/", other, string(body))
+	assert.Equal(t, http.StatusForbidden, w.Code, "Nor in other organisations")
+
+	w = do("GET", "/payments/1", reader, "")
+	assert.Equal(t, http.StatusOK, w.Code, "A token for all the organisations sees it")
+	w = do("GET", "/payments/1", other, "")
+	assert.Equal(t, http.StatusNotFound, w.Code, "Other organisations cannot see it")
+	w = do("DELETE", "/payments/1", writer, "")
+	assert.Equal(t, http.StatusForbidden, w.Code, "Deleting needs the delete role")
+	w = do("GET", "/webhooks/", writer, "")
+	assert.Equal(t, http.StatusForbidden, w.Code, "The webhooks need their own roles")
+
+	w = do("GET", "/payments/1/history", writer, "")
+	assert.Equal(t, http.StatusOK, w.Code, "The organisation of the token can see it")
+	assert.Contains(t, w.Body.String(), jwtActor("writer"), "The changes are recorded as done by the subject")
+}
+
+func TestRequestID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, _, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	core, logs := observer.New(zap.InfoLevel)
+	router := getHandler(zap.New(core), stores, newHealth())
+
+	do := func(method, url, requestID, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+		assert.NoError(t, err, "We can create the http request")
+		if len(requestID) > 0 {
+			req.Header.Set(requestIDHeader, requestID)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	body, _ := json.Marshal(testPayment("1"))
+	w := do("POST", "/payments/", "request-1", string(body))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "request-1", w.Header().Get(requestIDHeader), "The ID of the client is sent back")
+
+	w = do("GET", "/payments/1", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	generated := w.Header().Get(requestIDHeader)
+	assert.NotEmpty(t, generated, "An ID is generated when the client sends none")
+
+	w = do("GET", "/payments/1", strings.Repeat("a", maxRequestIDLength+1), "")
+	assert.Equal(t, 36, len(w.Header().Get(requestIDHeader)), "A too long ID is replaced")
+	w = do("GET", "/payments/1", "bad\tid", "")
+	assert.NotEqual(t, "bad\tid", w.Header().Get(requestIDHeader), "An ID that cannot be logged is replaced")
+
+	w = do("GET", "/payments/other", "request-2", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	obj := APIError{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &obj), "We can unmarshal the json")
+	assert.Equal(t, "request-2", obj.RequestID, "The error has the ID")
+
+	notFound := logs.FilterMessage("get-one-payments-db-not-found").All()
+	if assert.Equal(t, 1, len(notFound), "The handler logged the error") {
+		assert.Equal(t, "request-2", notFound[0].ContextMap()["request_id"], "The logs of the request have its ID")
+	}
+
+	w = do("GET", "/payments/1/history", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"request_id":"request-1"`, "The change has the ID of the request")
+}
+
+func TestTracing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, _, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+	_, err = setupTracing(ctx)
+	assert.NoError(t, err, "We can set up the propagation without exporter")
+
+	core, logs := observer.New(zap.InfoLevel)
+	router := getHandler(zap.New(core), stores, newHealth())
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	body, _ := json.Marshal(testPayment("1"))
+	req, err := http.NewRequest("POST", "/payments/", bytes.NewBuffer(body))
+	assert.NoError(t, err, "We can create the http request")
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	req, err = http.NewRequest("GET", "/payments/1", nil)
+	assert.NoError(t, err, "We can create the http request")
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		assert.Equal(t, traceID, span.SpanContext().TraceID().String(), "The spans are in the trace of the client")
+		spans[span.Name()] = span
+	}
+	server, found := spans["GET /payments/:paymentID"]
+	if assert.True(t, found, "There is a span of the request") {
+		assert.Contains(t, server.Attributes(), semconv.HTTPRoute("/payments/:paymentID"), "It has the route")
+		assert.Contains(t, server.Attributes(), semconv.HTTPResponseStatusCode(http.StatusOK), "And the status")
+		assert.Contains(t, server.Attributes(), persistent.AttributePaymentID.String("1"), "And the payment")
+	}
+	get, found := spans["Payments.Get"]
+	if assert.True(t, found, "There is a span of the store") && server != nil {
+		assert.Equal(t, server.SpanContext().SpanID(), get.Parent().SpanID(), "It is a child of the one of the request")
+		assert.Contains(t, get.Attributes(), persistent.AttributeOrganisationID.String("testOrg"), "It has the organisation")
+	}
+	_, found = spans["Payments.Save"]
+	assert.True(t, found, "The creation has its span too")
+
+	req, err = http.NewRequest("GET", "/payments/other", nil)
+	assert.NoError(t, err, "We can create the http request")
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	notFound := logs.FilterMessage("get-one-payments-db-not-found").All()
+	if assert.Equal(t, 1, len(notFound), "The handler logged the error") {
+		assert.Equal(t, traceID, notFound[0].ContextMap()["trace_id"], "The logs have the ID of the trace")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	router := getHandler(logger, stores, newHealth())
+
+	created := requestsTotal.WithLabelValues("POST", "/payments/", "201")
+	unknown := requestsTotal.WithLabelValues("GET", unknownRoute, "404")
+	createdBefore, unknownBefore := testutil.ToFloat64(created), testutil.ToFloat64(unknown)
+
+	body, _ := json.Marshal(testPayment("metrics"))
+	req, err := http.NewRequest("POST", "/payments/", bytes.NewBuffer(body))
+	assert.NoError(t, err, "We can create the http request")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	req, err = http.NewRequest("GET", "/nothing/here", nil)
+	assert.NoError(t, err, "We can create the http request")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	assert.Equal(t, createdBefore+1, testutil.ToFloat64(created), "The request is counted by route and status")
+	assert.Equal(t, unknownBefore+1, testutil.ToFloat64(unknown), "The ones without route have all the same one")
+	assert.Equal(t, 0.0, testutil.ToFloat64(requestsInFlight), "No request is being answered")
+
+	viper.Set(config.Auth, config.AuthAPIKey)
+	defer viper.Set(config.Auth, config.AuthNone)
+	router = getHandler(logger, stores, newHealth())
+
+	req, err = http.NewRequest("GET", "/metrics", nil)
+	assert.NoError(t, err, "We can create the http request")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "The metrics do not need authentication")
+	for _, metric := range []string{
+		`apipay_http_requests_total{method="POST",route="/payments/",status="201"}`,
+		`apipay_http_request_duration_seconds_bucket{method="POST",route="/payments/",status="201",le="0.005"}`,
+		`apipay_http_requests_in_flight 1`,
+		`apipay_db_operation_duration_seconds_count{method="Save"}`,
+		`apipay_payment_changes_total{currency="GBP",operation="create",scheme=""}`,
+	} {
+		assert.Contains(t, w.Body.String(), metric, "The metrics are exposed")
+	}
+}
+
+func TestHealth(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeOut)
+	defer cancel()
+
+	stores, logger, err := createSupportItems(ctx)
+	assert.NoError(t, err, "We can init the needed deps")
+
+	viper.Set(config.Auth, config.AuthAPIKey)
+	defer viper.Set(config.Auth, config.AuthNone)
+
+	down := true
+	h := newHealth(
+		dependency{name: "up", check: func(context.Context) error { return nil }},
+		dependency{name: "flaky", check: func(context.Context) error {
+			if down {
+				return errors.New("connection refused")
+			}
+			return nil
+		}},
+	)
+	router := getHandler(logger, stores, h)
+
+	ready := func() (int, ReadyStatus) {
+		req, err := http.NewRequest("GET", "/health/ready", nil)
+		assert.NoError(t, err, "We can create the http request")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var status ReadyStatus
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &status), "The status is JSON")
+		return w.Code, status
+	}
+
+	req, err := http.NewRequest("GET", "/health/live", nil)
+	assert.NoError(t, err, "We can create the http request")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "It is alive, without authentication")
+	assert.JSONEq(t, `{"status":"ok"}`, w.Body.String())
+
+	code, status := ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code, "It is not ready with a dependency down")
+	assert.Equal(t, statusNotReady, status.Status)
+	if assert.Len(t, status.Dependencies, 2, "All the dependencies are reported") {
+		assert.Equal(t, DependencyStatus{Name: "up", Status: statusUp, LatencyMs: status.Dependencies[0].LatencyMs},
+			status.Dependencies[0], "The ones up have no error")
+		assert.Equal(t, statusDown, status.Dependencies[1].Status, "The failing one is down")
+		assert.Equal(t, "connection refused", status.Dependencies[1].Error, "with why")
+	}
+
+	down = false
+	code, status = ready()
+	assert.Equal(t, http.StatusOK, code, "It is ready with all the dependencies up")
+	assert.Equal(t, statusReady, status.Status)
+
+	h.drain()
+	code, status = ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code, "It is not ready while shutting down")
+	assert.Equal(t, statusDraining, status.Status)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "but it is still alive")
+
+	router = getHandler(logger, stores, newHealth())
+	code, status = ready()
+	assert.Equal(t, http.StatusOK, code, "Without dependencies, like in memory, it is ready")
+	assert.Empty(t, status.Dependencies)
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"apipay/model"
+	"apipay/persistent"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// The codes of APIError. They are part of the API, so they cannot change
+const (
+	codeInvalidJSON           = "invalid_json"
+	codeValidationFailed      = "validation_failed"
+	codeInvalidParameter      = "invalid_parameter"
+	codeIDMismatch            = "id_mismatch"
+	codeInvalidID             = "invalid_id"
+	codeNotFound              = "not_found"
+	codeDuplicate             = "duplicate"
+	codeVersionConflict       = "version_conflict"
+	codeNotDeleted            = "not_deleted"
+	codeInvalidTransition     = "invalid_transition"
+	codePreconditionFailed    = "precondition_failed"
+	codeIdempotencyKeyReused  = "idempotency_key_reused"
+	codeIdempotencyInProgress = "idempotency_in_progress"
+	codeBatchTooLarge         = "batch_too_large"
+	codePaymentTooLarge       = "payment_too_large"
+	codeNotAcceptable         = "not_acceptable"
+	codeEventsMissed          = "events_missed"
+	codeDeliveryNotDead       = "delivery_not_dead"
+	codeUnauthorized          = "unauthorized"
+	codeForbidden             = "forbidden"
+	codeTimeout               = "timeout"
+	codeInternal              = "internal_error"
+)
+
+// APIError is the body of all the errors returned by the API
+type APIError struct {
+	// Code identifies the error, it does not change between versions
+	Code string `json:"code"`
+
+	// Message is a description of the error, for humans
+	Message string `json:"message"`
+
+	// RequestID is the ID of the request that failed, useful to trace it
+	RequestID string `json:"request_id,omitempty"`
+
+	// Details are the fields that are not valid, if that was the problem
+	Details []model.Violation `json:"details,omitempty"`
+}
+
+// requestID returns the ID of the request, see requestScope
+func requestID(ginCtx *gin.Context) string {
+
+	if id := ginCtx.GetString(requestIDKey); len(id) > 0 {
+		return id
+	}
+	return ginCtx.GetHeader(requestIDHeader)
+}
+
+// newAPIError returns an APIError of the request
+func newAPIError(ginCtx *gin.Context, code, message string, details ...model.Violation) *APIError {
+
+	return &APIError{
+		Code:      code,
+		Message:   message,
+		RequestID: requestID(ginCtx),
+		Details:   details,
+	}
+}
+
+// respondError aborts the request with an APIError
+func respondError(ginCtx *gin.Context, status int, code, message string, details ...model.Violation) {
+	ginCtx.AbortWithStatusJSON(status, newAPIError(ginCtx, code, message, details...))
+}
+
+// respondDBError aborts the request with the APIError matching the error of
+// the DB, and logs it with event
+func respondDBError(ginCtx *gin.Context, logger *zap.Logger, event string, err error) {
+
+	switch {
+	case persistent.IsErrorNoDBResults(err):
+		logger.Info(event + "-not-found")
+		respondError(ginCtx, http.StatusNotFound, codeNotFound, "the payment does not exist")
+
+	case persistent.IsErrorDuplicate(err):
+		logger.Info(event + "-duplicate")
+		respondError(ginCtx, http.StatusConflict, codeDuplicate, "there is already a payment with the same id")
+
+	case err == persistent.ErrVersionConflict:
+		logger.Info(event + "-version-conflict")
+		respondError(ginCtx, http.StatusConflict, codeVersionConflict, "the version is not the latest one")
+
+	case err == persistent.ErrInvalidTransition:
+		logger.Info(event + "-invalid-transition")
+		respondError(ginCtx, http.StatusConflict, codeInvalidTransition, "the action is not allowed in the status of the payment")
+
+	case err == persistent.ErrNotDeleted:
+		logger.Info(event + "-not-deleted")
+		respondError(ginCtx, http.StatusConflict, codeNotDeleted, "the payment is not deleted")
+
+	case err == persistent.ErrOrganisationNotAllowed:
+		logger.Info(event + "-organisation-not-allowed")
+		respondError(ginCtx, http.StatusForbidden, codeForbidden, "the organisation is not one of the credentials")
+
+	case err == persistent.ErrInvalidCursor:
+		logger.Info(event + "-invalid-cursor")
+		respondError(ginCtx, http.StatusBadRequest, codeInvalidParameter, "cursor is not valid")
+
+	case persistent.IsErrorTimeout(err):
+		logger.Sugar().Warnw(event+"-timeout", "error", err)
+		respondError(ginCtx, http.StatusGatewayTimeout, codeTimeout, "the request took too long")
+
+	default:
+		logger.Sugar().Warnw(event, "error", err)
+		respondError(ginCtx, http.StatusInternalServerError, codeInternal, "the request cannot be processed")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"apipay/config"
+	"apipay/model"
+	"apipay/oidc"
+	"apipay/persistent"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// apiKeyHeader is the header with the API key of the requests
+const apiKeyHeader = "X-API-Key"
+
+// bearerPrefix starts the Authorization header with a JWT
+const bearerPrefix = "bearer "
+
+// allOrganisations in the organisations of a JWT gives access to all of them
+const allOrganisations = "*"
+
+// rolesKey is the key in the gin context of the roles of the request. Without
+// it the request can do everything with the payments it sees
+const rolesKey = "roles"
+
+// The roles of the JWTs, required by the routes
+const (
+	rolePaymentsRead   = "payments:read"
+	rolePaymentsWrite  = "payments:write"
+	rolePaymentsDelete = "payments:delete"
+	roleWebhooksRead   = "webhooks:read"
+	roleWebhooksWrite  = "webhooks:write"
+)
+
+// organisationsKey is the key in the gin context of the organisations the
+// request can see and change. Without it all of them can be
+const organisationsKey = "organisations"
+
+// apiKeyActor returns the actor recorded in the changes done with an API key
+func apiKeyActor(id model.APIKeyID) string {
+	return "apikey:" + string(id)
+}
+
+// jwtActor returns the actor recorded in the changes done with a JWT
+func jwtActor(subject string) string {
+	return "jwt:" + subject
+}
+
+// authMethods returns the methods the requests can be authenticated with from
+// the config, none if they are not authenticated
+func authMethods() ([]string, error) {
+
+	methods := []string{}
+	for _, method := range strings.Split(viper.GetString(config.Auth), ",") {
+		switch method = strings.TrimSpace(method); method {
+		case config.AuthAPIKey, config.AuthJWT:
+			methods = append(methods, method)
+		case config.AuthNone:
+		default:
+			return nil, fmt.Errorf("unknown auth %q", method)
+		}
+	}
+	return methods, nil
+}
+
+// authenticate is a middleware requiring a valid JWT, when verifier is not
+// nil, or API key, when apiKeyDb is not nil, in the requests. The requests
+// only see and change the payments of the organisations of the token or key,
+// and the changes are recorded as done by them
+func authenticate(logger *zap.Logger, apiKeyDb persistent.APIKeyStore, verifier *oidc.Verifier) gin.HandlerFunc {
+
+	return func(ginCtx *gin.Context) {
+
+		logger := requestLogger(ginCtx, logger)
+
+		ctx, cancel := requestContext(ginCtx)
+		defer cancel()
+
+		authorization := ginCtx.GetHeader("Authorization")
+		if verifier != nil && len(authorization) > len(bearerPrefix) &&
+			strings.EqualFold(authorization[:len(bearerPrefix)], bearerPrefix) {
+
+			claims, err := verifier.Verify(ctx, strings.TrimSpace(authorization[len(bearerPrefix):]))
+			if err == nil && len(claims.Subject()) == 0 {
+				err = errors.New("the token has no subject")
+			}
+			if err != nil {
+				logger.Sugar().Infow("auth-invalid-jwt", "error", err)
+				respondError(ginCtx, http.StatusUnauthorized, codeUnauthorized, "the token is not valid")
+				return
+			}
+
+			ginCtx.Set(actorKey, jwtActor(claims.Subject()))
+			organisationIDs := claims.Strings(viper.GetString(config.JWTOrganisationsClaim))
+			if !containsString(organisationIDs, allOrganisations) {
+				ginCtx.Set(organisationsKey, organisationIDs)
+			}
+			ginCtx.Set(rolesKey, claims.Strings(viper.GetString(config.JWTRolesClaim)))
+			return
+		}
+
+		key := ginCtx.GetHeader(apiKeyHeader)
+		if apiKeyDb == nil || len(key) == 0 {
+			logger.Info("auth-missing-credentials")
+			respondError(ginCtx, http.StatusUnauthorized, codeUnauthorized, "the request has no credentials")
+			return
+		}
+
+		apiKey, err := apiKeyDb.GetByHash(ctx, model.HashAPIKey(key))
+		if persistent.IsErrorNoDBResults(err) || (err == nil && !apiKey.Active()) {
+			logger.Info("auth-invalid-api-key")
+			respondError(ginCtx, http.StatusUnauthorized, codeUnauthorized, "the API key is not valid")
+			return
+		}
+		if err != nil {
+			respondDBError(ginCtx, logger, "auth-api-key-db", err)
+			return
+		}
+
+		ginCtx.Set(actorKey, apiKeyActor(apiKey.ID))
+		ginCtx.Set(organisationsKey, apiKey.OrganisationIDs)
+	}
+}
+
+// requireRole is a middleware rejecting the requests without the role. The
+// requests without roles, like the ones with an API key, can do everything
+func requireRole(logger *zap.Logger, role string) gin.HandlerFunc {
+
+	return func(ginCtx *gin.Context) {
+
+		logger := requestLogger(ginCtx, logger)
+
+		value, found := ginCtx.Get(rolesKey)
+		if !found {
+			return
+		}
+		if roles, _ := value.([]string); !containsString(roles, role) {
+			logger.Sugar().Infow("auth-missing-role", "role", role)
+			respondError(ginCtx, http.StatusForbidden, codeForbidden, "the request needs the role "+role)
+		}
+	}
+}
+
+// organisations returns the organisations the request can see and change, and
+// false if it can all of them
+func organisations(ginCtx *gin.Context) ([]string, bool) {
+
+	value, found := ginCtx.Get(organisationsKey)
+	if !found {
+		return nil, false
+	}
+	organisationIDs, ok := value.([]string)
+	return organisationIDs, ok
+}
+
+// organisationAllowed checks if the request can see and change the payments
+// of an organisation
+func organisationAllowed(ginCtx *gin.Context, organisationID string) bool {
+	return persistent.OrganisationAllowed(requestValues(ginCtx), organisationID)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"apipay/model"
+	"apipay/persistent"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// errors reading a batch, the message is returned to the client
+var (
+	errBatchEmpty    = errors.New("the batch has no payments")
+	errBatchTooLarge = errors.New("the batch has too many payments")
+	errBatchBody     = errors.New("the body of the batch is too large")
+	errBatchJSON     = errors.New("the body is not a json array nor NDJSON")
+)
+
+// BatchItem is the result of one of the payments of a batch
+type BatchItem struct {
+	// Index is the position of the payment in the batch, from 0
+	Index int `json:"index"`
+
+	// Status is what creating the payment alone would have returned
+	Status int `json:"status"`
+
+	// Payment is the created payment, if it was created
+	Payment *model.Payment `json:"payment,omitempty"`
+
+	// Error is why the payment was not created
+	Error *APIError `json:"error,omitempty"`
+}
+
+// BatchResult is the result of creating a batch of payments
+type BatchResult struct {
+	Created int         `json:"created"`
+	Failed  int         `json:"failed"`
+	Items   []BatchItem `json:"items"`
+}
+
+// readBatch reads the payments of a batch, as a json array or NDJSON, one
+// payment per line. They are not parsed yet, so each one can fail on its own.
+// The body is read until there are more than maxSize payments or maxBody
+// bytes, and no further
+func readBatch(ginCtx *gin.Context, maxSize int, maxBody int64) ([]json.RawMessage, error) {
+
+	body := http.MaxBytesReader(ginCtx.Writer, ginCtx.Request.Body, maxBody)
+
+	items, err := readBatchItems(ginCtx.ContentType(), body, maxSize)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, errBatchBody
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(items) == 0 {
+		return nil, errBatchEmpty
+	}
+	return items, nil
+}
+
+// readBatchItems reads the payments of the body, with errors of the reader
+// returned as they are
+func readBatchItems(contentType string, body io.Reader, maxSize int) ([]json.RawMessage, error) {
+
+	var items []json.RawMessage
+
+	if contentType == ndjsonContentType {
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxPaymentSize)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			if len(items) == maxSize {
+				return nil, errBatchTooLarge
+			}
+			items = append(items, json.RawMessage(append([]byte(nil), line...)))
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, readError(err)
+		}
+		return items, nil
+	}
+
+	// the array is read one payment at a time, to stop at maxSize
+	decoder := json.NewDecoder(body)
+	start, err := decoder.Token()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, readError(err)
+	}
+	if start != json.Delim('[') {
+		return nil, errBatchJSON
+	}
+	for decoder.More() {
+		if len(items) == maxSize {
+			return nil, errBatchTooLarge
+		}
+		var item json.RawMessage
+		if err := decoder.Decode(&item); err != nil {
+			return nil, readError(err)
+		}
+		items = append(items, item)
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, readError(err)
+	}
+	// nothing but spaces after the array
+	if _, err := decoder.Token(); err != io.EOF {
+		if err != nil {
+			return nil, readError(err)
+		}
+		return nil, errBatchJSON
+	}
+	return items, nil
+}
+
+// readError is errBatchJSON, unless the body could not be read
+func readError(err error) error {
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return err
+	}
+	return errBatchJSON
+}
+
+// createPayments handler for creating many Payments at once
+// @Summary Create a batch of Payments
+// @Description The body is a json array of payments, or NDJSON (one payment per
+// @Description line) with the Content-Type application/x-ndjson. Each payment is
+// @Description validated and created on its own, the ones failing do not stop the
+// @Description rest. The result of each one is returned, in the same order
+// @Accept  json
+// @Produce  json
+// @Param payments body []model.Payment true "The payments to be created"
+// @Success 200 {object} BatchResult "What happened to each payment"
+// @Failure 400 {object} APIError "The body is not a json array nor NDJSON, or it is empty"
+// @Failure 413 {object} APIError "There are more payments than allowed in a batch"
+// @Failure 500 {object} APIError "Cannot process the request"
+// @Router /payments/batch [post]
+func createPayments(logger *zap.Logger, paymentDb persistent.PaymentStore, maxSize int, maxBody int64) func(ginCtx *gin.Context) {
+
+	return func(ginCtx *gin.Context) {
+
+		logger := requestLogger(ginCtx, logger)
+
+		ctx, cancel := requestContext(ginCtx)
+		defer cancel()
+
+		raws, err := readBatch(ginCtx, maxSize, maxBody)
+		if err == errBatchTooLarge {
+			logger.Sugar().Infow("create-batch-payments-too-large", "max", maxSize)
+			respondError(ginCtx, http.StatusRequestEntityTooLarge, codeBatchTooLarge,
+				"a batch cannot have more than "+strconv.Itoa(maxSize)+" payments")
+			return
+		}
+		if err == errBatchBody {
+			logger.Sugar().Infow("create-batch-payments-body-too-large", "max", maxBody)
+			respondError(ginCtx, http.StatusRequestEntityTooLarge, codeBatchTooLarge, err.Error())
+			return
+		}
+		if err != nil {
+			logger.Sugar().Infow("create-batch-payments-json", "error", err)
+			respondError(ginCtx, http.StatusBadRequest, codeInvalidJSON, err.Error())
+			return
+		}
+
+		result := BatchResult{Items: make([]BatchItem, len(raws))}
+
+		// the valid ones are saved, the rest already failed
+		var valid []model.Payment
+		var validIndex []int
+
+		for i, raw := range raws {
+			item := &result.Items[i]
+			item.Index = i
+
+			received := model.Payment{}
+			if err := json.Unmarshal(raw, &received); err != nil {
+				item.Status = http.StatusBadRequest
+				item.Error = newAPIError(ginCtx, codeInvalidJSON, "the item is not a valid payment json")
+				continue
+			}
+			if len(received.ID) == 0 {
+				received.ID = model.NewPaymentID()
+			}
+			if violations := received.Valid(); len(violations) > 0 {
+				item.Status = http.StatusBadRequest
+				item.Error = newAPIError(ginCtx, codeValidationFailed, "the payment is not valid", violations...)
+				continue
+			}
+			received.Version = 0 // the version and the deletion are handled by the server
+			received.Deleted = nil
+
+			valid = append(valid, received)
+			validIndex = append(validIndex, i)
+		}
+
+		saved, errs, err := paymentDb.SaveMany(ctx, valid)
+		if err != nil {
+			savedAny := false
+			for _, itemErr := range errs {
+				savedAny = savedAny || itemErr == nil
+			}
+			if !savedAny {
+				respondDBError(ginCtx, logger, "create-batch-payments-db", err)
+				return
+			}
+			// the client has to know which ones were saved, so it does not
+			// retry them
+			logger.Sugar().Errorw("create-batch-payments-db-partial", "error", err)
+		}
+
+		for j, i := range validIndex {
+			item := &result.Items[i]
+			switch {
+			case errs[j] == nil:
+				item.Status = http.StatusCreated
+				item.Payment = &saved[j]
+			case persistent.IsErrorDuplicate(errs[j]):
+				item.Status = http.StatusConflict
+				item.Error = newAPIError(ginCtx, codeDuplicate, "there is already a payment with the same id")
+			case errs[j] == persistent.ErrOrganisationNotAllowed:
+				item.Status = http.StatusForbidden
+				item.Error = newAPIError(ginCtx, codeForbidden, "the organisation is not one of the credentials")
+			default:
+				logger.Sugar().Errorw("create-batch-payments-db-item", "error", errs[j])
+				item.Status = http.StatusInternalServerError
+				item.Error = newAPIError(ginCtx, codeInternal, "the payment could not be created")
+			}
+		}
+
+		for _, item := range result.Items {
+			if item.Payment != nil {
+				result.Created++
+			} else {
+				result.Failed++
+			}
+		}
+		logger.Sugar().Infow("create-batch-payments", "created", result.Created, "failed", result.Failed)
+
+		ginCtx.JSON(http.StatusOK, result)
+	}
+}
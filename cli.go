@@ -0,0 +1,107 @@
+package main
+
+import (
+	"apipay/model"
+	"apipay/persistent"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// apiKeysUsage is the help of the apikeys subcommand
+const apiKeysUsage = `usage:
+  apipay apikeys create -name <name> -org <organisation id> [-org <organisation id>...]
+  apipay apikeys list
+  apipay apikeys revoke <id>`
+
+// errAPIKeysUsage is returned when the apikeys subcommand is not used right
+var errAPIKeysUsage = errors.New(apiKeysUsage)
+
+// organisationsFlag is a flag that can be given many times
+type organisationsFlag []string
+
+func (f *organisationsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *organisationsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// runAPIKeys runs the apikeys subcommand, which creates, lists and revokes the
+// API keys. What it prints goes to out
+func runAPIKeys(ctx context.Context, apiKeyDb persistent.APIKeyStore, args []string, out io.Writer) error {
+
+	if len(args) == 0 {
+		return errAPIKeysUsage
+	}
+
+	switch command, args := args[0], args[1:]; command {
+	case "create":
+		flags := flag.NewFlagSet("create", flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		name := flags.String("name", "", "who the key is for")
+		var orgs organisationsFlag
+		flags.Var(&orgs, "org", "organisation the key gives access to, it can be repeated")
+		if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+			return errAPIKeysUsage
+		}
+
+		apiKey, key, err := model.NewAPIKey(*name, orgs)
+		if err != nil {
+			return err
+		}
+		if violations := apiKey.Valid(); len(violations) > 0 {
+			return violations
+		}
+		if err := apiKeyDb.Save(ctx, apiKey); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "id:  %s\nkey: %s\n", apiKey.ID, key)
+		fmt.Fprintln(out, "The key cannot be shown again, keep it safe")
+		return nil
+
+	case "list":
+		if len(args) > 0 {
+			return errAPIKeysUsage
+		}
+		keys, err := apiKeyDb.List(ctx)
+		if err != nil {
+			return err
+		}
+		table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "ID\tNAME\tORGANISATIONS\tCREATED\tREVOKED")
+		for _, key := range keys {
+			revoked := "-"
+			if key.RevokedAt != nil {
+				revoked = key.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", key.ID, key.Name, strings.Join(key.OrganisationIDs, ","),
+				key.CreatedAt.Format(time.RFC3339), revoked)
+		}
+		return table.Flush()
+
+	case "revoke":
+		if len(args) != 1 {
+			return errAPIKeysUsage
+		}
+		revoked, err := apiKeyDb.Revoke(ctx, model.APIKeyID(args[0]))
+		if err != nil {
+			return err
+		}
+		if revoked == 0 {
+			return fmt.Errorf("the API key %s does not exist or it is already revoked", args[0])
+		}
+		fmt.Fprintf(out, "revoked %s\n", args[0])
+		return nil
+	}
+
+	return errAPIKeysUsage
+}
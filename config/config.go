@@ -7,7 +7,11 @@
 
 package config
 
-import "github.com/spf13/viper"
+import (
+	"apipay/model"
+
+	"github.com/spf13/viper"
+)
 
 const (
 	// MongoHost holds the mongo server name
@@ -21,6 +25,113 @@ const (
 
 	// MongoPassword holds the mongo server url
 	MongoPassword = "MongoPassword"
+
+	// Storage holds where payments are stored, StorageMongo or StorageMemory
+	Storage = "Storage"
+
+	// IdempotencyTTL holds for how long the responses of requests with an
+	// Idempotency-Key are kept, as a duration like "24h"
+	IdempotencyTTL = "IdempotencyTTL"
+
+	// PaymentIDFormat holds the regular expression the payment IDs have to match
+	PaymentIDFormat = "PaymentIDFormat"
+
+	// OrganisationIDFormat holds the regular expression the organisation IDs have to match
+	OrganisationIDFormat = "OrganisationIDFormat"
+
+	// BatchMaxSize holds the max number of payments that can be created in one batch
+	BatchMaxSize = "BatchMaxSize"
+
+	// BatchMaxBodySize holds the max size of the body of a batch, eg. 20MB
+	BatchMaxBodySize = "BatchMaxBodySize"
+
+	// WebhookMaxAttempts holds how many times a delivery to a webhook is tried
+	// before it is dead
+	WebhookMaxAttempts = "WebhookMaxAttempts"
+
+	// WebhookBackoff holds how long after the first failure a delivery is
+	// tried again, as a duration like "30s". It doubles after each failure
+	WebhookBackoff = "WebhookBackoff"
+
+	// WebhookTimeout holds how long the webhooks have to answer, as a duration
+	WebhookTimeout = "WebhookTimeout"
+
+	// OutboxSinks holds where the changes of the outbox are relayed to, comma
+	// separated: log, http. Empty to not relay them
+	OutboxSinks = "OutboxSinks"
+
+	// OutboxHTTPURL holds the URL the changes are posted to by the http sink
+	OutboxHTTPURL = "OutboxHTTPURL"
+
+	// Auth holds how the requests are authenticated, comma separated:
+	// AuthAPIKey, AuthJWT. Or AuthNone
+	Auth = "Auth"
+
+	// JWTJWKS holds the file or URL of the JWKS with the keys of the JWTs
+	JWTJWKS = "JWTJWKS"
+
+	// JWTIssuer holds the issuer the JWTs have to be from
+	JWTIssuer = "JWTIssuer"
+
+	// JWTAudience holds the audience the JWTs have to be for
+	JWTAudience = "JWTAudience"
+
+	// JWTOrganisationsClaim holds the claim of the JWTs with the organisations
+	// they give access to, "*" for all of them
+	JWTOrganisationsClaim = "JWTOrganisationsClaim"
+
+	// JWTRolesClaim holds the claim of the JWTs with their roles
+	JWTRolesClaim = "JWTRolesClaim"
+
+	// TracingExporter holds where the spans are sent, TracingOTLP,
+	// TracingStdout or TracingNone
+	TracingExporter = "TracingExporter"
+
+	// TracingOTLPEndpoint holds the URL spans are sent to by TracingOTLP. If
+	// empty the OTEL_EXPORTER_OTLP_* env vars are used
+	TracingOTLPEndpoint = "TracingOTLPEndpoint"
+
+	// ShutdownDrainDelay holds how long the server keeps answering after it is
+	// told to stop, not ready, so the load balancers stop sending requests
+	ShutdownDrainDelay = "ShutdownDrainDelay"
+
+	// ShutdownTimeout holds how long the server waits for the requests being
+	// answered to finish when it stops
+	ShutdownTimeout = "ShutdownTimeout"
+)
+
+const (
+	// StorageMongo stores the payments in Mongo, this is the default
+	StorageMongo = "mongo"
+
+	// StorageMemory keeps the payments in memory, nothing survives a restart
+	StorageMemory = "memory"
+)
+
+const (
+	// AuthAPIKey requires an API key in all the requests, and they only get
+	// the payments of its organisations. This is the default
+	AuthAPIKey = "apikey"
+
+	// AuthJWT requires a JWT of the identity provider in all the requests,
+	// they get the payments of its organisations and what they can do with
+	// them depends on its roles
+	AuthJWT = "jwt"
+
+	// AuthNone does not authenticate the requests, all of them get all the
+	// payments. Only for local runs
+	AuthNone = "none"
+)
+
+const (
+	// TracingOTLP sends the spans to a collector with OTLP over HTTP
+	TracingOTLP = "otlp"
+
+	// TracingStdout writes the spans to the standard output, for local runs
+	TracingStdout = "stdout"
+
+	// TracingNone does not record spans, this is the default
+	TracingNone = "none"
 )
 
 // Load loads the config from the env vars. It could be extended to load also
@@ -51,6 +162,124 @@ func Load() error {
 		return err
 	}
 
+	viper.SetDefault(Storage, StorageMongo)
+	err = viper.BindEnv(Storage)
+	if err != nil {
+		return err
+	}
+
+	viper.SetDefault(IdempotencyTTL, "24h")
+	err = viper.BindEnv(IdempotencyTTL)
+	if err != nil {
+		return err
+	}
+
+	viper.SetDefault(PaymentIDFormat, model.DefaultIDFormat)
+	err = viper.BindEnv(PaymentIDFormat)
+	if err != nil {
+		return err
+	}
+
+	viper.SetDefault(OrganisationIDFormat, model.DefaultIDFormat)
+	err = viper.BindEnv(OrganisationIDFormat)
+	if err != nil {
+		return err
+	}
+
+	viper.SetDefault(BatchMaxSize, 1000)
+	err = viper.BindEnv(BatchMaxSize)
+	if err != nil {
+		return err
+	}
+
+	viper.SetDefault(BatchMaxBodySize, "20MB")
+	err = viper.BindEnv(BatchMaxBodySize)
+	if err != nil {
+		return err
+	}
+
+	viper.SetDefault(WebhookMaxAttempts, 10)
+	err = viper.BindEnv(WebhookMaxAttempts)
+	if err != nil {
+		return err
+	}
+
+	viper.SetDefault(WebhookBackoff, "30s")
+	err = viper.BindEnv(WebhookBackoff)
+	if err != nil {
+		return err
+	}
+
+	viper.SetDefault(WebhookTimeout, "10s")
+	err = viper.BindEnv(WebhookTimeout)
+	if err != nil {
+		return err
+	}
+
+	viper.SetDefault(OutboxSinks, "log")
+	err = viper.BindEnv(OutboxSinks)
+	if err != nil {
+		return err
+	}
+
+	err = viper.BindEnv(OutboxHTTPURL)
+	if err != nil {
+		return err
+	}
+
+	viper.SetDefault(Auth, AuthAPIKey)
+	err = viper.BindEnv(Auth)
+	if err != nil {
+		return err
+	}
+
+	err = viper.BindEnv(JWTJWKS)
+	if err != nil {
+		return err
+	}
+	err = viper.BindEnv(JWTIssuer)
+	if err != nil {
+		return err
+	}
+	err = viper.BindEnv(JWTAudience)
+	if err != nil {
+		return err
+	}
+
+	viper.SetDefault(JWTOrganisationsClaim, "organisation_ids")
+	err = viper.BindEnv(JWTOrganisationsClaim)
+	if err != nil {
+		return err
+	}
+
+	viper.SetDefault(JWTRolesClaim, "roles")
+	err = viper.BindEnv(JWTRolesClaim)
+	if err != nil {
+		return err
+	}
+
+	viper.SetDefault(TracingExporter, TracingNone)
+	err = viper.BindEnv(TracingExporter)
+	if err != nil {
+		return err
+	}
+	err = viper.BindEnv(TracingOTLPEndpoint)
+	if err != nil {
+		return err
+	}
+
+	viper.SetDefault(ShutdownDrainDelay, "5s")
+	err = viper.BindEnv(ShutdownDrainDelay)
+	if err != nil {
+		return err
+	}
+
+	viper.SetDefault(ShutdownTimeout, "10s")
+	err = viper.BindEnv(ShutdownTimeout)
+	if err != nil {
+		return err
+	}
+
 	return nil
 
 }
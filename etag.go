@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// errInvalidETag is returned when an If-Match or If-None-Match header cannot be parsed
+var errInvalidETag = errors.New("invalid etag")
+
+// etag returns the ETag of a payment with the given version
+func etag(version uint) string {
+	return `"` + strconv.FormatUint(uint64(version), 10) + `"`
+}
+
+// parseETag returns the version of an ETag created with etag. Weak ETags are
+// accepted too, as W/"3"
+func parseETag(value string) (uint, error) {
+
+	value = strings.TrimPrefix(strings.TrimSpace(value), "W/")
+	if len(value) < 2 || !strings.HasPrefix(value, `"`) || !strings.HasSuffix(value, `"`) {
+		return 0, errInvalidETag
+	}
+	version, err := strconv.ParseUint(value[1:len(value)-1], 10, 0)
+	if err != nil {
+		return 0, errInvalidETag
+	}
+	return uint(version), nil
+}
+
+// matchesETag checks if an If-None-Match header matches the given version. It
+// can be a list of ETags or *
+func matchesETag(header string, version uint) bool {
+
+	for _, value := range strings.Split(header, ",") {
+		if strings.TrimSpace(value) == "*" {
+			return true
+		}
+		if parsed, err := parseETag(value); err == nil && parsed == version {
+			return true
+		}
+	}
+	return false
+}
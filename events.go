@@ -0,0 +1,151 @@
+package main
+
+import (
+	"apipay/model"
+	"apipay/persistent"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	eventStreamContentType = "text/event-stream"
+	lastEventIDHeader      = "Last-Event-ID"
+
+	// eventsHeartbeat is how often a comment is sent when there are no
+	// events, so the proxies do not close the connection
+	eventsHeartbeat = 15 * time.Second
+
+	// eventsCloseTimeout is how long closing the feed can take
+	eventsCloseTimeout = 5 * time.Second
+)
+
+// writeEvent writes an event in the format of the Server-Sent Events
+func writeEvent(ginCtx *gin.Context, event model.Event) error {
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(ginCtx.Writer, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// readEvents sends to events the events of the stream until it fails, then it
+// sends the error to failed and closes the stream
+func readEvents(ctx context.Context, stream persistent.EventStream, events chan<- model.Event, failed chan<- error) {
+
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), eventsCloseTimeout)
+		defer cancel()
+		stream.Close(closeCtx)
+	}()
+
+	for {
+		event, err := stream.Next(ctx)
+		if err != nil {
+			failed <- err
+			return
+		}
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			failed <- ctx.Err()
+			return
+		}
+	}
+}
+
+// streamEvents handler for following the changes to the payments
+// @Summary Follow the changes to the payments
+// @Description Streams the changes to the payments as Server-Sent Events, as
+// @Description they happen: payment.created, payment.updated (also restoring
+// @Description and the actions) and payment.deleted. To resume after a
+// @Description disconnection pass the ID of the last event received in the
+// @Description Last-Event-ID header, or the last_event_id param
+// @Produce  text/event-stream
+// @Param Last-Event-ID header string false "Resume after this event"
+// @Param last_event_id query string false "Resume after this event, if the header is not there"
+// @Success 200 {object} model.Event "One per change, in the data of each event"
+// @Failure 400 {object} APIError "The event ID is not valid"
+// @Failure 410 {object} APIError "The events after the event ID are not available anymore"
+// @Failure 500 {object} APIError "Cannot process the request"
+// @Router /payments/events [get]
+func streamEvents(logger *zap.Logger, paymentDb persistent.PaymentStore, h *health) func(ginCtx *gin.Context) {
+
+	return func(ginCtx *gin.Context) {
+
+		logger := requestLogger(ginCtx, logger)
+
+		// the feed is open until the client goes away, or the server stops.
+		// Then the client can resume it
+		ctx, cancel := h.streamContext(requestValues(ginCtx))
+		defer cancel()
+
+		after := ginCtx.GetHeader(lastEventIDHeader)
+		if len(after) == 0 {
+			after = ginCtx.Query("last_event_id")
+		}
+
+		stream, err := paymentDb.Events(ctx, after)
+		switch err {
+		case nil:
+		case persistent.ErrInvalidEventID:
+			logger.Sugar().Infow("stream-events-invalid-id", "after", after)
+			respondError(ginCtx, http.StatusBadRequest, codeInvalidParameter, "the last event id is not valid")
+			return
+		case persistent.ErrEventsMissed:
+			logger.Sugar().Infow("stream-events-missed", "after", after)
+			respondError(ginCtx, http.StatusGone, codeEventsMissed,
+				"the events after the last event id are not available anymore, get the payments again")
+			return
+		default:
+			respondDBError(ginCtx, logger, "stream-events-db", err)
+			return
+		}
+
+		events := make(chan model.Event)
+		failed := make(chan error, 1)
+		go readEvents(ctx, stream, events, failed)
+
+		ginCtx.Header("Content-Type", eventStreamContentType)
+		ginCtx.Header("Cache-Control", "no-cache")
+		ginCtx.Header("X-Accel-Buffering", "no")
+		ginCtx.Status(http.StatusOK)
+		ginCtx.Writer.WriteHeaderNow()
+		ginCtx.Writer.Flush()
+
+		logger.Sugar().Infow("stream-events-start", "after", after)
+
+		heartbeat := time.NewTicker(eventsHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case event := <-events:
+				err = writeEvent(ginCtx, event)
+			case <-heartbeat.C:
+				_, err = fmt.Fprint(ginCtx.Writer, ": heartbeat\n\n")
+			case err = <-failed:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+
+			if err != nil {
+				if ctx.Err() != nil {
+					logger.Sugar().Infow("stream-events-end")
+				} else {
+					// the client gets it as a disconnection, and can resume
+					logger.Sugar().Errorw("stream-events-failed", "error", err)
+				}
+				return
+			}
+			ginCtx.Writer.Flush()
+		}
+	}
+}
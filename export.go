@@ -0,0 +1,255 @@
+package main
+
+import (
+	"apipay/model"
+	"apipay/persistent"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	csvContentType = "text/csv"
+
+	// exportFlushEvery is how many payments are written before flushing them
+	// to the client
+	exportFlushEvery = 100
+)
+
+// exportColumn is a column of the CSV export
+type exportColumn struct {
+	name  string
+	value func(p *model.Payment) string
+}
+
+// partyColumns are the columns of a party of the payment
+func partyColumns(prefix string, party func(p *model.Payment) *model.Party) []exportColumn {
+
+	return []exportColumn{
+		{prefix + ".name", func(p *model.Payment) string { return party(p).Name }},
+		{prefix + ".account_name", func(p *model.Payment) string { return party(p).AccountName }},
+		{prefix + ".account_number", func(p *model.Payment) string { return party(p).AccountNumber }},
+		{prefix + ".account_number_code", func(p *model.Payment) string { return party(p).AccountNumberCode }},
+		{prefix + ".bank_id", func(p *model.Payment) string { return party(p).BankID }},
+		{prefix + ".bank_id_code", func(p *model.Payment) string { return party(p).BankIDCode }},
+	}
+}
+
+// exportColumns are the columns of the CSV export, the payments are flattened.
+// The sender charges and the status history are not exported, as they are lists
+var exportColumns = func() []exportColumn {
+
+	columns := []exportColumn{
+		{"id", func(p *model.Payment) string { return string(p.ID) }},
+		{"type", func(p *model.Payment) string { return p.Type }},
+		{"version", func(p *model.Payment) string { return strconv.FormatUint(uint64(p.Version), 10) }},
+		{"organisation_id", func(p *model.Payment) string { return p.OrganisationID }},
+		{"status", func(p *model.Payment) string { return string(p.Status) }},
+		{"amount", func(p *model.Payment) string { return p.Attributes.Amount.Value.String() }},
+		{"currency", func(p *model.Payment) string { return p.Attributes.Amount.Currency }},
+		{"processing_date", func(p *model.Payment) string { return p.Attributes.ProcessingDate }},
+		{"payment_scheme", func(p *model.Payment) string { return p.Attributes.PaymentScheme }},
+		{"payment_type", func(p *model.Payment) string { return p.Attributes.PaymentType }},
+		{"scheme_payment_type", func(p *model.Payment) string { return p.Attributes.SchemePaymentType }},
+		{"scheme_payment_sub_type", func(p *model.Payment) string { return p.Attributes.SchemePaymentSubType }},
+		{"payment_purpose", func(p *model.Payment) string { return p.Attributes.PaymentPurpose }},
+		{"reference", func(p *model.Payment) string { return p.Attributes.Reference }},
+		{"end_to_end_reference", func(p *model.Payment) string { return p.Attributes.EndToEndReference }},
+		{"numeric_reference", func(p *model.Payment) string { return p.Attributes.NumericReference }},
+	}
+	columns = append(columns, partyColumns("beneficiary_party",
+		func(p *model.Payment) *model.Party { return &p.Attributes.BeneficiaryParty })...)
+	columns = append(columns, partyColumns("debtor_party",
+		func(p *model.Payment) *model.Party { return &p.Attributes.DebtorParty })...)
+	columns = append(columns, []exportColumn{
+		{"bearer_code", func(p *model.Payment) string { return p.Attributes.ChargesInformation.BearerCode }},
+		{"receiver_charges_amount", func(p *model.Payment) string {
+			return p.Attributes.ChargesInformation.ReceiverCharges.Value.String()
+		}},
+		{"receiver_charges_currency", func(p *model.Payment) string {
+			return p.Attributes.ChargesInformation.ReceiverCharges.Currency
+		}},
+		{"fx.exchange_rate", func(p *model.Payment) string { return p.Attributes.Fx.ExchangeRate }},
+		{"fx.original_amount", func(p *model.Payment) string { return p.Attributes.Fx.Original.Value.String() }},
+		{"fx.original_currency", func(p *model.Payment) string { return p.Attributes.Fx.Original.Currency }},
+		{"deleted_at", func(p *model.Payment) string {
+			if p.Deleted == nil {
+				return ""
+			}
+			return p.Deleted.At.UTC().Format(time.RFC3339)
+		}},
+	}...)
+	return columns
+}()
+
+// exportWriter writes the exported payments in a format
+type exportWriter interface {
+	start() error
+	write(p *model.Payment) error
+	flush() error
+}
+
+// ndjsonExport writes the payments as json, one per line
+type ndjsonExport struct {
+	encoder *json.Encoder
+}
+
+func (e *ndjsonExport) start() error                 { return nil }
+func (e *ndjsonExport) write(p *model.Payment) error { return e.encoder.Encode(p) }
+func (e *ndjsonExport) flush() error                 { return nil }
+
+// csvExport writes the payments as CSV, with a header with the names of the
+// columns
+type csvExport struct {
+	writer *csv.Writer
+	record []string
+}
+
+func (e *csvExport) start() error {
+
+	for i, column := range exportColumns {
+		e.record[i] = column.name
+	}
+	return e.writer.Write(e.record)
+}
+
+func (e *csvExport) write(p *model.Payment) error {
+
+	for i, column := range exportColumns {
+		e.record[i] = column.value(p)
+	}
+	return e.writer.Write(e.record)
+}
+
+func (e *csvExport) flush() error {
+
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+// exportPayments handler for exporting all the payments matching the filters
+// @Summary Export payments
+// @Description Streams all the payments matching the filters, as NDJSON (one
+// @Description payment per line) or CSV, depending on the Accept header. NDJSON
+// @Description by default. The filters and sort are the ones of the list. If
+// @Description something fails after the export started, the response is cut
+// @Accept  json
+// @Produce  application/x-ndjson,text/csv
+// @Param organisation_id query string false "Only payments of this organisation"
+// @Param attributes.currency query string false "Only payments in this currency"
+// @Param attributes.payment_scheme query string false "Only payments of this scheme"
+// @Param attributes.payment_type query string false "Only payments of this type"
+// @Param processing_date_from query string false "Only payments processed this day (YYYY-MM-DD) or later"
+// @Param processing_date_to query string false "Only payments processed this day (YYYY-MM-DD) or before"
+// @Param amount_min query string false "Only payments of this amount or more"
+// @Param amount_max query string false "Only payments of this amount or less"
+// @Param sort query string false "created, processing_date or organisation_id. Prefix with - for descending. -created by default"
+// @Param include_deleted query bool false "Export also the deleted payments"
+// @Success 200 {array} model.Payment
+// @Failure 400 {object} APIError "Invalid params"
+// @Failure 406 {object} APIError "The Accept header does not allow NDJSON nor CSV"
+// @Failure 500 {object} APIError "Cannot process the request"
+// @Router /payments/export [get]
+func exportPayments(logger *zap.Logger, paymentDb persistent.PaymentStore, h *health) func(ginCtx *gin.Context) {
+
+	return func(ginCtx *gin.Context) {
+
+		logger := requestLogger(ginCtx, logger)
+
+		// an export can take longer than the default timeout, but it is cut
+		// short when the server stops
+		ctx, cancel := h.streamContext(requestValues(ginCtx))
+		defer cancel()
+
+		list, err := listOptions(ginCtx)
+		if err != nil {
+			logger.Sugar().Infow("export-payments-invalid-params", "error", err)
+			respondError(ginCtx, http.StatusBadRequest, codeInvalidParameter, err.Error())
+			return
+		}
+		opts := persistent.ExportOptions{
+			Filter:         list.Filter,
+			Sort:           list.Sort,
+			IncludeDeleted: list.IncludeDeleted,
+		}
+
+		format := ginCtx.NegotiateFormat(ndjsonContentType, csvContentType)
+		var writer exportWriter
+		switch format {
+		case ndjsonContentType:
+			writer = &ndjsonExport{encoder: json.NewEncoder(ginCtx.Writer)}
+		case csvContentType:
+			writer = &csvExport{writer: csv.NewWriter(ginCtx.Writer), record: make([]string, len(exportColumns))}
+		default:
+			logger.Sugar().Infow("export-payments-not-acceptable", "accept", ginCtx.GetHeader("Accept"))
+			respondError(ginCtx, http.StatusNotAcceptable, codeNotAcceptable,
+				"the export can only be "+ndjsonContentType+" or "+csvContentType)
+			return
+		}
+
+		// the response starts with the first payment, so if the query fails
+		// the error can still be returned
+		started := false
+		start := func() error {
+			started = true
+			ginCtx.Header("Content-Type", format)
+			ginCtx.Header("Content-Disposition", `attachment; filename="`+exportFileName(format)+`"`)
+			ginCtx.Status(http.StatusOK)
+			return writer.start()
+		}
+		flush := func() error {
+			if err := writer.flush(); err != nil {
+				return err
+			}
+			ginCtx.Writer.Flush()
+			return nil
+		}
+
+		count := 0
+		err = paymentDb.Export(ctx, opts, func(p *model.Payment) error {
+			if !started {
+				if err := start(); err != nil {
+					return err
+				}
+			}
+			if err := writer.write(p); err != nil {
+				return err
+			}
+			count++
+			if count%exportFlushEvery == 0 {
+				return flush()
+			}
+			return nil
+		})
+		if err == nil && !started {
+			err = start()
+		}
+		if err == nil {
+			err = flush()
+		}
+
+		if err != nil && !started {
+			respondDBError(ginCtx, logger, "export-payments-db", err)
+			return
+		}
+		if err != nil {
+			logger.Sugar().Errorw("export-payments-cut", "error", err, "exported", count)
+			return
+		}
+		logger.Sugar().Infow("export-payments", "format", format, "exported", count)
+	}
+}
+
+// exportFileName is the name of the file suggested to the client
+func exportFileName(format string) string {
+
+	if format == csvContentType {
+		return "payments.csv"
+	}
+	return "payments.ndjson"
+}
@@ -4,8 +4,13 @@ import (
 	"apipay/model"
 	"apipay/persistent"
 	"context"
-	"fmt"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,63 +20,325 @@ import (
 
 const (
 	defaultTimeout = time.Second * 10
+
+	// maxPaymentSize is the max size of the json of a payment. The bodies
+	// read before they are validated are limited to it
+	maxPaymentSize = 1024 * 1024
 )
 
+// actorKey is the key in the gin context of who is doing the request
+const actorKey = "actor"
+
+// requestContext returns the context for the DB calls of a request, with the
+// default timeout, who is doing the request and its ID
+func requestContext(ginCtx *gin.Context) (context.Context, context.CancelFunc) {
+
+	return context.WithTimeout(requestValues(ginCtx), defaultTimeout)
+}
+
+// requestValues returns the context of a request with who is doing it, its ID
+// and the organisations it can see, but without a timeout. It is cancelled
+// when the client goes away
+func requestValues(ginCtx *gin.Context) context.Context {
+
+	ctx := persistent.WithActor(ginCtx.Request.Context(), ginCtx.GetString(actorKey))
+	if organisationIDs, scoped := organisations(ginCtx); scoped {
+		ctx = persistent.WithOrganisations(ctx, organisationIDs)
+	}
+	return persistent.WithRequestID(ctx, requestID(ginCtx))
+}
+
+// queryBool reads an optional boolean query param, false if not there. The
+// error is returned to the client
+func queryBool(ginCtx *gin.Context, name string) (bool, error) {
+
+	raw, found := ginCtx.GetQuery(name)
+	if !found {
+		return false, nil
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, errors.New(name + " must be true or false")
+	}
+	return value, nil
+}
+
+// boolParam is queryBool for the handlers. If it is not valid the request is
+// aborted, and ok is false
+func boolParam(ginCtx *gin.Context, logger *zap.Logger, name string) (value bool, ok bool) {
+
+	value, err := queryBool(ginCtx, name)
+	if err != nil {
+		logger.Sugar().Infow("payments-invalid-bool-param", "name", name, "value", ginCtx.Query(name))
+		respondError(ginCtx, http.StatusBadRequest, codeInvalidParameter, err.Error())
+		return false, false
+	}
+	return value, true
+}
+
+// paymentIDParam returns the ID of the payment in the path. If it is not
+// valid the request is aborted, and false returned
+func paymentIDParam(ginCtx *gin.Context, logger *zap.Logger) (model.PaymentID, bool) {
+
+	id := model.PaymentID(ginCtx.Param("paymentID"))
+	if !id.Valid() {
+		logger.Sugar().Infow("payments-invalid-id", "id", id)
+		respondError(ginCtx, http.StatusBadRequest, codeInvalidID, "the id does not have the format of the IDs")
+		return id, false
+	}
+	return id, true
+}
+
+// paymentLocation returns the URL of a payment
+func paymentLocation(id model.PaymentID) string {
+	return "/payments/" + url.PathEscape(string(id))
+}
+
+// PaymentList is a page of payments
+type PaymentList struct {
+	Data []*model.Payment `json:"data"`
+
+	// NextCursor is the cursor to get the next page, empty if this is the last one
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// errors of the query params of the list, the message is returned to the client
+var (
+	errInvalidLimit  = errors.New("limit must be a positive number")
+	errInvalidDate   = errors.New("processing_date_from and processing_date_to must be dates as YYYY-MM-DD")
+	errInvalidAmount = errors.New("amount_min and amount_max must be decimal numbers")
+	errInvalidSort   = errors.New("sort must be created, processing_date or organisation_id, optionally prefixed by -")
+	errInvalidOrg    = errors.New("organisation_id does not have the format of the IDs")
+	errInvalidGroup  = errors.New("group_by must be organisation_id, currency, payment_scheme or processing_date, separated by commas")
+)
+
+// paymentFilter reads from the query params the filter of the payments
+func paymentFilter(ginCtx *gin.Context) (persistent.PaymentFilter, error) {
+
+	filter := persistent.PaymentFilter{
+		OrganisationID:     ginCtx.Query("organisation_id"),
+		Currency:           ginCtx.Query("attributes.currency"),
+		PaymentScheme:      ginCtx.Query("attributes.payment_scheme"),
+		PaymentType:        ginCtx.Query("attributes.payment_type"),
+		ProcessingDateFrom: ginCtx.Query("processing_date_from"),
+		ProcessingDateTo:   ginCtx.Query("processing_date_to"),
+		AmountMin:          ginCtx.Query("amount_min"),
+		AmountMax:          ginCtx.Query("amount_max"),
+	}
+
+	if org := filter.OrganisationID; len(org) > 0 && !model.ValidOrganisationID(org) {
+		return filter, errInvalidOrg
+	}
+
+	for _, date := range []string{filter.ProcessingDateFrom, filter.ProcessingDateTo} {
+		if len(date) == 0 {
+			continue
+		}
+		if _, err := time.Parse(model.DateFormat, date); err != nil {
+			return filter, errInvalidDate
+		}
+	}
+
+	if err := filter.Validate(); err != nil {
+		return filter, errInvalidAmount
+	}
+
+	return filter, nil
+}
+
+// listOptions reads from the query params the options to list payments
+func listOptions(ginCtx *gin.Context) (persistent.ListOptions, error) {
+
+	filter, err := paymentFilter(ginCtx)
+	opts := persistent.ListOptions{
+		Cursor: ginCtx.Query("cursor"),
+		Filter: filter,
+	}
+	if err != nil {
+		return opts, err
+	}
+
+	if limit, found := ginCtx.GetQuery("limit"); found {
+		parsed, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || parsed <= 0 {
+			return opts, errInvalidLimit
+		}
+		opts.Limit = parsed
+	}
+
+	if opts.IncludeDeleted, err = queryBool(ginCtx, "include_deleted"); err != nil {
+		return opts, err
+	}
+
+	sort, err := persistent.ParseSort(ginCtx.Query("sort"))
+	if err != nil {
+		return opts, errInvalidSort
+	}
+	opts.Sort = sort
+
+	return opts, nil
+}
+
 // getPayments handler for getting all the payments
-// @Summary Get the last 100 payments
-// @Description Gets the last 100 payments. It should have a pagination
+// @Summary Get a page of payments
+// @Description Gets the payments matching the filters, newest first unless
+// @Description sort is given. To get the next page pass the next_cursor of the
+// @Description response as the cursor param, with the same filters and sort
 // @Accept  json
 // @Produce  json
-// @Success 200 {array} model.Payment
-// @Failure 404 {object} APIError "Can not find ID"
+// @Param limit query int false "Max number of payments to return, 100 by default, 1000 max"
+// @Param cursor query string false "Cursor to get the next page"
+// @Param organisation_id query string false "Only payments of this organisation"
+// @Param attributes.currency query string false "Only payments in this currency"
+// @Param attributes.payment_scheme query string false "Only payments of this scheme"
+// @Param attributes.payment_type query string false "Only payments of this type"
+// @Param processing_date_from query string false "Only payments processed this day (YYYY-MM-DD) or later"
+// @Param processing_date_to query string false "Only payments processed this day (YYYY-MM-DD) or before"
+// @Param amount_min query string false "Only payments of this amount or more"
+// @Param amount_max query string false "Only payments of this amount or less"
+// @Param sort query string false "created, processing_date or organisation_id. Prefix with - for descending. -created by default"
+// @Param include_deleted query bool false "List also the deleted payments"
+// @Success 200 {object} PaymentList
+// @Failure 400 {object} APIError "Invalid params"
 // @Failure 500 {object} APIError "Cannot process the request"
 // @Router /payments [get]
-func getPayments(logger *zap.Logger, paymentDb persistent.Payments) func(ginCtx *gin.Context) {
+func getPayments(logger *zap.Logger, paymentDb persistent.PaymentStore) func(ginCtx *gin.Context) {
 
 	return func(ginCtx *gin.Context) {
 
-		ctx, cancel := context.WithTimeout(ginCtx.Request.Context(), defaultTimeout)
+		logger := requestLogger(ginCtx, logger)
+
+		ctx, cancel := requestContext(ginCtx)
 		defer cancel()
 
-		items, err := paymentDb.Last100(ctx)
+		opts, err := listOptions(ginCtx)
+		if err != nil {
+			logger.Sugar().Infow("get-payments-invalid-params", "error", err)
+			respondError(ginCtx, http.StatusBadRequest, codeInvalidParameter, err.Error())
+			return
+		}
+
+		res, err := paymentDb.List(ctx, opts)
+		if err != nil {
+			respondDBError(ginCtx, logger, "get-payments-db", err)
+		} else {
+			ginCtx.JSON(http.StatusOK, PaymentList{Data: res.Items, NextCursor: res.NextCursor})
+		}
+	}
+}
+
+// summaryOptions reads from the query params the options of the summary
+func summaryOptions(ginCtx *gin.Context) (persistent.SummaryOptions, error) {
+
+	filter, err := paymentFilter(ginCtx)
+	opts := persistent.SummaryOptions{Filter: filter}
+	if err != nil {
+		return opts, err
+	}
+
+	if groupBy := ginCtx.Query("group_by"); len(groupBy) > 0 {
+		opts.GroupBy = strings.Split(groupBy, ",")
+	}
+	if err := opts.Validate(); err != nil {
+		return opts, errInvalidGroup
+	}
+
+	return opts, nil
+}
+
+// PaymentSummary is the totals of the payments
+type PaymentSummary struct {
+	Data []model.Summary `json:"data"`
+}
+
+// getPaymentSummary handler for getting the totals of the payments
+// @Summary Get the totals of the payments
+// @Description Counts and adds the amounts and the charges of the payments
+// @Description matching the filters, grouped by the fields of group_by. They are
+// @Description always grouped by currency. Deleted payments are not added
+// @Accept  json
+// @Produce  json
+// @Param group_by query string false "organisation_id, currency, payment_scheme and/or processing_date, separated by commas"
+// @Param organisation_id query string false "Only payments of this organisation"
+// @Param attributes.currency query string false "Only payments in this currency"
+// @Param attributes.payment_scheme query string false "Only payments of this scheme"
+// @Param attributes.payment_type query string false "Only payments of this type"
+// @Param processing_date_from query string false "Only payments processed this day (YYYY-MM-DD) or later"
+// @Param processing_date_to query string false "Only payments processed this day (YYYY-MM-DD) or before"
+// @Param amount_min query string false "Only payments of this amount or more"
+// @Param amount_max query string false "Only payments of this amount or less"
+// @Success 200 {object} PaymentSummary
+// @Failure 400 {object} APIError "Invalid params"
+// @Failure 500 {object} APIError "Cannot process the request"
+// @Router /payments/summary [get]
+func getPaymentSummary(logger *zap.Logger, paymentDb persistent.PaymentStore) func(ginCtx *gin.Context) {
+
+	return func(ginCtx *gin.Context) {
+
+		logger := requestLogger(ginCtx, logger)
+
+		ctx, cancel := requestContext(ginCtx)
+		defer cancel()
+
+		opts, err := summaryOptions(ginCtx)
+		if err != nil {
+			logger.Sugar().Infow("get-summary-payments-invalid-params", "error", err)
+			respondError(ginCtx, http.StatusBadRequest, codeInvalidParameter, err.Error())
+			return
+		}
+
+		res, err := paymentDb.Summary(ctx, opts)
 		if err != nil {
-			logger.Sugar().Warnw("get-payments-db", "error", err)
-			ginCtx.Status(http.StatusInternalServerError)
+			respondDBError(ginCtx, logger, "get-summary-payments-db", err)
 		} else {
-			ginCtx.JSON(http.StatusOK, items)
+			ginCtx.JSON(http.StatusOK, PaymentSummary{Data: res})
 		}
 	}
 }
 
 // getOnePayment handler for getting one Payment by ID
 // @Summary Get a Payment by ID
+// @Description The ETag header has the version of the payment. It can be used
+// @Description in If-None-Match, to avoid getting it again, and in If-Match when updating
 // @Accept  json
 // @Produce  json
 // @Param paymentID path string true "Payment ID"
+// @Param If-None-Match header string false "ETag of the version the client has"
+// @Param include_deleted query bool false "Get it also if it is deleted"
 // @Success 200 {object} model.Payment
+// @Success 304 {object} model.Payment "Empty result, the client has the latest version"
+// @Failure 400 {object} APIError "Invalid ID"
 // @Failure 404 {object} APIError "Can not find ID"
 // @Failure 500 {object} APIError "Cannot process the request"
 // @Router /payments/{paymentID} [get]
-func getOnePayment(logger *zap.Logger, paymentDb persistent.Payments) func(ginCtx *gin.Context) {
+func getOnePayment(logger *zap.Logger, paymentDb persistent.PaymentStore) func(ginCtx *gin.Context) {
 
 	return func(ginCtx *gin.Context) {
 
-		ctx, cancel := context.WithTimeout(ginCtx.Request.Context(), defaultTimeout)
+		logger := requestLogger(ginCtx, logger)
+
+		ctx, cancel := requestContext(ginCtx)
 		defer cancel()
 
-		id := model.PaymentID(ginCtx.Param("paymentID"))
-		// TODO Can we do some validation of the ID?
+		id, ok := paymentIDParam(ginCtx, logger)
+		if !ok {
+			return
+		}
+
+		includeDeleted, ok := boolParam(ginCtx, logger, "include_deleted")
+		if !ok {
+			return
+		}
 
-		item, err := paymentDb.Get(ctx, id)
+		item, err := paymentDb.Get(ctx, id, persistent.GetOptions{IncludeDeleted: includeDeleted})
 		if err != nil {
-			if persistent.IsErrorNoDBResults(err) {
-				logger.Info("get-one-payments-db-not-found")
-				ginCtx.Status(http.StatusNotFound)
-			} else {
-				logger.Sugar().Warnw("get-one-payments-db", "error", err)
-				ginCtx.Status(http.StatusInternalServerError)
+			respondDBError(ginCtx, logger, "get-one-payments-db", err)
+			return
+		}
 
-			}
+		ginCtx.Header("ETag", etag(item.Version))
+		if header := ginCtx.GetHeader("If-None-Match"); len(header) > 0 && matchesETag(header, item.Version) {
+			ginCtx.Status(http.StatusNotModified)
 		} else {
 			ginCtx.JSON(http.StatusOK, item)
 		}
@@ -80,120 +347,302 @@ func getOnePayment(logger *zap.Logger, paymentDb persistent.Payments) func(ginCt
 
 // updatePayment handler for getting one Payment by ID
 // @Summary Update a Payment by ID
+// @Description The version of the payment has to be the stored one, the server
+// @Description increments it. If-Match can be used instead, with the ETag of the payment
 // @Accept  json
 // @Produce  json
 // @Param paymentID path string true "Payment ID"
+// @Param If-Match header string false "ETag of the version being updated, * for any"
 // @Param payment body model.Payment true "The payment to be updated"
-// @Success 201 {object} model.Payment "Empty result, it is not the created object" TODO fix this
+// @Success 200 {object} model.Payment "The updated payment, with the new version"
 // @Failure 400 {object} APIError "Invalid payment received"
+// @Failure 403 {object} APIError "The organisation is not one of the credentials, or they miss a role"
 // @Failure 404 {object} APIError "Can not find ID"
+// @Failure 409 {object} APIError "The version is not the stored one"
+// @Failure 412 {object} APIError "If-Match does not match the stored version"
 // @Failure 500 {object} APIError "Cannot process the request"
 // @Router /payments/{paymentID} [put]
-func updatePayment(logger *zap.Logger, paymentDb persistent.Payments) func(ginCtx *gin.Context) {
+func updatePayment(logger *zap.Logger, paymentDb persistent.PaymentStore) func(ginCtx *gin.Context) {
 
 	return func(ginCtx *gin.Context) {
 
-		ctx, cancel := context.WithTimeout(ginCtx.Request.Context(), defaultTimeout)
+		logger := requestLogger(ginCtx, logger)
+
+		ctx, cancel := requestContext(ginCtx)
 		defer cancel()
 
-		id := model.PaymentID(ginCtx.Param("paymentID"))
-		// TODO Can we do some validation of the ID?
+		id, ok := paymentIDParam(ginCtx, logger)
+		if !ok {
+			return
+		}
 
 		received := &model.Payment{}
 		if err := binding.JSON.Bind(ginCtx.Request, received); err != nil {
 			logger.Sugar().Warnw("update-payments-db-json", "error", err)
-			ginCtx.Status(http.StatusBadRequest)
+			respondError(ginCtx, http.StatusBadRequest, codeInvalidJSON, "the body is not a valid payment json")
 			return
 		}
-		if !received.Valid() {
-			logger.Warn("update-payments-db-invalid")
-			ginCtx.Status(http.StatusBadRequest)
+		if violations := received.Valid(); len(violations) > 0 {
+			logger.Sugar().Infow("update-payments-invalid", "violations", violations)
+			respondError(ginCtx, http.StatusBadRequest, codeValidationFailed, "the payment is not valid", violations...)
 			return
 		}
 		if received.ID != id {
 			logger.Warn("update-payments-db-id-mismatch")
-			ginCtx.Status(http.StatusBadRequest)
+			respondError(ginCtx, http.StatusBadRequest, codeIDMismatch, "the id of the payment is not the one of the path")
 			return
 		}
 
-		err := paymentDb.Update(ctx, *received)
-		fmt.Println("updated", err)
+		// If-Match takes precedence over the version in the body
+		ifMatch := ginCtx.GetHeader("If-Match")
+		if strings.TrimSpace(ifMatch) == "*" {
+			current, err := paymentDb.Get(ctx, id, persistent.GetOptions{})
+			if err != nil {
+				if persistent.IsErrorNoDBResults(err) {
+					logger.Info("update-payments-db-not-found")
+					respondError(ginCtx, http.StatusPreconditionFailed, codePreconditionFailed, "the payment does not exist")
+				} else {
+					respondDBError(ginCtx, logger, "update-payments-db", err)
+				}
+				return
+			}
+			received.Version = current.Version
+		} else if len(ifMatch) > 0 {
+			version, err := parseETag(ifMatch)
+			if err != nil {
+				logger.Sugar().Infow("update-payments-invalid-if-match", "ifMatch", ifMatch)
+				respondError(ginCtx, http.StatusBadRequest, codeInvalidParameter, "If-Match must be an ETag or *")
+				return
+			}
+			received.Version = version
+		}
+
+		updated, err := paymentDb.Update(ctx, *received)
 		if err != nil {
-			if persistent.IsErrorNoDBResults(err) {
-				logger.Info("get-one-payments-db-not-found")
-				ginCtx.Status(http.StatusNotFound)
+			if err == persistent.ErrVersionConflict && len(ifMatch) > 0 {
+				logger.Info("update-payments-db-precondition-failed")
+				respondError(ginCtx, http.StatusPreconditionFailed, codePreconditionFailed, "If-Match is not the latest version")
 			} else {
-				logger.Sugar().Warnw("get-one-payments-db", "error", err)
-				ginCtx.Status(http.StatusInternalServerError)
+				respondDBError(ginCtx, logger, "update-payments-db", err)
 			}
 		} else {
-			ginCtx.Status(http.StatusOK)
+			ginCtx.Header("ETag", etag(updated.Version))
+			ginCtx.JSON(http.StatusOK, updated)
 		}
 	}
 }
 
-// deletePayment handler for deleting one Payment by ID
+// deletePayment handler for deleting one Payment by ID. Payments are not
+// really deleted, they are marked as deleted and they can be restored
 // @Summary Delete a Payment by ID
 // @Accept  json
 // @Produce  json
 // @Param paymentID path string true "Payment ID"
-// @Success 204 {object} model.Payment "Empty result, it is not the created object" TODO fix this
+// @Success 204 {object} model.Payment "Empty result"
+// @Failure 400 {object} APIError "Invalid ID"
 // @Failure 404 {object} APIError "Can not find ID"
 // @Failure 500 {object} APIError "Cannot process the request"
 // @Router /payments/{paymentID} [delete]
-func deletePayment(logger *zap.Logger, paymentDb persistent.Payments) func(ginCtx *gin.Context) {
+func deletePayment(logger *zap.Logger, paymentDb persistent.PaymentStore) func(ginCtx *gin.Context) {
 
 	return func(ginCtx *gin.Context) {
 
-		ctx, cancel := context.WithTimeout(ginCtx.Request.Context(), defaultTimeout)
+		logger := requestLogger(ginCtx, logger)
+
+		ctx, cancel := requestContext(ginCtx)
 		defer cancel()
 
-		id := model.PaymentID(ginCtx.Param("paymentID"))
-		// TODO Can we do some validation of the ID?
+		id, ok := paymentIDParam(ginCtx, logger)
+		if !ok {
+			return
+		}
 
-		_, err := paymentDb.Delete(ctx, id)
+		deleted, err := paymentDb.Delete(ctx, id)
 		if err != nil {
-			logger.Sugar().Warnw("delete-payments-db", "error", err)
-			ginCtx.Status(http.StatusInternalServerError)
+			respondDBError(ginCtx, logger, "delete-payments-db", err)
+		} else if deleted == 0 {
+			logger.Info("delete-payments-db-not-found")
+			respondError(ginCtx, http.StatusNotFound, codeNotFound, "the payment does not exist")
 		} else {
 			ginCtx.Status(http.StatusNoContent)
 		}
 	}
 }
 
+// restorePayment handler for restoring a deleted Payment
+// @Summary Restore a deleted Payment by ID
+// @Accept  json
+// @Produce  json
+// @Param paymentID path string true "Payment ID"
+// @Success 200 {object} model.Payment "The restored payment"
+// @Failure 400 {object} APIError "Invalid ID"
+// @Failure 404 {object} APIError "Can not find ID"
+// @Failure 409 {object} APIError "The payment is not deleted"
+// @Failure 500 {object} APIError "Cannot process the request"
+// @Router /payments/{paymentID}/restore [post]
+func restorePayment(logger *zap.Logger, paymentDb persistent.PaymentStore) func(ginCtx *gin.Context) {
+
+	return func(ginCtx *gin.Context) {
+
+		logger := requestLogger(ginCtx, logger)
+
+		ctx, cancel := requestContext(ginCtx)
+		defer cancel()
+
+		id, ok := paymentIDParam(ginCtx, logger)
+		if !ok {
+			return
+		}
+
+		restored, err := paymentDb.Restore(ctx, id)
+		if err != nil {
+			respondDBError(ginCtx, logger, "restore-payments-db", err)
+		} else {
+			ginCtx.Header("ETag", etag(restored.Version))
+			ginCtx.JSON(http.StatusOK, restored)
+		}
+	}
+}
+
+// PaymentHistory is the audit log of a payment
+type PaymentHistory struct {
+	Data []model.AuditEntry `json:"data"`
+}
+
+// getPaymentHistory handler for getting the audit log of a Payment
+// @Summary Get all the changes of a Payment by ID
+// @Description Every change is there, oldest first, with who did it, when, the
+// @Description ID of the request and the payment before and after. Deleted payments have it too
+// @Accept  json
+// @Produce  json
+// @Param paymentID path string true "Payment ID"
+// @Success 200 {object} PaymentHistory
+// @Failure 400 {object} APIError "Invalid ID"
+// @Failure 404 {object} APIError "Can not find ID"
+// @Failure 500 {object} APIError "Cannot process the request"
+// @Router /payments/{paymentID}/history [get]
+func getPaymentHistory(logger *zap.Logger, paymentDb persistent.PaymentStore) func(ginCtx *gin.Context) {
+
+	return func(ginCtx *gin.Context) {
+
+		logger := requestLogger(ginCtx, logger)
+
+		ctx, cancel := requestContext(ginCtx)
+		defer cancel()
+
+		id, ok := paymentIDParam(ginCtx, logger)
+		if !ok {
+			return
+		}
+
+		entries, err := paymentDb.History(ctx, id)
+		if err != nil {
+			respondDBError(ginCtx, logger, "get-history-payments-db", err)
+		} else {
+			ginCtx.JSON(http.StatusOK, PaymentHistory{Data: entries})
+		}
+	}
+}
+
+// TransitionRequest is the optional body of the actions of the payments
+type TransitionRequest struct {
+	// Reason is recorded in the status history
+	Reason string `json:"reason"`
+}
+
+// transitionPayment handler for doing an action to a Payment, which changes its status.
+// @Summary Do an action to a Payment by ID, changing its status
+// @Description The actions are submit (pending to submitted), settle (submitted
+// @Description to settled), reject (pending or submitted to rejected) and return
+// @Description (settled to returned). The body is optional
+// @Accept  json
+// @Produce  json
+// @Param paymentID path string true "Payment ID"
+// @Param action path string true "submit, settle, reject or return"
+// @Param transition body main.TransitionRequest false "Why the action is done"
+// @Success 200 {object} model.Payment "The payment in its new status"
+// @Failure 400 {object} APIError "Invalid ID or body"
+// @Failure 404 {object} APIError "Can not find ID"
+// @Failure 409 {object} APIError "The action is not allowed in the status of the payment"
+// @Failure 500 {object} APIError "Cannot process the request"
+// @Router /payments/{paymentID}/{action} [post]
+func transitionPayment(logger *zap.Logger, paymentDb persistent.PaymentStore, action model.Action) func(ginCtx *gin.Context) {
+
+	return func(ginCtx *gin.Context) {
+
+		logger := requestLogger(ginCtx, logger)
+
+		ctx, cancel := requestContext(ginCtx)
+		defer cancel()
+
+		id, ok := paymentIDParam(ginCtx, logger)
+		if !ok {
+			return
+		}
+
+		received := &TransitionRequest{}
+		if err := json.NewDecoder(ginCtx.Request.Body).Decode(received); err != nil && err != io.EOF {
+			logger.Sugar().Warnw("transition-payments-json", "action", action, "error", err)
+			respondError(ginCtx, http.StatusBadRequest, codeInvalidJSON, "the body is not a valid json")
+			return
+		}
+
+		updated, err := paymentDb.Transition(ctx, id, action, received.Reason)
+		if err != nil {
+			respondDBError(ginCtx, logger, "transition-payments-db", err)
+		} else {
+			ginCtx.Header("ETag", etag(updated.Version))
+			ginCtx.JSON(http.StatusOK, updated)
+		}
+	}
+}
+
 // createPayment handler for creating a new Payment
 // @Summary Create  a new Payment
+// @Description If the payment has no id, a UUID is generated
 // @Accept  json
 // @Produce  json
 // @Param payment body model.Payment true "The payment to be created"
-// @Success 204 {object} model.Payment "Empty result, it is not the created object" TODO fix this
+// @Success 201 {object} model.Payment "The created payment. The Location header has its URL"
 // @Failure 400 {object} APIError "Payment with invalid format"
+// @Failure 403 {object} APIError "The organisation is not one of the credentials, or they miss a role"
+// @Failure 409 {object} APIError "There is already a payment with the same ID, or the Idempotency-Key is in use"
+// @Failure 422 {object} APIError "The Idempotency-Key was used with a different payment"
 // @Failure 500 {object} APIError "Cannot process the request"
 // @Router /payments [post]
-func createPayment(logger *zap.Logger, paymentDb persistent.Payments) func(ginCtx *gin.Context) {
+func createPayment(logger *zap.Logger, paymentDb persistent.PaymentStore) func(ginCtx *gin.Context) {
 
 	return func(ginCtx *gin.Context) {
 
-		ctx, cancel := context.WithTimeout(ginCtx.Request.Context(), defaultTimeout)
+		logger := requestLogger(ginCtx, logger)
+
+		ctx, cancel := requestContext(ginCtx)
 		defer cancel()
 
 		received := &model.Payment{}
 		if err := binding.JSON.Bind(ginCtx.Request, received); err != nil {
 			logger.Sugar().Warnw("create-payments-db-json", "error", err)
-			ginCtx.Status(http.StatusBadRequest)
+			respondError(ginCtx, http.StatusBadRequest, codeInvalidJSON, "the body is not a valid payment json")
 			return
 		}
-		if !received.Valid() {
-			logger.Warn("create-payments-db-invalid")
-			ginCtx.Status(http.StatusBadRequest)
+		if len(received.ID) == 0 {
+			received.ID = model.NewPaymentID()
+		}
+		if violations := received.Valid(); len(violations) > 0 {
+			logger.Sugar().Infow("create-payments-invalid", "violations", violations)
+			respondError(ginCtx, http.StatusBadRequest, codeValidationFailed, "the payment is not valid", violations...)
 			return
 		}
-		err := paymentDb.Save(ctx, *received)
+		received.Version = 0 // the version and the deletion are handled by the server
+		received.Deleted = nil
+
+		saved, err := paymentDb.Save(ctx, *received)
 		if err != nil {
-			logger.Sugar().Warnw("create-payments-db", "error", err)
-			ginCtx.Status(http.StatusInternalServerError)
+			respondDBError(ginCtx, logger, "create-payments-db", err)
 		} else {
-			ginCtx.Status(http.StatusCreated) //TODO. Should we return the ID?
+			ginCtx.Header("Location", paymentLocation(saved.ID))
+			ginCtx.Header("ETag", etag(saved.Version))
+			ginCtx.JSON(http.StatusCreated, saved)
 		}
 	}
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"apipay/persistent"
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// readinessTimeout is how long each dependency has to answer the readiness
+// check
+const readinessTimeout = 2 * time.Second
+
+// The status of the service and of its dependencies in the health APIs
+const (
+	statusOK       = "ok"
+	statusReady    = "ready"
+	statusNotReady = "not_ready"
+	statusDraining = "draining"
+	statusUp       = "up"
+	statusDown     = "down"
+)
+
+// dependency is something the service needs to answer the requests
+type dependency struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// mongoDependencies are the checks of Mongo: it answers and the collections
+// have their indices
+func mongoDependencies(db *persistent.Client) []dependency {
+
+	return []dependency{
+		{name: "mongo", check: db.Ping},
+		{name: "mongo-indexes", check: db.CheckIndexes},
+	}
+}
+
+// health is what the health APIs report. It is not ready once it is draining,
+// so the load balancers stop sending requests before the server stops
+type health struct {
+	dependencies []dependency
+	draining     atomic.Bool
+
+	// shutdown is closed when the server shuts down, see streamContext
+	shutdown chan struct{}
+	stopOnce sync.Once
+}
+
+// newHealth returns the health of a service needing these dependencies
+func newHealth(dependencies ...dependency) *health {
+	return &health{dependencies: dependencies, shutdown: make(chan struct{})}
+}
+
+// drain makes the service not ready, for the graceful shutdown
+func (h *health) drain() {
+	h.draining.Store(true)
+}
+
+// stop ends the streaming responses, once the server is shutting down
+func (h *health) stop() {
+	h.stopOnce.Do(func() { close(h.shutdown) })
+}
+
+// streamContext returns a context cancelled also when the server shuts down.
+// The streaming responses use it, as they could go on for longer than the
+// server waits for the requests to finish
+func (h *health) streamContext(ctx context.Context) (context.Context, context.CancelFunc) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-h.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// LiveStatus is the result of the liveness check
+type LiveStatus struct {
+	Status string `json:"status"`
+}
+
+// DependencyStatus is the result of checking a dependency
+type DependencyStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+
+	// LatencyMs is how long the check took, in milliseconds
+	LatencyMs float64 `json:"latency_ms"`
+
+	// Error is why the dependency is down
+	Error string `json:"error,omitempty"`
+}
+
+// ReadyStatus is the result of the readiness check
+type ReadyStatus struct {
+	Status       string             `json:"status"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// getLive handler for checking the service is alive
+// @Summary Check the service is alive
+// @Description It is alive while it can answer requests, even if its
+// @Description dependencies are down or it is shutting down. No authentication
+// @Produce  json
+// @Success 200 {object} main.LiveStatus
+// @Router /health/live [get]
+func getLive() func(ginCtx *gin.Context) {
+
+	return func(ginCtx *gin.Context) {
+		ginCtx.JSON(http.StatusOK, LiveStatus{Status: statusOK})
+	}
+}
+
+// getReady handler for checking the service can answer requests
+// @Summary Check the service is ready
+// @Description Checks each dependency, with its status and latency. It is not
+// @Description ready if any of them is down or the service is shutting down.
+// @Description No authentication
+// @Produce  json
+// @Success 200 {object} main.ReadyStatus
+// @Failure 503 {object} main.ReadyStatus
+// @Router /health/ready [get]
+func getReady(logger *zap.Logger, h *health) func(ginCtx *gin.Context) {
+
+	return func(ginCtx *gin.Context) {
+		logger := requestLogger(ginCtx, logger)
+
+		result := ReadyStatus{Status: statusReady, Dependencies: []DependencyStatus{}}
+		if h.draining.Load() {
+			// the dependencies are not checked, it will not be ready again
+			result.Status = statusDraining
+			ginCtx.JSON(http.StatusServiceUnavailable, result)
+			return
+		}
+
+		for _, dep := range h.dependencies {
+			status := checkDependency(ginCtx.Request.Context(), dep)
+			if status.Status != statusUp {
+				logger.Sugar().Warnw("health-dependency-down", "dependency", dep.name, "error", status.Error)
+				result.Status = statusNotReady
+			}
+			result.Dependencies = append(result.Dependencies, status)
+		}
+
+		code := http.StatusOK
+		if result.Status != statusReady {
+			code = http.StatusServiceUnavailable
+		}
+		ginCtx.JSON(code, result)
+	}
+}
+
+// checkDependency checks a dependency, timing how long it takes
+func checkDependency(ctx context.Context, dep dependency) DependencyStatus {
+
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	started := time.Now()
+	err := dep.check(ctx)
+	status := DependencyStatus{
+		Name:      dep.name,
+		Status:    statusUp,
+		LatencyMs: float64(time.Since(started).Microseconds()) / 1000,
+	}
+	if err != nil {
+		status.Status = statusDown
+		status.Error = err.Error()
+	}
+	return status
+}
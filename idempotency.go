@@ -0,0 +1,191 @@
+package main
+
+import (
+	"apipay/persistent"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// idempotencyReplayedHeader is set when the response is a replay
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+)
+
+// replayedHeaders are the headers of the response stored to be replayed
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// recordingWriter keeps a copy of what is written, so it can be stored
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotency is a middleware for the requests with an Idempotency-Key header.
+// The first response for each key and organisation is stored, and retries of
+// the same request get it replayed. Reusing the key with a different request
+// fails with 422. Requests without the header are not affected
+func idempotency(logger *zap.Logger, idempotencyDb persistent.IdempotencyStore) gin.HandlerFunc {
+
+	return func(ginCtx *gin.Context) {
+
+		logger := requestLogger(ginCtx, logger)
+
+		key := ginCtx.GetHeader(idempotencyKeyHeader)
+		if len(key) == 0 {
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			logger.Info("idempotency-key-too-long")
+			respondError(ginCtx, http.StatusBadRequest, codeInvalidParameter, "Idempotency-Key is too long")
+			return
+		}
+
+		// the whole body is read before it is validated, so it is limited
+		body, err := ioutil.ReadAll(http.MaxBytesReader(ginCtx.Writer, ginCtx.Request.Body, maxPaymentSize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			logger.Sugar().Infow("idempotency-body-too-large", "max", maxPaymentSize)
+			respondError(ginCtx, http.StatusRequestEntityTooLarge, codePaymentTooLarge, "the payment is larger than 1 MB")
+			return
+		}
+		if err != nil {
+			logger.Sugar().Warnw("idempotency-read-body", "error", err)
+			respondError(ginCtx, http.StatusBadRequest, codeInvalidJSON, "the body cannot be read")
+			return
+		}
+		ginCtx.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		// the keys are scoped by organisation. Without it the request is not
+		// valid, so the handler will reject it anyway
+		var scope struct {
+			OrganisationID string `json:"organisation_id"`
+		}
+		if err := json.Unmarshal(body, &scope); err != nil || len(scope.OrganisationID) == 0 {
+			return
+		}
+		// nor if the organisation is not allowed, and its responses must not
+		// be replayed to this request
+		if !organisationAllowed(ginCtx, scope.OrganisationID) {
+			return
+		}
+
+		hash := requestHash(body)
+
+		ctx, cancel := context.WithTimeout(ginCtx.Request.Context(), defaultTimeout)
+		defer cancel()
+
+		existing, err := idempotencyDb.Reserve(ctx, key, scope.OrganisationID, hash)
+		if err != nil {
+			respondDBError(ginCtx, logger, "idempotency-reserve-db", err)
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case existing.RequestHash != hash:
+				logger.Info("idempotency-key-reused")
+				respondError(ginCtx, http.StatusUnprocessableEntity, codeIdempotencyKeyReused,
+					"the Idempotency-Key was already used with a different request")
+			case !existing.Completed:
+				logger.Info("idempotency-key-in-progress")
+				respondError(ginCtx, http.StatusConflict, codeIdempotencyInProgress,
+					"a request with the same Idempotency-Key is being processed")
+			default:
+				logger.Info("idempotency-replay")
+				for name, value := range existing.Headers {
+					ginCtx.Header(name, value)
+				}
+				ginCtx.Header(idempotencyReplayedHeader, "true")
+				ginCtx.Status(existing.StatusCode)
+				_, _ = ginCtx.Writer.Write(existing.Body)
+				ginCtx.Abort()
+			}
+			return
+		}
+
+		writer := &recordingWriter{ResponseWriter: ginCtx.Writer}
+		ginCtx.Writer = writer
+
+		// deferred so the key is released also when the handler panics,
+		// otherwise it would be in progress until it expires
+		defer func() {
+			// the request context can be already done, but this has to be stored
+			ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+			defer cancel()
+
+			if p := recover(); p != nil {
+				// Recovery answers it with a 500, so it can be retried
+				if err := idempotencyDb.Release(ctx, key, scope.OrganisationID); err != nil {
+					logger.Sugar().Warnw("idempotency-release-db", "error", err)
+				}
+				panic(p)
+			}
+
+			var err error
+			if status := writer.Status(); status >= http.StatusInternalServerError {
+				// it could not be processed, so it can be retried
+				err = idempotencyDb.Release(ctx, key, scope.OrganisationID)
+			} else {
+				record := persistent.IdempotencyRecord{
+					Key:            key,
+					OrganisationID: scope.OrganisationID,
+					StatusCode:     status,
+					Headers:        map[string]string{},
+					Body:           writer.body.Bytes(),
+				}
+				for _, name := range replayedHeaders {
+					if value := writer.Header().Get(name); len(value) > 0 {
+						record.Headers[name] = value
+					}
+				}
+				err = idempotencyDb.Complete(ctx, record)
+			}
+			if err != nil {
+				logger.Sugar().Warnw("idempotency-complete-db", "error", err)
+			}
+		}()
+
+		ginCtx.Next()
+	}
+}
+
+// requestHash is the hash of the json of a request, of its canonical form so
+// the same json formatted in a different way has the same hash
+func requestHash(body []byte) string {
+
+	canonical := body
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err == nil {
+		// the keys of the objects are sorted and the spaces are removed
+		if data, err := json.Marshal(value); err == nil {
+			canonical = data
+		}
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
@@ -2,14 +2,22 @@ package main
 
 import (
 	"apipay/config"
+	"apipay/model"
+	"apipay/oidc"
+	"apipay/outbox"
 	"apipay/persistent"
+	"apipay/webhook"
 	"context"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
 
 	"github.com/gin-gonic/gin"
@@ -20,29 +28,148 @@ var (
 	gitHash string // This is set when building
 )
 
-func getHandler(logger *zap.Logger, paymentDb persistent.Payments) http.Handler {
+// jwksTimeout is how long loading the JWKS of the JWTs can take
+const jwksTimeout = 10 * time.Second
+
+func getHandler(logger *zap.Logger, stores persistent.Stores, h *health) http.Handler {
 
 	gin.SetMode(gin.ReleaseMode)
 
 	router := gin.Default()
+	router.Use(measureRequests(), traceRequests(), requestScope(logger))
+
+	// the metrics are for the monitoring, they do not need authentication
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	// and neither do the health checks, of the load balancers
+	router.GET("/health/live", getLive())
+	router.GET("/health/ready", getReady(logger, h))
+	auth := authMiddlewares(logger, stores)
 
-	paymentsRoute := router.Group("/payments/") //TODO add any specific AUTH
-	// TODO add tracing and request id to the logger
+	paymentsRoute := router.Group("/payments/", auth...)
 	{
-		paymentsRoute.GET("/", getPayments(logger, paymentDb))
+		read := requireRole(logger, rolePaymentsRead)
+		write := requireRole(logger, rolePaymentsWrite)
+		remove := requireRole(logger, rolePaymentsDelete)
+
+		paymentsRoute.GET("/", read, getPayments(logger, stores.Payments))
+
+		paymentsRoute.GET("/summary", read, getPaymentSummary(logger, stores.Payments))
+
+		paymentsRoute.GET("/export", read, exportPayments(logger, stores.Payments, h))
+
+		paymentsRoute.GET("/events", read, streamEvents(logger, stores.Payments, h))
+
+		paymentsRoute.GET("/:paymentID", read, getOnePayment(logger, stores.Payments))
+
+		paymentsRoute.GET("/:paymentID/history", read, getPaymentHistory(logger, stores.Payments))
 
-		paymentsRoute.GET("/:paymentID", getOnePayment(logger, paymentDb))
+		paymentsRoute.PUT("/:paymentID", write, updatePayment(logger, stores.Payments))
 
-		paymentsRoute.PUT("/:paymentID", updatePayment(logger, paymentDb))
+		paymentsRoute.DELETE("/:paymentID", remove, deletePayment(logger, stores.Payments))
 
-		paymentsRoute.DELETE("/:paymentID", deletePayment(logger, paymentDb))
+		paymentsRoute.POST("/:paymentID/restore", remove, restorePayment(logger, stores.Payments))
 
-		paymentsRoute.POST("/", createPayment(logger, paymentDb))
+		for _, action := range []model.Action{model.ActionSubmit, model.ActionSettle,
+			model.ActionReject, model.ActionReturn} {
+
+			paymentsRoute.POST("/:paymentID/"+string(action), write, transitionPayment(logger, stores.Payments, action))
+		}
+
+		paymentsRoute.POST("/", write, idempotency(logger, stores.Idempotency), createPayment(logger, stores.Payments))
+
+		paymentsRoute.POST("/batch", write, createPayments(logger, stores.Payments, viper.GetInt(config.BatchMaxSize),
+			int64(viper.GetSizeInBytes(config.BatchMaxBodySize))))
+	}
+
+	webhooksRoute := router.Group("/webhooks/", auth...)
+	{
+		read := requireRole(logger, roleWebhooksRead)
+		write := requireRole(logger, roleWebhooksWrite)
+
+		webhooksRoute.GET("/", read, getWebhooks(logger, stores.Webhooks))
+
+		webhooksRoute.GET("/:webhookID", read, getOneWebhook(logger, stores.Webhooks))
+
+		webhooksRoute.PUT("/:webhookID", write, updateWebhook(logger, stores.Webhooks))
+
+		webhooksRoute.DELETE("/:webhookID", write, deleteWebhook(logger, stores.Webhooks))
+
+		webhooksRoute.POST("/", write, createWebhook(logger, stores.Webhooks))
+
+		webhooksRoute.GET("/:webhookID/deliveries", read, getWebhookDeliveries(logger, stores.Webhooks))
+
+		webhooksRoute.POST("/:webhookID/deliveries/:deliveryID/retry", write, retryWebhookDelivery(logger, stores.Webhooks))
 	}
 
 	return router
 }
 
+// authMiddlewares returns the middlewares authenticating the requests, as the
+// config says. Unless it is disabled an API key or a JWT is required
+func authMiddlewares(logger *zap.Logger, stores persistent.Stores) []gin.HandlerFunc {
+
+	methods, err := authMethods()
+	if err != nil {
+		logger.Sugar().Fatalw("init-auth", "error", err)
+		panic("init-error")
+	}
+	if len(methods) == 0 {
+		return nil
+	}
+
+	var apiKeyDb persistent.APIKeyStore
+	var verifier *oidc.Verifier
+	for _, method := range methods {
+		switch method {
+		case config.AuthAPIKey:
+			apiKeyDb = stores.APIKeys
+		case config.AuthJWT:
+			ctx, cancel := context.WithTimeout(context.Background(), jwksTimeout)
+			verifier, err = oidc.NewVerifier(ctx, viper.GetString(config.JWTJWKS), viper.GetString(config.JWTIssuer),
+				viper.GetString(config.JWTAudience), &http.Client{Timeout: jwksTimeout})
+			cancel()
+			if err != nil {
+				logger.Sugar().Fatalw("init-auth-jwks", "jwks", viper.GetString(config.JWTJWKS), "error", err)
+				panic("init-error")
+			}
+		}
+	}
+	return []gin.HandlerFunc{authenticate(logger, apiKeyDb, verifier)}
+}
+
+// webhookOptions returns the options of the webhook deliveries from the config
+func webhookOptions() webhook.Options {
+
+	opts := webhook.DefaultOptions
+	opts.MaxAttempts = viper.GetInt(config.WebhookMaxAttempts)
+	opts.Backoff = viper.GetDuration(config.WebhookBackoff)
+	opts.Timeout = viper.GetDuration(config.WebhookTimeout)
+	return opts
+}
+
+// outboxSinks returns the sinks the outbox is relayed to from the config
+func outboxSinks(logger *zap.Logger) ([]outbox.Sink, error) {
+
+	sinks := []outbox.Sink{}
+	for _, name := range strings.Split(viper.GetString(config.OutboxSinks), ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "":
+		case "log":
+			sinks = append(sinks, outbox.NewLogSink(logger))
+		case "http":
+			url := viper.GetString(config.OutboxHTTPURL)
+			if len(url) == 0 {
+				return nil, fmt.Errorf("the http outbox sink needs %s", config.OutboxHTTPURL)
+			}
+			sinks = append(sinks, outbox.NewHTTPSink(url, &http.Client{Timeout: outbox.DefaultOptions.Timeout}))
+		default:
+			return nil, fmt.Errorf("unknown outbox sink %q", name)
+		}
+	}
+	return sinks, nil
+}
+
 // @title APIPAY Payments API
 // @version 1.0
 // @description This is an example implementation of an API to serve Payments
@@ -50,6 +177,14 @@ func getHandler(logger *zap.Logger, paymentDb persistent.Payments) http.Handler
 // @description There are many TODOs and things not fully finalized.
 // @description Please read the README file in the same repository.
 
+// @securityDefinitions.apikey ApiKeyAuth
+// @in header
+// @name X-API-Key
+
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
+
 func main() {
 	ctx := context.Background()
 	err := config.Load()
@@ -57,6 +192,11 @@ func main() {
 		panic("Cannot load config " + err.Error())
 	}
 
+	err = model.SetIDFormats(viper.GetString(config.PaymentIDFormat), viper.GetString(config.OrganisationIDFormat))
+	if err != nil {
+		panic("Cannot set the ID formats " + err.Error())
+	}
+
 	logger, err := zap.NewProduction()
 	if err != nil {
 		panic("Cannot create logger")
@@ -67,27 +207,96 @@ func main() {
 
 	logger.Sugar().Infow("server-init", "gitHash", gitHash)
 
-	db, err := persistent.Connect(ctx,
-		viper.GetString(config.MongoHost),
-		viper.GetInt(config.MongoPort),
-		viper.GetString(config.MongoUser),
-		viper.GetString(config.MongoPassword))
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		logger.Sugar().Fatalw("init-tracing", "error", err)
+		panic("init-error")
+	}
+	defer func() {
+		// the spans not sent yet are flushed
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Sugar().Warnw("shutdown-tracing", "error", err)
+		}
+	}()
+
+	var stores persistent.Stores
+	h := newHealth()
+	idempotencyTTL := viper.GetDuration(config.IdempotencyTTL)
+
+	switch storage := viper.GetString(config.Storage); storage {
+	case config.StorageMemory:
+		logger.Warn("init-db-memory")
+		stores = persistent.NewMemoryStores(idempotencyTTL)
 
+	case config.StorageMongo:
+		db, err := persistent.Connect(ctx,
+			viper.GetString(config.MongoHost),
+			viper.GetInt(config.MongoPort),
+			viper.GetString(config.MongoUser),
+			viper.GetString(config.MongoPassword))
+
+		if err != nil {
+			logger.Sugar().Fatalw("init-db-error", "error", err)
+			panic("init-error")
+		}
+		defer db.Close(ctx)
+
+		stores, err = persistent.GetStores(ctx, db, idempotencyTTL)
+		if err != nil {
+			logger.Sugar().Fatalw("init-db-stores-error", "error", err)
+			panic("init-error")
+		}
+		if !stores.Transactional {
+			// the outbox can miss changes, or have some not done
+			logger.Warn("init-db-outbox-not-transactional")
+		}
+		prometheus.MustRegister(persistent.NewServerConnectionsCollector(db))
+		h.dependencies = mongoDependencies(&db)
+
+	default:
+		logger.Sugar().Fatalw("init-db-unknown-storage", "storage", storage)
+		panic("init-error")
+	}
+
+	// apipay apikeys ... manages the API keys instead of running the server
+	if len(os.Args) > 1 && os.Args[1] == "apikeys" {
+		if err := runAPIKeys(ctx, stores.APIKeys, os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	methods, err := authMethods()
 	if err != nil {
-		logger.Sugar().Fatalw("init-db-error", "error", err)
+		logger.Sugar().Fatalw("init-unknown-auth", "auth", viper.GetString(config.Auth), "error", err)
 		panic("init-error")
 	}
-	defer db.Close(ctx)
+	if len(methods) == 0 {
+		logger.Warn("init-auth-none")
+	}
 
-	paymentsDB, err := persistent.GetPayments(ctx, db)
+	// the webhooks are sent while the server runs
+	dispatcherCtx, stopDispatcher := context.WithCancel(ctx)
+	defer stopDispatcher()
+	go webhook.NewDispatcher(logger, stores.Webhooks, webhook.NewClient(), webhookOptions()).Run(dispatcherCtx)
+
+	// and so are the changes written to the outbox
+	prometheus.MustRegister(persistent.NewOutboxCollector(stores.Outbox))
+	sinks, err := outboxSinks(logger)
 	if err != nil {
-		logger.Sugar().Fatalw("init-db-payments-error", "error", err)
+		logger.Sugar().Fatalw("init-outbox-sinks", "error", err)
 		panic("init-error")
 	}
+	if len(sinks) > 0 {
+		go outbox.NewDispatcher(logger, stores.Outbox, outbox.DefaultOptions, sinks...).Run(dispatcherCtx)
+	}
 
 	srv := &http.Server{
 		Addr:    ":8080",
-		Handler: getHandler(logger, paymentsDB),
+		Handler: getHandler(logger, stores, h),
 	}
 
 	// Open the server for incoming connections
@@ -102,11 +311,20 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	// not ready first, so the load balancers stop sending requests while the
+	// ones they already sent are answered
+	h.drain()
+	logger.Info("shutdown-draining")
+	time.Sleep(viper.GetDuration(config.ShutdownDrainDelay))
+
+	// the streaming responses end, the rest are waited for, up to the timeout
+	srv.RegisterOnShutdown(h.stop)
+	shutdownCtx, cancel := context.WithTimeout(ctx, viper.GetDuration(config.ShutdownTimeout))
 	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
-		logger.Sugar().Fatalw("shutdown-error", "error", err)
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		// the deferred cleanup still has to run, so it is not fatal
+		logger.Sugar().Errorw("shutdown-error", "error", err)
+		_ = srv.Close()
 	}
-
-	<-ctx.Done()
+	logger.Info("shutdown-done")
 }
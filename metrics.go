@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// unknownRoute is the route of the metrics of the requests not matching any
+const unknownRoute = "unknown"
+
+// The metrics of the requests, in the default Prometheus registry
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apipay_http_requests_total",
+		Help: "Requests answered, by method, route and status.",
+	}, []string{"method", "route", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "apipay_http_request_duration_seconds",
+		Help:    "How long the requests take to be answered, by method, route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	requestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "apipay_http_requests_in_flight",
+		Help: "Requests being answered, including the open event feeds.",
+	})
+)
+
+// measureRequests is a middleware recording the metrics of the requests. They
+// are by route, not path, so there is a fixed number of them
+func measureRequests() gin.HandlerFunc {
+
+	return func(ginCtx *gin.Context) {
+
+		started := time.Now()
+		requestsInFlight.Inc()
+		defer requestsInFlight.Dec()
+
+		ginCtx.Next()
+
+		route := ginCtx.FullPath()
+		if len(route) == 0 {
+			route = unknownRoute
+		}
+		labels := []string{ginCtx.Request.Method, route, strconv.Itoa(ginCtx.Writer.Status())}
+		requestsTotal.WithLabelValues(labels...).Inc()
+		requestDuration.WithLabelValues(labels...).Observe(time.Since(started).Seconds())
+	}
+}
@@ -0,0 +1,28 @@
+package model
+
+import (
+	"errors"
+	"math/big"
+	"regexp"
+)
+
+// ErrInvalidAmount is returned when an amount is not a decimal number
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// amountFormat is how amounts are written, eg. "100.21". No exponents, no
+// thousand separators
+var amountFormat = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// ParseAmount parses a decimal that is not money, like the exchange rates,
+// into an exact number
+func ParseAmount(amount string) (*big.Rat, error) {
+
+	if !amountFormat.MatchString(amount) {
+		return nil, ErrInvalidAmount
+	}
+	r, ok := new(big.Rat).SetString(amount)
+	if !ok {
+		return nil, ErrInvalidAmount
+	}
+	return r, nil
+}
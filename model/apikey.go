@@ -0,0 +1,84 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// apiKeyPrefix starts all the API keys, so they are easy to recognise, eg. in
+// secret scanners
+const apiKeyPrefix = "apipay_"
+
+// APIKeyID is the type of the IDs of the API keys
+type APIKeyID string
+
+// APIKey gives access to the payments of some organisations. The key itself
+// is only known by the client, only its hash is stored
+type APIKey struct {
+	ID   APIKeyID `json:"id"`
+	Name string   `json:"name"`
+
+	// Hash is the hex SHA-256 of the key
+	Hash string `json:"-"`
+
+	OrganisationIDs []string `json:"organisation_ids"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// NewAPIKey generates a new API key of the organisations. It returns the key
+// to store and the key to give to the client, which cannot be got again
+func NewAPIKey(name string, organisationIDs []string) (APIKey, string, error) {
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return APIKey{}, "", err
+	}
+	key := apiKeyPrefix + hex.EncodeToString(secret)
+
+	return APIKey{
+		ID:              APIKeyID(uuid.New().String()),
+		Name:            name,
+		Hash:            HashAPIKey(key),
+		OrganisationIDs: append([]string(nil), organisationIDs...),
+		CreatedAt:       time.Now().UTC(),
+	}, key, nil
+}
+
+// HashAPIKey returns the hash of a key, as it is stored. The keys are random,
+// so they do not need a slow hash
+func HashAPIKey(key string) string {
+
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Valid checks if the API key is valid. It returns what is not valid, empty if
+// it is
+func (k *APIKey) Valid() Violations {
+
+	var res Violations
+
+	res.checkRequired("name", k.Name)
+	if len(k.OrganisationIDs) == 0 {
+		res.add("organisation_ids", "is required")
+	}
+	for _, id := range k.OrganisationIDs {
+		if !ValidOrganisationID(id) {
+			res.add("organisation_ids", "does not have the format of the IDs")
+			break
+		}
+	}
+
+	return res
+}
+
+// Active checks the key has not been revoked
+func (k *APIKey) Active() bool {
+	return k.RevokedAt == nil
+}
@@ -0,0 +1,37 @@
+package model
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAPIKey(t *testing.T) {
+
+	apiKey, key, err := NewAPIKey("partner", []string{"org"})
+	assert.NoError(t, err, "We can generate a key")
+	assert.True(t, strings.HasPrefix(key, apiKeyPrefix), "The key has the prefix")
+	assert.Equal(t, HashAPIKey(key), apiKey.Hash, "Only the hash is stored")
+	assert.NotContains(t, apiKey.Hash, key, "The key is not in the hash")
+	assert.True(t, apiKey.Active(), "It is active")
+
+	_, other, err := NewAPIKey("partner", []string{"org"})
+	assert.NoError(t, err, "We can generate another key")
+	assert.NotEqual(t, key, other, "The keys are random")
+}
+
+func TestAPIKey_Valid(t *testing.T) {
+
+	apiKey := APIKey{Name: "partner", OrganisationIDs: []string{"org"}}
+	assert.Empty(t, apiKey.Valid(), "It is valid")
+
+	apiKey.OrganisationIDs = nil
+	assert.Equal(t, "organisation_ids", apiKey.Valid()[0].Field, "It needs an organisation")
+
+	apiKey.OrganisationIDs = []string{"org", "not valid"}
+	assert.Equal(t, "organisation_ids", apiKey.Valid()[0].Field, "The organisations are checked")
+
+	apiKey = APIKey{OrganisationIDs: []string{"org"}}
+	assert.Equal(t, "name", apiKey.Valid()[0].Field, "It needs a name")
+}
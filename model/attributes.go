@@ -1,33 +1,128 @@
 package model
 
-// SenderCharges contains the information of the charges to the sender
-type SenderCharges struct {
-	Amount   string `json:"amount"`
-	Currency string `json:"currency"`
+import (
+	"encoding/json"
+	"math/big"
+	"strconv"
+)
+
+// bearerCodes are the allowed ChargesInformation.BearerCode, who pays the charges
+var bearerCodes = map[string]bool{
+	"DEBT": true, // the debtor
+	"CRED": true, // the creditor
+	"SHAR": true, // shared
+	"SLEV": true, // following the service level
 }
 
+// fxTolerance is how much original_amount × exchange_rate can differ from
+// the amount, in minor units of the currency, because of rounding
+const fxTolerance = 1
+
 // ChargesInformation holds the information about all charges of the transaction
 type ChargesInformation struct {
-	BearerCode              string          `json:"bearer_code"`
-	SenderCharges           []SenderCharges `json:"sender_charges"`
-	ReceiverChargesAmount   string          `json:"receiver_charges_amount"`
-	ReceiverChargesCurrency string          `json:"receiver_charges_currency"`
+	BearerCode    string  `json:"bearer_code"`
+	SenderCharges []Money `json:"sender_charges"`
+
+	// ReceiverCharges are receiver_charges_amount and receiver_charges_currency
+	// in json
+	ReceiverCharges Money `json:"-"`
+}
+
+// chargesInformation is ChargesInformation without its json methods
+type chargesInformation ChargesInformation
+
+// MarshalJSON writes the receiver charges as two fields
+func (c ChargesInformation) MarshalJSON() ([]byte, error) {
+
+	return json.Marshal(struct {
+		chargesInformation
+		ReceiverChargesAmount   Decimal `json:"receiver_charges_amount"`
+		ReceiverChargesCurrency string  `json:"receiver_charges_currency"`
+	}{chargesInformation(c), c.ReceiverCharges.Value, c.ReceiverCharges.Currency})
+}
+
+// UnmarshalJSON reads the receiver charges from two fields
+func (c *ChargesInformation) UnmarshalJSON(data []byte) error {
+
+	raw := struct {
+		*chargesInformation
+		ReceiverChargesAmount   Decimal `json:"receiver_charges_amount"`
+		ReceiverChargesCurrency string  `json:"receiver_charges_currency"`
+	}{chargesInformation: (*chargesInformation)(c)}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	c.ReceiverCharges = readMoney(raw.ReceiverChargesAmount, raw.ReceiverChargesCurrency)
+	return nil
+}
+
+// Valid checks if the given charges are valid. It returns what is not valid,
+// empty if they are
+func (c *ChargesInformation) Valid() Violations {
+
+	var res Violations
+
+	res.checkOneOf("bearer_code", c.BearerCode, bearerCodes)
+
+	for i, charge := range c.SenderCharges {
+		var chargeRes Violations
+		chargeRes.checkMoney("amount", "currency", charge, true)
+		res.addAll("sender_charges["+strconv.Itoa(i)+"]", chargeRes)
+	}
+
+	res.checkMoney("receiver_charges_amount", "receiver_charges_currency", c.ReceiverCharges, false)
+	if !c.ReceiverCharges.Value.Empty() {
+		res.checkRequired("receiver_charges_currency", c.ReceiverCharges.Currency)
+	}
+
+	return res
 }
 
-// Fx is something I dont' kow about TODO
+// Fx holds the foreign exchange information, when the payment was originally
+// in a different currency
 type Fx struct {
 	ContractReference string `json:"contract_reference"`
 	ExchangeRate      string `json:"exchange_rate"`
-	OriginalAmount    string `json:"original_amount"`
-	OriginalCurrency  string `json:"original_currency"`
+
+	// Original is original_amount and original_currency in json
+	Original Money `json:"-"`
+}
+
+// fx is Fx without its json methods
+type fx Fx
+
+// MarshalJSON writes the original amount as two fields
+func (f Fx) MarshalJSON() ([]byte, error) {
+
+	return json.Marshal(struct {
+		fx
+		OriginalAmount   Decimal `json:"original_amount"`
+		OriginalCurrency string  `json:"original_currency"`
+	}{fx(f), f.Original.Value, f.Original.Currency})
+}
+
+// UnmarshalJSON reads the original amount from two fields
+func (f *Fx) UnmarshalJSON(data []byte) error {
+
+	raw := struct {
+		*fx
+		OriginalAmount   Decimal `json:"original_amount"`
+		OriginalCurrency string  `json:"original_currency"`
+	}{fx: (*fx)(f)}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	f.Original = readMoney(raw.OriginalAmount, raw.OriginalCurrency)
+	return nil
 }
 
 // Attributes holds extra information of the transaction
 type Attributes struct {
-	Amount               string             `json:"amount"`
+	// Amount is amount and currency in json
+	Amount Money `json:"-" bson:",inline"`
+
 	BeneficiaryParty     Party              `json:"beneficiary_party"`
 	ChargesInformation   ChargesInformation `json:"charges_information"`
-	Currency             string             `json:"currency"`
 	DebtorParty          Party              `json:"debtor_party"`
 	EndToEndReference    string             `json:"end_to_end_reference"`
 	Fx                   Fx                 `json:"fx"`
@@ -43,9 +138,92 @@ type Attributes struct {
 	SponsorParty         Party              `json:"sponsor_party"`
 }
 
-// Valid checks if the given attributes are valid or not
-func (a *Attributes) Valid() bool {
+// attributes is Attributes without its json methods
+type attributes Attributes
+
+// MarshalJSON writes the amount as two fields
+func (a Attributes) MarshalJSON() ([]byte, error) {
+
+	return json.Marshal(struct {
+		attributes
+		Amount   Decimal `json:"amount"`
+		Currency string  `json:"currency"`
+	}{attributes(a), a.Amount.Value, a.Amount.Currency})
+}
+
+// UnmarshalJSON reads the amount from two fields
+func (a *Attributes) UnmarshalJSON(data []byte) error {
+
+	raw := struct {
+		*attributes
+		Amount   Decimal `json:"amount"`
+		Currency string  `json:"currency"`
+	}{attributes: (*attributes)(a)}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	a.Amount = readMoney(raw.Amount, raw.Currency)
+	return nil
+}
+
+// empty checks if there is no Fx information
+func (f *Fx) empty() bool {
+	return *f == Fx{}
+}
+
+// Valid checks if the given Fx is valid, including that the original amount
+// converted with the exchange rate is the amount of the payment. It returns
+// what is not valid, empty if it is
+func (f *Fx) Valid(amount *big.Rat, currency string) Violations {
+
+	var res Violations
+
+	if f.empty() {
+		return res
+	}
+
+	var rate, original *big.Rat
+	if res.checkRequired("exchange_rate", f.ExchangeRate) {
+		rate = res.checkAmount("exchange_rate", f.ExchangeRate)
+		if rate != nil && rate.Sign() == 0 {
+			res.add("exchange_rate", "cannot be zero")
+			rate = nil
+		}
+	}
+	original = res.checkMoney("original_amount", "original_currency", f.Original, true)
+
+	units, known := MinorUnits(currency)
+	if rate == nil || original == nil || amount == nil || !known {
+		return res // nothing else can be checked
+	}
+
+	// |original × rate - amount| has to be within the tolerance
+	diff := new(big.Rat).Mul(original, rate)
+	diff.Sub(diff, amount)
+	diff.Abs(diff)
+
+	tolerance := new(big.Rat).SetFrac(big.NewInt(fxTolerance), new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(units)), nil))
+	if diff.Cmp(tolerance) > 0 {
+		res.add("original_amount", "multiplied by exchange_rate does not match the amount")
+	}
+
+	return res
+}
+
+// Valid checks if the given attributes are valid. It returns what is not
+// valid, empty if they are
+func (a *Attributes) Valid() Violations {
+
+	var res Violations
+
+	amount := res.checkMoney("amount", "currency", a.Amount, true)
+	res.checkDate("processing_date", a.ProcessingDate)
+
+	res.addAll("beneficiary_party", a.BeneficiaryParty.Valid())
+	res.addAll("debtor_party", a.DebtorParty.Valid())
+	res.addAll("sponsor_party", a.SponsorParty.Valid())
+	res.addAll("charges_information", a.ChargesInformation.Valid())
+	res.addAll("fx", a.Fx.Valid(amount, a.Amount.Currency))
 
-	// TODO, depending on the data model, implement this
-	return true
+	return res
 }
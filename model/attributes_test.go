@@ -0,0 +1,193 @@
+package model
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func validAttributes() Attributes {
+
+	return Attributes{
+		Amount:         Money{Value: MustParseDecimal("100.21"), Currency: "GBP"},
+		ProcessingDate: "2017-01-18",
+		BeneficiaryParty: Party{
+			BankID:     "403000",
+			BankIDCode: "GBDSC",
+		},
+		ChargesInformation: ChargesInformation{
+			BearerCode: "SHAR",
+			SenderCharges: []Money{
+				{Value: MustParseDecimal("5.00"), Currency: "GBP"},
+				{Value: MustParseDecimal("10.00"), Currency: "USD"},
+			},
+			ReceiverCharges: Money{Value: MustParseDecimal("1.00"), Currency: "USD"},
+		},
+		Fx: Fx{
+			ContractReference: "FX123",
+			ExchangeRate:      "2.00000",
+			Original:          Money{Value: MustParseDecimal("50.10"), Currency: "USD"},
+		},
+	}
+}
+
+func TestAttributes_Valid(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		change func(a *Attributes)
+		want   []string // fields not valid
+	}{
+		{
+			name:   "Correct entry",
+			change: func(a *Attributes) {},
+		},
+		{
+			name:   "Fully empty",
+			change: func(a *Attributes) { *a = Attributes{} },
+			want:   []string{"amount", "currency"},
+		},
+		{
+			name:   "Negative amount",
+			change: func(a *Attributes) { a.Amount.Value = MustParseDecimal("-100.21") },
+			want:   []string{"amount"},
+		},
+		{
+			name: "More decimals than the currency",
+			change: func(a *Attributes) {
+				a.Amount.Value = MustParseDecimal("100.211")
+				a.Fx = Fx{}
+			},
+			want: []string{"amount"},
+		},
+		{
+			name: "Decimals in a currency without them",
+			change: func(a *Attributes) {
+				a.ChargesInformation.SenderCharges[0] = Money{Value: MustParseDecimal("5.5"), Currency: "JPY"}
+			},
+			want: []string{"charges_information.sender_charges[0].amount"},
+		},
+		{
+			name:   "Unknown currency",
+			change: func(a *Attributes) { a.Amount.Currency = "GBX" },
+			want:   []string{"currency"},
+		},
+		{
+			name:   "Wrong processing date",
+			change: func(a *Attributes) { a.ProcessingDate = "18/01/2017" },
+			want:   []string{"processing_date"},
+		},
+		{
+			name:   "Unknown bank ID code",
+			change: func(a *Attributes) { a.BeneficiaryParty.BankIDCode = "XXXXX" },
+			want:   []string{"beneficiary_party.bank_id_code"},
+		},
+		{
+			name:   "Bank ID without code",
+			change: func(a *Attributes) { a.DebtorParty.BankID = "203301" },
+			want:   []string{"debtor_party.bank_id_code"},
+		},
+		{
+			name:   "Unknown bearer code",
+			change: func(a *Attributes) { a.ChargesInformation.BearerCode = "ALL" },
+			want:   []string{"charges_information.bearer_code"},
+		},
+		{
+			name: "Wrong sender charges",
+			change: func(a *Attributes) {
+				a.ChargesInformation.SenderCharges[1] = Money{Value: MustParseDecimal("-10")}
+			},
+			want: []string{"charges_information.sender_charges[1].amount",
+				"charges_information.sender_charges[1].currency"},
+		},
+		{
+			name:   "Fx not matching",
+			change: func(a *Attributes) { a.Fx.ExchangeRate = "2.1" },
+			want:   []string{"fx.original_amount"},
+		},
+		{
+			name:   "Fx within rounding",
+			change: func(a *Attributes) { a.Fx.Original.Value = MustParseDecimal("50.1") },
+		},
+		{
+			name:   "Fx incomplete",
+			change: func(a *Attributes) { a.Fx = Fx{ExchangeRate: "2"} },
+			want:   []string{"fx.original_amount", "fx.original_currency"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := validAttributes()
+			tt.change(&a)
+
+			var got []string
+			for _, violation := range a.Valid() {
+				got = append(got, violation.Field)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Attributes.Valid() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttributes_JSON(t *testing.T) {
+
+	data := []byte(`{"amount": "100.2", "currency": "GBP", "charges_information": {
+		"sender_charges": [{"amount": "5", "currency": "USD"}, {"amount": "1.5", "currency": "JPY"}],
+		"receiver_charges_amount": "1.0", "receiver_charges_currency": "EUR"},
+		"fx": {"exchange_rate": "2", "original_amount": "50.100", "original_currency": "USD"}}`)
+
+	var a Attributes
+	if err := json.Unmarshal(data, &a); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+
+	amounts := map[string]Money{
+		"amount":                  a.Amount,
+		"sender_charges[0]":       a.ChargesInformation.SenderCharges[0],
+		"sender_charges[1]":       a.ChargesInformation.SenderCharges[1],
+		"receiver_charges_amount": a.ChargesInformation.ReceiverCharges,
+		"original_amount":         a.Fx.Original,
+	}
+	want := map[string]string{
+		"amount":                  "100.20",
+		"sender_charges[0]":       "5.00",
+		"sender_charges[1]":       "1.5", // too many decimals, Valid reports it
+		"receiver_charges_amount": "1.00",
+		"original_amount":         "50.10",
+	}
+	for field, money := range amounts {
+		if got := money.Value.String(); got != want[field] {
+			t.Errorf("%s = %v, want %v", field, got, want[field])
+		}
+	}
+
+	out, err := json.Marshal(a)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(out, &fields); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	if fields["amount"] != "100.20" || fields["currency"] != "GBP" {
+		t.Errorf("json.Marshal() = %s, want the amount and the currency as fields", out)
+	}
+	charges := fields["charges_information"].(map[string]interface{})
+	if charges["receiver_charges_amount"] != "1.00" || charges["receiver_charges_currency"] != "EUR" {
+		t.Errorf("json.Marshal() = %s, want the receiver charges as fields", out)
+	}
+
+	// amounts that are not decimals are read, and reported by Valid
+	var invalid Attributes
+	if err := json.Unmarshal([]byte(`{"amount": "100,21", "currency": "GBP"}`), &invalid); err != nil {
+		t.Fatalf("json.Unmarshal() of an amount that is not a decimal error = %v", err)
+	}
+	if got := invalid.Valid(); len(got) != 1 || got[0].Field != "amount" {
+		t.Errorf("Attributes.Valid() = %v, want the amount not valid", got)
+	}
+	if got := invalid.Amount.Value.String(); got != "100,21" {
+		t.Errorf("Amount = %v, want what was read", got)
+	}
+}
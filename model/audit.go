@@ -0,0 +1,29 @@
+package model
+
+import "time"
+
+// Operation is a kind of change to a payment
+type Operation string
+
+// The operations recorded in the audit log. The actions are recorded as
+// operations too, with the same name
+const (
+	OperationCreate  Operation = "create"
+	OperationUpdate  Operation = "update"
+	OperationDelete  Operation = "delete"
+	OperationRestore Operation = "restore"
+)
+
+// AuditEntry records a change to a payment, what it was before and after it.
+// They are never changed nor deleted
+type AuditEntry struct {
+	PaymentID PaymentID `json:"payment_id"`
+	Operation Operation `json:"operation"`
+	Actor     string    `json:"actor"`
+	RequestID string    `json:"request_id,omitempty"`
+	At        time.Time `json:"at"`
+
+	// Before is empty when the payment is created
+	Before *Payment `json:"before,omitempty"`
+	After  *Payment `json:"after,omitempty"`
+}
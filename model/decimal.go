@@ -0,0 +1,164 @@
+package model
+
+import (
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// maxDecimalScale is the most decimals a Decimal can have
+const maxDecimalScale = 18
+
+// Decimal is an exact decimal number, like 100.21, kept as an integer number
+// of units of 10^-scale, so it has up to 18 digits. It is parsed once, when
+// read, and it is a string in json, as the amounts always were. The zero value
+// is no number, "" in json. A string that is not a number is kept as it is,
+// not Valid, so it is reported with the rest of the fields
+type Decimal struct {
+	units   int64
+	scale   int32
+	set     bool
+	invalid string
+}
+
+// ParseDecimal parses a decimal like "100.21". No exponents, no thousand
+// separators
+func ParseDecimal(s string) (Decimal, error) {
+
+	if !amountFormat.MatchString(s) {
+		return Decimal{}, ErrInvalidAmount
+	}
+	digits, scale := s, 0
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		digits, scale = s[:dot]+s[dot+1:], len(s)-dot-1
+	}
+	if scale > maxDecimalScale {
+		return Decimal{}, ErrInvalidAmount
+	}
+	units, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Decimal{}, ErrInvalidAmount
+	}
+	return Decimal{units: units, scale: int32(scale), set: true}, nil
+}
+
+// MustParseDecimal is ParseDecimal for the decimals known to be valid, it
+// panics if they are not
+func MustParseDecimal(s string) Decimal {
+
+	d, err := ParseDecimal(s)
+	if err != nil {
+		panic("not a decimal: " + s)
+	}
+	return d
+}
+
+// DecimalFromRat returns the number with the given decimals, or
+// ErrInvalidAmount if it does not have an exact representation with them
+func DecimalFromRat(r *big.Rat, scale int) (Decimal, error) {
+
+	if scale < 0 || scale > maxDecimalScale {
+		return Decimal{}, ErrInvalidAmount
+	}
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(pow10(scale)))
+	if !scaled.IsInt() || !scaled.Num().IsInt64() {
+		return Decimal{}, ErrInvalidAmount
+	}
+	return Decimal{units: scaled.Num().Int64(), scale: int32(scale), set: true}, nil
+}
+
+// Empty checks if there is no number, nor anything that is not a number
+func (d Decimal) Empty() bool {
+	return !d.set && len(d.invalid) == 0
+}
+
+// Valid checks it is a number or empty, it is not if it was read from a
+// string that is not a number. The ones not valid are 0
+func (d Decimal) Valid() bool {
+	return len(d.invalid) == 0
+}
+
+// Scale returns the number of decimals, eg. 2 for 100.21 and for 100.00
+func (d Decimal) Scale() int {
+	return int(d.scale)
+}
+
+// Sign returns -1, 0 or +1. Empty is 0
+func (d Decimal) Sign() int {
+
+	switch {
+	case d.units < 0:
+		return -1
+	case d.units > 0:
+		return 1
+	}
+	return 0
+}
+
+// Rat returns the exact value, 0 if empty
+func (d Decimal) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(big.NewInt(d.units), pow10(int(d.scale)))
+}
+
+// Cmp compares the values, so 1.0 and 1.00 are the same. Empty is 0
+func (d Decimal) Cmp(other Decimal) int {
+	return d.Rat().Cmp(other.Rat())
+}
+
+// Rescale returns the same number with the given decimals, and if it can be
+// done exactly: 100.2 can be 100.20, but 100.21 cannot be 100.2
+func (d Decimal) Rescale(scale int) (Decimal, bool) {
+
+	if !d.Valid() {
+		return d, false
+	}
+	if d.Empty() {
+		return d, true
+	}
+	res, err := DecimalFromRat(d.Rat(), scale)
+	return res, err == nil
+}
+
+// String returns the number with all its decimals, eg. "100.20". Empty is "",
+// and the ones not valid are what was read
+func (d Decimal) String() string {
+
+	if !d.set {
+		return d.invalid
+	}
+	if d.scale == 0 {
+		return strconv.FormatInt(d.units, 10)
+	}
+	return d.Rat().FloatString(int(d.scale))
+}
+
+// MarshalJSON writes the decimal as a string
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON reads a decimal string. Empty strings and null are no number,
+// and the strings that are not numbers are read not Valid
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+
+	var s *string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return ErrInvalidAmount
+	}
+	if s == nil || len(*s) == 0 {
+		*d = Decimal{}
+		return nil
+	}
+	parsed, err := ParseDecimal(*s)
+	if err != nil {
+		parsed = Decimal{invalid: *s}
+	}
+	*d = parsed
+	return nil
+}
+
+// pow10 returns 10^n
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
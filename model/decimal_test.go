@@ -0,0 +1,66 @@
+package model
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecimal(t *testing.T) {
+
+	d, err := ParseDecimal("100.21")
+	assert.NoError(t, err, "It is a decimal")
+	assert.Equal(t, 2, d.Scale(), "It has 2 decimals")
+	assert.Equal(t, "10021/100", d.Rat().String(), "It is exact")
+	assert.Equal(t, "100.21", d.String(), "It is written as it was read")
+	assert.Equal(t, "-0.10", MustParseDecimal("-0.10").String(), "Negative ones too")
+	assert.Equal(t, 3, MustParseDecimal("0.100").Scale(), "The zeros count")
+
+	for _, invalid := range []string{"", "1e5", "100,21", "ten", ".5", "1.", "99999999999999999999"} {
+		_, err = ParseDecimal(invalid)
+		assert.Equal(t, ErrInvalidAmount, err, "%q is not a decimal", invalid)
+	}
+
+	assert.Equal(t, 0, MustParseDecimal("1.0").Cmp(MustParseDecimal("1.00")), "The zeros do not change the value")
+	assert.Equal(t, -1, MustParseDecimal("9.99").Cmp(MustParseDecimal("10")), "They compare as numbers")
+
+	rescaled, exact := MustParseDecimal("100.2").Rescale(2)
+	assert.True(t, exact, "It can have more decimals")
+	assert.Equal(t, "100.20", rescaled.String())
+	_, exact = MustParseDecimal("100.21").Rescale(1)
+	assert.False(t, exact, "It cannot lose decimals")
+
+	sum, err := DecimalFromRat(big.NewRat(20042, 100), 2)
+	assert.NoError(t, err, "It is exact with 2 decimals")
+	assert.Equal(t, MustParseDecimal("200.42"), sum)
+	_, err = DecimalFromRat(big.NewRat(1, 3), 2)
+	assert.Equal(t, ErrInvalidAmount, err, "A third is not exact")
+}
+
+func TestDecimalJSON(t *testing.T) {
+
+	var value struct {
+		Amount Decimal `json:"amount"`
+		Other  Decimal `json:"other"`
+	}
+	err := json.Unmarshal([]byte(`{"amount": "100.20", "other": ""}`), &value)
+	assert.NoError(t, err, "Decimals are strings")
+	assert.Equal(t, MustParseDecimal("100.20"), value.Amount)
+	assert.True(t, value.Other.Empty(), "Empty strings are no number")
+
+	data, err := json.Marshal(value)
+	assert.NoError(t, err, "We can marshal them")
+	assert.JSONEq(t, `{"amount": "100.20", "other": ""}`, string(data), "They are written as strings")
+
+	assert.Error(t, json.Unmarshal([]byte(`{"amount": 100.2}`), &value), "Decimals are not json numbers")
+
+	err = json.Unmarshal([]byte(`{"amount": "1e5"}`), &value)
+	assert.NoError(t, err, "Strings that are not decimals are read")
+	assert.False(t, value.Amount.Valid(), "but they are not valid")
+	assert.False(t, value.Amount.Empty(), "nor empty")
+	assert.Equal(t, "1e5", value.Amount.String(), "They are kept as they are")
+	_, err = NewMoney(value.Amount, "GBP")
+	assert.Equal(t, ErrInvalidAmount, err, "They are not money")
+}
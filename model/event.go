@@ -0,0 +1,56 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EventType is the kind of change notified by an Event
+type EventType string
+
+// The types of the events. Restoring a payment and changing its status are
+// updates, the operation tells which one it was
+const (
+	EventCreated EventType = "payment.created"
+	EventUpdated EventType = "payment.updated"
+	EventDeleted EventType = "payment.deleted"
+)
+
+// Event notifies a change to a payment, with the payment after it
+type Event struct {
+	// ID identifies the event in the feed, to resume it after this event
+	ID string `json:"id"`
+
+	Type      EventType `json:"type"`
+	Operation Operation `json:"operation"`
+	PaymentID PaymentID `json:"payment_id"`
+	At        time.Time `json:"at"`
+	Payment   *Payment  `json:"payment"`
+}
+
+// NewEventID generates a new random event ID, a UUID
+func NewEventID() string {
+	return uuid.New().String()
+}
+
+// NewEvent returns the event of a change recorded in the audit log
+func NewEvent(id string, entry AuditEntry) Event {
+
+	eventType := EventUpdated
+	switch entry.Operation {
+	case OperationCreate:
+		eventType = EventCreated
+	case OperationDelete:
+		eventType = EventDeleted
+	}
+
+	return Event{
+		ID:        id,
+		Type:      eventType,
+		Operation: entry.Operation,
+		PaymentID: entry.PaymentID,
+		At:        entry.At,
+		Payment:   entry.After,
+	}
+}
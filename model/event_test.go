@@ -0,0 +1,26 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewEvent(t *testing.T) {
+
+	after := &Payment{ID: "1"}
+
+	event := NewEvent("10", AuditEntry{PaymentID: "1", Operation: OperationCreate, After: after})
+	assert.Equal(t, EventCreated, event.Type, "Creating is a created event")
+	assert.Equal(t, "10", event.ID, "It has the ID given")
+	assert.Equal(t, after, event.Payment, "It has the payment after the change")
+
+	event = NewEvent("11", AuditEntry{PaymentID: "1", Operation: OperationDelete, After: after})
+	assert.Equal(t, EventDeleted, event.Type, "Deleting is a deleted event")
+
+	for _, operation := range []Operation{OperationUpdate, OperationRestore, Operation(ActionSubmit)} {
+		event = NewEvent("12", AuditEntry{PaymentID: "1", Operation: operation, After: after})
+		assert.Equal(t, EventUpdated, event.Type, "Other changes are updates")
+		assert.Equal(t, operation, event.Operation, "The operation is kept")
+	}
+}
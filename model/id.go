@@ -0,0 +1,50 @@
+package model
+
+import (
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// DefaultIDFormat is the format of the IDs unless another one is set with
+// SetIDFormats. It accepts UUIDs, but also other simple IDs
+const DefaultIDFormat = `^[A-Za-z0-9_-]{1,64}$`
+
+var (
+	paymentIDFormat      = regexp.MustCompile(DefaultIDFormat)
+	organisationIDFormat = regexp.MustCompile(DefaultIDFormat)
+)
+
+// SetIDFormats changes the regular expressions the payment and organisation
+// IDs have to match. It is meant to be called at start up, it is not safe to
+// call it while validating
+func SetIDFormats(paymentID, organisationID string) error {
+
+	paymentRe, err := regexp.Compile(paymentID)
+	if err != nil {
+		return err
+	}
+	organisationRe, err := regexp.Compile(organisationID)
+	if err != nil {
+		return err
+	}
+
+	paymentIDFormat = paymentRe
+	organisationIDFormat = organisationRe
+	return nil
+}
+
+// NewPaymentID generates a new random payment ID, a UUID
+func NewPaymentID() PaymentID {
+	return PaymentID(uuid.New().String())
+}
+
+// Valid checks if the ID has the format of the payment IDs
+func (id PaymentID) Valid() bool {
+	return paymentIDFormat.MatchString(string(id))
+}
+
+// ValidOrganisationID checks if the ID has the format of the organisation IDs
+func ValidOrganisationID(id string) bool {
+	return organisationIDFormat.MatchString(id)
+}
@@ -0,0 +1,41 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestSetIDFormats(t *testing.T) {
+
+	defer func() {
+		if err := SetIDFormats(DefaultIDFormat, DefaultIDFormat); err != nil {
+			t.Fatalf("SetIDFormats() cannot restore the default: %v", err)
+		}
+	}()
+
+	if err := SetIDFormats("(", DefaultIDFormat); err == nil {
+		t.Errorf("SetIDFormats() accepted an invalid regular expression")
+	}
+
+	uuidFormat := `^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`
+	if err := SetIDFormats(uuidFormat, uuidFormat); err != nil {
+		t.Fatalf("SetIDFormats() = %v", err)
+	}
+
+	tests := []struct {
+		id   PaymentID
+		want bool
+	}{
+		{NewPaymentID(), true},
+		{"4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", true},
+		{"12345", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := tt.id.Valid(); got != tt.want {
+			t.Errorf("PaymentID(%q).Valid() = %v, want %v", tt.id, got, tt.want)
+		}
+		if got := ValidOrganisationID(string(tt.id)); got != tt.want {
+			t.Errorf("ValidOrganisationID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// ErrTooManyDecimals is returned when an amount has more decimals than the
+// minor units of its currency
+var ErrTooManyDecimals = errors.New("the amount has more decimals than its currency")
+
+// Money is an amount in a currency. Made with NewMoney, or read from json,
+// the amount has as many decimals as the minor units of the currency, eg.
+// 100.20 GBP and 100 JPY, so the same amount is always the same Money
+type Money struct {
+	Value    Decimal `json:"amount" bson:"amount"`
+	Currency string  `json:"currency" bson:"currency"`
+}
+
+// NewMoney returns the amount in the currency, with the decimals of its minor
+// units, or ErrTooManyDecimals if it has more. The amounts of unknown
+// currencies are kept as they are
+func NewMoney(amount Decimal, currency string) (Money, error) {
+
+	res := Money{Value: amount, Currency: currency}
+	if !amount.Valid() {
+		return res, ErrInvalidAmount
+	}
+	units, known := MinorUnits(currency)
+	if !known {
+		return res, nil
+	}
+	rescaled, exact := amount.Rescale(units)
+	if !exact {
+		return res, ErrTooManyDecimals
+	}
+	res.Value = rescaled
+	return res, nil
+}
+
+// readMoney is NewMoney for the amounts being read. The ones not valid or with
+// too many decimals are kept as they are, so Valid reports them in their field
+func readMoney(amount Decimal, currency string) Money {
+
+	res, err := NewMoney(amount, currency)
+	if err != nil {
+		return Money{Value: amount, Currency: currency}
+	}
+	return res
+}
+
+// Empty checks if there is neither amount nor currency
+func (m Money) Empty() bool {
+	return m.Value.Empty() && len(m.Currency) == 0
+}
+
+// Exact checks the amount fits in the minor units of the currency. Unknown
+// currencies are not checked
+func (m Money) Exact() bool {
+
+	units, known := MinorUnits(m.Currency)
+	if !known {
+		return true
+	}
+	_, exact := m.Value.Rescale(units)
+	return exact
+}
+
+// UnmarshalJSON reads the money with the decimals of its currency
+func (m *Money) UnmarshalJSON(data []byte) error {
+
+	var raw struct {
+		Amount   Decimal `json:"amount"`
+		Currency string  `json:"currency"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = readMoney(raw.Amount, raw.Currency)
+	return nil
+}
@@ -0,0 +1,34 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMoney(t *testing.T) {
+
+	money := func(amount, currency string) Money {
+		return Money{Value: MustParseDecimal(amount), Currency: currency}
+	}
+	assert.True(t, money("100.21", "GBP").Exact(), "GBP has 2 decimals")
+	assert.False(t, money("100.211", "GBP").Exact(), "GBP does not have 3 decimals")
+	assert.True(t, money("100", "JPY").Exact(), "JPY has no decimals")
+	assert.True(t, money("100.0", "JPY").Exact(), "The zeros are not decimals")
+	assert.False(t, money("100.5", "JPY").Exact(), "JPY does not have decimals")
+	assert.True(t, money("1.234", "KWD").Exact(), "KWD has 3 decimals")
+
+	m, err := NewMoney(MustParseDecimal("1.0"), "GBP")
+	assert.NoError(t, err, "It fits in GBP")
+	assert.Equal(t, "1.00", m.Value.String(), "It has the decimals of GBP")
+	other, err := NewMoney(MustParseDecimal("1.000"), "GBP")
+	assert.NoError(t, err, "The zeros are not decimals")
+	assert.Equal(t, m, other, "The same amount is the same money")
+
+	_, err = NewMoney(MustParseDecimal("1.5"), "JPY")
+	assert.Equal(t, ErrTooManyDecimals, err, "JPY has no decimals")
+
+	m, err = NewMoney(MustParseDecimal("1.5"), "XXX")
+	assert.NoError(t, err, "Unknown currencies are not checked")
+	assert.Equal(t, "1.5", m.Value.String(), "Their amounts are kept")
+}
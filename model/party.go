@@ -12,9 +12,28 @@ type Party struct {
 	Name              string `json:"name,omitempty"`
 }
 
-// Valid checks if the given Party are valid or not
-func (a *Party) Valid() bool {
+// bankIDCodes are the known schemes of Party.BankID
+var bankIDCodes = map[string]bool{
+	"GBDSC": true, // UK sort code
+	"IENCC": true, // Irish national clearing code
+	"DEBLZ": true, // German Bankleitzahl
+	"FRBDF": true, // French Banque de France code
+	"USABA": true, // US routing number
+	"CACPA": true, // Canadian payments association
+	"AUBSB": true, // Australian bank state branch
+	"SWBIC": true, // SWIFT BIC
+}
+
+// Valid checks if the given Party is valid. It returns what is not valid,
+// empty if it is
+func (a *Party) Valid() Violations {
+
+	var res Violations
+
+	res.checkOneOf("bank_id_code", a.BankIDCode, bankIDCodes)
+	if len(a.BankID) > 0 {
+		res.checkRequired("bank_id_code", a.BankIDCode)
+	}
 
-	// TODO, depending on the data model, implement this
-	return true
+	return res
 }
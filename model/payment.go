@@ -1,8 +1,17 @@
 package model
 
+import "time"
+
 // PaymentID is the type of the IDs of payments
 type PaymentID string
 
+// Deletion records when and who deleted a payment. Payments are never really
+// deleted, they are just marked
+type Deletion struct {
+	At time.Time `json:"at"`
+	By string    `json:"by"`
+}
+
 // Payment defines a payment in the system
 // TODO, probably this can be generalized to a Transaction or similar, once more types are added
 type Payment struct {
@@ -11,10 +20,32 @@ type Payment struct {
 	Version        uint       `json:"version"`
 	OrganisationID string     `json:"organisation_id"`
 	Attributes     Attributes `json:"attributes"`
+
+	// Status and StatusHistory are handled by the server, they can only be
+	// changed with the actions
+	Status        Status         `json:"status,omitempty"`
+	StatusHistory []StatusChange `json:"status_history,omitempty"`
+
+	// Deleted is set by the server when the payment is deleted
+	Deleted *Deletion `json:"deleted,omitempty"`
 }
 
-// Valid checks if the given payment is valid or not
-func (p *Payment) Valid() bool {
+// Valid checks if the given payment is valid. It returns what is not valid,
+// empty if it is
+func (p *Payment) Valid() Violations {
+
+	var res Violations
+
+	if p.Type != "Payment" {
+		res.add("type", "must be Payment")
+	}
+	if res.checkRequired("id", string(p.ID)) && !p.ID.Valid() {
+		res.add("id", "does not have the format of the IDs")
+	}
+	if res.checkRequired("organisation_id", p.OrganisationID) && !ValidOrganisationID(p.OrganisationID) {
+		res.add("organisation_id", "does not have the format of the IDs")
+	}
+	res.addAll("attributes", p.Attributes.Valid())
 
-	return p.Type == "Payment" && len(p.ID) > 0 && len(p.OrganisationID) > 0 && p.Attributes.Valid()
+	return res
 }
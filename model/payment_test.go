@@ -35,9 +35,22 @@ func TestPayment_Valid(t *testing.T) {
 				ID:             PaymentID("343423423"),
 				Version:        1,
 				OrganisationID: "87847584385",
+				Attributes: Attributes{
+					Amount: Money{Value: MustParseDecimal("100.21"), Currency: "GBP"},
+				},
 			},
 			want: true,
 		},
+		{
+			name: "Invalid attributes",
+			fields: fields{
+				Type:           "Payment",
+				ID:             PaymentID("343423423"),
+				Version:        1,
+				OrganisationID: "87847584385",
+			},
+			want: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -48,7 +61,7 @@ func TestPayment_Valid(t *testing.T) {
 				OrganisationID: tt.fields.OrganisationID,
 				Attributes:     tt.fields.Attributes,
 			}
-			if got := p.Valid(); got != tt.want {
+			if got := p.Valid(); (len(got) == 0) != tt.want {
 				t.Errorf("Payment.Valid() = %v, want %v", got, tt.want)
 			}
 		})
@@ -0,0 +1,85 @@
+package model
+
+import "time"
+
+// Status is the state of a payment in its lifecycle
+type Status string
+
+// The statuses of a payment. New payments are pending
+const (
+	StatusPending   Status = "pending"
+	StatusSubmitted Status = "submitted"
+	StatusSettled   Status = "settled"
+	StatusRejected  Status = "rejected"
+	StatusReturned  Status = "returned"
+)
+
+// Action is what moves a payment from one status to another
+type Action string
+
+// The actions that can be done to a payment
+const (
+	ActionSubmit Action = "submit"
+	ActionSettle Action = "settle"
+	ActionReject Action = "reject"
+	ActionReturn Action = "return"
+)
+
+// transition is the status an action moves to, and from which ones it can be done
+type transition struct {
+	from []Status
+	to   Status
+}
+
+// transitions is the state machine of the payments
+//
+//	pending --submit--> submitted --settle--> settled --return--> returned
+//	   |                    |
+//	   +------reject--------+-----> rejected
+var transitions = map[Action]transition{
+	ActionSubmit: {from: []Status{StatusPending}, to: StatusSubmitted},
+	ActionSettle: {from: []Status{StatusSubmitted}, to: StatusSettled},
+	ActionReject: {from: []Status{StatusPending, StatusSubmitted}, to: StatusRejected},
+	ActionReturn: {from: []Status{StatusSettled}, to: StatusReturned},
+}
+
+// StatusChange is an entry of the history of statuses of a payment
+type StatusChange struct {
+	From   Status    `json:"from,omitempty"`
+	To     Status    `json:"to"`
+	At     time.Time `json:"at"`
+	By     string    `json:"by"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Valid checks if the action is a known one
+func (a Action) Valid() bool {
+
+	_, found := transitions[a]
+	return found
+}
+
+// From returns the statuses the action can be done from
+func (a Action) From() []Status {
+	return transitions[a].from
+}
+
+// To returns the status the action moves to
+func (a Action) To() Status {
+	return transitions[a].to
+}
+
+// AllowedFrom checks if the action can be done to a payment in the given
+// status. Empty is pending, as payments created before there were statuses
+func (a Action) AllowedFrom(status Status) bool {
+
+	if len(status) == 0 {
+		status = StatusPending
+	}
+	for _, from := range a.From() {
+		if from == status {
+			return true
+		}
+	}
+	return false
+}
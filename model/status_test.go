@@ -0,0 +1,25 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransitions(t *testing.T) {
+
+	assert.True(t, ActionSubmit.Valid(), "submit is an action")
+	assert.False(t, Action("cancel").Valid(), "cancel is not an action")
+
+	assert.True(t, ActionSubmit.AllowedFrom(StatusPending), "Pending payments can be submitted")
+	assert.True(t, ActionSubmit.AllowedFrom(""), "No status is pending")
+	assert.False(t, ActionSubmit.AllowedFrom(StatusSubmitted), "Payments cannot be submitted twice")
+	assert.True(t, ActionReject.AllowedFrom(StatusPending), "Pending payments can be rejected")
+	assert.True(t, ActionReject.AllowedFrom(StatusSubmitted), "Submitted payments can be rejected")
+	assert.False(t, ActionReject.AllowedFrom(StatusSettled), "Settled payments cannot be rejected")
+	assert.True(t, ActionReturn.AllowedFrom(StatusSettled), "Settled payments can be returned")
+	assert.False(t, ActionSettle.AllowedFrom(StatusReturned), "Returned payments cannot be settled")
+
+	assert.Equal(t, StatusSettled, ActionSettle.To(), "Settling settles")
+	assert.False(t, Action("cancel").AllowedFrom(StatusPending), "Unknown actions are not allowed")
+}
@@ -0,0 +1,22 @@
+package model
+
+// Summary is the totals of a group of payments. Only the fields the payments
+// are grouped by are set, but the currency, as amounts in different
+// currencies cannot be added
+type Summary struct {
+	OrganisationID string `json:"organisation_id,omitempty"`
+	Currency       string `json:"currency"`
+	PaymentScheme  string `json:"payment_scheme,omitempty"`
+	ProcessingDate string `json:"processing_date,omitempty"`
+
+	// Count is the number of payments of the group
+	Count int64 `json:"count"`
+
+	// Amount is the total of the amounts, in Currency
+	Amount Decimal `json:"amount"`
+
+	// SenderCharges and ReceiverCharges are the total of the charges of the
+	// payments of the group, per currency
+	SenderCharges   []Money `json:"sender_charges"`
+	ReceiverCharges []Money `json:"receiver_charges"`
+}
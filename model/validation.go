@@ -0,0 +1,146 @@
+package model
+
+import (
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DateFormat is the format of the dates, eg. processing_date
+const DateFormat = "2006-01-02"
+
+// Violation is a field that is not valid, and why
+type Violation struct {
+	// Field is the path of the field in the json, eg. attributes.amount
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Violations are all the fields that are not valid. Empty means it is valid
+type Violations []Violation
+
+// Error makes Violations usable as an error
+func (v Violations) Error() string {
+
+	msgs := make([]string, 0, len(v))
+	for _, violation := range v {
+		msgs = append(msgs, violation.Field+": "+violation.Message)
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// add adds a violation of the given field
+func (v *Violations) add(field, message string) {
+	*v = append(*v, Violation{Field: field, Message: message})
+}
+
+// addAll adds the violations of a nested object, prefixing their fields
+func (v *Violations) addAll(prefix string, nested Violations) {
+	for _, violation := range nested {
+		v.add(prefix+"."+violation.Field, violation.Message)
+	}
+}
+
+// checkAmount checks an optional amount is a positive decimal, and returns it
+// parsed, nil if not there or not valid
+func (v *Violations) checkAmount(field, amount string) *big.Rat {
+
+	if len(amount) == 0 {
+		return nil
+	}
+	parsed, err := ParseAmount(amount)
+	if err != nil {
+		v.add(field, "must be a decimal number, like 100.21")
+		return nil
+	}
+	if parsed.Sign() < 0 {
+		v.add(field, "cannot be negative")
+		return nil
+	}
+	return parsed
+}
+
+// checkDecimal checks an optional decimal is a number and not negative, and
+// returns it, nil if not there or not valid
+func (v *Violations) checkDecimal(field string, value Decimal) *big.Rat {
+
+	if value.Empty() {
+		return nil
+	}
+	if !value.Valid() {
+		v.add(field, "must be a decimal number, like 100.21")
+		return nil
+	}
+	if value.Sign() < 0 {
+		v.add(field, "cannot be negative")
+		return nil
+	}
+	return value.Rat()
+}
+
+// checkMoney checks an amount and its currency: the amount is a positive
+// decimal with no more decimals than the minor units of the currency, and the
+// currency is known. If required both have to be there. It returns the amount
+// parsed, nil if not there or not valid
+func (v *Violations) checkMoney(amountField, currencyField string, money Money, required bool) *big.Rat {
+
+	var amount *big.Rat
+	if !required || v.checkRequired(amountField, money.Value.String()) {
+		amount = v.checkDecimal(amountField, money.Value)
+	}
+	if !required || v.checkRequired(currencyField, money.Currency) {
+		v.checkCurrency(currencyField, money.Currency)
+	}
+
+	if amount != nil && !money.Exact() {
+		units, _ := MinorUnits(money.Currency)
+		v.add(amountField, "cannot have more than "+strconv.Itoa(units)+" decimals in "+money.Currency)
+		return nil
+	}
+	return amount
+}
+
+// checkCurrency checks an optional currency is a known ISO 4217 code
+func (v *Violations) checkCurrency(field, currency string) {
+
+	if len(currency) > 0 && !ValidCurrency(currency) {
+		v.add(field, "must be an ISO 4217 currency code, like GBP")
+	}
+}
+
+// checkDate checks an optional date is in DateFormat
+func (v *Violations) checkDate(field, date string) {
+
+	if len(date) == 0 {
+		return
+	}
+	if _, err := time.Parse(DateFormat, date); err != nil {
+		v.add(field, "must be a date as YYYY-MM-DD")
+	}
+}
+
+// checkRequired checks a field is not empty
+func (v *Violations) checkRequired(field, value string) bool {
+
+	if len(value) == 0 {
+		v.add(field, "is required")
+		return false
+	}
+	return true
+}
+
+// checkOneOf checks an optional field has one of the allowed values
+func (v *Violations) checkOneOf(field, value string, allowed map[string]bool) {
+
+	if len(value) == 0 || allowed[value] {
+		return
+	}
+	names := make([]string, 0, len(allowed))
+	for name := range allowed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	v.add(field, "must be one of "+strings.Join(names, ", "))
+}
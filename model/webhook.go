@@ -0,0 +1,127 @@
+package model
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WebhookID is the type of the IDs of the webhooks
+type WebhookID string
+
+// NewWebhookID generates a new random webhook ID, a UUID
+func NewWebhookID() WebhookID {
+	return WebhookID(uuid.New().String())
+}
+
+// NewWebhookSecret generates a new random secret to sign the deliveries
+func NewWebhookSecret() (string, error) {
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// Webhook is a subscription of an organisation to the changes to its payments,
+// they are sent to its URL
+type Webhook struct {
+	ID             WebhookID `json:"id"`
+	OrganisationID string    `json:"organisation_id"`
+	URL            string    `json:"url"`
+
+	// EventTypes are the events sent, all of them if empty
+	EventTypes []EventType `json:"event_types,omitempty"`
+
+	// Secret signs the deliveries. It is generated by the server, and only
+	// returned when the webhook is created
+	Secret string `json:"secret,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Valid checks if the webhook is valid. It returns what is not valid, empty if
+// it is
+func (w *Webhook) Valid() Violations {
+
+	var res Violations
+
+	if res.checkRequired("organisation_id", w.OrganisationID) && !ValidOrganisationID(w.OrganisationID) {
+		res.add("organisation_id", "does not have the format of the IDs")
+	}
+	if res.checkRequired("url", w.URL) {
+		parsed, err := url.Parse(w.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 {
+			res.add("url", "must be an absolute http or https URL")
+		}
+	}
+	for _, eventType := range w.EventTypes {
+		if eventType != EventCreated && eventType != EventUpdated && eventType != EventDeleted {
+			res.add("event_types", "must be payment.created, payment.updated or payment.deleted")
+			break
+		}
+	}
+
+	return res
+}
+
+// Wants checks if the events of a type are sent to the webhook
+func (w *Webhook) Wants(eventType EventType) bool {
+
+	if len(w.EventTypes) == 0 {
+		return true
+	}
+	for _, wanted := range w.EventTypes {
+		if wanted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// DeliveryID is the type of the IDs of the deliveries
+type DeliveryID string
+
+// NewDeliveryID generates a new random delivery ID, a UUID
+func NewDeliveryID() DeliveryID {
+	return DeliveryID(uuid.New().String())
+}
+
+// DeliveryStatus is where a delivery is
+type DeliveryStatus string
+
+// The statuses of the deliveries. Deliveries failing too many times are dead,
+// they are not retried unless asked
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryDead      DeliveryStatus = "dead"
+)
+
+// Valid checks if it is one of the statuses of the deliveries
+func (s DeliveryStatus) Valid() bool {
+	return s == DeliveryPending || s == DeliveryDelivered || s == DeliveryDead
+}
+
+// Delivery is an event to be sent to a webhook, and how sending it went
+type Delivery struct {
+	ID             DeliveryID     `json:"id"`
+	WebhookID      WebhookID      `json:"webhook_id"`
+	OrganisationID string         `json:"organisation_id"`
+	Event          Event          `json:"event"`
+	Status         DeliveryStatus `json:"status"`
+
+	// Attempts is how many times sending it failed
+	Attempts int `json:"attempts"`
+
+	// NextAttempt is when it is sent next, if it is pending
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
@@ -0,0 +1,31 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhook_Valid(t *testing.T) {
+
+	webhook := Webhook{OrganisationID: "org", URL: "https://example.com/hooks"}
+	assert.Empty(t, webhook.Valid(), "It is valid")
+
+	for _, url := range []string{"", "example.com/hooks", "ftp://example.com", "https://"} {
+		webhook.URL = url
+		assert.Equal(t, 1, len(webhook.Valid()), "The URL is not valid: "+url)
+	}
+
+	webhook = Webhook{OrganisationID: "org", URL: "http://localhost:8080", EventTypes: []EventType{EventCreated, "payment.lost"}}
+	assert.Equal(t, "event_types", webhook.Valid()[0].Field, "The event types are checked")
+}
+
+func TestWebhook_Wants(t *testing.T) {
+
+	webhook := Webhook{}
+	assert.True(t, webhook.Wants(EventDeleted), "It gets all the events by default")
+
+	webhook.EventTypes = []EventType{EventCreated, EventUpdated}
+	assert.True(t, webhook.Wants(EventUpdated), "It gets the ones listed")
+	assert.False(t, webhook.Wants(EventDeleted), "But not the rest")
+}
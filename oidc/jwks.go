@@ -0,0 +1,164 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+// maxJWKSSize is the biggest JWKS read, they are a few keys
+const maxJWKSSize = 1 << 20
+
+// ErrNoKeys is returned when a JWKS has no key that can be used
+var ErrNoKeys = errors.New("the JWKS has no RSA nor P-256 keys")
+
+// jwk is a key of a JWKS, only the fields of the RSA and EC keys are read
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// KeySet are the public keys of a JWKS by their ID. The keys are
+// *rsa.PublicKey or *ecdsa.PublicKey
+type KeySet map[string]crypto.PublicKey
+
+// ParseJWKS parses a JWKS (RFC 7517). The keys not for signatures, or of
+// other types, are ignored
+func ParseJWKS(data []byte) (KeySet, error) {
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := KeySet{}
+	for _, key := range jwks.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		switch key.Kty {
+		case "RSA":
+			public, err := key.rsa()
+			if err != nil {
+				return nil, fmt.Errorf("the key %q is not valid: %v", key.Kid, err)
+			}
+			keys[key.Kid] = public
+		case "EC":
+			if key.Crv != "P-256" {
+				continue
+			}
+			public, err := key.ecdsa()
+			if err != nil {
+				return nil, fmt.Errorf("the key %q is not valid: %v", key.Kid, err)
+			}
+			keys[key.Kid] = public
+		}
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	return keys, nil
+}
+
+// rsa returns the RSA public key of the JWK
+func (k jwk) rsa() (*rsa.PublicKey, error) {
+
+	n, err := decodeBigInt(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeBigInt(k.E)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid exponent")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+// ecdsa returns the P-256 public key of the JWK
+func (k jwk) ecdsa() (*ecdsa.PublicKey, error) {
+
+	x, err := decodeBigInt(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeBigInt(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	curve := elliptic.P256()
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("the point is not on the curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// decodeBigInt decodes a base64url big endian number of a JWK
+func decodeBigInt(value string) (*big.Int, error) {
+
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, errors.New("empty number")
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// LoadJWKS loads a JWKS from source, which is a http(s) URL or a file
+func LoadJWKS(ctx context.Context, source string, client *http.Client) (KeySet, error) {
+
+	if !strings.HasPrefix(source, "https://") && !strings.HasPrefix(source, "http://") {
+		data, err := ioutil.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+		return ParseJWKS(data)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getting the JWKS answered %d", res.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxJWKSSize))
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(data)
+}
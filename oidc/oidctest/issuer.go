@@ -0,0 +1,111 @@
+// Package oidctest issues JWTs signed with local keys, to test their
+// verification without an identity provider
+package oidctest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+)
+
+// Issuer signs tokens with a RSA and a P-256 key generated for it
+type Issuer struct {
+	RSA      *rsa.PrivateKey
+	RSAKeyID string
+	EC       *ecdsa.PrivateKey
+	ECKeyID  string
+}
+
+// NewIssuer generates the keys of an issuer
+func NewIssuer() (*Issuer, error) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Issuer{RSA: rsaKey, RSAKeyID: "rsa", EC: ecKey, ECKeyID: "ec"}, nil
+}
+
+// JWKS returns the JWKS with the public keys of the issuer
+func (i *Issuer) JWKS() []byte {
+
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kid": i.RSAKeyID, "kty": "RSA", "use": "sig", "alg": "RS256",
+				"n": encode(i.RSA.N.Bytes()),
+				"e": encode(big.NewInt(int64(i.RSA.E)).Bytes()),
+			},
+			{
+				"kid": i.ECKeyID, "kty": "EC", "use": "sig", "alg": "ES256", "crv": "P-256",
+				"x": encode(padded(i.EC.X, 32)),
+				"y": encode(padded(i.EC.Y, 32)),
+			},
+		},
+	}
+	data, _ := json.Marshal(jwks)
+	return data
+}
+
+// Token returns the claims signed with alg, RS256 or ES256, and the key for it
+func (i *Issuer) Token(alg string, claims map[string]interface{}) (string, error) {
+
+	kid := i.RSAKeyID
+	if alg == "ES256" {
+		kid = i.ECKeyID
+	}
+	return i.TokenWithKey(alg, kid, claims)
+}
+
+// TokenWithKey returns the claims signed with alg, RS256 or ES256, with the
+// key ID kid in the header. The key used is the one of alg
+func (i *Issuer) TokenWithKey(alg, kid string, claims map[string]interface{}) (string, error) {
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	if strings.HasPrefix(alg, "ES") {
+		r, s, err := ecdsa.Sign(rand.Reader, i.EC, digest[:])
+		if err != nil {
+			return "", err
+		}
+		signature = append(padded(r, 32), padded(s, 32)...)
+	} else {
+		signature, err = rsa.SignPKCS1v15(rand.Reader, i.RSA, crypto.SHA256, digest[:])
+		if err != nil {
+			return "", err
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// padded returns the big endian bytes of n, padded with zeros to size
+func padded(n *big.Int, size int) []byte {
+
+	raw := n.Bytes()
+	if len(raw) >= size {
+		return raw
+	}
+	return append(make([]byte, size-len(raw)), raw...)
+}
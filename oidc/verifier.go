@@ -0,0 +1,297 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// leeway is the clock skew allowed checking the times of the tokens
+	leeway = time.Minute
+	// reloadInterval is how often at most the JWKS URLs are loaded again
+	// finding tokens signed with unknown keys
+	reloadInterval = time.Minute
+)
+
+var (
+	// ErrMalformed is returned when the token is not a compact JWS
+	ErrMalformed = errors.New("the token is malformed")
+	// ErrAlgorithm is returned when the token is not signed with RS256 or ES256
+	ErrAlgorithm = errors.New("the token is not signed with RS256 nor ES256")
+	// ErrUnknownKey is returned when the key of the token is not in the JWKS
+	ErrUnknownKey = errors.New("the key of the token is unknown")
+	// ErrSignature is returned when the signature of the token is wrong
+	ErrSignature = errors.New("the signature of the token is not valid")
+	// ErrIssuer is returned when the token is not issued by the issuer
+	ErrIssuer = errors.New("the token has another issuer")
+	// ErrAudience is returned when the token is not for the audience
+	ErrAudience = errors.New("the token is for another audience")
+	// ErrExpired is returned when the token has expired or it is not valid yet
+	ErrExpired = errors.New("the token has expired or it is not valid yet")
+	// ErrNoIssuer is returned by NewVerifier without an issuer, as then
+	// tokens without one would be valid
+	ErrNoIssuer = errors.New("the verifier needs an issuer")
+	// ErrNoAudience is returned by NewVerifier without an audience, as then
+	// tokens for any audience would be valid
+	ErrNoAudience = errors.New("the verifier needs an audience")
+)
+
+// Claims are the claims of a verified token
+type Claims map[string]interface{}
+
+// Subject returns the sub claim
+func (c Claims) Subject() string {
+	subject, _ := c["sub"].(string)
+	return subject
+}
+
+// Strings returns a claim which is an array of strings or a string with them
+// separated by spaces, like the scope claim
+func (c Claims) Strings(name string) []string {
+
+	switch value := c[name].(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// time returns a NumericDate claim, and false if it is not in the claims
+func (c Claims) time(name string) (time.Time, bool) {
+
+	number, ok := c[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// Verifier verifies the tokens issued by an identity provider
+type Verifier struct {
+	source   string
+	issuer   string
+	audience string
+	client   *http.Client
+	now      func() time.Time
+
+	lock     sync.RWMutex
+	keys     KeySet
+	loadedAt time.Time
+
+	// reload is held while the JWKS is loaded again
+	reload sync.Mutex
+}
+
+// NewVerifier returns a verifier of the tokens of issuer for audience signed
+// with the keys of the JWKS in source, a file or a http(s) URL. The JWKS of
+// an URL is loaded again when a token is signed with an unknown key. The
+// issuer and the audience are required
+func NewVerifier(ctx context.Context, source, issuer, audience string, client *http.Client) (*Verifier, error) {
+
+	if len(issuer) == 0 {
+		return nil, ErrNoIssuer
+	}
+	if len(audience) == 0 {
+		return nil, ErrNoAudience
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	keys, err := LoadJWKS(ctx, source, client)
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{
+		source:   source,
+		issuer:   issuer,
+		audience: audience,
+		client:   client,
+		now:      time.Now,
+		keys:     keys,
+		loadedAt: time.Now(),
+	}, nil
+}
+
+// Verify checks the signature, issuer, audience and times of a compact
+// serialised token, returning its claims
+func (v *Verifier) Verify(ctx context.Context, token string) (Claims, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(header.Alg, key, digest[:], signature); err != nil {
+		return nil, err
+	}
+
+	claims := Claims{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrMalformed
+	}
+	if issuer, _ := claims["iss"].(string); issuer != v.issuer {
+		return nil, ErrIssuer
+	}
+	if !contains(claims.Strings("aud"), v.audience) {
+		return nil, ErrAudience
+	}
+	now := v.now()
+	expires, found := claims.time("exp")
+	if !found || now.After(expires.Add(leeway)) {
+		return nil, ErrExpired
+	}
+	if notBefore, found := claims.time("nbf"); found && now.Add(leeway).Before(notBefore) {
+		return nil, ErrExpired
+	}
+	return claims, nil
+}
+
+// key returns the key with the ID, loading the JWKS URL again if it is unknown
+func (v *Verifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+
+	key, found, stale := v.lookup(kid)
+	if found {
+		return key, nil
+	}
+	if !stale || !strings.Contains(v.source, "://") {
+		return nil, ErrUnknownKey
+	}
+
+	// only one request loads the JWKS, the rest wait for it and use its keys
+	v.reload.Lock()
+	defer v.reload.Unlock()
+
+	key, found, stale = v.lookup(kid)
+	if found {
+		return key, nil
+	}
+	if !stale {
+		return nil, ErrUnknownKey
+	}
+
+	// it is not loaded again so soon even if it fails, not to flood the issuer
+	keys, err := LoadJWKS(ctx, v.source, v.client)
+	v.lock.Lock()
+	v.loadedAt = time.Now()
+	if err == nil {
+		v.keys = keys
+	}
+	v.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if key, found := keys[kid]; found {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// lookup returns the loaded key with the ID, and if the keys are stale
+func (v *Verifier) lookup(kid string) (crypto.PublicKey, bool, bool) {
+
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	key, found := v.keys[kid]
+	if !found && kid == "" && len(v.keys) == 1 {
+		// without an ID the token is signed with the only key
+		for _, key = range v.keys {
+			found = true
+		}
+	}
+	return key, found, time.Since(v.loadedAt) > reloadInterval
+}
+
+// verifySignature checks the signature of the digest with the algorithm,
+// which has to be the one of the key
+func verifySignature(alg string, key crypto.PublicKey, digest, signature []byte) error {
+
+	switch alg {
+	case "RS256":
+		public, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrAlgorithm
+		}
+		if rsa.VerifyPKCS1v15(public, crypto.SHA256, digest, signature) != nil {
+			return ErrSignature
+		}
+		return nil
+	case "ES256":
+		public, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrAlgorithm
+		}
+		if len(signature) != 64 {
+			return ErrSignature
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(public, digest, r, s) {
+			return ErrSignature
+		}
+		return nil
+	}
+	return ErrAlgorithm
+}
+
+// decodeSegment decodes a base64url JSON segment of a token
+func decodeSegment(segment string, value interface{}) error {
+
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(raw)))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package oidc
+
+import (
+	"apipay/oidc/oidctest"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testIssuer   = "https://idp.example.com/"
+	testAudience = "apipay"
+)
+
+// testClaims returns valid claims for the test issuer and audience
+func testClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":              testIssuer,
+		"aud":              []string{"other", testAudience},
+		"sub":              "service",
+		"exp":              time.Now().Add(time.Hour).Unix(),
+		"organisation_ids": []string{"org1", "org2"},
+		"scope":            "payments:read payments:write",
+	}
+}
+
+func TestVerifier(t *testing.T) {
+
+	ctx := context.Background()
+	issuer, err := oidctest.NewIssuer()
+	assert.NoError(t, err, "We can create an issuer")
+
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, ioutil.WriteFile(jwks, issuer.JWKS(), 0600), "We can write the JWKS")
+
+	verifier, err := NewVerifier(ctx, jwks, testIssuer, testAudience, nil)
+	assert.NoError(t, err, "We can load the JWKS from a file")
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		token, err := issuer.Token(alg, testClaims())
+		assert.NoError(t, err, "We can sign a token")
+
+		claims, err := verifier.Verify(ctx, token)
+		assert.NoError(t, err, "A valid %s token is verified", alg)
+		assert.Equal(t, "service", claims.Subject(), "The subject is in the claims")
+		assert.Equal(t, []string{"org1", "org2"}, claims.Strings("organisation_ids"), "An array claim is read")
+		assert.Equal(t, []string{"payments:read", "payments:write"}, claims.Strings("scope"), "A space separated claim is read")
+		assert.Empty(t, claims.Strings("missing"), "A missing claim is empty")
+	}
+
+	checks := []struct {
+		name   string
+		change func(claims map[string]interface{})
+		err    error
+	}{
+		{"another issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com/" }, ErrIssuer},
+		{"another audience", func(c map[string]interface{}) { c["aud"] = "other" }, ErrAudience},
+		{"no expiry", func(c map[string]interface{}) { delete(c, "exp") }, ErrExpired},
+		{"expired", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, ErrExpired},
+		{"not valid yet", func(c map[string]interface{}) { c["nbf"] = time.Now().Add(time.Hour).Unix() }, ErrExpired},
+	}
+	for _, check := range checks {
+		claims := testClaims()
+		check.change(claims)
+		token, err := issuer.Token("RS256", claims)
+		assert.NoError(t, err, "We can sign a token")
+
+		_, err = verifier.Verify(ctx, token)
+		assert.Equal(t, check.err, err, "A token with %s is rejected", check.name)
+	}
+
+	// a string audience is fine too, and a bit of clock skew
+	claims := testClaims()
+	claims["aud"] = testAudience
+	claims["exp"] = time.Now().Add(-30 * time.Second).Unix()
+	token, err := issuer.Token("ES256", claims)
+	assert.NoError(t, err, "We can sign a token")
+	_, err = verifier.Verify(ctx, token)
+	assert.NoError(t, err, "A string audience and a just expired token are fine")
+
+	token, err = issuer.Token("RS256", testClaims())
+	assert.NoError(t, err, "We can sign a token")
+	_, err = verifier.Verify(ctx, token[:len(token)-4]+"AAAA")
+	assert.Equal(t, ErrSignature, err, "A token with a wrong signature is rejected")
+
+	_, err = verifier.Verify(ctx, "not.a-token")
+	assert.Equal(t, ErrMalformed, err, "A malformed token is rejected")
+
+	token, err = issuer.TokenWithKey("RS256", issuer.ECKeyID, testClaims())
+	assert.NoError(t, err, "We can sign a token")
+	_, err = verifier.Verify(ctx, token)
+	assert.Equal(t, ErrAlgorithm, err, "A token signed with an algorithm not of its key is rejected")
+
+	token, err = issuer.TokenWithKey("HS256", issuer.RSAKeyID, testClaims())
+	assert.NoError(t, err, "We can sign a token")
+	_, err = verifier.Verify(ctx, token)
+	assert.Equal(t, ErrAlgorithm, err, "A token not signed with RS256 nor ES256 is rejected")
+
+	token, err = issuer.TokenWithKey("RS256", "unknown", testClaims())
+	assert.NoError(t, err, "We can sign a token")
+	_, err = verifier.Verify(ctx, token)
+	assert.Equal(t, ErrUnknownKey, err, "A token signed with an unknown key is rejected")
+
+	_, err = NewVerifier(ctx, filepath.Join(t.TempDir(), "missing.json"), testIssuer, testAudience, nil)
+	assert.Error(t, err, "A missing JWKS file is an error")
+	_, err = NewVerifier(ctx, jwks, "", testAudience, nil)
+	assert.Equal(t, ErrNoIssuer, err, "The issuer is required")
+	_, err = NewVerifier(ctx, jwks, testIssuer, "", nil)
+	assert.Equal(t, ErrNoAudience, err, "The audience is required")
+}
+
+func TestVerifierURL(t *testing.T) {
+
+	ctx := context.Background()
+	issuer, err := oidctest.NewIssuer()
+	assert.NoError(t, err, "We can create an issuer")
+	rotated, err := oidctest.NewIssuer()
+	assert.NoError(t, err, "We can create another issuer")
+
+	rotated.RSAKeyID, rotated.ECKeyID = "rsa-2", "ec-2"
+
+	var mu sync.Mutex
+	current, loads := issuer, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		loads++
+		_, _ = w.Write(current.JWKS())
+	}))
+	defer server.Close()
+	loaded := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return loads
+	}
+
+	verifier, err := NewVerifier(ctx, server.URL, testIssuer, testAudience, server.Client())
+	assert.NoError(t, err, "We can load the JWKS from a URL")
+
+	token, err := issuer.Token("RS256", testClaims())
+	assert.NoError(t, err, "We can sign a token")
+	_, err = verifier.Verify(ctx, token)
+	assert.NoError(t, err, "A token signed with a key of the URL is verified")
+
+	// the keys are rotated
+	mu.Lock()
+	current = rotated
+	mu.Unlock()
+
+	token, err = rotated.Token("ES256", testClaims())
+	assert.NoError(t, err, "We can sign a token")
+	_, err = verifier.Verify(ctx, token)
+	assert.Equal(t, ErrUnknownKey, err, "The JWKS is not loaded again so soon")
+	assert.Equal(t, 1, loaded(), "The JWKS was loaded once")
+
+	verifier.loadedAt = verifier.loadedAt.Add(-reloadInterval - time.Second)
+	_, err = verifier.Verify(ctx, token)
+	assert.NoError(t, err, "The JWKS is loaded again finding a new key")
+	assert.Equal(t, 2, loaded(), "The JWKS was loaded again")
+
+	token, err = rotated.TokenWithKey("RS256", "unknown", testClaims())
+	assert.NoError(t, err, "We can sign a token")
+	_, err = verifier.Verify(ctx, token)
+	assert.Equal(t, ErrUnknownKey, err, "A token signed with an unknown key is rejected")
+	assert.Equal(t, 2, loaded(), "The JWKS was just loaded, it is not loaded again")
+
+	// many requests with unknown keys at once
+	verifier.loadedAt = verifier.loadedAt.Add(-reloadInterval - time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := verifier.Verify(ctx, token)
+			assert.Equal(t, ErrUnknownKey, err, "A token signed with an unknown key is rejected")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 3, loaded(), "The JWKS was loaded only once for all of them")
+
+	// the issuer fails
+	verifier.loadedAt = verifier.loadedAt.Add(-reloadInterval - time.Second)
+	server.Close()
+	_, err = verifier.Verify(ctx, token)
+	assert.Error(t, err, "The JWKS cannot be loaded")
+	_, err = verifier.Verify(ctx, token)
+	assert.Equal(t, ErrUnknownKey, err, "It is not tried again so soon")
+
+	token, err = rotated.Token("ES256", testClaims())
+	assert.NoError(t, err, "We can sign a token")
+	_, err = verifier.Verify(ctx, token)
+	assert.NoError(t, err, "The keys loaded before failing are kept")
+}
@@ -0,0 +1,146 @@
+// package outbox relays the changes to the payments, written to the outbox with
+// them, to the sinks configured: the logs, an HTTP endpoint...
+
+package outbox
+
+import (
+	"apipay/persistent"
+	"context"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Options are how the entries of the outbox are relayed
+type Options struct {
+	// Backoff is how long after the first failure an entry is relayed again.
+	// It doubles after each failure, up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Timeout is how long the sinks have to send an event
+	Timeout time.Duration
+
+	// PollInterval is how often the entries not relayed are looked for
+	PollInterval time.Duration
+
+	// BatchSize is how many entries are claimed at once
+	BatchSize int
+}
+
+// DefaultOptions are the options used unless others are given
+var DefaultOptions = Options{
+	Backoff:      5 * time.Second,
+	MaxBackoff:   10 * time.Minute,
+	Timeout:      10 * time.Second,
+	PollInterval: time.Second,
+	BatchSize:    50,
+}
+
+// Dispatcher relays the entries of the outbox to the sinks, at least once but
+// not ordered, and marks them relayed. An entry is relayed again to all the
+// sinks when any of them fails, while the next ones go on, so the sinks can get
+// an event more than once and after later ones. Many of them can run at
+// once, even in different instances, as the entries are claimed
+type Dispatcher struct {
+	logger *zap.Logger
+	store  persistent.OutboxStore
+	sinks  []Sink
+	opts   Options
+
+	// now returns the current time, it can be changed in tests
+	now func() time.Time
+}
+
+// NewDispatcher creates a Dispatcher of the entries of store to sinks
+func NewDispatcher(logger *zap.Logger, store persistent.OutboxStore, opts Options, sinks ...Sink) *Dispatcher {
+
+	return &Dispatcher{
+		logger: logger,
+		store:  store,
+		sinks:  sinks,
+		opts:   opts,
+		now:    func() time.Time { return time.Now().UTC() },
+	}
+}
+
+// Run relays the entries as they are written, until ctx is done
+func (d *Dispatcher) Run(ctx context.Context) {
+
+	ticker := time.NewTicker(d.opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		// while there are entries they are relayed without waiting
+		for {
+			relayed, err := d.RelayDue(ctx)
+			if err != nil && ctx.Err() == nil {
+				d.logger.Sugar().Errorw("outbox-dispatcher-claim", "error", err)
+			}
+			if err != nil || relayed < d.opts.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RelayDue relays the entries not relayed yet, up to a batch of them, and
+// returns how many were tried
+func (d *Dispatcher) RelayDue(ctx context.Context) (int, error) {
+
+	// the lease is long enough to relay them all, even if all the sinks time out
+	lease := time.Duration(d.opts.BatchSize*(len(d.sinks)+1)) * d.opts.Timeout
+	entries, err := d.store.Claim(ctx, d.now(), lease, d.opts.BatchSize)
+
+	for _, entry := range entries {
+		d.relay(ctx, entry)
+	}
+	return len(entries), err
+}
+
+// relay sends an entry to all the sinks and stores how it went
+func (d *Dispatcher) relay(ctx context.Context, entry persistent.OutboxEntry) {
+
+	var failed []string
+	for _, sink := range d.sinks {
+		sinkCtx, cancel := context.WithTimeout(ctx, d.opts.Timeout)
+		err := sink.Send(sinkCtx, entry.Event)
+		cancel()
+		if err != nil {
+			d.logger.Sugar().Infow("outbox-relay-failed", "entry", entry.ID, "sink", sink.Name(), "error", err)
+			failed = append(failed, sink.Name()+": "+err.Error())
+		}
+	}
+
+	var err error
+	if len(failed) == 0 {
+		err = d.store.MarkRelayed(ctx, entry.ID, d.now())
+	} else {
+		retryAt := d.now().Add(d.backoff(entry.Attempts + 1))
+		err = d.store.MarkFailed(ctx, entry.ID, retryAt, strings.Join(failed, "; "))
+	}
+	if err != nil {
+		// it is relayed again when the lease expires
+		d.logger.Sugar().Errorw("outbox-relay-mark", "entry", entry.ID, "error", err)
+	}
+}
+
+// backoff returns how long to wait after the failed attempt number attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+
+	wait := d.opts.Backoff
+	for i := 1; i < attempts && wait < d.opts.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.opts.MaxBackoff {
+		wait = d.opts.MaxBackoff
+	}
+	return wait
+}
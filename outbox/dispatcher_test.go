@@ -0,0 +1,92 @@
+package outbox
+
+import (
+	"apipay/model"
+	"apipay/persistent"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestDispatcher(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	posted := []model.Event{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var event model.Event
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&event), "The body is an event")
+		assert.Equal(t, event.ID, req.Header.Get(EventIDHeader), "The event ID is in the headers")
+
+		mu.Lock()
+		defer mu.Unlock()
+		posted = append(posted, event)
+	}))
+	defer server.Close()
+
+	stores := persistent.NewMemoryStores(time.Hour)
+	sink := NewMemorySink()
+	dispatcher := NewDispatcher(zap.NewNop(), stores.Outbox, DefaultOptions, sink, NewHTTPSink(server.URL, server.Client()))
+
+	// the entries are created now, so they are due in a second
+	now := time.Now().UTC().Add(time.Second)
+	dispatcher.now = func() time.Time { return now }
+
+	payment := model.Payment{Type: "Payment", ID: "1", OrganisationID: "testOrg"}
+	_, err := stores.Payments.Save(ctx, payment)
+	assert.NoError(t, err, "We can save a payment")
+
+	sink.SetErr(errors.New("it failed"))
+	relayed, err := dispatcher.RelayDue(ctx)
+	assert.NoError(t, err, "We can relay the outbox")
+	assert.Equal(t, 1, relayed, "The change was tried")
+	assert.Equal(t, 0, len(sink.Events()), "The failing sink got nothing")
+
+	relayed, err = dispatcher.RelayDue(ctx)
+	assert.NoError(t, err, "We can relay the outbox again")
+	assert.Equal(t, 0, relayed, "The failed one waits")
+
+	sink.SetErr(nil)
+	now = now.Add(DefaultOptions.Backoff)
+	relayed, err = dispatcher.RelayDue(ctx)
+	assert.NoError(t, err, "We can relay the outbox later")
+	assert.Equal(t, 1, relayed, "The failed one is tried again")
+
+	events := sink.Events()
+	assert.Equal(t, 1, len(events), "The sink got the change")
+	if len(events) == 1 {
+		assert.Equal(t, model.EventCreated, events[0].Type, "It is the creation")
+		assert.Equal(t, model.PaymentID("1"), events[0].PaymentID, "Of the payment")
+	}
+
+	mu.Lock()
+	assert.Equal(t, 2, len(posted), "The HTTP sink got it twice, once per attempt")
+	if len(posted) == 2 {
+		assert.Equal(t, posted[0].ID, posted[1].ID, "With the same ID, so it can be ignored")
+	}
+	mu.Unlock()
+
+	now = now.Add(time.Hour)
+	relayed, err = dispatcher.RelayDue(ctx)
+	assert.NoError(t, err, "We can relay the outbox once more")
+	assert.Equal(t, 0, relayed, "The relayed one is not relayed again")
+}
+
+func TestBackoff(t *testing.T) {
+
+	dispatcher := NewDispatcher(zap.NewNop(), persistent.NewMemoryOutbox(), DefaultOptions)
+
+	assert.Equal(t, DefaultOptions.Backoff, dispatcher.backoff(1), "It waits the backoff after the first failure")
+	assert.Equal(t, 4*DefaultOptions.Backoff, dispatcher.backoff(3), "It doubles after each failure")
+	assert.Equal(t, DefaultOptions.MaxBackoff, dispatcher.backoff(100), "Up to the max")
+}
@@ -0,0 +1,149 @@
+package outbox
+
+import (
+	"apipay/model"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// EventIDHeader is the header with the ID of the event sent by HTTPSink, the
+// same every time it is sent
+const EventIDHeader = "X-Apipay-Event-ID"
+
+// Sink is where the events of the outbox are relayed to. An event can be sent
+// more than once, eg. when another sink failed, so they have to ignore the
+// events with an ID already received
+type Sink interface {
+	// Name identifies the sink in the logs
+	Name() string
+
+	// Send sends an event, it is tried again later if it fails
+	Send(ctx context.Context, event model.Event) error
+}
+
+// LogSink logs the events
+type LogSink struct {
+	logger *zap.Logger
+}
+
+// NewLogSink creates a sink logging the events with logger
+func NewLogSink(logger *zap.Logger) *LogSink {
+	return &LogSink{logger: logger}
+}
+
+// Name is "log"
+func (s *LogSink) Name() string {
+	return "log"
+}
+
+// Send logs an event, it never fails
+func (s *LogSink) Send(ctx context.Context, event model.Event) error {
+
+	s.logger.Sugar().Infow("outbox-event", "event", event.ID, "type", event.Type,
+		"operation", event.Operation, "payment", event.PaymentID)
+	return nil
+}
+
+// HTTPSink posts the events as json to a URL
+type HTTPSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPSink creates a sink posting the events to url with client. The
+// client should have a timeout
+func NewHTTPSink(url string, client *http.Client) *HTTPSink {
+	return &HTTPSink{url: url, client: client}
+}
+
+// Name is "http"
+func (s *HTTPSink) Name() string {
+	return "http"
+}
+
+// Send posts an event, it fails if the URL does not answer with a 2xx
+func (s *HTTPSink) Send(ctx context.Context, event model.Event) error {
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventIDHeader, event.ID)
+
+	res, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024)) // so the connection is reused
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("the sink answered %d", res.StatusCode)
+	}
+	return nil
+}
+
+// MemorySink keeps the events in memory, for tests. It is safe for concurrent
+// use
+type MemorySink struct {
+	mu     sync.Mutex
+	events []model.Event
+
+	// err is returned by Send when set, to test the failures
+	err error
+}
+
+// NewMemorySink creates an empty MemorySink
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+// Name is "memory"
+func (s *MemorySink) Name() string {
+	return "memory"
+}
+
+// Send keeps an event, unless an error was set
+func (s *MemorySink) Send(ctx context.Context, event model.Event) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+// SetErr sets the error returned by Send, nil to succeed again
+func (s *MemorySink) SetErr(err error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err
+}
+
+// Events returns the events received, oldest first
+func (s *MemorySink) Events() []model.Event {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]model.Event(nil), s.events...)
+}
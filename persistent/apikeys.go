@@ -0,0 +1,129 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultAPIKeysCollection = "apikeys"
+
+// Names of the fields of the API keys as they are stored in Mongo
+const (
+	fieldHash      = "hash"
+	fieldRevokedAt = "revokedat"
+)
+
+// APIKeyStore keeps the API keys. Only their hashes are stored
+type APIKeyStore interface {
+	// Save saves a new API key. If it is already there it will fail
+	Save(ctx context.Context, key model.APIKey) error
+
+	// GetByHash gets the API key with a hash, even if it is revoked
+	GetByHash(ctx context.Context, hash string) (model.APIKey, error)
+
+	// List gets all the API keys, oldest first
+	List(ctx context.Context) ([]model.APIKey, error)
+
+	// Revoke revokes an API key, so it cannot be used anymore. It returns the
+	// number of revoked keys, 0 if it is not there or it was already revoked
+	Revoke(ctx context.Context, id model.APIKeyID) (int64, error)
+}
+
+// GetAPIKeys is to get the APIKeys object (to interact with DB) with a given
+// DB connection
+func GetAPIKeys(ctx context.Context, cl Client) (*APIKeys, error) {
+
+	obj := &APIKeys{collection: cl.db.Collection(defaultAPIKeysCollection)}
+
+	err := obj.init(ctx)
+	return obj, err
+}
+
+// APIKeys is the Mongo APIKeyStore
+type APIKeys struct {
+	collection *mongo.Collection
+}
+
+// init the collection, setting up indices…
+func (a *APIKeys) init(ctx context.Context) error {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	_, err := a.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Options: options.Index().SetBackground(true).SetUnique(true),
+			Keys:    bson.D{{Key: fieldID, Value: 1}},
+		},
+		{
+			Options: options.Index().SetBackground(true).SetUnique(true),
+			Keys:    bson.D{{Key: fieldHash, Value: 1}},
+		},
+	})
+	return err
+}
+
+// Save saves a new API key. If it is already there it will fail
+func (a *APIKeys) Save(ctx context.Context, key model.APIKey) error {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	_, err := a.collection.InsertOne(ctx, key)
+	return err
+}
+
+// GetByHash gets the API key with a hash, even if it is revoked
+func (a *APIKeys) GetByHash(ctx context.Context, hash string) (model.APIKey, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	var res model.APIKey
+	err := a.collection.FindOne(ctx, bson.D{{Key: fieldHash, Value: hash}}).Decode(&res)
+	return res, err
+}
+
+// List gets all the API keys, oldest first
+func (a *APIKeys) List(ctx context.Context) ([]model.APIKey, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	cur, err := a.collection.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: fieldMongoID, Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	res := []model.APIKey{}
+	for cur.Next(ctx) {
+		var elem model.APIKey
+		if err := cur.Decode(&elem); err != nil {
+			return nil, err
+		}
+		res = append(res, elem)
+	}
+	return res, cur.Err()
+}
+
+// Revoke revokes an API key, so it cannot be used anymore
+func (a *APIKeys) Revoke(ctx context.Context, id model.APIKeyID) (int64, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	filter := bson.D{{Key: fieldID, Value: id}, {Key: fieldRevokedAt, Value: nil}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: fieldRevokedAt, Value: time.Now().UTC()}}}}
+
+	res, err := a.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
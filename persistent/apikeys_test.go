@@ -0,0 +1,60 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeys(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "apiKeysDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	apiKeysDB, err := GetAPIKeys(ctx, client)
+	assert.NoError(t, err, "We can init DB")
+
+	testAPIKeys(ctx, t, apiKeysDB)
+}
+
+// testAPIKeys checks the API keys are found by their hash until they are
+// revoked, in any APIKeyStore
+func testAPIKeys(ctx context.Context, t *testing.T, apiKeysDB APIKeyStore) {
+
+	apiKey, key, err := model.NewAPIKey("partner", []string{"org1", "org2"})
+	assert.NoError(t, err, "We can generate a key")
+
+	err = apiKeysDB.Save(ctx, apiKey)
+	assert.NoError(t, err, "We can save a key")
+	err = apiKeysDB.Save(ctx, apiKey)
+	assert.True(t, IsErrorDuplicate(err), "We cannot save it twice")
+
+	found, err := apiKeysDB.GetByHash(ctx, model.HashAPIKey(key))
+	assert.NoError(t, err, "We can find a key by its hash")
+	assert.Equal(t, apiKey.ID, found.ID, "It is the key")
+	assert.Equal(t, []string{"org1", "org2"}, found.OrganisationIDs, "With its organisations")
+	assert.True(t, found.Active(), "It is active")
+
+	_, err = apiKeysDB.GetByHash(ctx, model.HashAPIKey("apipay_unknown"))
+	assert.True(t, IsErrorNoDBResults(err), "We cannot find a key that is not there")
+
+	keys, err := apiKeysDB.List(ctx)
+	assert.NoError(t, err, "We can list the keys")
+	assert.Equal(t, 1, len(keys), "The key is there")
+
+	revoked, err := apiKeysDB.Revoke(ctx, apiKey.ID)
+	assert.NoError(t, err, "We can revoke a key")
+	assert.Equal(t, int64(1), revoked, "It was revoked")
+	revoked, err = apiKeysDB.Revoke(ctx, apiKey.ID)
+	assert.NoError(t, err, "We can revoke a key twice")
+	assert.Equal(t, int64(0), revoked, "But it was already revoked")
+
+	found, err = apiKeysDB.GetByHash(ctx, model.HashAPIKey(key))
+	assert.NoError(t, err, "We can find a revoked key")
+	assert.False(t, found.Active(), "But it is not active")
+}
@@ -0,0 +1,241 @@
+package persistent
+
+import (
+	"apipay/model"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	tDecimal            = reflect.TypeOf(model.Decimal{})
+	tChargesInformation = reflect.TypeOf(model.ChargesInformation{})
+	tChargesDocument    = reflect.TypeOf(chargesDocument{})
+	tFx                 = reflect.TypeOf(model.Fx{})
+	tFxDocument         = reflect.TypeOf(fxDocument{})
+)
+
+// registry is how the models are stored in Mongo. It is the default one, but
+// the amounts are stored as Decimal128, so Mongo can compare and sum them,
+// and the money of the charges and the fx is in two fields, as it always was
+func registry() *bsoncodec.Registry {
+
+	return bson.NewRegistryBuilder().
+		RegisterEncoder(tDecimal, bsoncodec.ValueEncoderFunc(encodeDecimal)).
+		RegisterDecoder(tDecimal, bsoncodec.ValueDecoderFunc(decodeDecimal)).
+		RegisterEncoder(tChargesInformation, documentEncoder(tChargesDocument, func(val reflect.Value) interface{} {
+			return newChargesDocument(val.Interface().(model.ChargesInformation))
+		})).
+		RegisterDecoder(tChargesInformation, documentDecoder(tChargesDocument, func(doc interface{}) interface{} {
+			return doc.(chargesDocument).charges()
+		})).
+		RegisterEncoder(tFx, documentEncoder(tFxDocument, func(val reflect.Value) interface{} {
+			return newFxDocument(val.Interface().(model.Fx))
+		})).
+		RegisterDecoder(tFx, documentDecoder(tFxDocument, func(doc interface{}) interface{} {
+			return doc.(fxDocument).fx()
+		})).
+		Build()
+}
+
+// chargesDocument is how model.ChargesInformation is stored
+type chargesDocument struct {
+	BearerCode              string        `bson:"bearercode"`
+	SenderCharges           []model.Money `bson:"sendercharges"`
+	ReceiverChargesAmount   model.Decimal `bson:"receiverchargesamount"`
+	ReceiverChargesCurrency string        `bson:"receiverchargescurrency"`
+}
+
+func newChargesDocument(c model.ChargesInformation) chargesDocument {
+
+	return chargesDocument{
+		BearerCode:              c.BearerCode,
+		SenderCharges:           c.SenderCharges,
+		ReceiverChargesAmount:   c.ReceiverCharges.Value,
+		ReceiverChargesCurrency: c.ReceiverCharges.Currency,
+	}
+}
+
+func (d chargesDocument) charges() model.ChargesInformation {
+
+	return model.ChargesInformation{
+		BearerCode:      d.BearerCode,
+		SenderCharges:   d.SenderCharges,
+		ReceiverCharges: model.Money{Value: d.ReceiverChargesAmount, Currency: d.ReceiverChargesCurrency},
+	}
+}
+
+// fxDocument is how model.Fx is stored
+type fxDocument struct {
+	ContractReference string        `bson:"contractreference"`
+	ExchangeRate      string        `bson:"exchangerate"`
+	OriginalAmount    model.Decimal `bson:"originalamount"`
+	OriginalCurrency  string        `bson:"originalcurrency"`
+}
+
+func newFxDocument(f model.Fx) fxDocument {
+
+	return fxDocument{
+		ContractReference: f.ContractReference,
+		ExchangeRate:      f.ExchangeRate,
+		OriginalAmount:    f.Original.Value,
+		OriginalCurrency:  f.Original.Currency,
+	}
+}
+
+func (d fxDocument) fx() model.Fx {
+
+	return model.Fx{
+		ContractReference: d.ContractReference,
+		ExchangeRate:      d.ExchangeRate,
+		Original:          model.Money{Value: d.OriginalAmount, Currency: d.OriginalCurrency},
+	}
+}
+
+// documentEncoder stores a value as the document toDoc makes of it
+func documentEncoder(docType reflect.Type, toDoc func(val reflect.Value) interface{}) bsoncodec.ValueEncoder {
+
+	return bsoncodec.ValueEncoderFunc(func(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+
+		encoder, err := ec.LookupEncoder(docType)
+		if err != nil {
+			return err
+		}
+		return encoder.EncodeValue(ec, vw, reflect.ValueOf(toDoc(val)))
+	})
+}
+
+// documentDecoder reads a value stored by documentEncoder, fromDoc makes it
+// from the document
+func documentDecoder(docType reflect.Type, fromDoc func(doc interface{}) interface{}) bsoncodec.ValueDecoder {
+
+	return bsoncodec.ValueDecoderFunc(func(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+
+		if !val.CanSet() {
+			return bsoncodec.ValueDecoderError{Name: "documentDecoder", Types: []reflect.Type{val.Type()}, Received: val}
+		}
+		decoder, err := dc.LookupDecoder(docType)
+		if err != nil {
+			return err
+		}
+		doc := reflect.New(docType).Elem()
+		if err := decoder.DecodeValue(dc, vr, doc); err != nil {
+			return err
+		}
+		val.Set(reflect.ValueOf(fromDoc(doc.Interface())))
+		return nil
+	})
+}
+
+// encodeDecimal stores a model.Decimal as Decimal128, or null if empty
+func encodeDecimal(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+
+	if val.Type() != tDecimal {
+		return bsoncodec.ValueEncoderError{Name: "encodeDecimal", Types: []reflect.Type{tDecimal}, Received: val}
+	}
+
+	amount := val.Interface().(model.Decimal)
+	if !amount.Valid() {
+		return model.ErrInvalidAmount
+	}
+	if amount.Empty() {
+		return vw.WriteNull()
+	}
+	value, err := primitive.ParseDecimal128(amount.String())
+	if err != nil {
+		return model.ErrInvalidAmount
+	}
+	return vw.WriteDecimal128(value)
+}
+
+// decodeDecimal reads a model.Decimal. Payments stored before amounts were
+// decimals have strings, they are migrated by GetStores but the audit keeps
+// them, so they are read too. And the sums of the aggregations can be integers
+func decodeDecimal(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+
+	if !val.CanSet() || val.Type() != tDecimal {
+		return bsoncodec.ValueDecoderError{Name: "decodeDecimal", Types: []reflect.Type{tDecimal}, Received: val}
+	}
+
+	var amount model.Decimal
+	var err error
+
+	switch vr.Type() {
+	case bsontype.Decimal128:
+		var value primitive.Decimal128
+		if value, err = vr.ReadDecimal128(); err == nil {
+			amount, err = fromDecimal128(value)
+		}
+	case bsontype.String:
+		var value string
+		if value, err = vr.ReadString(); err == nil && len(value) > 0 {
+			amount, err = model.ParseDecimal(value)
+		}
+	case bsontype.Int32:
+		// $sum of nothing
+		var value int32
+		if value, err = vr.ReadInt32(); err == nil {
+			amount, err = model.ParseDecimal(strconv.FormatInt(int64(value), 10))
+		}
+	case bsontype.Int64:
+		var value int64
+		if value, err = vr.ReadInt64(); err == nil {
+			amount, err = model.ParseDecimal(strconv.FormatInt(value, 10))
+		}
+	case bsontype.Null:
+		err = vr.ReadNull()
+	default:
+		return model.ErrInvalidAmount
+	}
+	if err != nil {
+		return err
+	}
+
+	val.Set(reflect.ValueOf(amount))
+	return nil
+}
+
+// fromDecimal128 converts a Decimal128, keeping its decimals. Mongo writes
+// some of them with exponents, like 1.050E+3
+func fromDecimal128(value primitive.Decimal128) (model.Decimal, error) {
+
+	s := value.String()
+	exp := 0
+	if i := strings.IndexByte(s, 'E'); i >= 0 {
+		var err error
+		if exp, err = strconv.Atoi(s[i+1:]); err != nil {
+			return model.Decimal{}, model.ErrInvalidAmount
+		}
+		s = s[:i]
+	}
+	mantissa, err := model.ParseDecimal(s)
+	if err != nil || exp == 0 {
+		return mantissa, err
+	}
+
+	scale := mantissa.Scale() - exp
+	if scale < 0 {
+		scale = 0
+	}
+	shift := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(exp))), nil))
+	if exp < 0 {
+		shift.Inv(shift)
+	}
+	return model.DecimalFromRat(shift.Mul(shift, mantissa.Rat()), scale)
+}
+
+// abs returns the absolute value of n
+func abs(n int) int {
+
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,75 @@
+package persistent
+
+import (
+	"apipay/model"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDecimalCodec(t *testing.T) {
+
+	payment := testPayment(model.PaymentID("12345"))
+	payment.Attributes.Amount = testMoney("100.2", "GBP")
+	payment.Attributes.ChargesInformation.SenderCharges = []model.Money{testMoney("5", "USD")}
+	payment.Attributes.Fx.Original = testMoney("50.1", "EUR")
+
+	raw, err := bson.MarshalWithRegistry(registry(), payment)
+	assert.NoError(t, err, "We can marshal it")
+
+	for _, path := range [][]string{
+		{"attributes", "amount"},
+		{"attributes", "chargesinformation", "sendercharges", "0", "amount"},
+		{"attributes", "fx", "originalamount"},
+	} {
+		amount, err := bson.Raw(raw).LookupErr(path...)
+		assert.NoError(t, err, "The amount is there, as it always was: %v", path)
+		assert.Equal(t, bsontype.Decimal128, amount.Type, "It is stored as a decimal: %v", path)
+	}
+	currency, err := bson.Raw(raw).LookupErr("attributes", "currency")
+	assert.NoError(t, err, "The currency is next to the amount")
+	assert.Equal(t, "GBP", currency.StringValue())
+
+	charges, err := bson.Raw(raw).LookupErr("attributes", "chargesinformation", "receiverchargesamount")
+	assert.NoError(t, err, "The charges are there")
+	assert.Equal(t, bsontype.Null, charges.Type, "Empty amounts are null")
+
+	var decoded model.Payment
+	err = bson.UnmarshalWithRegistry(registry(), raw, &decoded)
+	assert.NoError(t, err, "We can unmarshal it")
+	assert.Equal(t, payment, decoded, "We got what we marshalled, with the same decimals")
+
+	// payments stored before amounts were decimals
+	legacy, err := bson.MarshalWithRegistry(registry(), bson.D{
+		{Key: "id", Value: "12345"},
+		{Key: "attributes", Value: bson.D{{Key: "amount", Value: "100.21"}, {Key: "currency", Value: "GBP"}}},
+	})
+	assert.NoError(t, err, "We can marshal it")
+	decoded = model.Payment{}
+	err = bson.UnmarshalWithRegistry(registry(), legacy, &decoded)
+	assert.NoError(t, err, "We can unmarshal it")
+	assert.Equal(t, testMoney("100.21", "GBP"), decoded.Attributes.Amount, "Amounts as strings are read")
+}
+
+func TestFromDecimal128(t *testing.T) {
+
+	for value, want := range map[string]string{
+		"100.21":    "100.21",
+		"1.050E+3":  "1050",
+		"1E+3":      "1000",
+		"-1.00E-6":  "-0.00000100",
+		"0.0000001": "0.0000001",
+	} {
+		d, err := primitive.ParseDecimal128(value)
+		assert.NoError(t, err, "It is a Decimal128")
+		got, err := fromDecimal128(d)
+		assert.NoError(t, err, "We can convert %s", value)
+		assert.Equal(t, 0, got.Cmp(model.MustParseDecimal(want)), "%s is %s", value, want)
+	}
+
+	_, err := fromDecimal128(primitive.NewDecimal128(0x7C00000000000000, 0))
+	assert.Equal(t, model.ErrInvalidAmount, err, "NaN is not an amount")
+}
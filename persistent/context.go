@@ -0,0 +1,103 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+
+	"go.uber.org/zap"
+)
+
+// AnonymousActor is the actor when none is known
+const AnonymousActor = "anonymous"
+
+type contextKey int
+
+const (
+	actorKey contextKey = iota
+	requestIDKey
+	organisationsKey
+	loggerKey
+	// changesKey has the changes of a transaction, see Payments.inTransaction
+	changesKey
+)
+
+// ErrOrganisationNotAllowed is returned when creating a payment, or moving
+// one, to an organisation not allowed by the context
+var ErrOrganisationNotAllowed = errors.New("organisation not allowed")
+
+// WithActor returns a context with who is doing the changes, so it can be
+// recorded with them
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey, actor)
+}
+
+// actorFrom returns who is doing the changes, AnonymousActor if not known
+func actorFrom(ctx context.Context) string {
+
+	if actor, ok := ctx.Value(actorKey).(string); ok && len(actor) > 0 {
+		return actor
+	}
+	return AnonymousActor
+}
+
+// WithRequestID returns a context with the ID of the request doing the
+// changes, so it can be recorded with them
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// requestIDFrom returns the ID of the request doing the changes, empty if not known
+func requestIDFrom(ctx context.Context) string {
+
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// WithLogger returns a context with the logger of the request, so what the
+// stores log can be traced back to it
+func WithLogger(ctx context.Context, logger *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// Logger returns the logger of the context, one discarding everything if it
+// has none
+func Logger(ctx context.Context) *zap.Logger {
+
+	if logger, ok := ctx.Value(loggerKey).(*zap.Logger); ok && logger != nil {
+		return logger
+	}
+	return zap.NewNop()
+}
+
+// WithOrganisations returns a context that only sees and changes the payments
+// of the organisations given. Without it all of them are allowed
+func WithOrganisations(ctx context.Context, organisationIDs []string) context.Context {
+	return context.WithValue(ctx, organisationsKey, append([]string{}, organisationIDs...))
+}
+
+// organisationsFrom returns the organisations allowed by the context, and
+// false if all of them are
+func organisationsFrom(ctx context.Context) ([]string, bool) {
+
+	organisationIDs, ok := ctx.Value(organisationsKey).([]string)
+	return organisationIDs, ok
+}
+
+// OrganisationAllowed checks if the context allows the payments of an
+// organisation
+func OrganisationAllowed(ctx context.Context, organisationID string) bool {
+
+	organisationIDs, scoped := organisationsFrom(ctx)
+	return !scoped || containsOrganisation(organisationIDs, organisationID)
+}
+
+// containsOrganisation checks if an organisation is one of organisationIDs
+func containsOrganisation(organisationIDs []string, organisationID string) bool {
+
+	for _, id := range organisationIDs {
+		if id == organisationID {
+			return true
+		}
+	}
+	return false
+}
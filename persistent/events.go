@@ -0,0 +1,288 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultEventsBuffer is how many of the last events the Broadcaster keeps, to
+// resume the feeds from them
+const defaultEventsBuffer = 1000
+
+// Codes of the errors of Mongo when resuming a change stream that is too old
+const (
+	errorChangeStreamFatal       = 280
+	errorChangeStreamHistoryLost = 286
+)
+
+// errors of the event feeds
+var (
+	// ErrInvalidEventID is returned when resuming from an ID that is not one
+	// of the feed
+	ErrInvalidEventID = errors.New("invalid event id")
+
+	// ErrEventsMissed is returned when the events after an ID are not there
+	// anymore, so the feed cannot be resumed from it
+	ErrEventsMissed = errors.New("the events after the id are not available anymore")
+)
+
+// EventStream is a feed of the changes to the payments, as they happen
+type EventStream interface {
+	// Next waits for the next event. The events must not be changed
+	Next(ctx context.Context) (model.Event, error)
+
+	// Close stops the feed
+	Close(ctx context.Context) error
+}
+
+// scopedStream is a feed that skips the events of the payments not of the
+// organisations given
+type scopedStream struct {
+	EventStream
+	organisationIDs []string
+}
+
+// scopeEvents returns a feed with only the events of the organisations allowed
+// by the context
+func scopeEvents(ctx context.Context, stream EventStream) EventStream {
+
+	organisationIDs, scoped := organisationsFrom(ctx)
+	if !scoped {
+		return stream
+	}
+	return &scopedStream{EventStream: stream, organisationIDs: organisationIDs}
+}
+
+// Next waits for the next event of the organisations
+func (s *scopedStream) Next(ctx context.Context) (model.Event, error) {
+
+	for {
+		event, err := s.EventStream.Next(ctx)
+		if err != nil {
+			return event, err
+		}
+		if event.Payment != nil && containsOrganisation(s.organisationIDs, event.Payment.OrganisationID) {
+			return event, nil
+		}
+	}
+}
+
+// Broadcaster sends the events to the feeds of this process. It keeps the
+// last events, so the feeds can be resumed after them. Sending never waits,
+// feeds too slow to keep up fail with ErrEventsMissed
+type Broadcaster struct {
+	mu sync.Mutex
+
+	// epoch identifies this broadcaster, as the sequence starts again when
+	// the process restarts
+	epoch  string
+	seq    uint64
+	recent []model.Event
+	size   int
+
+	feeds map[*broadcastStream]struct{}
+}
+
+// NewBroadcaster creates a Broadcaster keeping the last size events
+func NewBroadcaster(size int) *Broadcaster {
+
+	return &Broadcaster{
+		epoch: strconv.FormatInt(time.Now().UnixNano(), 36),
+		size:  size,
+		feeds: make(map[*broadcastStream]struct{}),
+	}
+}
+
+// Publish sends the event of a change recorded in the audit log
+func (b *Broadcaster) Publish(entry model.AuditEntry) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	b.recent = append(b.recent, model.NewEvent(b.epoch+"-"+strconv.FormatUint(b.seq, 10), entry))
+	if len(b.recent) > b.size {
+		b.recent = b.recent[len(b.recent)-b.size:]
+	}
+
+	for feed := range b.feeds {
+		select {
+		case feed.wake <- struct{}{}:
+		default: // it was already woken up
+		}
+	}
+}
+
+// Subscribe returns a feed of the events after the one with the ID after, or
+// of the new ones if it is empty
+func (b *Broadcaster) Subscribe(after string) (EventStream, error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	last := b.seq
+	if len(after) > 0 {
+		parts := strings.SplitN(after, "-", 2)
+		if len(parts) != 2 {
+			return nil, ErrInvalidEventID
+		}
+		seq, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, ErrInvalidEventID
+		}
+		if parts[0] != b.epoch {
+			return nil, ErrEventsMissed
+		}
+		if seq > b.seq {
+			return nil, ErrInvalidEventID
+		}
+		if seq < b.oldest()-1 {
+			return nil, ErrEventsMissed
+		}
+		last = seq
+	}
+
+	feed := &broadcastStream{broadcaster: b, last: last, wake: make(chan struct{}, 1)}
+	b.feeds[feed] = struct{}{}
+	return feed, nil
+}
+
+// oldest returns the sequence of the oldest event kept
+func (b *Broadcaster) oldest() uint64 {
+	return b.seq - uint64(len(b.recent)) + 1
+}
+
+// broadcastStream is a feed of a Broadcaster
+type broadcastStream struct {
+	broadcaster *Broadcaster
+	last        uint64
+	wake        chan struct{}
+}
+
+// next returns the event after the last one sent, if it is there
+func (s *broadcastStream) next() (model.Event, bool, error) {
+
+	b := s.broadcaster
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if s.last == b.seq {
+		return model.Event{}, false, nil
+	}
+	if s.last+1 < b.oldest() {
+		return model.Event{}, false, ErrEventsMissed
+	}
+	event := b.recent[s.last+1-b.oldest()]
+	s.last++
+	return event, true, nil
+}
+
+// Next waits for the next event
+func (s *broadcastStream) Next(ctx context.Context) (model.Event, error) {
+
+	for {
+		event, found, err := s.next()
+		if err != nil || found {
+			return event, err
+		}
+		select {
+		case <-s.wake:
+		case <-ctx.Done():
+			return model.Event{}, ctx.Err()
+		}
+	}
+}
+
+// Close stops getting the events
+func (s *broadcastStream) Close(ctx context.Context) error {
+
+	s.broadcaster.mu.Lock()
+	defer s.broadcaster.mu.Unlock()
+
+	delete(s.broadcaster.feeds, s)
+	return nil
+}
+
+// auditChange is the change of a Mongo change stream of the audit log
+type auditChange struct {
+	Token bson.Raw         `bson:"_id"`
+	Entry model.AuditEntry `bson:"fullDocument"`
+}
+
+// changeStream is a feed of the changes recorded in the audit log, read from
+// a Mongo change stream. The IDs of the events are the resume tokens
+type changeStream struct {
+	stream *mongo.ChangeStream
+}
+
+// watchAudit returns a feed of the changes recorded in the audit log, after
+// the one with the ID after, or of the new ones if it is empty
+func watchAudit(ctx context.Context, audit *mongo.Collection, after string) (EventStream, error) {
+
+	streamOptions := options.ChangeStream()
+	if len(after) > 0 {
+		token, err := base64.RawURLEncoding.DecodeString(after)
+		if err != nil || bson.Raw(token).Validate() != nil {
+			return nil, ErrInvalidEventID
+		}
+		streamOptions.SetResumeAfter(bson.Raw(token))
+	}
+
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.D{{Key: "operationType", Value: "insert"}}}}}
+	stream, err := audit.Watch(ctx, pipeline, streamOptions)
+	if err != nil {
+		if cmdErr, ok := err.(mongo.CommandError); ok && (cmdErr.Code == errorChangeStreamFatal ||
+			cmdErr.Code == errorChangeStreamHistoryLost) {
+			return nil, ErrEventsMissed
+		}
+		return nil, err
+	}
+	return &changeStream{stream: stream}, nil
+}
+
+// Next waits for the next change
+func (s *changeStream) Next(ctx context.Context) (model.Event, error) {
+
+	if !s.stream.Next(ctx) {
+		if err := s.stream.Err(); err != nil {
+			return model.Event{}, err
+		}
+		if err := ctx.Err(); err != nil {
+			return model.Event{}, err
+		}
+		return model.Event{}, errors.New("the change stream was closed")
+	}
+
+	var change auditChange
+	if err := s.stream.Decode(&change); err != nil {
+		return model.Event{}, err
+	}
+	return model.NewEvent(base64.RawURLEncoding.EncodeToString(change.Token), change.Entry), nil
+}
+
+// Close closes the change stream
+func (s *changeStream) Close(ctx context.Context) error {
+	return s.stream.Close(ctx)
+}
+
+// isReplicated checks if the Mongo server is a replica set or a sharded
+// cluster, only they have change streams and transactions
+func isReplicated(ctx context.Context, db *mongo.Database) (bool, error) {
+
+	var res struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := db.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&res)
+	return len(res.SetName) > 0 || res.Msg == "isdbgrid", err
+}
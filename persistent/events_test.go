@@ -0,0 +1,54 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroadcaster(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	broadcaster := NewBroadcaster(2)
+	publish := func(id model.PaymentID) {
+		broadcaster.Publish(model.AuditEntry{PaymentID: id, Operation: model.OperationCreate})
+	}
+
+	stream, err := broadcaster.Subscribe("")
+	assert.NoError(t, err, "We can subscribe")
+
+	go publish("1")
+	first, err := stream.Next(ctx)
+	assert.NoError(t, err, "We wait for the event")
+	assert.Equal(t, model.PaymentID("1"), first.PaymentID, "We got the event published")
+
+	publish("2")
+	publish("3")
+	publish("4")
+	_, err = stream.Next(ctx)
+	assert.Equal(t, ErrEventsMissed, err, "The events were published faster than read")
+
+	_, err = broadcaster.Subscribe(first.ID)
+	assert.Equal(t, ErrEventsMissed, err, "The event after it is not kept anymore")
+
+	_, err = NewBroadcaster(2).Subscribe(first.ID)
+	assert.Equal(t, ErrEventsMissed, err, "The IDs of other broadcasters are too old")
+
+	_, err = broadcaster.Subscribe(first.ID + "0")
+	assert.Equal(t, ErrInvalidEventID, err, "The event has not happened yet")
+
+	stream.Close(ctx)
+	assert.Equal(t, 0, len(broadcaster.feeds), "The closed feeds are not sent the events")
+
+	canceled, cancelNext := context.WithCancel(ctx)
+	cancelNext()
+	stream, err = broadcaster.Subscribe("")
+	assert.NoError(t, err, "We can subscribe")
+	_, err = stream.Next(canceled)
+	assert.Equal(t, context.Canceled, err, "We stop waiting when the context is done")
+}
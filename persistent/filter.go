@@ -0,0 +1,250 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"errors"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Names of the fields as they are stored in Mongo
+const (
+	fieldMongoID        = "_id"
+	fieldID             = "id"
+	fieldVersion        = "version"
+	fieldDeleted        = "deleted"
+	fieldType           = "type"
+	fieldAttributes     = "attributes"
+	fieldStatus         = "status"
+	fieldStatusHistory  = "statushistory"
+	fieldOrganisationID = "organisationid"
+	fieldCurrency       = "attributes.currency"
+	fieldPaymentScheme  = "attributes.paymentscheme"
+	fieldPaymentType    = "attributes.paymenttype"
+	fieldProcessingDate = "attributes.processingdate"
+	fieldAmount         = "attributes.amount"
+	fieldOriginalAmount = "attributes.fx.originalamount"
+	fieldAuditPaymentID = "paymentid"
+)
+
+// Fields the list can be sorted by
+const (
+	// SortCreated sorts by creation order, it is the default
+	SortCreated = "created"
+
+	// SortProcessingDate sorts by attributes.processing_date
+	SortProcessingDate = "processing_date"
+
+	// SortOrganisation sorts by organisation_id
+	SortOrganisation = "organisation_id"
+)
+
+// ErrInvalidSort is returned when sorting by a field that is not allowed
+var ErrInvalidSort = errors.New("invalid sort")
+
+// sortFields are the fields allowed for sorting, with their name in Mongo
+var sortFields = map[string]string{
+	SortCreated:        fieldMongoID,
+	SortProcessingDate: fieldProcessingDate,
+	SortOrganisation:   fieldOrganisationID,
+}
+
+// PaymentFilter holds the conditions the listed payments have to match.
+// Empty fields are not used
+type PaymentFilter struct {
+	OrganisationID string
+	Currency       string
+	PaymentScheme  string
+	PaymentType    string
+
+	// ProcessingDateFrom and ProcessingDateTo are inclusive, as YYYY-MM-DD
+	ProcessingDateFrom string
+	ProcessingDateTo   string
+
+	// AmountMin and AmountMax are inclusive, as decimal strings
+	AmountMin string
+	AmountMax string
+}
+
+// Sort is the order of the list
+type Sort struct {
+	Field      string
+	Descending bool
+}
+
+// ParseSort parses a sort like "processing_date" (ascending) or
+// "-processing_date" (descending). Empty means newest first
+func ParseSort(sort string) (Sort, error) {
+
+	if len(sort) == 0 {
+		return Sort{}.normalize(), nil
+	}
+
+	res := Sort{Field: strings.TrimPrefix(sort, "-")}
+	res.Descending = len(res.Field) != len(sort)
+
+	if _, found := sortFields[res.Field]; !found {
+		return Sort{}, ErrInvalidSort
+	}
+	return res, nil
+}
+
+// String is the inverse of ParseSort
+func (s Sort) String() string {
+
+	s = s.normalize()
+	if s.Descending {
+		return "-" + s.Field
+	}
+	return s.Field
+}
+
+// normalize replaces the zero value by the default sort
+func (s Sort) normalize() Sort {
+
+	if len(s.Field) == 0 {
+		return Sort{Field: SortCreated, Descending: true}
+	}
+	return s
+}
+
+// key returns the value of the sort field of a payment. It is empty when
+// sorting by creation, as that is not part of the payment
+func (s Sort) key(p *model.Payment) string {
+
+	switch s.Field {
+	case SortProcessingDate:
+		return p.Attributes.ProcessingDate
+	case SortOrganisation:
+		return p.OrganisationID
+	}
+	return ""
+}
+
+// Validate checks the values of the filter can be used
+func (f PaymentFilter) Validate() error {
+
+	for _, amount := range []string{f.AmountMin, f.AmountMax} {
+		if len(amount) == 0 {
+			continue
+		}
+		if _, err := model.ParseDecimal(amount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mongoFilter translates the filter into a Mongo query
+func (f PaymentFilter) mongoFilter() (bson.D, error) {
+
+	filter := bson.D{}
+
+	equals := []struct {
+		field string
+		value string
+	}{
+		{fieldOrganisationID, f.OrganisationID},
+		{fieldCurrency, f.Currency},
+		{fieldPaymentScheme, f.PaymentScheme},
+		{fieldPaymentType, f.PaymentType},
+	}
+	for _, cond := range equals {
+		if len(cond.value) > 0 {
+			filter = append(filter, bson.E{Key: cond.field, Value: cond.value})
+		}
+	}
+
+	// dates are ISO so comparing the strings is enough
+	dates := bson.D{}
+	if len(f.ProcessingDateFrom) > 0 {
+		dates = append(dates, bson.E{Key: "$gte", Value: f.ProcessingDateFrom})
+	}
+	if len(f.ProcessingDateTo) > 0 {
+		dates = append(dates, bson.E{Key: "$lte", Value: f.ProcessingDateTo})
+	}
+	if len(dates) > 0 {
+		filter = append(filter, bson.E{Key: fieldProcessingDate, Value: dates})
+	}
+
+	// amounts are stored as Decimal128, so they are compared as numbers
+	amounts := bson.D{}
+	for _, limit := range []struct {
+		op    string
+		value string
+	}{{"$gte", f.AmountMin}, {"$lte", f.AmountMax}} {
+		if len(limit.value) == 0 {
+			continue
+		}
+		value, err := primitive.ParseDecimal128(limit.value)
+		if err != nil {
+			return nil, model.ErrInvalidAmount
+		}
+		amounts = append(amounts, bson.E{Key: limit.op, Value: value})
+	}
+	if len(amounts) > 0 {
+		filter = append(filter, bson.E{Key: fieldAmount, Value: amounts})
+	}
+
+	return filter, nil
+}
+
+// matches checks a payment against the filter, it is what mongoFilter does
+// but in memory
+func (f PaymentFilter) matches(p *model.Payment) bool {
+
+	equals := []struct {
+		want  string
+		value string
+	}{
+		{f.OrganisationID, p.OrganisationID},
+		{f.Currency, p.Attributes.Amount.Currency},
+		{f.PaymentScheme, p.Attributes.PaymentScheme},
+		{f.PaymentType, p.Attributes.PaymentType},
+	}
+	for _, cond := range equals {
+		if len(cond.want) > 0 && cond.want != cond.value {
+			return false
+		}
+	}
+
+	date := p.Attributes.ProcessingDate
+	if len(f.ProcessingDateFrom) > 0 && date < f.ProcessingDateFrom {
+		return false
+	}
+	if len(f.ProcessingDateTo) > 0 && date > f.ProcessingDateTo {
+		return false
+	}
+
+	if len(f.AmountMin) > 0 || len(f.AmountMax) > 0 {
+		amount := p.Attributes.Amount.Value
+		if amount.Empty() {
+			return false
+		}
+		if min, err := model.ParseDecimal(f.AmountMin); err == nil && amount.Cmp(min) < 0 {
+			return false
+		}
+		if max, err := model.ParseDecimal(f.AmountMax); err == nil && amount.Cmp(max) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// scoped adds to a Mongo query the organisations allowed by the context, if
+// it has them. It is a separate condition, so it does not replace the one of
+// the filter of the organisation
+func scoped(ctx context.Context, filter bson.D) bson.D {
+
+	organisationIDs, ok := organisationsFrom(ctx)
+	if !ok {
+		return filter
+	}
+	return append(filter, bson.E{Key: "$and", Value: bson.A{
+		bson.D{{Key: fieldOrganisationID, Value: bson.D{{Key: "$in", Value: organisationIDs}}}},
+	}})
+}
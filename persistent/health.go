@@ -0,0 +1,85 @@
+package persistent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// requiredIndexes are the unique indices of each collection, by their fields.
+// Without them the IDs could be duplicated, so the stores are not usable
+var requiredIndexes = map[string][][]string{
+	defaultPaymentsCollection:    {{fieldID}},
+	defaultOutboxCollection:      {{fieldID}},
+	defaultAPIKeysCollection:     {{fieldID}, {fieldHash}},
+	defaultIdempotencyCollection: {{"key", "organisation_id"}},
+	defaultWebhooksCollection:    {{fieldID}},
+	defaultDeliveriesCollection:  {{fieldID}},
+}
+
+// Ping checks Mongo answers, asking the primary
+func (cl *Client) Ping(ctx context.Context) error {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	return cl.mongoClient.Ping(ctx, readpref.Primary())
+}
+
+// CheckIndexes checks the collections have the unique indices the stores
+// need. They are created by GetStores, so they are missing only if someone
+// dropped them
+func (cl *Client) CheckIndexes(ctx context.Context) error {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	collections := make([]string, 0, len(requiredIndexes))
+	for collection := range requiredIndexes {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+
+	for _, collection := range collections {
+		existing, err := cl.indexes(ctx, collection)
+		if err != nil {
+			return err
+		}
+		for _, fields := range requiredIndexes[collection] {
+			if !existing[strings.Join(fields, ",")] {
+				return fmt.Errorf("the collection %s has no index on %s", collection, strings.Join(fields, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// indexes returns the fields of the indices of a collection, comma separated
+func (cl *Client) indexes(ctx context.Context, collection string) (map[string]bool, error) {
+
+	cursor, err := cl.db.Collection(collection).Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	indexes := map[string]bool{}
+	for cursor.Next(ctx) {
+		var index struct {
+			Key bson.D `bson:"key"`
+		}
+		if err := cursor.Decode(&index); err != nil {
+			return nil, err
+		}
+		fields := make([]string, 0, len(index.Key))
+		for _, key := range index.Key {
+			fields = append(fields, key.Key)
+		}
+		indexes[strings.Join(fields, ",")] = true
+	}
+	return indexes, cursor.Err()
+}
@@ -0,0 +1,33 @@
+package persistent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "healthDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	assert.NoError(t, client.Ping(ctx), "Mongo answers")
+
+	err = client.CheckIndexes(ctx)
+	assert.Error(t, err, "There are no indices before the stores are created")
+
+	_, err = GetStores(ctx, client, time.Hour)
+	assert.NoError(t, err, "We can init the stores")
+	assert.NoError(t, client.CheckIndexes(ctx), "The stores create the indices")
+
+	_, err = client.db.Collection(defaultWebhooksCollection).Indexes().DropOne(ctx, "id_1")
+	assert.NoError(t, err, "We can drop an index")
+	err = client.CheckIndexes(ctx)
+	assert.Error(t, err, "A dropped index is missing")
+	assert.Contains(t, err.Error(), defaultWebhooksCollection, "The error says which collection")
+}
@@ -0,0 +1,162 @@
+package persistent
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultIdempotencyCollection = "idempotency"
+)
+
+// IdempotencyRecord is what is stored for a request with an Idempotency-Key,
+// so its response can be replayed when the same request is retried
+type IdempotencyRecord struct {
+	Key            string `bson:"key"`
+	OrganisationID string `bson:"organisation_id"`
+
+	// RequestHash identifies the request, a retry has to be identical
+	RequestHash string `bson:"request_hash"`
+
+	// Completed is false while the first request is being processed
+	Completed bool `bson:"completed"`
+
+	StatusCode int               `bson:"status_code"`
+	Headers    map[string]string `bson:"headers"`
+	Body       []byte            `bson:"body"`
+
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// IdempotencyStore keeps the responses of the requests with an Idempotency-Key
+type IdempotencyStore interface {
+	// Reserve stores a new not completed record for the key and organisation.
+	// If there was already one (not expired) it is returned instead, and nothing
+	// is stored
+	Reserve(ctx context.Context, key, organisationID, requestHash string) (*IdempotencyRecord, error)
+
+	// Complete stores the response of a reserved record
+	Complete(ctx context.Context, record IdempotencyRecord) error
+
+	// Release deletes a reserved record, so the request can be retried
+	Release(ctx context.Context, key, organisationID string) error
+}
+
+// GetIdempotency is to get the Idempotency object (to interact with DB) with
+// a given DB connection. Records expire after ttl
+func GetIdempotency(ctx context.Context, cl Client, ttl time.Duration) (*Idempotency, error) {
+
+	obj := &Idempotency{
+		collection: cl.db.Collection(defaultIdempotencyCollection),
+		ttl:        ttl,
+	}
+
+	err := obj.init(ctx)
+	return obj, err
+}
+
+// Idempotency is the Mongo IdempotencyStore. Records are deleted by Mongo
+// with a TTL index
+type Idempotency struct {
+	collection *mongo.Collection
+	ttl        time.Duration
+}
+
+// init the collection, setting up indices…
+func (i *Idempotency) init(ctx context.Context) error {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	indices := []mongo.IndexModel{
+		{
+			Options: options.Index().SetBackground(true).SetUnique(true),
+			Keys:    bson.D{{Key: "key", Value: 1}, {Key: "organisation_id", Value: 1}},
+		},
+		{
+			Options: options.Index().SetBackground(true).SetExpireAfterSeconds(int32(i.ttl.Seconds())),
+			Keys:    bson.D{{Key: "created_at", Value: 1}},
+		},
+	}
+
+	_, err := i.collection.Indexes().CreateMany(ctx, indices)
+	return err
+}
+
+func (i *Idempotency) filter(key, organisationID string) bson.D {
+	return bson.D{{Key: "key", Value: key}, {Key: "organisation_id", Value: organisationID}}
+}
+
+// Reserve stores a new not completed record for the key and organisation.
+// If there was already one (not expired) it is returned instead
+func (i *Idempotency) Reserve(ctx context.Context, key, organisationID, requestHash string) (*IdempotencyRecord, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	record := IdempotencyRecord{
+		Key:            key,
+		OrganisationID: organisationID,
+		RequestHash:    requestHash,
+		CreatedAt:      time.Now().UTC(),
+	}
+
+	// the TTL monitor runs only every minute, so there can be expired records
+	// still there. In that case it is deleted and tried again
+	for attempt := 0; attempt < 2; attempt++ {
+
+		_, err := i.collection.InsertOne(ctx, record)
+		if err == nil {
+			return nil, nil
+		}
+		if !isDuplicateKey(err) {
+			return nil, err
+		}
+
+		var existing IdempotencyRecord
+		err = i.collection.FindOne(ctx, i.filter(key, organisationID)).Decode(&existing)
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(existing.CreatedAt) < i.ttl {
+			return &existing, nil
+		}
+
+		filter := append(i.filter(key, organisationID), bson.E{Key: "created_at", Value: existing.CreatedAt})
+		if _, err := i.collection.DeleteOne(ctx, filter); err != nil {
+			return nil, err
+		}
+	}
+	return nil, mongo.ErrNoDocuments // someone else keeps reserving it, it should not happen
+}
+
+// Complete stores the response of a reserved record
+func (i *Idempotency) Complete(ctx context.Context, record IdempotencyRecord) error {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "completed", Value: true},
+		{Key: "status_code", Value: record.StatusCode},
+		{Key: "headers", Value: record.Headers},
+		{Key: "body", Value: record.Body},
+	}}}
+
+	_, err := i.collection.UpdateOne(ctx, i.filter(record.Key, record.OrganisationID), update)
+	return err
+}
+
+// Release deletes a reserved record, so the request can be retried
+func (i *Idempotency) Release(ctx context.Context, key, organisationID string) error {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	_, err := i.collection.DeleteOne(ctx, i.filter(key, organisationID))
+	return err
+}
@@ -0,0 +1,206 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the tracer of the spans of the stores
+const tracerName = "apipay/persistent"
+
+// The attributes of the spans that are not in the semantic conventions
+const (
+	AttributePaymentID      = attribute.Key("apipay.payment.id")
+	AttributeOrganisationID = attribute.Key("apipay.organisation.id")
+	attributeAction         = attribute.Key("apipay.payment.action")
+	attributeCount          = attribute.Key("apipay.payments.count")
+)
+
+// instrumentedPayments is a PaymentStore recording a span and the metrics of
+// each call to the store it wraps
+type instrumentedPayments struct {
+	payments PaymentStore
+
+	// kind and attributes are the ones of all the spans, they say where the
+	// payments are
+	kind       trace.SpanKind
+	attributes []attribute.KeyValue
+}
+
+// InstrumentedPayments returns payments recording a span for each of its
+// methods, with the IDs of the payment and its organisation when they are
+// known, and how long they take and if they fail in the metrics. collection is
+// the Mongo collection of the payments, empty if they are not in Mongo. The
+// spans go to the global tracer provider
+func InstrumentedPayments(payments PaymentStore, collection string) PaymentStore {
+
+	instrumented := &instrumentedPayments{payments: payments, kind: trace.SpanKindInternal}
+	if len(collection) > 0 {
+		instrumented.kind = trace.SpanKindClient
+		instrumented.attributes = []attribute.KeyValue{semconv.DBSystemNameMongoDB, semconv.DBCollectionName(collection)}
+	}
+	return instrumented
+}
+
+// call is a call to a method of the store being instrumented
+type call struct {
+	method  string
+	started time.Time
+	span    trace.Span
+}
+
+// start starts a call to a method, and its span
+func (t *instrumentedPayments) start(ctx context.Context, method string, attributes ...attribute.KeyValue) (context.Context, *call) {
+
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "Payments."+method, trace.WithSpanKind(t.kind),
+		trace.WithAttributes(t.attributes...), trace.WithAttributes(semconv.DBOperationName(method)))
+	span.SetAttributes(attributes...)
+	return ctx, &call{method: method, started: time.Now(), span: span}
+}
+
+// end ends a call, with the error of the method if it failed. Not finding a
+// payment is not an error of the store
+func (c *call) end(err error) {
+
+	observeOperation(c.method, c.started, err)
+	if err != nil && !IsErrorNoDBResults(err) {
+		c.span.RecordError(err)
+		c.span.SetStatus(codes.Error, err.Error())
+	}
+	c.span.End()
+}
+
+// paymentAttributes returns the attributes of a payment of a span
+func paymentAttributes(obj model.Payment) []attribute.KeyValue {
+
+	return []attribute.KeyValue{
+		AttributePaymentID.String(string(obj.ID)),
+		AttributeOrganisationID.String(obj.OrganisationID),
+	}
+}
+
+// filterAttributes returns the attributes of a filter of a span
+func filterAttributes(filter PaymentFilter) []attribute.KeyValue {
+
+	if len(filter.OrganisationID) == 0 {
+		return nil
+	}
+	return []attribute.KeyValue{AttributeOrganisationID.String(filter.OrganisationID)}
+}
+
+func (t *instrumentedPayments) Save(ctx context.Context, obj model.Payment) (model.Payment, error) {
+
+	ctx, call := t.start(ctx, "Save", paymentAttributes(obj)...)
+	saved, err := t.payments.Save(ctx, obj)
+	call.end(err)
+	return saved, err
+}
+
+func (t *instrumentedPayments) SaveMany(ctx context.Context, objs []model.Payment) ([]model.Payment, []error, error) {
+
+	ctx, call := t.start(ctx, "SaveMany", attributeCount.Int(len(objs)))
+	saved, errs, err := t.payments.SaveMany(ctx, objs)
+	call.end(err)
+	return saved, errs, err
+}
+
+func (t *instrumentedPayments) Update(ctx context.Context, obj model.Payment) (model.Payment, error) {
+
+	ctx, call := t.start(ctx, "Update", paymentAttributes(obj)...)
+	updated, err := t.payments.Update(ctx, obj)
+	call.end(err)
+	return updated, err
+}
+
+func (t *instrumentedPayments) Get(ctx context.Context, id model.PaymentID, opts GetOptions) (model.Payment, error) {
+
+	ctx, call := t.start(ctx, "Get", AttributePaymentID.String(string(id)))
+	obj, err := t.payments.Get(ctx, id, opts)
+	if err == nil {
+		call.span.SetAttributes(AttributeOrganisationID.String(obj.OrganisationID))
+	}
+	call.end(err)
+	return obj, err
+}
+
+func (t *instrumentedPayments) Delete(ctx context.Context, id model.PaymentID) (int64, error) {
+
+	ctx, call := t.start(ctx, "Delete", AttributePaymentID.String(string(id)))
+	deleted, err := t.payments.Delete(ctx, id)
+	call.end(err)
+	return deleted, err
+}
+
+func (t *instrumentedPayments) Restore(ctx context.Context, id model.PaymentID) (model.Payment, error) {
+
+	ctx, call := t.start(ctx, "Restore", AttributePaymentID.String(string(id)))
+	obj, err := t.payments.Restore(ctx, id)
+	if err == nil {
+		call.span.SetAttributes(AttributeOrganisationID.String(obj.OrganisationID))
+	}
+	call.end(err)
+	return obj, err
+}
+
+func (t *instrumentedPayments) Transition(ctx context.Context, id model.PaymentID, action model.Action,
+	reason string) (model.Payment, error) {
+
+	ctx, call := t.start(ctx, "Transition", AttributePaymentID.String(string(id)), attributeAction.String(string(action)))
+	obj, err := t.payments.Transition(ctx, id, action, reason)
+	if err == nil {
+		call.span.SetAttributes(AttributeOrganisationID.String(obj.OrganisationID))
+	}
+	call.end(err)
+	return obj, err
+}
+
+func (t *instrumentedPayments) List(ctx context.Context, opts ListOptions) (ListResult, error) {
+
+	ctx, call := t.start(ctx, "List", filterAttributes(opts.Filter)...)
+	result, err := t.payments.List(ctx, opts)
+	if err == nil {
+		call.span.SetAttributes(attributeCount.Int(len(result.Items)))
+	}
+	call.end(err)
+	return result, err
+}
+
+func (t *instrumentedPayments) Export(ctx context.Context, opts ExportOptions, fn func(*model.Payment) error) error {
+
+	ctx, call := t.start(ctx, "Export", filterAttributes(opts.Filter)...)
+	err := t.payments.Export(ctx, opts, fn)
+	call.end(err)
+	return err
+}
+
+func (t *instrumentedPayments) Summary(ctx context.Context, opts SummaryOptions) ([]model.Summary, error) {
+
+	ctx, call := t.start(ctx, "Summary", filterAttributes(opts.Filter)...)
+	summaries, err := t.payments.Summary(ctx, opts)
+	call.end(err)
+	return summaries, err
+}
+
+func (t *instrumentedPayments) History(ctx context.Context, id model.PaymentID) ([]model.AuditEntry, error) {
+
+	ctx, call := t.start(ctx, "History", AttributePaymentID.String(string(id)))
+	entries, err := t.payments.History(ctx, id)
+	call.end(err)
+	return entries, err
+}
+
+func (t *instrumentedPayments) Events(ctx context.Context, after string) (EventStream, error) {
+
+	// the span is of opening the feed, which is open until the client goes away
+	ctx, call := t.start(ctx, "Events")
+	stream, err := t.payments.Events(ctx, after)
+	call.end(err)
+	return stream, err
+}
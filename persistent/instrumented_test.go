@@ -0,0 +1,157 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// testTracing checks the spans of the payments of stores, which are in the
+// Mongo collection, or not in Mongo if it is empty
+func testTracing(ctx context.Context, t *testing.T, stores Stores, collection string) {
+
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	payment := testPayment("1")
+	payment.OrganisationID = "testOrg"
+	_, err := stores.Payments.Save(ctx, payment)
+	assert.NoError(t, err, "We can save a payment")
+
+	_, err = stores.Payments.Get(ctx, "1", GetOptions{})
+	assert.NoError(t, err, "We can get it")
+
+	_, err = stores.Payments.Get(ctx, "2", GetOptions{})
+	assert.True(t, IsErrorNoDBResults(err), "Another one is not found")
+
+	_, err = stores.Payments.Save(ctx, payment)
+	assert.Error(t, err, "We cannot save it twice")
+
+	spans := recorder.Ended()
+	if !assert.Equal(t, 4, len(spans), "There is a span per call") {
+		return
+	}
+
+	attributes := func(span sdktrace.ReadOnlySpan) map[attribute.Key]string {
+		values := map[attribute.Key]string{}
+		for _, kv := range span.Attributes() {
+			values[kv.Key] = kv.Value.Emit()
+		}
+		return values
+	}
+
+	for i, name := range []string{"Payments.Save", "Payments.Get", "Payments.Get", "Payments.Save"} {
+		assert.Equal(t, name, spans[i].Name(), "The span is named after the method")
+		if len(collection) > 0 {
+			assert.Equal(t, collection, attributes(spans[i])["db.collection.name"], "The span has the collection")
+		}
+	}
+
+	assert.Equal(t, "1", attributes(spans[0])[AttributePaymentID], "The span has the payment")
+	assert.Equal(t, "testOrg", attributes(spans[0])[AttributeOrganisationID], "And its organisation")
+	assert.Equal(t, codes.Unset, spans[0].Status().Code, "It did not fail")
+
+	assert.Equal(t, "testOrg", attributes(spans[1])[AttributeOrganisationID], "Getting a payment finds its organisation")
+	assert.Equal(t, codes.Unset, spans[2].Status().Code, "Not finding a payment is not an error")
+	assert.Equal(t, codes.Error, spans[3].Status().Code, "A duplicate is")
+}
+
+func TestTracing(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "tracingDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	stores, err := GetStores(ctx, client, time.Hour)
+	assert.NoError(t, err, "We can init DB")
+
+	testTracing(ctx, t, stores, defaultPaymentsCollection)
+}
+
+// testMetrics checks the metrics of the payments of stores. They are global,
+// so only their increments are checked
+func testMetrics(ctx context.Context, t *testing.T, stores Stores) {
+
+	saves := observations(t, operationDuration.WithLabelValues("Save"))
+	errors := testutil.ToFloat64(operationErrors.WithLabelValues("Save"))
+	notFound := testutil.ToFloat64(operationErrors.WithLabelValues("Get"))
+	created := paymentChanges.WithLabelValues(string(model.OperationCreate), "FPS", "EUR")
+	deleted := paymentChanges.WithLabelValues(string(model.OperationDelete), "FPS", "EUR")
+	createdBefore, deletedBefore := testutil.ToFloat64(created), testutil.ToFloat64(deleted)
+
+	payment := testPayment("metrics")
+	payment.Attributes.PaymentScheme = "FPS"
+	payment.Attributes.Amount.Currency = "EUR"
+	_, err := stores.Payments.Save(ctx, payment)
+	assert.NoError(t, err, "We can save a payment")
+	_, err = stores.Payments.Save(ctx, payment)
+	assert.Error(t, err, "We cannot save it twice")
+	_, err = stores.Payments.Get(ctx, "missing", GetOptions{})
+	assert.True(t, IsErrorNoDBResults(err), "Another one is not found")
+	_, err = stores.Payments.Delete(ctx, "metrics")
+	assert.NoError(t, err, "We can delete it")
+
+	assert.Equal(t, saves+2, observations(t, operationDuration.WithLabelValues("Save")), "Both saves are measured")
+	assert.Equal(t, errors+1, testutil.ToFloat64(operationErrors.WithLabelValues("Save")), "The failed one is an error")
+	assert.Equal(t, notFound, testutil.ToFloat64(operationErrors.WithLabelValues("Get")), "Not finding one is not")
+	assert.Equal(t, createdBefore+1, testutil.ToFloat64(created), "The creation is counted by scheme and currency")
+	assert.Equal(t, deletedBefore+1, testutil.ToFloat64(deleted), "And so is the deletion")
+
+	backlog, err := stores.Outbox.Backlog(ctx)
+	assert.NoError(t, err, "We can get the backlog of the outbox")
+	assert.Equal(t, 2, backlog.Pending, "The changes are not relayed")
+	assert.False(t, backlog.Oldest.IsZero(), "The oldest one is from the creation")
+	count, err := testutil.GatherAndCount(registryOf(NewOutboxCollector(stores.Outbox)),
+		"apipay_outbox_pending", "apipay_outbox_oldest_pending_age_seconds")
+	assert.NoError(t, err, "We can collect the backlog")
+	assert.Equal(t, 2, count, "How many and how old")
+}
+
+func TestMetrics(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "metricsDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	stores, err := GetStores(ctx, client, time.Hour)
+	assert.NoError(t, err, "We can init DB")
+
+	testMetrics(ctx, t, stores)
+
+	count, err := testutil.GatherAndCount(registryOf(NewServerConnectionsCollector(client)), "apipay_mongo_server_connections")
+	assert.NoError(t, err, "We can get the connections of Mongo")
+	assert.Equal(t, 3, count, "There are the current, available and active ones")
+}
+
+// observations returns how many values a histogram has got
+func observations(t *testing.T, observer prometheus.Observer) uint64 {
+
+	metric := &dto.Metric{}
+	assert.NoError(t, observer.(prometheus.Metric).Write(metric), "We can read the histogram")
+	return metric.GetHistogram().GetSampleCount()
+}
+
+// registryOf returns a registry with only the collector
+func registryOf(collector prometheus.Collector) *prometheus.Registry {
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	return registry
+}
@@ -0,0 +1,114 @@
+package persistent
+
+import (
+	"apipay/model"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+const (
+	// DefaultListLimit is the page size used when none is given
+	DefaultListLimit = 100
+
+	// MaxListLimit is the biggest page size allowed
+	MaxListLimit = 1000
+)
+
+// ErrInvalidCursor is returned when a cursor cannot be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ListOptions are the options to get a page of payments
+type ListOptions struct {
+	// Limit is the max number of items to return, DefaultListLimit if zero
+	Limit int64
+
+	// Cursor is the NextCursor of the previous page, empty for the first one
+	Cursor string
+
+	// Filter are the conditions the payments have to match
+	Filter PaymentFilter
+
+	// Sort is the order of the payments, newest first if empty
+	Sort Sort
+
+	// IncludeDeleted lists also the deleted payments
+	IncludeDeleted bool
+}
+
+// ListResult is a page of payments
+type ListResult struct {
+	Items []*model.Payment
+
+	// NextCursor is the cursor to get the next page, empty if this is the last one
+	NextCursor string
+}
+
+// limit returns the limit to use, after applying the defaults and the max
+func (o ListOptions) limit() int64 {
+
+	if o.Limit <= 0 {
+		return DefaultListLimit
+	}
+	if o.Limit > MaxListLimit {
+		return MaxListLimit
+	}
+	return o.Limit
+}
+
+// cursorPosition is what goes inside the opaque cursors. After is the
+// position of the last item returned, each store decides its format. Key is
+// the value of the sort field of that item, and Sort the sort used, as the
+// cursor is only valid with it
+type cursorPosition struct {
+	Sort  string `json:"s"`
+	Key   string `json:"k,omitempty"`
+	After string `json:"a"`
+}
+
+func encodeCursor(pos cursorPosition) string {
+
+	raw, err := json.Marshal(pos)
+	if err != nil { // it cannot really happen with a struct of strings
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(cursor string, sort Sort) (cursorPosition, error) {
+
+	var pos cursorPosition
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return pos, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(raw, &pos); err != nil || len(pos.After) == 0 {
+		return pos, ErrInvalidCursor
+	}
+	if pos.Sort != sort.String() {
+		return pos, ErrInvalidCursor
+	}
+	return pos, nil
+}
+
+// exportBatchSize is how many payments are read from Mongo at once when exporting
+const exportBatchSize = 1000
+
+// ExportOptions are the options to export payments. They are the ones of the
+// list, without the pagination
+type ExportOptions struct {
+	Filter         PaymentFilter
+	Sort           Sort
+	IncludeDeleted bool
+}
+
+// listOptions returns the options of the list of the same payments
+func (o ExportOptions) listOptions() ListOptions {
+
+	return ListOptions{
+		Filter:         o.Filter,
+		Sort:           o.Sort,
+		IncludeDeleted: o.IncludeDeleted,
+	}
+}
@@ -0,0 +1,446 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var errMemoryDuplicateID = errors.New("payment with the same id already exists")
+
+// memoryEntry is how a payment is kept in memory. seq keeps the insertion
+// order, the same way _id does in Mongo
+type memoryEntry struct {
+	seq     uint64
+	payment model.Payment
+}
+
+// MemoryPayments is an in-memory PaymentStore. It is safe for concurrent use
+// but nothing survives a restart, so it is meant for tests and local runs
+type MemoryPayments struct {
+	mu      sync.RWMutex
+	lastSeq uint64
+	items   map[model.PaymentID]*memoryEntry
+	audit   map[model.PaymentID][]model.AuditEntry
+	events  *Broadcaster
+	outbox  *MemoryOutbox
+
+	// webhooks gets the deliveries of the changes, if set
+	webhooks *MemoryWebhooks
+}
+
+// NewMemoryPayments creates an empty in-memory PaymentStore
+func NewMemoryPayments() *MemoryPayments {
+	return &MemoryPayments{
+		items:  make(map[model.PaymentID]*memoryEntry),
+		audit:  make(map[model.PaymentID][]model.AuditEntry),
+		events: NewBroadcaster(defaultEventsBuffer),
+		outbox: NewMemoryOutbox(),
+	}
+}
+
+// Save saves a payment, pending. If it is already there it will fail
+func (m *MemoryPayments) Save(ctx context.Context, obj model.Payment) (model.Payment, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.save(ctx, obj)
+}
+
+// SaveMany saves many payments, pending, carrying on when some of them fail
+func (m *MemoryPayments) SaveMany(ctx context.Context, objs []model.Payment) ([]model.Payment, []error, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	saved := make([]model.Payment, len(objs))
+	errs := make([]error, len(objs))
+	for i, obj := range objs {
+		saved[i], errs[i] = m.save(ctx, obj)
+	}
+	return saved, errs, nil
+}
+
+// find returns a payment, if it is there and its organisation is allowed by
+// the context. It has to be called with the lock held
+func (m *MemoryPayments) find(ctx context.Context, id model.PaymentID) (*memoryEntry, bool) {
+
+	entry, found := m.items[id]
+	if !found || !OrganisationAllowed(ctx, entry.payment.OrganisationID) {
+		return nil, false
+	}
+	return entry, true
+}
+
+// save saves a payment, it has to be called with the lock held
+func (m *MemoryPayments) save(ctx context.Context, obj model.Payment) (model.Payment, error) {
+
+	if !OrganisationAllowed(ctx, obj.OrganisationID) {
+		return model.Payment{}, ErrOrganisationNotAllowed
+	}
+	if _, found := m.items[obj.ID]; found {
+		return model.Payment{}, errMemoryDuplicateID
+	}
+	obj = pending(ctx, obj)
+	m.lastSeq++
+	m.items[obj.ID] = &memoryEntry{seq: m.lastSeq, payment: clonePayment(obj)}
+	m.record(ctx, model.OperationCreate, nil, obj)
+	return clonePayment(obj), nil
+}
+
+// Update replaces an existing payment, if obj has the stored version.
+// Returns the updated payment, with the version incremented. Deleted
+// payments cannot be updated, and the status is kept as it is
+func (m *MemoryPayments) Update(ctx context.Context, obj model.Payment) (model.Payment, error) {
+
+	if !OrganisationAllowed(ctx, obj.OrganisationID) {
+		return model.Payment{}, ErrOrganisationNotAllowed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, found := m.find(ctx, obj.ID)
+	if !found || entry.payment.Deleted != nil {
+		return model.Payment{}, mongo.ErrNoDocuments
+	}
+	if entry.payment.Version != obj.Version {
+		return model.Payment{}, ErrVersionConflict
+	}
+	before := entry.payment
+	entry.payment = clonePayment(updatedPayment(before, obj))
+	m.record(ctx, model.OperationUpdate, &before, entry.payment)
+	return clonePayment(entry.payment), nil
+}
+
+// Get finds a payment by ID
+func (m *MemoryPayments) Get(ctx context.Context, id model.PaymentID, opts GetOptions) (model.Payment, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entry, found := m.find(ctx, id)
+	if !found || (entry.payment.Deleted != nil && !opts.IncludeDeleted) {
+		return model.Payment{}, mongo.ErrNoDocuments
+	}
+	return clonePayment(entry.payment), nil
+}
+
+// Delete marks a payment as deleted by the actor of the context, returns
+// the number of deleted items
+func (m *MemoryPayments) Delete(ctx context.Context, id model.PaymentID) (int64, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, found := m.find(ctx, id)
+	if !found || entry.payment.Deleted != nil {
+		return 0, nil
+	}
+	before := entry.payment
+	entry.payment = clonePayment(before)
+	entry.payment.Deleted = &model.Deletion{At: now(), By: actorFrom(ctx)}
+	entry.payment.Version++
+	m.record(ctx, model.OperationDelete, &before, entry.payment)
+	return 1, nil
+}
+
+// Restore undoes the Delete of a payment. Returns the restored payment, or
+// ErrNotDeleted if it was not deleted
+func (m *MemoryPayments) Restore(ctx context.Context, id model.PaymentID) (model.Payment, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, found := m.find(ctx, id)
+	if !found {
+		return model.Payment{}, mongo.ErrNoDocuments
+	}
+	if entry.payment.Deleted == nil {
+		return model.Payment{}, ErrNotDeleted
+	}
+	before := entry.payment
+	entry.payment = clonePayment(before)
+	entry.payment.Deleted = nil
+	entry.payment.Version++
+	m.record(ctx, model.OperationRestore, &before, entry.payment)
+	return clonePayment(entry.payment), nil
+}
+
+// Transition does an action to a payment, if it is allowed from its current
+// status, otherwise it fails with ErrInvalidTransition
+func (m *MemoryPayments) Transition(ctx context.Context, id model.PaymentID, action model.Action,
+	reason string) (model.Payment, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, found := m.find(ctx, id)
+	if !found || entry.payment.Deleted != nil {
+		return model.Payment{}, mongo.ErrNoDocuments
+	}
+	if !action.AllowedFrom(entry.payment.Status) {
+		return model.Payment{}, ErrInvalidTransition
+	}
+	before := entry.payment
+	change := statusChange(ctx, before.Status, action, reason)
+	entry.payment = clonePayment(transitionedPayment(before, change))
+	m.record(ctx, model.Operation(action), &before, entry.payment)
+	return clonePayment(entry.payment), nil
+}
+
+// Export calls fn with each of the payments matching the options, in order.
+// They are read in pages, as List does
+func (m *MemoryPayments) Export(ctx context.Context, opts ExportOptions, fn func(*model.Payment) error) error {
+
+	listOpts := opts.listOptions()
+	listOpts.Limit = MaxListLimit
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		res, err := m.List(ctx, listOpts)
+		if err != nil {
+			return err
+		}
+		for _, item := range res.Items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+		if len(res.NextCursor) == 0 {
+			return nil
+		}
+		listOpts.Cursor = res.NextCursor
+	}
+}
+
+// Summary adds the payments matching the filter of the options, grouped by
+// the fields of the options, the same way Payments does
+func (m *MemoryPayments) Summary(ctx context.Context, opts SummaryOptions) ([]model.Summary, error) {
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	type total struct {
+		count int64
+		sum   decimalSum
+	}
+	payments := map[summaryKey]*total{}
+	sender := map[summaryKey]*total{}
+	receiver := map[summaryKey]*total{}
+
+	add := func(totals map[summaryKey]*total, key summaryKey, amount model.Decimal) {
+		t, found := totals[key]
+		if !found {
+			t = &total{}
+			totals[key] = t
+		}
+		t.count++
+		t.sum.add(amount)
+	}
+
+	m.mu.RLock()
+	for _, entry := range m.items {
+		p := &entry.payment
+		if p.Deleted != nil || !opts.Filter.matches(p) || !OrganisationAllowed(ctx, p.OrganisationID) {
+			continue
+		}
+
+		key := opts.groupKey(p)
+		add(payments, key, p.Attributes.Amount.Value)
+
+		for _, charge := range p.Attributes.ChargesInformation.SenderCharges {
+			chargeKey := key
+			chargeKey.ChargesCurrency = charge.Currency
+			add(sender, chargeKey, charge.Value)
+		}
+
+		if charges := p.Attributes.ChargesInformation.ReceiverCharges; !charges.Value.Empty() {
+			chargeKey := key
+			chargeKey.ChargesCurrency = charges.Currency
+			add(receiver, chargeKey, charges.Value)
+		}
+	}
+	m.mu.RUnlock()
+
+	var facets summaryFacets
+	for _, facet := range []struct {
+		totals map[summaryKey]*total
+		rows   *[]summaryRow
+	}{{payments, &facets.Payments}, {sender, &facets.Sender}, {receiver, &facets.Receiver}} {
+		for key, t := range facet.totals {
+			amount, err := t.sum.decimal()
+			if err != nil {
+				return nil, err
+			}
+			*facet.rows = append(*facet.rows, summaryRow{Key: key, Count: t.count, Amount: amount})
+		}
+	}
+	return summaries(facets), nil
+}
+
+// History gets the audit log of a payment, oldest first
+func (m *MemoryPayments) History(ctx context.Context, id model.PaymentID) ([]model.AuditEntry, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, found := m.find(ctx, id); !found {
+		return nil, mongo.ErrNoDocuments
+	}
+	entries, found := m.audit[id]
+	if !found {
+		return nil, mongo.ErrNoDocuments
+	}
+	res := make([]model.AuditEntry, 0, len(entries))
+	for _, entry := range entries {
+		res = append(res, cloneAuditEntry(entry))
+	}
+	return res, nil
+}
+
+// record appends an entry to the audit log. It has to be called with the lock
+// held. The stored payments are replaced on every change, never modified, so
+// before and after can be kept as they are
+func (m *MemoryPayments) record(ctx context.Context, operation model.Operation, before *model.Payment,
+	after model.Payment) {
+
+	entry := auditEntry(ctx, operation, before, &after)
+	m.audit[after.ID] = append(m.audit[after.ID], entry)
+
+	outboxEntry := newOutboxEntry(entry)
+	m.outbox.add(outboxEntry)
+	m.events.Publish(entry)
+	if m.webhooks != nil {
+		_ = m.webhooks.Enqueue(ctx, outboxEntry.Event) // it does not fail in memory
+	}
+	countChange(entry)
+}
+
+// Events returns a feed of the changes to the payments, after the event with
+// the ID after, or of the new ones if it is empty
+func (m *MemoryPayments) Events(ctx context.Context, after string) (EventStream, error) {
+	stream, err := m.events.Subscribe(after)
+	if err != nil {
+		return nil, err
+	}
+	return scopeEvents(ctx, stream), nil
+}
+
+// List gets a page of payments. The cursor is based on the sort field and the
+// insertion order, so the pages are stable even when new payments are inserted
+func (m *MemoryPayments) List(ctx context.Context, opts ListOptions) (ListResult, error) {
+
+	if err := opts.Filter.Validate(); err != nil {
+		return ListResult{}, err
+	}
+
+	sorting := opts.Sort.normalize()
+	if _, found := sortFields[sorting.Field]; !found {
+		return ListResult{}, ErrInvalidSort
+	}
+
+	// before tells if a goes before b in the list
+	before := func(aKey string, aSeq uint64, bKey string, bSeq uint64) bool {
+		if aKey != bKey {
+			return (aKey < bKey) != sorting.Descending
+		}
+		if aSeq != bSeq {
+			return (aSeq < bSeq) != sorting.Descending
+		}
+		return false
+	}
+
+	var afterKey string
+	var afterSeq uint64
+	if len(opts.Cursor) > 0 {
+		pos, err := decodeCursor(opts.Cursor, sorting)
+		if err != nil {
+			return ListResult{}, err
+		}
+		afterKey = pos.Key
+		afterSeq, err = strconv.ParseUint(pos.After, 10, 64)
+		if err != nil {
+			return ListResult{}, ErrInvalidCursor
+		}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entries := make([]*memoryEntry, 0, len(m.items))
+	for _, entry := range m.items {
+		if !opts.Filter.matches(&entry.payment) || !OrganisationAllowed(ctx, entry.payment.OrganisationID) {
+			continue
+		}
+		if entry.payment.Deleted != nil && !opts.IncludeDeleted {
+			continue
+		}
+		if len(opts.Cursor) > 0 && !before(afterKey, afterSeq, sorting.key(&entry.payment), entry.seq) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return before(sorting.key(&entries[i].payment), entries[i].seq, sorting.key(&entries[j].payment), entries[j].seq)
+	})
+
+	result := ListResult{Items: []*model.Payment{}}
+
+	limit := opts.limit()
+	if int64(len(entries)) > limit {
+		entries = entries[:limit]
+		last := entries[len(entries)-1]
+		result.NextCursor = encodeCursor(cursorPosition{
+			Sort:  sorting.String(),
+			Key:   sorting.key(&last.payment),
+			After: strconv.FormatUint(last.seq, 10),
+		})
+	}
+
+	for _, entry := range entries {
+		elem := clonePayment(entry.payment)
+		result.Items = append(result.Items, &elem)
+	}
+	return result, nil
+}
+
+// clonePayment makes a deep copy, so callers cannot change what is stored
+func clonePayment(obj model.Payment) model.Payment {
+
+	charges := obj.Attributes.ChargesInformation.SenderCharges
+	if charges != nil {
+		obj.Attributes.ChargesInformation.SenderCharges = append([]model.Money(nil), charges...)
+	}
+	if obj.StatusHistory != nil {
+		obj.StatusHistory = append([]model.StatusChange(nil), obj.StatusHistory...)
+	}
+	if obj.Deleted != nil {
+		deleted := *obj.Deleted
+		obj.Deleted = &deleted
+	}
+	return obj
+}
+
+// cloneAuditEntry makes a deep copy, so callers cannot change the audit log
+func cloneAuditEntry(entry model.AuditEntry) model.AuditEntry {
+
+	if entry.Before != nil {
+		before := clonePayment(*entry.Before)
+		entry.Before = &before
+	}
+	if entry.After != nil {
+		after := clonePayment(*entry.After)
+		entry.After = &after
+	}
+	return entry
+}
@@ -0,0 +1,86 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MemoryAPIKeys is an in-memory APIKeyStore. It is safe for concurrent use
+type MemoryAPIKeys struct {
+	mu   sync.Mutex
+	keys []model.APIKey
+}
+
+// NewMemoryAPIKeys creates an empty in-memory APIKeyStore
+func NewMemoryAPIKeys() *MemoryAPIKeys {
+	return &MemoryAPIKeys{}
+}
+
+// cloneAPIKey returns a copy of a key not sharing the organisations
+func cloneAPIKey(key model.APIKey) model.APIKey {
+
+	key.OrganisationIDs = append([]string(nil), key.OrganisationIDs...)
+	return key
+}
+
+// Save saves a new API key. If it is already there it will fail
+func (m *MemoryAPIKeys) Save(ctx context.Context, key model.APIKey) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, stored := range m.keys {
+		if stored.ID == key.ID || stored.Hash == key.Hash {
+			return errMemoryDuplicateID
+		}
+	}
+	m.keys = append(m.keys, cloneAPIKey(key))
+	return nil
+}
+
+// GetByHash gets the API key with a hash, even if it is revoked
+func (m *MemoryAPIKeys) GetByHash(ctx context.Context, hash string) (model.APIKey, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range m.keys {
+		if key.Hash == hash {
+			return cloneAPIKey(key), nil
+		}
+	}
+	return model.APIKey{}, mongo.ErrNoDocuments
+}
+
+// List gets all the API keys, oldest first
+func (m *MemoryAPIKeys) List(ctx context.Context) ([]model.APIKey, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := make([]model.APIKey, 0, len(m.keys))
+	for _, key := range m.keys {
+		res = append(res, cloneAPIKey(key))
+	}
+	return res, nil
+}
+
+// Revoke revokes an API key, so it cannot be used anymore
+func (m *MemoryAPIKeys) Revoke(ctx context.Context, id model.APIKeyID) (int64, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.keys {
+		if m.keys[i].ID == id && m.keys[i].RevokedAt == nil {
+			now := time.Now().UTC()
+			m.keys[i].RevokedAt = &now
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
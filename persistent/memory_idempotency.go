@@ -0,0 +1,81 @@
+package persistent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryIdempotencyKey identifies a record in MemoryIdempotency
+type memoryIdempotencyKey struct {
+	key            string
+	organisationID string
+}
+
+// MemoryIdempotency is an in-memory IdempotencyStore. It is safe for
+// concurrent use. Expired records are ignored and replaced when found
+type MemoryIdempotency struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	records map[memoryIdempotencyKey]IdempotencyRecord
+}
+
+// NewMemoryIdempotency creates an empty in-memory IdempotencyStore. Records
+// expire after ttl
+func NewMemoryIdempotency(ttl time.Duration) *MemoryIdempotency {
+	return &MemoryIdempotency{
+		ttl:     ttl,
+		records: make(map[memoryIdempotencyKey]IdempotencyRecord),
+	}
+}
+
+// Reserve stores a new not completed record for the key and organisation.
+// If there was already one (not expired) it is returned instead
+func (m *MemoryIdempotency) Reserve(ctx context.Context, key, organisationID, requestHash string) (*IdempotencyRecord, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := memoryIdempotencyKey{key: key, organisationID: organisationID}
+	if existing, found := m.records[id]; found && time.Since(existing.CreatedAt) < m.ttl {
+		existing.Body = append([]byte(nil), existing.Body...)
+		return &existing, nil
+	}
+
+	m.records[id] = IdempotencyRecord{
+		Key:            key,
+		OrganisationID: organisationID,
+		RequestHash:    requestHash,
+		CreatedAt:      time.Now().UTC(),
+	}
+	return nil, nil
+}
+
+// Complete stores the response of a reserved record
+func (m *MemoryIdempotency) Complete(ctx context.Context, record IdempotencyRecord) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := memoryIdempotencyKey{key: record.Key, organisationID: record.OrganisationID}
+	existing, found := m.records[id]
+	if !found {
+		return nil // like an update matching nothing in Mongo
+	}
+	existing.Completed = true
+	existing.StatusCode = record.StatusCode
+	existing.Headers = record.Headers
+	existing.Body = append([]byte(nil), record.Body...)
+	m.records[id] = existing
+	return nil
+}
+
+// Release deletes a reserved record, so the request can be retried
+func (m *MemoryIdempotency) Release(ctx context.Context, key, organisationID string) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.records, memoryIdempotencyKey{key: key, organisationID: organisationID})
+	return nil
+}
@@ -0,0 +1,107 @@
+package persistent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryOutbox is an in-memory OutboxStore. It is safe for concurrent use. The
+// relayed entries are not deleted
+type MemoryOutbox struct {
+	mu      sync.Mutex
+	entries []OutboxEntry
+}
+
+// NewMemoryOutbox creates an empty in-memory OutboxStore
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{}
+}
+
+// add adds an entry to the outbox
+func (m *MemoryOutbox) add(entry OutboxEntry) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries = append(m.entries, entry)
+}
+
+// find returns the position of an entry, -1 if it is not there
+func (m *MemoryOutbox) find(id string) int {
+
+	for i := range m.entries {
+		if m.entries[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Claim gets up to limit entries not relayed yet that can be claimed at now,
+// oldest first, and locks them for lease
+func (m *MemoryOutbox) Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]OutboxEntry, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := []OutboxEntry{}
+	for i := range m.entries {
+		if len(res) == limit {
+			break
+		}
+		entry := &m.entries[i]
+		if entry.RelayedAt != nil || entry.LockedUntil.After(now) {
+			continue
+		}
+		entry.LockedUntil = now.Add(lease)
+		res = append(res, *entry)
+	}
+	return res, nil
+}
+
+// MarkRelayed marks an entry as relayed at, it is not claimed anymore
+func (m *MemoryOutbox) MarkRelayed(ctx context.Context, id string, at time.Time) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.find(id); i >= 0 {
+		m.entries[i].RelayedAt = &at
+		m.entries[i].LastError = ""
+	}
+	return nil
+}
+
+// MarkFailed stores why relaying an entry failed, and locks it until retryAt
+func (m *MemoryOutbox) MarkFailed(ctx context.Context, id string, retryAt time.Time, reason string) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.find(id); i >= 0 {
+		m.entries[i].LockedUntil = retryAt
+		m.entries[i].LastError = reason
+		m.entries[i].Attempts++
+	}
+	return nil
+}
+
+// Backlog returns the entries not relayed yet
+func (m *MemoryOutbox) Backlog(ctx context.Context) (OutboxBacklog, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var res OutboxBacklog
+	for _, entry := range m.entries {
+		if entry.RelayedAt != nil {
+			continue
+		}
+		if res.Pending == 0 || entry.CreatedAt.Before(res.Oldest) {
+			res.Oldest = entry.CreatedAt
+		}
+		res.Pending++
+	}
+	return res, nil
+}
@@ -0,0 +1,207 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemorySaveGetDelete(t *testing.T) {
+
+	ctx := context.Background()
+	paymentsDB := NewMemoryPayments()
+
+	payment1 := testPayment(model.PaymentID("12345"))
+
+	_, err := paymentsDB.Get(ctx, payment1.ID, GetOptions{})
+	assert.True(t, IsErrorNoDBResults(err), "We didn't get anything")
+
+	saved, err := paymentsDB.Save(ctx, payment1)
+	assert.NoError(t, err, "We can save one item")
+	assert.Equal(t, model.StatusPending, saved.Status, "New payments are pending")
+
+	_, err = paymentsDB.Save(ctx, payment1)
+	assert.Error(t, err, "We cannot save twice")
+
+	dbItem, err := paymentsDB.Get(ctx, payment1.ID, GetOptions{})
+	assert.NoError(t, err, "We can get items")
+	assert.True(t, reflect.DeepEqual(saved, dbItem), "We loaded what we saved")
+
+	numberDeleted, err := paymentsDB.Delete(ctx, payment1.ID)
+	assert.NoError(t, err, "We can delete")
+	assert.Equal(t, int64(1), numberDeleted, "We deleted one item")
+
+	numberDeleted, err = paymentsDB.Delete(ctx, payment1.ID)
+	assert.NoError(t, err, "We can try to delete")
+	assert.Equal(t, int64(0), numberDeleted, "We deleted zero items")
+}
+
+func TestMemoryUpdate(t *testing.T) {
+
+	ctx := context.Background()
+	paymentsDB := NewMemoryPayments()
+
+	payment1 := testPayment(model.PaymentID("12345"))
+
+	_, err := paymentsDB.Update(ctx, payment1)
+	assert.True(t, IsErrorNoDBResults(err), "We cannot update what is not there")
+
+	_, err = paymentsDB.Save(ctx, payment1)
+	assert.NoError(t, err, "We can save one item")
+
+	payment1.OrganisationID = "newOrg"
+	updated, err := paymentsDB.Update(ctx, payment1)
+	assert.NoError(t, err, "We can update")
+	assert.Equal(t, payment1.Version+1, updated.Version, "The version got incremented")
+
+	dbItem, err := paymentsDB.Get(ctx, payment1.ID, GetOptions{})
+	assert.NoError(t, err, "We can get items")
+	assert.Equal(t, "newOrg", dbItem.OrganisationID, "We loaded what we updated")
+}
+
+func TestMemoryUpdateConflict(t *testing.T) {
+
+	testUpdateConflict(context.Background(), t, NewMemoryPayments())
+}
+
+func TestMemoryList100(t *testing.T) {
+
+	ctx := context.Background()
+	paymentsDB := NewMemoryPayments()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 150; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := paymentsDB.Save(ctx, testPayment(model.PaymentID(fmt.Sprint(i))))
+			assert.NoError(t, err, "We can save concurrently")
+		}(i)
+	}
+	wg.Wait()
+
+	_, err := paymentsDB.Save(ctx, testPayment(model.PaymentID("last")))
+	assert.NoError(t, err, "We can save one item")
+
+	list, err := paymentsDB.List(ctx, ListOptions{Limit: 100})
+	assert.NoError(t, err, "We can fetch the list")
+	assert.Equal(t, 100, len(list.Items), "We got at most 100")
+	assert.Equal(t, model.PaymentID("last"), list.Items[0].ID, "Newest first")
+}
+
+func TestMemoryListPages(t *testing.T) {
+
+	testListPages(context.Background(), t, NewMemoryPayments())
+}
+
+func TestMemoryListFilters(t *testing.T) {
+
+	testListFilters(context.Background(), t, NewMemoryPayments())
+}
+
+func TestMemoryIdempotency(t *testing.T) {
+
+	ctx := context.Background()
+	idempotencyDB := NewMemoryIdempotency(50 * time.Millisecond)
+
+	existing, err := idempotencyDB.Reserve(ctx, "key", "org", "hash")
+	assert.NoError(t, err, "We can reserve a key")
+	assert.Nil(t, existing, "It was not there")
+
+	existing, err = idempotencyDB.Reserve(ctx, "key", "org", "hash")
+	assert.NoError(t, err, "We can try to reserve it again")
+	assert.False(t, existing.Completed, "It is still in progress")
+
+	err = idempotencyDB.Complete(ctx, IdempotencyRecord{Key: "key", OrganisationID: "org", StatusCode: 201})
+	assert.NoError(t, err, "We can complete it")
+
+	existing, err = idempotencyDB.Reserve(ctx, "key", "org", "hash")
+	assert.NoError(t, err, "We can try to reserve it again")
+	assert.True(t, existing.Completed, "It is completed")
+	assert.Equal(t, 201, existing.StatusCode, "We got the stored response")
+	assert.Equal(t, "hash", existing.RequestHash, "The hash is kept")
+
+	time.Sleep(60 * time.Millisecond)
+
+	existing, err = idempotencyDB.Reserve(ctx, "key", "org", "otherHash")
+	assert.NoError(t, err, "We can reserve an expired key")
+	assert.Nil(t, existing, "It was expired")
+
+	err = idempotencyDB.Release(ctx, "key", "org")
+	assert.NoError(t, err, "We can release it")
+
+	existing, err = idempotencyDB.Reserve(ctx, "key", "org", "hash")
+	assert.NoError(t, err, "We can reserve a released key")
+	assert.Nil(t, existing, "It was released")
+}
+
+func TestMemorySoftDelete(t *testing.T) {
+
+	testSoftDelete(context.Background(), t, NewMemoryPayments())
+}
+
+func TestMemoryTransitions(t *testing.T) {
+
+	testTransitions(context.Background(), t, NewMemoryPayments())
+}
+
+func TestMemoryHistory(t *testing.T) {
+
+	testHistory(context.Background(), t, NewMemoryPayments())
+}
+
+func TestMemorySummary(t *testing.T) {
+
+	testSummary(context.Background(), t, NewMemoryPayments())
+}
+
+func TestMemorySaveMany(t *testing.T) {
+
+	testSaveMany(context.Background(), t, NewMemoryPayments())
+}
+
+func TestMemoryExport(t *testing.T) {
+
+	testExport(context.Background(), t, NewMemoryPayments())
+}
+
+func TestMemoryEvents(t *testing.T) {
+
+	testEvents(context.Background(), t, NewMemoryPayments())
+}
+
+func TestMemoryWebhooks(t *testing.T) {
+
+	testWebhooks(context.Background(), t, NewMemoryStores(time.Hour))
+}
+
+func TestMemoryOutbox(t *testing.T) {
+
+	testOutbox(context.Background(), t, NewMemoryStores(time.Hour))
+}
+
+func TestMemoryOrganisationScoping(t *testing.T) {
+
+	testOrganisationScoping(context.Background(), t, NewMemoryPayments())
+}
+
+func TestMemoryAPIKeys(t *testing.T) {
+
+	testAPIKeys(context.Background(), t, NewMemoryAPIKeys())
+}
+
+func TestMemoryTracing(t *testing.T) {
+
+	testTracing(context.Background(), t, NewMemoryStores(time.Hour), "")
+}
+
+func TestMemoryMetrics(t *testing.T) {
+
+	testMetrics(context.Background(), t, NewMemoryStores(time.Hour))
+}
@@ -0,0 +1,228 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MemoryWebhooks is an in-memory WebhookStore. It is safe for concurrent use
+type MemoryWebhooks struct {
+	mu         sync.Mutex
+	webhooks   []model.Webhook
+	deliveries []model.Delivery
+}
+
+// NewMemoryWebhooks creates an empty in-memory WebhookStore
+func NewMemoryWebhooks() *MemoryWebhooks {
+	return &MemoryWebhooks{}
+}
+
+// find returns the position of a webhook, -1 if it is not there
+func (m *MemoryWebhooks) find(id model.WebhookID) int {
+
+	for i := range m.webhooks {
+		if m.webhooks[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// findDelivery returns the position of a delivery of a webhook, -1 if it is
+// not there
+func (m *MemoryWebhooks) findDelivery(id model.WebhookID, deliveryID model.DeliveryID) int {
+
+	for i := range m.deliveries {
+		if m.deliveries[i].ID == deliveryID && m.deliveries[i].WebhookID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// cloneWebhook returns a copy of a webhook not sharing the event types
+func cloneWebhook(webhook model.Webhook) model.Webhook {
+
+	webhook.EventTypes = append([]model.EventType(nil), webhook.EventTypes...)
+	return webhook
+}
+
+// Save saves a new webhook. If it is already there it will fail
+func (m *MemoryWebhooks) Save(ctx context.Context, webhook model.Webhook) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.find(webhook.ID) >= 0 {
+		return errMemoryDuplicateID
+	}
+	m.webhooks = append(m.webhooks, cloneWebhook(webhook))
+	return nil
+}
+
+// Get gets a webhook, with its secret
+func (m *MemoryWebhooks) Get(ctx context.Context, id model.WebhookID) (model.Webhook, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.find(id)
+	if i < 0 {
+		return model.Webhook{}, mongo.ErrNoDocuments
+	}
+	return cloneWebhook(m.webhooks[i]), nil
+}
+
+// List gets the webhooks of an organisation, or all if it is empty, oldest first
+func (m *MemoryWebhooks) List(ctx context.Context, organisationID string) ([]model.Webhook, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.list(organisationID), nil
+}
+
+// list is List, but the lock has to be held
+func (m *MemoryWebhooks) list(organisationID string) []model.Webhook {
+
+	res := []model.Webhook{}
+	for _, webhook := range m.webhooks {
+		if len(organisationID) == 0 || webhook.OrganisationID == organisationID {
+			res = append(res, cloneWebhook(webhook))
+		}
+	}
+	return res
+}
+
+// Update changes the URL and the event types of a webhook
+func (m *MemoryWebhooks) Update(ctx context.Context, webhook model.Webhook) (model.Webhook, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.find(webhook.ID)
+	if i < 0 {
+		return model.Webhook{}, mongo.ErrNoDocuments
+	}
+	m.webhooks[i].URL = webhook.URL
+	m.webhooks[i].EventTypes = append([]model.EventType(nil), webhook.EventTypes...)
+	return cloneWebhook(m.webhooks[i]), nil
+}
+
+// Delete deletes a webhook. Its pending deliveries are not sent
+func (m *MemoryWebhooks) Delete(ctx context.Context, id model.WebhookID) (int64, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.find(id)
+	if i < 0 {
+		return 0, nil
+	}
+	m.webhooks = append(m.webhooks[:i], m.webhooks[i+1:]...)
+	return 1, nil
+}
+
+// Enqueue creates the deliveries of the event of a change, to the webhooks of
+// the organisation of the payment wanting it
+func (m *MemoryWebhooks) Enqueue(ctx context.Context, event model.Event) error {
+
+	if event.Payment == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deliveries = append(m.deliveries, deliveries(event, m.list(event.Payment.OrganisationID))...)
+	return nil
+}
+
+// ClaimDeliveries gets up to limit pending deliveries due at now, oldest
+// first, and delays them by lease
+func (m *MemoryWebhooks) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration,
+	limit int) ([]model.Delivery, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var due []int
+	for i, delivery := range m.deliveries {
+		if delivery.Status == model.DeliveryPending && !delivery.NextAttempt.After(now) {
+			due = append(due, i)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return m.deliveries[due[i]].NextAttempt.Before(m.deliveries[due[j]].NextAttempt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	res := make([]model.Delivery, 0, len(due))
+	for _, i := range due {
+		m.deliveries[i].NextAttempt = now.Add(lease)
+		res = append(res, m.deliveries[i])
+	}
+	return res, nil
+}
+
+// UpdateDelivery stores how sending a delivery went
+func (m *MemoryWebhooks) UpdateDelivery(ctx context.Context, delivery model.Delivery) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findDelivery(delivery.WebhookID, delivery.ID)
+	if i < 0 {
+		return nil // as Mongo, nothing is updated
+	}
+	m.deliveries[i].Status = delivery.Status
+	m.deliveries[i].Attempts = delivery.Attempts
+	m.deliveries[i].NextAttempt = delivery.NextAttempt
+	m.deliveries[i].LastError = delivery.LastError
+	m.deliveries[i].DeliveredAt = delivery.DeliveredAt
+	return nil
+}
+
+// ListDeliveries gets the last deliveries of a webhook, newest first. Only
+// the ones with the status given, unless it is empty
+func (m *MemoryWebhooks) ListDeliveries(ctx context.Context, id model.WebhookID,
+	status model.DeliveryStatus) ([]model.Delivery, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := []model.Delivery{}
+	for i := len(m.deliveries) - 1; i >= 0 && len(res) < maxDeliveries; i-- {
+		delivery := m.deliveries[i]
+		if delivery.WebhookID == id && (len(status) == 0 || delivery.Status == status) {
+			res = append(res, delivery)
+		}
+	}
+	return res, nil
+}
+
+// RetryDelivery makes a dead delivery pending again, due now, with all the
+// attempts again. It fails with ErrNotDead if it is not dead
+func (m *MemoryWebhooks) RetryDelivery(ctx context.Context, id model.WebhookID,
+	deliveryID model.DeliveryID) (model.Delivery, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findDelivery(id, deliveryID)
+	if i < 0 {
+		return model.Delivery{}, mongo.ErrNoDocuments
+	}
+	if m.deliveries[i].Status != model.DeliveryDead {
+		return model.Delivery{}, ErrNotDead
+	}
+	m.deliveries[i] = retried(m.deliveries[i])
+	return m.deliveries[i], nil
+}
@@ -0,0 +1,168 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// The metrics of the stores, in the default Prometheus registry
+var (
+	operationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "apipay_db_operation_duration_seconds",
+		Help:    "How long the calls to the store of the payments take, by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+
+	operationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apipay_db_operation_errors_total",
+		Help: "Calls to the store of the payments that failed, by method. Not finding a payment is not an error.",
+	}, []string{"method"})
+
+	paymentChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "apipay_payment_changes_total",
+		Help: "Changes done to the payments, by operation (create, update, delete...), scheme and currency.",
+	}, []string{"operation", "scheme", "currency"})
+
+	commandsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "apipay_mongo_commands_in_flight",
+		Help: "Commands sent to Mongo waiting for an answer, each one using a connection of the pool.",
+	})
+)
+
+// collectTimeout is how long getting the metrics from Mongo can take
+const collectTimeout = 2 * time.Second
+
+// observeOperation records the duration of a call to the store of the payments
+// and if it failed
+func observeOperation(method string, started time.Time, err error) {
+
+	operationDuration.WithLabelValues(method).Observe(time.Since(started).Seconds())
+	if err != nil && !IsErrorNoDBResults(err) {
+		operationErrors.WithLabelValues(method).Inc()
+	}
+}
+
+// countChange counts a change done to a payment
+func countChange(entry model.AuditEntry) {
+
+	payment := entry.After
+	if payment == nil {
+		payment = entry.Before
+	}
+	var scheme, currency string
+	if payment != nil {
+		scheme, currency = payment.Attributes.PaymentScheme, payment.Attributes.Amount.Currency
+	}
+	paymentChanges.WithLabelValues(string(entry.Operation), scheme, currency).Inc()
+}
+
+// commandMonitor counts the commands sent to Mongo that are not answered yet
+func commandMonitor() *event.CommandMonitor {
+
+	return &event.CommandMonitor{
+		Started: func(context.Context, *event.CommandStartedEvent) {
+			commandsInFlight.Inc()
+		},
+		Succeeded: func(context.Context, *event.CommandSucceededEvent) {
+			commandsInFlight.Dec()
+		},
+		Failed: func(context.Context, *event.CommandFailedEvent) {
+			commandsInFlight.Dec()
+		},
+	}
+}
+
+// serverConnectionsCollector collects the connections the Mongo server has
+// open, asking it when the metrics are collected
+type serverConnectionsCollector struct {
+	client Client
+	desc   *prometheus.Desc
+}
+
+// NewServerConnectionsCollector returns a Prometheus collector of the
+// connections the Mongo server has open, of all its clients and not only of
+// this one: current, available and active. They are got with serverStatus,
+// which needs the clusterMonitor role, otherwise they are not collected
+func NewServerConnectionsCollector(cl Client) prometheus.Collector {
+
+	return &serverConnectionsCollector{
+		client: cl,
+		desc: prometheus.NewDesc("apipay_mongo_server_connections",
+			"Connections of the whole Mongo server, of all its clients, by state, as reported by serverStatus.", []string{"state"}, nil),
+	}
+}
+
+func (c *serverConnectionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *serverConnectionsCollector) Collect(ch chan<- prometheus.Metric) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+
+	var status struct {
+		Connections map[string]float64 `bson:"connections"`
+	}
+	err := c.client.db.RunCommand(ctx, bson.D{{Key: "serverStatus", Value: 1}}).Decode(&status)
+	if err != nil {
+		// eg. without the clusterMonitor role, the rest of the metrics are still
+		// collected
+		return
+	}
+	for _, state := range []string{"current", "available", "active"} {
+		if value, found := status.Connections[state]; found {
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, value, state)
+		}
+	}
+}
+
+// outboxCollector collects the backlog of the outbox, asking the store when
+// the metrics are collected
+type outboxCollector struct {
+	store   OutboxStore
+	pending *prometheus.Desc
+	age     *prometheus.Desc
+}
+
+// NewOutboxCollector returns a Prometheus collector of the entries of the
+// outbox of store not relayed yet: how many and how old the oldest one is
+func NewOutboxCollector(store OutboxStore) prometheus.Collector {
+
+	return &outboxCollector{
+		store: store,
+		pending: prometheus.NewDesc("apipay_outbox_pending",
+			"Entries of the outbox not relayed yet.", nil, nil),
+		age: prometheus.NewDesc("apipay_outbox_oldest_pending_age_seconds",
+			"How long ago the oldest entry of the outbox not relayed yet was created, 0 if there are none.", nil, nil),
+	}
+}
+
+func (c *outboxCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.pending
+	ch <- c.age
+}
+
+func (c *outboxCollector) Collect(ch chan<- prometheus.Metric) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+
+	backlog, err := c.store.Backlog(ctx)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.pending, err)
+		return
+	}
+	var age float64
+	if backlog.Pending > 0 {
+		age = time.Since(backlog.Oldest).Seconds()
+	}
+	ch <- prometheus.MustNewConstMetric(c.pending, prometheus.GaugeValue, float64(backlog.Pending))
+	ch <- prometheus.MustNewConstMetric(c.age, prometheus.GaugeValue, age)
+}
@@ -0,0 +1,63 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// migrationTimeout is how long migrating the stored payments can take
+const migrationTimeout = 5 * time.Minute
+
+// amountFields are the fields of the payments with amounts
+var amountFields = []string{
+	fieldAmount,
+	fieldSenderCharges + ".amount",
+	fieldReceiverChargesAmount,
+	fieldOriginalAmount,
+}
+
+// migrateAmounts stores as Decimal128 the amounts of the payments stored
+// before they were decimals, as strings. Otherwise Mongo would skip them
+// when filtering by amount and adding them. It returns how many payments
+// were migrated. The audit keeps the strings, as it is never filtered
+func (p *Payments) migrateAmounts(ctx context.Context) (int, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, migrationTimeout)
+	defer cancel()
+
+	conds := bson.A{}
+	for _, field := range amountFields {
+		conds = append(conds, bson.D{{Key: field, Value: bson.D{{Key: "$type", Value: "string"}}}})
+	}
+	cursor, err := p.collection.Find(ctx, bson.D{{Key: "$or", Value: conds}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	migrated := 0
+	for cursor.Next(ctx) {
+		var doc struct {
+			MongoID    primitive.ObjectID `bson:"_id"`
+			Version    uint               `bson:"version"`
+			Attributes model.Attributes   `bson:"attributes"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return migrated, err
+		}
+		// the attributes are written back as they are read, with decimals. If
+		// the payment was changed meanwhile it has them already
+		res, err := p.collection.UpdateOne(ctx,
+			bson.D{{Key: fieldMongoID, Value: doc.MongoID}, {Key: fieldVersion, Value: doc.Version}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: fieldAttributes, Value: doc.Attributes}}}})
+		if err != nil {
+			return migrated, err
+		}
+		migrated += int(res.ModifiedCount)
+	}
+	return migrated, cursor.Err()
+}
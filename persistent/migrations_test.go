@@ -0,0 +1,61 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMigrateAmounts(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "migrationsDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	// a payment stored before the amounts were decimals
+	_, err = client.db.Collection(defaultPaymentsCollection).InsertOne(ctx, bson.D{
+		{Key: "type", Value: "Payment"},
+		{Key: "id", Value: "legacy"},
+		{Key: "version", Value: 0},
+		{Key: "organisationid", Value: "testOrg"},
+		{Key: "attributes", Value: bson.D{
+			{Key: "amount", Value: "100.21"},
+			{Key: "currency", Value: "GBP"},
+			{Key: "chargesinformation", Value: bson.D{
+				{Key: "sendercharges", Value: bson.A{bson.D{{Key: "amount", Value: "5.00"}, {Key: "currency", Value: "GBP"}}}},
+				{Key: "receiverchargesamount", Value: "1.00"},
+				{Key: "receiverchargescurrency", Value: "GBP"},
+			}},
+		}},
+	})
+	assert.NoError(t, err, "We can insert a payment with string amounts")
+
+	stores, err := GetStores(ctx, client, time.Hour)
+	assert.NoError(t, err, "We can init DB, migrating the amounts")
+
+	payments, err := GetPayments(ctx, client)
+	assert.NoError(t, err, "We can get the payments")
+	migrated, err := payments.migrateAmounts(ctx)
+	assert.NoError(t, err, "We can migrate again")
+	assert.Equal(t, 0, migrated, "There is nothing else to migrate")
+
+	res, err := stores.Payments.List(ctx, ListOptions{Filter: PaymentFilter{AmountMin: "100", AmountMax: "100.21"}})
+	assert.NoError(t, err, "We can filter by amount")
+	if assert.Len(t, res.Items, 1, "Mongo compares the migrated amount") {
+		assert.Equal(t, testMoney("100.21", "GBP"), res.Items[0].Attributes.Amount, "It is the same amount")
+	}
+
+	summary, err := stores.Payments.Summary(ctx, SummaryOptions{})
+	assert.NoError(t, err, "We can summarise")
+	if assert.Len(t, summary, 1, "There is one currency") {
+		assert.Equal(t, model.MustParseDecimal("100.21"), summary[0].Amount, "Mongo adds the migrated amount")
+		assert.Equal(t, []model.Money{testMoney("5.00", "GBP")}, summary[0].SenderCharges, "And the charges")
+		assert.Equal(t, []model.Money{testMoney("1.00", "GBP")}, summary[0].ReceiverCharges, "All of them")
+	}
+}
@@ -0,0 +1,208 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultOutboxCollection = "outbox"
+
+	// outboxRetention is how long the relayed entries are kept
+	outboxRetention = 7 * 24 * time.Hour
+
+	// transientTransactionError is the label of the errors of transactions
+	// that can be tried again, eg. because of a conflict with another one
+	transientTransactionError = "TransientTransactionError"
+	maxTransactionAttempts    = 3
+)
+
+// Names of the fields of the outbox as they are stored in Mongo
+const (
+	fieldCreatedAt   = "createdat"
+	fieldLockedUntil = "lockeduntil"
+	fieldRelayedAt   = "relayedat"
+)
+
+// OutboxEntry is a change to a payment to be relayed. It is written with the
+// change, in the same transaction, so no change is lost nor relayed when it
+// was not done
+type OutboxEntry struct {
+	// ID is the ID of the event too, so the sinks can ignore the repeated ones
+	ID    string
+	Event model.Event
+
+	CreatedAt time.Time
+
+	// LockedUntil is when it can be claimed, again if it was already
+	LockedUntil time.Time
+
+	// Attempts is how many times relaying it failed
+	Attempts  int
+	LastError string
+
+	// RelayedAt is set when it was relayed to all the sinks
+	RelayedAt *time.Time
+}
+
+// newOutboxEntry returns the entry of the outbox of a change recorded in the
+// audit log
+func newOutboxEntry(entry model.AuditEntry) OutboxEntry {
+
+	id := model.NewEventID()
+	now := time.Now().UTC()
+
+	return OutboxEntry{
+		ID:          id,
+		Event:       model.NewEvent(id, entry),
+		CreatedAt:   now,
+		LockedUntil: now,
+	}
+}
+
+// OutboxStore gets the entries of the outbox to relay them
+type OutboxStore interface {
+	// Claim gets up to limit entries not relayed yet that can be claimed at
+	// now, oldest first, and locks them for lease, so they are not claimed
+	// again while they are relayed
+	Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]OutboxEntry, error)
+
+	// MarkRelayed marks an entry as relayed at, it is not claimed anymore
+	MarkRelayed(ctx context.Context, id string, at time.Time) error
+
+	// MarkFailed stores why relaying an entry failed, and locks it until retryAt
+	MarkFailed(ctx context.Context, id string, retryAt time.Time, reason string) error
+
+	// Backlog returns the entries not relayed yet
+	Backlog(ctx context.Context) (OutboxBacklog, error)
+}
+
+// OutboxBacklog is what is not relayed yet of the outbox
+type OutboxBacklog struct {
+	// Pending is how many entries are not relayed
+	Pending int
+
+	// Oldest is when the oldest of them was created, zero if there are none
+	Oldest time.Time
+}
+
+// outboxIndices are the indices of the outbox collection. The relayed entries
+// are deleted by Mongo after outboxRetention
+func outboxIndices() []mongo.IndexModel {
+
+	return []mongo.IndexModel{
+		{
+			Options: options.Index().SetBackground(true).SetUnique(true),
+			Keys:    bson.D{{Key: fieldID, Value: 1}},
+		},
+		{
+			Options: options.Index().SetBackground(true),
+			Keys:    bson.D{{Key: fieldRelayedAt, Value: 1}, {Key: fieldLockedUntil, Value: 1}},
+		},
+		{
+			Options: options.Index().SetBackground(true).SetExpireAfterSeconds(int32(outboxRetention.Seconds())),
+			Keys:    bson.D{{Key: fieldRelayedAt, Value: 1}},
+		},
+	}
+}
+
+// GetOutbox is to get the Outbox object (to interact with DB) with a given DB
+// connection. The entries are written by Payments
+func GetOutbox(cl Client) *Outbox {
+
+	return &Outbox{collection: cl.db.Collection(defaultOutboxCollection)}
+}
+
+// Outbox is the Mongo OutboxStore
+type Outbox struct {
+	collection *mongo.Collection
+}
+
+// Claim gets up to limit entries not relayed yet that can be claimed at now,
+// oldest first, and locks them for lease. They are claimed one by one, so two
+// instances never get the same one
+func (o *Outbox) Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]OutboxEntry, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	filter := bson.D{
+		{Key: fieldRelayedAt, Value: nil},
+		{Key: fieldLockedUntil, Value: bson.D{{Key: "$lte", Value: now}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: fieldLockedUntil, Value: now.Add(lease)}}}}
+	findOptions := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: fieldLockedUntil, Value: 1}}).
+		SetReturnDocument(options.After)
+
+	res := []OutboxEntry{}
+	for len(res) < limit {
+		var entry OutboxEntry
+		err := o.collection.FindOneAndUpdate(ctx, filter, update, findOptions).Decode(&entry)
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		if err != nil {
+			return res, err
+		}
+		res = append(res, entry)
+	}
+	return res, nil
+}
+
+// MarkRelayed marks an entry as relayed at, it is not claimed anymore
+func (o *Outbox) MarkRelayed(ctx context.Context, id string, at time.Time) error {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: fieldRelayedAt, Value: at},
+		{Key: fieldLastError, Value: ""},
+	}}}
+	_, err := o.collection.UpdateOne(ctx, bson.D{{Key: fieldID, Value: id}}, update)
+	return err
+}
+
+// MarkFailed stores why relaying an entry failed, and locks it until retryAt
+func (o *Outbox) MarkFailed(ctx context.Context, id string, retryAt time.Time, reason string) error {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: fieldLockedUntil, Value: retryAt},
+			{Key: fieldLastError, Value: reason},
+		}},
+		{Key: "$inc", Value: bson.D{{Key: fieldAttempts, Value: 1}}},
+	}
+	_, err := o.collection.UpdateOne(ctx, bson.D{{Key: fieldID, Value: id}}, update)
+	return err
+}
+
+// Backlog returns the entries not relayed yet
+func (o *Outbox) Backlog(ctx context.Context) (OutboxBacklog, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	filter := bson.D{{Key: fieldRelayedAt, Value: nil}}
+	pending, err := o.collection.CountDocuments(ctx, filter)
+	if err != nil || pending == 0 {
+		return OutboxBacklog{}, err
+	}
+
+	var oldest OutboxEntry
+	err = o.collection.FindOne(ctx, filter, options.FindOne().SetSort(bson.D{{Key: fieldCreatedAt, Value: 1}})).Decode(&oldest)
+	if err == mongo.ErrNoDocuments {
+		// it was relayed in the meantime
+		return OutboxBacklog{}, nil
+	}
+	return OutboxBacklog{Pending: int(pending), Oldest: oldest.CreatedAt}, err
+}
@@ -0,0 +1,113 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestOutbox(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "outboxDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	stores, err := GetStores(ctx, client, time.Hour)
+	assert.NoError(t, err, "We can init DB")
+
+	testOutbox(ctx, t, stores)
+}
+
+// testOutbox checks the changes to the payments are written to the outbox,
+// and they can be claimed until they are relayed, in any Stores
+func testOutbox(ctx context.Context, t *testing.T, stores Stores) {
+
+	_, err := stores.Payments.Save(ctx, testPayment(model.PaymentID("1")))
+	assert.NoError(t, err, "We can save a payment")
+	_, err = stores.Payments.Delete(ctx, model.PaymentID("1"))
+	assert.NoError(t, err, "We can delete a payment")
+
+	// the entries are created now, so they can be claimed in a second
+	now := time.Now().UTC().Add(time.Second)
+	claimed, err := stores.Outbox.Claim(ctx, now, time.Minute, 10)
+	assert.NoError(t, err, "We can claim the outbox")
+	assert.Equal(t, 2, len(claimed), "Both changes are there")
+	if len(claimed) != 2 {
+		return
+	}
+	assert.Equal(t, model.EventCreated, claimed[0].Event.Type, "Oldest first")
+	assert.Equal(t, model.EventDeleted, claimed[1].Event.Type, "Then the deletion")
+	assert.Equal(t, claimed[0].ID, claimed[0].Event.ID, "The event has the ID of the entry")
+
+	again, err := stores.Outbox.Claim(ctx, now, time.Minute, 10)
+	assert.NoError(t, err, "We can claim the outbox again")
+	assert.Equal(t, 0, len(again), "They were already claimed")
+
+	err = stores.Outbox.MarkRelayed(ctx, claimed[0].ID, now)
+	assert.NoError(t, err, "We can mark an entry relayed")
+	err = stores.Outbox.MarkFailed(ctx, claimed[1].ID, now.Add(time.Minute), "it failed")
+	assert.NoError(t, err, "We can mark an entry failed")
+
+	later := now.Add(2 * time.Minute)
+	claimed, err = stores.Outbox.Claim(ctx, later, time.Minute, 10)
+	assert.NoError(t, err, "We can claim the outbox later")
+	assert.Equal(t, 1, len(claimed), "Only the failed one is claimed again")
+	if len(claimed) == 1 {
+		assert.Equal(t, model.EventDeleted, claimed[0].Event.Type, "It is the failed one")
+		assert.Equal(t, 1, claimed[0].Attempts, "It failed once")
+		assert.Equal(t, "it failed", claimed[0].LastError, "With why")
+	}
+}
+
+// TestOutboxTransaction checks the changes and their outbox entries are
+// written in a transaction, when Mongo is a replica set
+func TestOutboxTransaction(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "outboxTransactionDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	payments, err := GetPayments(ctx, client)
+	assert.NoError(t, err, "We can init DB")
+	if !payments.replicated {
+		if len(os.Getenv("APIPAY_TESTREPLICASET")) > 0 {
+			t.Fatal("Mongo is not a replica set")
+		}
+		t.Skip("Mongo is not a replica set, there are no transactions")
+	}
+
+	failed := errors.New("failed")
+	err = payments.inTransaction(ctx, func(ctx context.Context) error {
+		payment := testPayment(model.PaymentID("1"))
+		if _, err := payments.collection.InsertOne(ctx, payment); err != nil {
+			return err
+		}
+		if err := payments.record(ctx, auditEntry(ctx, model.OperationCreate, nil, &payment)); err != nil {
+			return err
+		}
+		return failed
+	})
+	assert.Equal(t, failed, err, "The transaction fails")
+
+	_, err = payments.Get(ctx, model.PaymentID("1"), GetOptions{})
+	assert.True(t, IsErrorNoDBResults(err), "The payment is not saved")
+	count, err := payments.outbox.CountDocuments(ctx, bson.D{})
+	assert.NoError(t, err, "We can count the outbox")
+	assert.Equal(t, int64(0), count, "Nor its outbox entry")
+
+	_, err = payments.Save(ctx, testPayment(model.PaymentID("1")))
+	assert.NoError(t, err, "We can save it")
+	count, err = payments.outbox.CountDocuments(ctx, bson.D{})
+	assert.NoError(t, err, "We can count the outbox")
+	assert.Equal(t, int64(1), count, "The outbox entry is committed with it")
+}
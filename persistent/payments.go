@@ -3,10 +3,9 @@ package persistent
 import (
 	"apipay/model"
 	"context"
-	"fmt"
-	"log"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
@@ -15,28 +14,67 @@ import (
 
 const (
 	defaultPaymentsCollection = "payments"
+	defaultAuditCollection    = "audit"
 
 	defaultDBTimeout = time.Second * 3
 )
 
 // GetPayments is to get the Payments object (to interact with DB) with a
 // given DB connection
-func GetPayments(ctx context.Context, cl Client) (Payments, error) {
+func GetPayments(ctx context.Context, cl Client) (*Payments, error) {
 
-	obj := Payments{
+	obj := &Payments{
+		client:     cl.mongoClient,
 		collection: cl.db.Collection(defaultPaymentsCollection),
+		audit:      cl.db.Collection(defaultAuditCollection),
+		outbox:     cl.db.Collection(defaultOutboxCollection),
 	}
 
 	err := obj.init(ctx)
+	if err != nil {
+		return obj, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	obj.replicated, err = isReplicated(ctx, cl.db)
+	if !obj.replicated {
+		obj.events = NewBroadcaster(defaultEventsBuffer)
+	}
 	return obj, err
 }
 
+// paymentDocument is a payment as it is stored in Mongo, with its _id
+type paymentDocument struct {
+	MongoID       primitive.ObjectID `bson:"_id"`
+	model.Payment `bson:",inline"`
+}
+
 // Payments is the way to persist payments to DB
 // it abstracts all the interactions to the DB. New methods should be added here
-// depending on the needs
+// (and to PaymentStore) depending on the needs
 // also here is where the needed checks should be added
 type Payments struct {
+	client     *mongo.Client
 	collection *mongo.Collection
+
+	// audit is the append only log of all the changes
+	audit *mongo.Collection
+
+	// outbox has the changes to be relayed, see Outbox
+	outbox *mongo.Collection
+
+	// replicated is true when Mongo is a replica set (or a sharded cluster),
+	// then the changes are done in transactions and there are change streams
+	replicated bool
+
+	// events sends the changes to the feeds when Mongo has no change streams,
+	// nil if it has them. Then only the changes done by this process are sent
+	events *Broadcaster
+
+	// webhooks gets the deliveries of the changes, if set
+	webhooks WebhookStore
 }
 
 // init the collection, setting up indices…
@@ -49,58 +87,314 @@ func (p *Payments) init(ctx context.Context) error {
 	indexOps.SetBackground(true)
 	indexOps.SetUnique(true)
 
-	index := mongo.IndexModel{
+	indices := []mongo.IndexModel{{
 		Options: indexOps,
-		Keys:    bson.D{{Key: "id", Value: 1}},
+		Keys:    bson.D{{Key: fieldID, Value: 1}},
+	}}
+
+	// the ones used by the filters and sorts of List. They all end with _id, so
+	// they can be used also to paginate
+	for _, field := range []string{fieldOrganisationID, fieldCurrency, fieldPaymentScheme,
+		fieldPaymentType, fieldProcessingDate, fieldAmount} {
+
+		indices = append(indices, mongo.IndexModel{
+			Options: options.Index().SetBackground(true),
+			Keys:    bson.D{{Key: field, Value: 1}, {Key: fieldMongoID, Value: 1}},
+		})
 	}
+	indices = append(indices, mongo.IndexModel{
+		Options: options.Index().SetBackground(true),
+		Keys: bson.D{{Key: fieldOrganisationID, Value: 1}, {Key: fieldProcessingDate, Value: 1},
+			{Key: fieldMongoID, Value: 1}},
+	})
 
-	//TODO depending on the usage more indices should be created
-	_, err := p.collection.Indexes().CreateOne(ctx, index)
+	_, err := p.collection.Indexes().CreateMany(ctx, indices)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	_, err = p.audit.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Options: options.Index().SetBackground(true),
+		Keys:    bson.D{{Key: fieldAuditPaymentID, Value: 1}, {Key: fieldMongoID, Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// the collections have to be there before writing to them in transactions,
+	// creating the indices creates them
+	_, err = p.outbox.Indexes().CreateMany(ctx, outboxIndices())
+	return err
+}
+
+// inTransaction calls fn with a context in which all its writes are done in a
+// transaction, if Mongo has them. Otherwise they are done one by one. It is
+// tried again when the transaction fails because of another one
+func (p *Payments) inTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+
+	if !p.replicated {
+		return fn(ctx)
+	}
+
+	return p.client.UseSession(ctx, func(sc mongo.SessionContext) error {
+		for attempt := 1; ; attempt++ {
+			if err := sc.StartTransaction(); err != nil {
+				return err
+			}
+			// the changes are counted once they are committed
+			changes := []model.AuditEntry{}
+			err := fn(context.WithValue(sc, changesKey, &changes))
+			if err == nil {
+				err = sc.CommitTransaction(sc)
+			} else {
+				_ = sc.AbortTransaction(sc)
+			}
+			if err == nil {
+				for _, entry := range changes {
+					countChange(entry)
+				}
+			}
+
+			cmdErr, ok := err.(mongo.CommandError)
+			if !ok || !cmdErr.HasErrorLabel(transientTransactionError) || attempt == maxTransactionAttempts {
+				return err
+			}
+			Logger(ctx).Sugar().Infow("db-transaction-retry", "attempt", attempt, "error", err)
+		}
+	})
 }
 
-// Save saves a payment to DB. If it is already there it will fail
-func (p *Payments) Save(ctx context.Context, obj model.Payment) error {
+// Save saves a payment to DB, pending. If it is already there it will fail
+func (p *Payments) Save(ctx context.Context, obj model.Payment) (model.Payment, error) {
+
+	if !OrganisationAllowed(ctx, obj.OrganisationID) {
+		return model.Payment{}, ErrOrganisationNotAllowed
+	}
 
 	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
 	defer cancel()
 
-	_, err := p.collection.InsertOne(ctx, obj)
-	return err
+	obj = pending(ctx, obj)
+
+	err := p.inTransaction(ctx, func(ctx context.Context) error {
+		if _, err := p.collection.InsertOne(ctx, obj); err != nil {
+			return err
+		}
+		return p.record(ctx, auditEntry(ctx, model.OperationCreate, nil, &obj))
+	})
+	if err != nil {
+		return model.Payment{}, err
+	}
+	return obj, nil
 }
 
-// Update updates a payment to DB. If it is already there it will replace it, otherwise
-// it will create it
-func (p *Payments) Update(ctx context.Context, obj model.Payment) error {
+// errAlreadySaved is the error of the payments of a batch left out of the
+// insert because their ID is already there. It is the one the insert fails
+// with, but in a transaction that would abort all of them
+var errAlreadySaved = mongo.WriteError{Code: 11000, Message: "there is already a payment with the same id"}
+
+// SaveMany saves many payments to DB, pending, with one unordered insert, and
+// their audit entries with another one. The ones that fail, eg. because they
+// are already there, do not stop the rest. With transactions it is all done
+// in one. Without them, if what comes after the insert fails the payments
+// inserted are returned as saved, with the error
+func (p *Payments) SaveMany(ctx context.Context, objs []model.Payment) ([]model.Payment, []error, error) {
+
+	saved := make([]model.Payment, len(objs))
+	errs := make([]error, len(objs))
+	if len(objs) == 0 {
+		return saved, errs, nil
+	}
 
 	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
 	defer cancel()
 
-	_, err := p.Get(ctx, obj.ID) //TODO investigate why it cannot be done in one go
+	var inserted []int
+	err := p.inTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		if inserted, err = p.insertMany(ctx, objs, saved, errs); err != nil {
+			return err
+		}
+		entries := make([]model.AuditEntry, 0, len(inserted))
+		for _, i := range inserted {
+			entries = append(entries, auditEntry(ctx, model.OperationCreate, nil, &saved[i]))
+		}
+		return p.recordMany(ctx, entries)
+	})
+	if err != nil && (p.replicated || len(inserted) == 0) {
+		// nothing was saved
+		for i := range objs {
+			saved[i] = model.Payment{}
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+	return saved, errs, err
+}
+
+// insertMany inserts the payments with one unordered insert, setting in saved
+// and errs the result of each one. It returns the positions in objs of the
+// ones inserted. In a transaction the ones already there are left out first,
+// as any error aborts it
+func (p *Payments) insertMany(ctx context.Context, objs []model.Payment, saved []model.Payment,
+	errs []error) ([]int, error) {
+
+	// positions are the ones in objs of the docs
+	docs := []interface{}{}
+	positions := []int{}
+	ids := map[model.PaymentID]bool{}
+	for i, obj := range objs {
+		saved[i], errs[i] = model.Payment{}, nil
+		switch {
+		case !OrganisationAllowed(ctx, obj.OrganisationID):
+			errs[i] = ErrOrganisationNotAllowed
+		case p.replicated && ids[obj.ID]:
+			errs[i] = errAlreadySaved
+		default:
+			ids[obj.ID] = true
+			saved[i] = pending(ctx, obj)
+			docs = append(docs, saved[i])
+			positions = append(positions, i)
+		}
+	}
+
+	if p.replicated && len(docs) > 0 {
+		existing, err := p.existingIDs(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		kept := 0
+		for j, i := range positions {
+			if existing[objs[i].ID] {
+				saved[i], errs[i] = model.Payment{}, errAlreadySaved
+				continue
+			}
+			docs[kept], positions[kept] = docs[j], i
+			kept++
+		}
+		docs, positions = docs[:kept], positions[:kept]
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+
+	_, err := p.collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if bulkErr, ok := err.(mongo.BulkWriteException); ok && bulkErr.WriteConcernError == nil && !p.replicated {
+		for _, writeErr := range bulkErr.WriteErrors {
+			i := positions[writeErr.Index]
+			saved[i], errs[i] = model.Payment{}, writeErr.WriteError
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	inserted := []int{}
+	for _, i := range positions {
+		if errs[i] == nil {
+			inserted = append(inserted, i)
+		}
+	}
+	return inserted, nil
+}
+
+// existingIDs returns which of the IDs are already there, in any organisation
+func (p *Payments) existingIDs(ctx context.Context, ids map[model.PaymentID]bool) (map[model.PaymentID]bool, error) {
+
+	in := bson.A{}
+	for id := range ids {
+		in = append(in, id)
+	}
+	cursor, err := p.collection.Find(ctx, bson.D{{Key: fieldID, Value: bson.D{{Key: "$in", Value: in}}}},
+		options.Find().SetProjection(bson.D{{Key: fieldID, Value: 1}}))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	existing := map[model.PaymentID]bool{}
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID model.PaymentID `bson:"id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		existing[doc.ID] = true
+	}
+	return existing, cursor.Err()
+}
+
+// Update updates a payment in DB. The version of obj has to be the one stored,
+// otherwise it fails with ErrVersionConflict, and if it is not there (or it
+// is deleted) it fails also. Only what the clients can change is updated, the
+// status is kept. It returns the updated payment, with the new version
+func (p *Payments) Update(ctx context.Context, obj model.Payment) (model.Payment, error) {
+
+	if !OrganisationAllowed(ctx, obj.OrganisationID) {
+		return model.Payment{}, ErrOrganisationNotAllowed
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	filter := scoped(ctx, bson.D{
+		{Key: fieldID, Value: obj.ID},
+		{Key: fieldVersion, Value: obj.Version},
+		{Key: fieldDeleted, Value: nil},
+	})
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: fieldType, Value: obj.Type},
+			{Key: fieldOrganisationID, Value: obj.OrganisationID},
+			{Key: fieldAttributes, Value: obj.Attributes},
+		}},
+		{Key: "$inc", Value: bson.D{{Key: fieldVersion, Value: 1}}},
 	}
-	filter := bson.D{{"id", obj.ID}}
 
-	res := p.collection.FindOneAndReplace(ctx, filter, obj)
-	fmt.Println(res, res.Err())
-	return res.Err()
+	// the one before is returned, to have it in the audit log
+	findOptions := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+
+	var after model.Payment
+
+	err := p.inTransaction(ctx, func(ctx context.Context) error {
+		var before model.Payment
+
+		err := p.collection.FindOneAndUpdate(ctx, filter, update, findOptions).Decode(&before)
+		if IsErrorNoDBResults(err) {
+			// either it is not there or it has a different version
+			if _, err := p.Get(ctx, obj.ID, GetOptions{}); err != nil {
+				return err
+			}
+			return ErrVersionConflict
+		}
+		if err != nil {
+			return err
+		}
+
+		after = updatedPayment(before, obj)
+		return p.record(ctx, auditEntry(ctx, model.OperationUpdate, &before, &after))
+	})
+	if err != nil {
+		return model.Payment{}, err
+	}
+	return after, nil
 }
 
 // Get tries to find a payment in the DB and returns it
-func (p *Payments) Get(ctx context.Context, id model.PaymentID) (model.Payment, error) {
+func (p *Payments) Get(ctx context.Context, id model.PaymentID, opts GetOptions) (model.Payment, error) {
 
 	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
 	defer cancel()
 
-	filter := bson.D{{"id", id}}
+	filter := bson.D{{Key: fieldID, Value: id}}
+	if !opts.IncludeDeleted {
+		filter = append(filter, bson.E{Key: fieldDeleted, Value: nil})
+	}
 
 	var result model.Payment
 
-	err := p.collection.FindOne(ctx, filter).Decode(&result)
+	err := p.collection.FindOne(ctx, scoped(ctx, filter)).Decode(&result)
 	if err != nil {
 		return result, err
 	}
@@ -108,55 +402,449 @@ func (p *Payments) Get(ctx context.Context, id model.PaymentID) (model.Payment,
 	return result, nil
 }
 
-// Delete tries to delete a payment in the DB, returns the number of deleted items
+// Delete marks a payment in the DB as deleted, by the actor of the context.
+// Returns the number of deleted items
 func (p *Payments) Delete(ctx context.Context, id model.PaymentID) (int64, error) {
 
 	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
 	defer cancel()
 
-	filter := bson.D{{"id", id}}
+	filter := scoped(ctx, bson.D{{Key: fieldID, Value: id}, {Key: fieldDeleted, Value: nil}})
+
+	deletion := model.Deletion{At: now(), By: actorFrom(ctx)}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: fieldDeleted, Value: deletion}}},
+		{Key: "$inc", Value: bson.D{{Key: fieldVersion, Value: 1}}},
+	}
+	findOptions := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+
+	var deleted int64
+
+	err := p.inTransaction(ctx, func(ctx context.Context) error {
+		var before model.Payment
+
+		err := p.collection.FindOneAndUpdate(ctx, filter, update, findOptions).Decode(&before)
+		if IsErrorNoDBResults(err) {
+			deleted = 0
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 
-	res, err := p.collection.DeleteOne(ctx, filter)
+		after := before
+		after.Deleted = &deletion
+		after.Version++
+		deleted = 1
+		return p.record(ctx, auditEntry(ctx, model.OperationDelete, &before, &after))
+	})
 	if err != nil {
 		return 0, err
 	}
+	return deleted, nil
+}
+
+// Restore undoes the Delete of a payment. Returns the restored payment, or
+// ErrNotDeleted if it was not deleted
+func (p *Payments) Restore(ctx context.Context, id model.PaymentID) (model.Payment, error) {
 
-	return res.DeletedCount, nil
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	filter := scoped(ctx, bson.D{{Key: fieldID, Value: id}, {Key: fieldDeleted, Value: bson.D{{Key: "$ne", Value: nil}}}})
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: fieldDeleted, Value: nil}}},
+		{Key: "$inc", Value: bson.D{{Key: fieldVersion, Value: 1}}},
+	}
+	findOptions := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+
+	var after model.Payment
+
+	err := p.inTransaction(ctx, func(ctx context.Context) error {
+		var before model.Payment
+
+		err := p.collection.FindOneAndUpdate(ctx, filter, update, findOptions).Decode(&before)
+		if IsErrorNoDBResults(err) {
+			// either it is not there or it is not deleted
+			if _, err := p.Get(ctx, id, GetOptions{}); err != nil {
+				return err
+			}
+			return ErrNotDeleted
+		}
+		if err != nil {
+			return err
+		}
+
+		after = before
+		after.Deleted = nil
+		after.Version++
+		return p.record(ctx, auditEntry(ctx, model.OperationRestore, &before, &after))
+	})
+	if err != nil {
+		return model.Payment{}, err
+	}
+	return after, nil
 }
 
-// Last100 gets the last 100 items of the list
-func (p *Payments) Last100(ctx context.Context) ([]*model.Payment, error) {
+// Transition does an action to a payment, if it is allowed from its current
+// status, otherwise it fails with ErrInvalidTransition. The status is only
+// changed if it is still the one read, so concurrent actions cannot both
+// succeed. If it was changed it is tried again with the new status, which
+// ends as the statuses never go back
+func (p *Payments) Transition(ctx context.Context, id model.PaymentID, action model.Action,
+	reason string) (model.Payment, error) {
 
 	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
 	defer cancel()
 
+	for {
+		current, err := p.Get(ctx, id, GetOptions{})
+		if err != nil {
+			return model.Payment{}, err
+		}
+		if !action.AllowedFrom(current.Status) {
+			return model.Payment{}, ErrInvalidTransition
+		}
+
+		// payments stored before there were statuses have none
+		var status interface{} = current.Status
+		if len(current.Status) == 0 {
+			status = nil
+		}
+
+		filter := scoped(ctx, bson.D{
+			{Key: fieldID, Value: id},
+			{Key: fieldStatus, Value: status},
+			{Key: fieldDeleted, Value: nil},
+		})
+		change := statusChange(ctx, current.Status, action, reason)
+		update := bson.D{
+			{Key: "$set", Value: bson.D{{Key: fieldStatus, Value: change.To}}},
+			{Key: "$push", Value: bson.D{{Key: fieldStatusHistory, Value: change}}},
+			{Key: "$inc", Value: bson.D{{Key: fieldVersion, Value: 1}}},
+		}
+		findOptions := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+
+		var after model.Payment
+
+		err = p.inTransaction(ctx, func(ctx context.Context) error {
+			var before model.Payment
+
+			err := p.collection.FindOneAndUpdate(ctx, filter, update, findOptions).Decode(&before)
+			if err != nil {
+				return err
+			}
+
+			after = transitionedPayment(before, change)
+			return p.record(ctx, auditEntry(ctx, model.Operation(action), &before, &after))
+		})
+		if IsErrorNoDBResults(err) {
+			continue
+		}
+		if err != nil {
+			return model.Payment{}, err
+		}
+		return after, nil
+	}
+}
+
+// Export calls fn with each of the payments matching the options, in order,
+// reading them from a Mongo cursor, so they are never all in memory. It stops
+// when fn fails. There is no timeout but the one of ctx, as it can take long
+func (p *Payments) Export(ctx context.Context, opts ExportOptions, fn func(*model.Payment) error) error {
+
+	filter, order, err := opts.listOptions().mongoQuery()
+	if err != nil {
+		return err
+	}
+
 	findOptions := options.Find()
-	findOptions.SetLimit(100)
-	findOptions.Sort = bson.D{{"_id", -1}} //descending
+	findOptions.SetSort(order)
+	findOptions.SetBatchSize(exportBatchSize)
+
+	cur, err := p.collection.Find(ctx, scoped(ctx, filter), findOptions)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var elem model.Payment
+		if err := cur.Decode(&elem); err != nil {
+			return err
+		}
+		if err := fn(&elem); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// Summary adds the payments matching the filter of the options, grouped by
+// the fields of the options. It is all done by Mongo, in one aggregation
+func (p *Payments) Summary(ctx context.Context, opts SummaryOptions) ([]model.Summary, error) {
 
-	var results []*model.Payment
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	filter, err := opts.Filter.mongoFilter()
+	if err != nil {
+		return nil, err
+	}
+	filter = append(filter, bson.E{Key: fieldDeleted, Value: nil})
 
-	cur, err := p.collection.Find(ctx, bson.D{{}}, findOptions)
+	cur, err := p.collection.Aggregate(ctx, opts.mongoPipeline(scoped(ctx, filter)))
 	if err != nil {
 		return nil, err
 	}
+	defer cur.Close(ctx)
+
+	var facets summaryFacets
+	if cur.Next(ctx) {
+		if err := cur.Decode(&facets); err != nil {
+			return nil, err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
 
+	return summaries(facets), nil
+}
+
+// History gets the audit log of a payment, oldest first. When the context only
+// allows some organisations the payment has to be of one of them now
+func (p *Payments) History(ctx context.Context, id model.PaymentID) ([]model.AuditEntry, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	if _, scoped := organisationsFrom(ctx); scoped {
+		if _, err := p.Get(ctx, id, GetOptions{IncludeDeleted: true}); err != nil {
+			return nil, err
+		}
+	}
+
+	findOptions := options.Find().SetSort(bson.D{{Key: fieldMongoID, Value: 1}})
+
+	cur, err := p.audit.Find(ctx, bson.D{{Key: fieldAuditPaymentID, Value: id}}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	entries := []model.AuditEntry{}
 	for cur.Next(ctx) {
+		var entry model.AuditEntry
+		if err := cur.Decode(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+	return entries, nil
+}
 
-		var elem model.Payment
+// record appends an entry to the audit log. Entries are only inserted, never
+// changed. It is done after the change, so if it fails the change is done but
+// the error is returned
+func (p *Payments) record(ctx context.Context, entry model.AuditEntry) error {
+
+	_, err := p.audit.InsertOne(ctx, entry)
+	if err != nil {
+		return err
+	}
+	return p.recorded(ctx, entry)
+}
+
+// recordMany is record for many entries, with one insert
+func (p *Payments) recordMany(ctx context.Context, entries []model.AuditEntry) error {
+
+	if len(entries) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(entries))
+	for i := range entries {
+		docs[i] = entries[i]
+	}
+	if _, err := p.audit.InsertMany(ctx, docs); err != nil {
+		return err
+	}
+	return p.recorded(ctx, entries...)
+}
+
+// recorded writes changes already in the audit log to the outbox, with one
+// insert, and enqueues their deliveries to the webhooks. Without transactions
+// they are also sent to the feeds of this process, as there are no change
+// streams. They are counted in the metrics, in a transaction once it is
+// committed
+func (p *Payments) recorded(ctx context.Context, entries ...model.AuditEntry) error {
+
+	outboxEntries := make([]OutboxEntry, len(entries))
+	docs := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		outboxEntries[i] = newOutboxEntry(entry)
+		docs[i] = outboxEntries[i]
+	}
+	if _, err := p.outbox.InsertMany(ctx, docs); err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		if p.events != nil {
+			p.events.Publish(entry)
+		}
+		if p.webhooks != nil {
+			if err := p.webhooks.Enqueue(ctx, outboxEntries[i].Event); err != nil {
+				return err
+			}
+		}
+
+		if changes, ok := ctx.Value(changesKey).(*[]model.AuditEntry); ok {
+			*changes = append(*changes, entry)
+		} else {
+			countChange(entry)
+		}
+	}
+	return nil
+}
+
+// Events returns a feed of the changes to the payments, after the event with
+// the ID after, or of the new ones if it is empty. It is a change stream of
+// the audit log if Mongo has them
+func (p *Payments) Events(ctx context.Context, after string) (EventStream, error) {
+
+	var stream EventStream
+	var err error
+	if p.events != nil {
+		stream, err = p.events.Subscribe(after)
+	} else {
+		stream, err = watchAudit(ctx, p.audit, after)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scopeEvents(ctx, stream), nil
+}
+
+// mongoQuery translates the options into the Mongo query and order of the
+// payments, starting after the cursor if there is one
+func (opts ListOptions) mongoQuery() (filter bson.D, order bson.D, err error) {
+
+	if err := opts.Filter.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	filter, err = opts.Filter.mongoFilter()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !opts.IncludeDeleted {
+		filter = append(filter, bson.E{Key: fieldDeleted, Value: nil})
+	}
+
+	sorting := opts.Sort.normalize()
+	field, found := sortFields[sorting.Field]
+	if !found {
+		return nil, nil, ErrInvalidSort
+	}
+	direction, compare := 1, "$gt"
+	if sorting.Descending {
+		direction, compare = -1, "$lt"
+	}
+
+	if len(opts.Cursor) > 0 {
+		pos, err := decodeCursor(opts.Cursor, sorting)
+		if err != nil {
+			return nil, nil, err
+		}
+		after, err := primitive.ObjectIDFromHex(pos.After)
+		if err != nil {
+			return nil, nil, ErrInvalidCursor
+		}
+
+		afterID := bson.D{{Key: fieldMongoID, Value: bson.D{{Key: compare, Value: after}}}}
+		if field == fieldMongoID {
+			filter = append(filter, afterID...)
+		} else {
+			filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+				bson.D{{Key: field, Value: bson.D{{Key: compare, Value: pos.Key}}}},
+				append(bson.D{{Key: field, Value: pos.Key}}, afterID...),
+			}})
+		}
+	}
+
+	order = bson.D{{Key: fieldMongoID, Value: direction}}
+	if field != fieldMongoID {
+		order = append(bson.D{{Key: field, Value: direction}}, order...)
+	}
+
+	return filter, order, nil
+}
+
+// List gets a page of payments. The cursor is based on the sort field and the
+// Mongo _id, so the pages are stable even when new payments are inserted
+func (p *Payments) List(ctx context.Context, opts ListOptions) (ListResult, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	filter, order, err := opts.mongoQuery()
+	if err != nil {
+		return ListResult{}, err
+	}
+	sorting := opts.Sort.normalize()
+
+	limit := opts.limit()
+
+	findOptions := options.Find()
+	findOptions.SetLimit(limit + 1) // one more, to know if there is a next page
+	findOptions.SetSort(order)
+
+	cur, err := p.collection.Find(ctx, scoped(ctx, filter), findOptions)
+	if err != nil {
+		return ListResult{}, err
+	}
+	defer cur.Close(ctx)
+
+	result := ListResult{Items: []*model.Payment{}}
+	var last primitive.ObjectID
+
+	for cur.Next(ctx) {
+
+		if int64(len(result.Items)) == limit {
+			lastItem := result.Items[len(result.Items)-1]
+			result.NextCursor = encodeCursor(cursorPosition{
+				Sort:  sorting.String(),
+				Key:   sorting.key(lastItem),
+				After: last.Hex(),
+			})
+			break
+		}
+
+		var elem paymentDocument
 		err := cur.Decode(&elem)
 		if err != nil {
-			log.Fatal(err)
+			return ListResult{}, err
 		}
 
-		results = append(results, &elem)
+		last = elem.MongoID
+		payment := elem.Payment
+		result.Items = append(result.Items, &payment)
 	}
 
 	if err := cur.Err(); err != nil {
-		log.Fatal(err)
+		return ListResult{}, err
 	}
 
-	cur.Close(ctx)
-
-	return results, nil
+	return result, nil
 }
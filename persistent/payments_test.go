@@ -4,6 +4,8 @@ import (
 	"apipay/config"
 	"apipay/model"
 	"context"
+	"errors"
+	"fmt"
 	"reflect"
 	"testing"
 
@@ -42,6 +44,21 @@ func createTestDB(ctx context.Context, dbName string) (Client, error) {
 	return client, nil
 }
 
+// testMoney returns the money as the API reads it, with the decimals of the
+// currency. Empty amounts are no amount
+func testMoney(amount, currency string) model.Money {
+
+	var value model.Decimal
+	if len(amount) > 0 {
+		value = model.MustParseDecimal(amount)
+	}
+	money, err := model.NewMoney(value, currency)
+	if err != nil {
+		panic(err)
+	}
+	return money
+}
+
 func testPayment(id model.PaymentID) model.Payment {
 
 	return model.Payment{
@@ -60,9 +77,9 @@ func TestEmpty(t *testing.T) {
 	paymentsDB, err := GetPayments(ctx, client)
 	assert.NoError(t, err, "We can init DB")
 
-	payments, err := paymentsDB.Last100(ctx)
+	list, err := paymentsDB.List(ctx, ListOptions{Limit: 100})
 	assert.NoError(t, err, "We can fetch list from DB")
-	assert.Equal(t, 0, len(payments), "We got nothing from DB")
+	assert.Equal(t, 0, len(list.Items), "We got nothing from DB")
 }
 
 func TestSave(t *testing.T) {
@@ -76,20 +93,20 @@ func TestSave(t *testing.T) {
 	paymentsDB, err := GetPayments(ctx, client)
 	assert.NoError(t, err, "We can init DB")
 
-	payments, err := paymentsDB.Last100(ctx)
+	list, err := paymentsDB.List(ctx, ListOptions{Limit: 100})
 	assert.NoError(t, err, "We can fetch list from DB")
-	assert.Equal(t, 0, len(payments), "We got nothing from DB")
+	assert.Equal(t, 0, len(list.Items), "We got nothing from DB")
 
 	payment1 := testPayment(model.PaymentID("12345"))
 
-	err = paymentsDB.Save(ctx, payment1)
+	_, err = paymentsDB.Save(ctx, payment1)
 	assert.NoError(t, err, "We can save one item to DB")
 
-	payments, err = paymentsDB.Last100(ctx)
+	list, err = paymentsDB.List(ctx, ListOptions{Limit: 100})
 	assert.NoError(t, err, "We can fetch list from DB")
-	assert.Equal(t, 1, len(payments), "We got what we inserted")
+	assert.Equal(t, 1, len(list.Items), "We got what we inserted")
 
-	err = paymentsDB.Save(ctx, payment1)
+	_, err = paymentsDB.Save(ctx, payment1)
 	assert.Error(t, err, "We cannot save twice")
 
 }
@@ -107,20 +124,20 @@ func TestInsertDelete(t *testing.T) {
 
 	payment1 := testPayment(model.PaymentID("12345"))
 
-	err = paymentsDB.Save(ctx, payment1)
+	_, err = paymentsDB.Save(ctx, payment1)
 	assert.NoError(t, err, "We can save one item to DB")
 
-	payments, err := paymentsDB.Last100(ctx)
+	list, err := paymentsDB.List(ctx, ListOptions{Limit: 100})
 	assert.NoError(t, err, "We can fetch list from DB")
-	assert.Equal(t, 1, len(payments), "We got what we inserted")
+	assert.Equal(t, 1, len(list.Items), "We got what we inserted")
 
 	numberDeleted, err := paymentsDB.Delete(ctx, payment1.ID)
 	assert.NoError(t, err, "We can delete from DB")
 	assert.Equal(t, int64(1), numberDeleted, "We deleted one item")
 
-	payments, err = paymentsDB.Last100(ctx)
+	list, err = paymentsDB.List(ctx, ListOptions{Limit: 100})
 	assert.NoError(t, err, "We can fetch list from DB")
-	assert.Equal(t, 0, len(payments), "List is empty now")
+	assert.Equal(t, 0, len(list.Items), "List is empty now")
 
 	numberDeleted, err = paymentsDB.Delete(ctx, payment1.ID)
 	assert.NoError(t, err, "We can try to delete from DB")
@@ -140,14 +157,18 @@ func TestGet(t *testing.T) {
 
 	payment1 := testPayment(model.PaymentID("12345"))
 
-	_, err = paymentsDB.Get(ctx, payment1.ID)
+	_, err = paymentsDB.Get(ctx, payment1.ID, GetOptions{})
 	assert.True(t, IsErrorNoDBResults(err), "We didn't get anything from DB")
 
-	err = paymentsDB.Save(ctx, payment1)
+	saved, err := paymentsDB.Save(ctx, payment1)
 	assert.NoError(t, err, "We can save one item to DB")
+	assert.Equal(t, model.StatusPending, saved.Status, "New payments are pending")
 
-	dbItem, err := paymentsDB.Get(ctx, payment1.ID)
+	dbItem, err := paymentsDB.Get(ctx, payment1.ID, GetOptions{})
 	assert.NoError(t, err, "We can get items from DB")
+	assert.Equal(t, saved.Status, dbItem.Status, "We loaded from DB the status")
+	assert.Equal(t, len(saved.StatusHistory), len(dbItem.StatusHistory), "We loaded from DB the history")
+	dbItem.Status, dbItem.StatusHistory = "", nil
 	assert.True(t, reflect.DeepEqual(payment1, dbItem), "We loaded from DB what we saved")
 }
 
@@ -164,18 +185,21 @@ func TestInsertUpdate(t *testing.T) {
 
 	payment1 := testPayment(model.PaymentID("12345"))
 
-	err = paymentsDB.Save(ctx, payment1)
+	_, err = paymentsDB.Save(ctx, payment1)
 	assert.NoError(t, err, "We can save one item to DB")
 
-	payments, err := paymentsDB.Last100(ctx)
+	list, err := paymentsDB.List(ctx, ListOptions{Limit: 100})
 	assert.NoError(t, err, "We can fetch list from DB")
-	assert.Equal(t, 1, len(payments), "We got what we inserted")
+	assert.Equal(t, 1, len(list.Items), "We got what we inserted")
 
 	payment1.OrganisationID = "newOrg"
-	err = paymentsDB.Update(ctx, payment1)
+	updated, err := paymentsDB.Update(ctx, payment1)
 	assert.NoError(t, err, "We can update from DB")
 
-	dbItem, err := paymentsDB.Get(ctx, payment1.ID)
+	payment1.Version++ // the server increments it
+	assert.True(t, reflect.DeepEqual(payment1, updated), "We got back what we saved")
+
+	dbItem, err := paymentsDB.Get(ctx, payment1.ID, GetOptions{})
 	assert.NoError(t, err, "We can get items from DB")
 	assert.True(t, reflect.DeepEqual(payment1, dbItem), "We loaded from DB what we saved")
 
@@ -194,10 +218,52 @@ func TestUpdateError(t *testing.T) {
 
 	payment2 := testPayment(model.PaymentID("123456"))
 
-	err = paymentsDB.Update(ctx, payment2)
+	_, err = paymentsDB.Update(ctx, payment2)
 	assert.Error(t, err, "We cannot update")
 
 }
+
+func TestUpdateConflict(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "updateConflictDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	paymentsDB, err := GetPayments(ctx, client)
+	assert.NoError(t, err, "We can init DB")
+
+	testUpdateConflict(ctx, t, paymentsDB)
+}
+
+// testUpdateConflict checks two updates of the same version of a payment in
+// any PaymentStore, only the first one can win
+func testUpdateConflict(ctx context.Context, t *testing.T, paymentsDB PaymentStore) {
+
+	payment1 := testPayment(model.PaymentID("12345"))
+
+	_, err := paymentsDB.Save(ctx, payment1)
+	assert.NoError(t, err, "We can save one item to DB")
+
+	first := payment1
+	first.OrganisationID = "first"
+	updated, err := paymentsDB.Update(ctx, first)
+	assert.NoError(t, err, "We can update from DB")
+	assert.Equal(t, uint(1), updated.Version, "The version got incremented")
+
+	second := payment1
+	second.OrganisationID = "second"
+	_, err = paymentsDB.Update(ctx, second)
+	assert.Equal(t, ErrVersionConflict, err, "We cannot update an old version")
+
+	dbItem, err := paymentsDB.Get(ctx, payment1.ID, GetOptions{})
+	assert.NoError(t, err, "We can get items from DB")
+	assert.Equal(t, "first", dbItem.OrganisationID, "The first update won")
+
+	_, err = paymentsDB.Update(ctx, testPayment(model.PaymentID("notThere")))
+	assert.True(t, IsErrorNoDBResults(err), "We cannot update what is not there")
+}
 func TestList100(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
@@ -211,31 +277,686 @@ func TestList100(t *testing.T) {
 
 	payment1 := testPayment(model.PaymentID("12345"))
 
-	payments, err := paymentsDB.Last100(ctx)
+	list, err := paymentsDB.List(ctx, ListOptions{Limit: 100})
 	assert.NoError(t, err, "We can fetch list from DB")
-	assert.Equal(t, 0, len(payments), "We got nothing from DB")
+	assert.Equal(t, 0, len(list.Items), "We got nothing from DB")
 
-	err = paymentsDB.Save(ctx, payment1)
+	_, err = paymentsDB.Save(ctx, payment1)
 	assert.NoError(t, err, "We can save one item to DB")
 
-	payments, err = paymentsDB.Last100(ctx)
+	list, err = paymentsDB.List(ctx, ListOptions{Limit: 100})
 	assert.NoError(t, err, "We can fetch list from DB")
-	assert.Equal(t, 1, len(payments), "We got one item from DB")
+	assert.Equal(t, 1, len(list.Items), "We got one item from DB")
 
 	payment2 := testPayment(model.PaymentID("12346"))
-	err = paymentsDB.Save(ctx, payment2)
+	_, err = paymentsDB.Save(ctx, payment2)
 	assert.NoError(t, err, "We can save one item to DB")
 
-	payments, err = paymentsDB.Last100(ctx)
+	list, err = paymentsDB.List(ctx, ListOptions{Limit: 100})
 	assert.NoError(t, err, "We can fetch list from DB")
-	assert.Equal(t, 2, len(payments), "We got two items from DB")
+	assert.Equal(t, 2, len(list.Items), "We got two items from DB")
 
 	payment3 := testPayment(model.PaymentID("12347"))
-	err = paymentsDB.Save(ctx, payment3)
+	_, err = paymentsDB.Save(ctx, payment3)
+	assert.NoError(t, err, "We can save one item to DB")
+
+	list, err = paymentsDB.List(ctx, ListOptions{Limit: 100})
+	assert.NoError(t, err, "We can fetch list from DB")
+	assert.Equal(t, 3, len(list.Items), "We got three items from DB")
+
+}
+
+func TestListPages(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "listPagesDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	paymentsDB, err := GetPayments(ctx, client)
+	assert.NoError(t, err, "We can init DB")
+
+	testListPages(ctx, t, paymentsDB)
+}
+
+// testListPages checks the pagination of any PaymentStore
+func testListPages(ctx context.Context, t *testing.T, paymentsDB PaymentStore) {
+
+	for _, id := range []model.PaymentID{"1", "2", "3", "4", "5"} {
+		_, err := paymentsDB.Save(ctx, testPayment(id))
+		assert.NoError(t, err, "We can save one item to DB")
+	}
+
+	page, err := paymentsDB.List(ctx, ListOptions{Limit: 2})
+	assert.NoError(t, err, "We can fetch the first page")
+	assert.Equal(t, 2, len(page.Items), "We got a full page")
+	assert.Equal(t, model.PaymentID("5"), page.Items[0].ID, "Newest first")
+	assert.NotEmpty(t, page.NextCursor, "There is a next page")
+
+	_, err = paymentsDB.Save(ctx, testPayment("6"))
+	assert.NoError(t, err, "We can save while paginating")
+
+	page, err = paymentsDB.List(ctx, ListOptions{Limit: 2, Cursor: page.NextCursor})
+	assert.NoError(t, err, "We can fetch the second page")
+	assert.Equal(t, 2, len(page.Items), "We got a full page")
+	assert.Equal(t, model.PaymentID("3"), page.Items[0].ID, "The new one did not move the page")
+
+	page, err = paymentsDB.List(ctx, ListOptions{Limit: 2, Cursor: page.NextCursor})
+	assert.NoError(t, err, "We can fetch the last page")
+	assert.Equal(t, 1, len(page.Items), "We got what was left")
+	assert.Empty(t, page.NextCursor, "There is no next page")
+
+	_, err = paymentsDB.List(ctx, ListOptions{Cursor: "garbage"})
+	assert.Equal(t, ErrInvalidCursor, err, "We cannot use a random cursor")
+}
+
+func TestListFilters(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "listFiltersDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	paymentsDB, err := GetPayments(ctx, client)
+	assert.NoError(t, err, "We can init DB")
+
+	testListFilters(ctx, t, paymentsDB)
+}
+
+// testListFilters checks the filters and sorts of any PaymentStore
+func testListFilters(ctx context.Context, t *testing.T, paymentsDB PaymentStore) {
+
+	items := []struct {
+		id       model.PaymentID
+		org      string
+		currency string
+		date     string
+		amount   string
+	}{
+		{"1", "org1", "GBP", "2017-01-18", "100.21"},
+		{"2", "org1", "USD", "2017-01-19", "9.5"},
+		{"3", "org2", "GBP", "2017-01-17", "1000"},
+		{"4", "org1", "GBP", "2017-01-20", ""},
+	}
+	for _, item := range items {
+		payment := testPayment(item.id)
+		payment.OrganisationID = item.org
+		payment.Attributes.ProcessingDate = item.date
+		payment.Attributes.Amount = testMoney(item.amount, item.currency)
+		_, err := paymentsDB.Save(ctx, payment)
+		assert.NoError(t, err, "We can save one item to DB")
+	}
+
+	ids := func(res ListResult) []model.PaymentID {
+		var found []model.PaymentID
+		for _, item := range res.Items {
+			found = append(found, item.ID)
+		}
+		return found
+	}
+
+	tests := []struct {
+		name string
+		opts ListOptions
+		want []model.PaymentID
+	}{
+		{"organisation", ListOptions{Filter: PaymentFilter{OrganisationID: "org1"}}, []model.PaymentID{"4", "2", "1"}},
+		{"currency", ListOptions{Filter: PaymentFilter{OrganisationID: "org1", Currency: "GBP"}}, []model.PaymentID{"4", "1"}},
+		{"dates", ListOptions{Filter: PaymentFilter{ProcessingDateFrom: "2017-01-18", ProcessingDateTo: "2017-01-19"}}, []model.PaymentID{"2", "1"}},
+		{"amounts", ListOptions{Filter: PaymentFilter{AmountMin: "10", AmountMax: "1000"}}, []model.PaymentID{"3", "1"}},
+		{"max amount", ListOptions{Filter: PaymentFilter{AmountMax: "100.21"}}, []model.PaymentID{"2", "1"}},
+		{"sort by date", ListOptions{Sort: Sort{Field: SortProcessingDate}}, []model.PaymentID{"3", "1", "2", "4"}},
+		{"sort by date desc", ListOptions{Sort: Sort{Field: SortProcessingDate, Descending: true}}, []model.PaymentID{"4", "2", "1", "3"}},
+	}
+	for _, tt := range tests {
+		res, err := paymentsDB.List(ctx, tt.opts)
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.want, ids(res), tt.name)
+	}
+
+	// paginating a sorted list
+	opts := ListOptions{Limit: 3, Sort: Sort{Field: SortOrganisation}}
+	res, err := paymentsDB.List(ctx, opts)
+	assert.NoError(t, err, "We can fetch the first page")
+	assert.Equal(t, []model.PaymentID{"1", "2", "4"}, ids(res), "Sorted by organisation")
+
+	opts.Cursor = res.NextCursor
+	res, err = paymentsDB.List(ctx, opts)
+	assert.NoError(t, err, "We can fetch the second page")
+	assert.Equal(t, []model.PaymentID{"3"}, ids(res), "Sorted by organisation")
+
+	opts.Sort = Sort{}
+	_, err = paymentsDB.List(ctx, opts)
+	assert.Equal(t, ErrInvalidCursor, err, "We cannot change the sort while paginating")
+
+	_, err = paymentsDB.List(ctx, ListOptions{Sort: Sort{Field: "id"}})
+	assert.Equal(t, ErrInvalidSort, err, "We cannot sort by any field")
+}
+
+func TestSoftDelete(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "softDeleteDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	paymentsDB, err := GetPayments(ctx, client)
+	assert.NoError(t, err, "We can init DB")
+
+	testSoftDelete(ctx, t, paymentsDB)
+}
+
+// testSoftDelete checks deleted payments are kept, and can be restored, in
+// any PaymentStore
+func testSoftDelete(ctx context.Context, t *testing.T, paymentsDB PaymentStore) {
+
+	payment1 := testPayment(model.PaymentID("12345"))
+
+	_, err := paymentsDB.Save(ctx, payment1)
+	assert.NoError(t, err, "We can save one item to DB")
+
+	_, err = paymentsDB.Restore(ctx, payment1.ID)
+	assert.Equal(t, ErrNotDeleted, err, "We cannot restore what is not deleted")
+
+	numberDeleted, err := paymentsDB.Delete(WithActor(ctx, "someone"), payment1.ID)
+	assert.NoError(t, err, "We can delete from DB")
+	assert.Equal(t, int64(1), numberDeleted, "We deleted one item")
+
+	_, err = paymentsDB.Get(ctx, payment1.ID, GetOptions{})
+	assert.True(t, IsErrorNoDBResults(err), "Deleted payments are not found")
+
+	dbItem, err := paymentsDB.Get(ctx, payment1.ID, GetOptions{IncludeDeleted: true})
+	assert.NoError(t, err, "Deleted payments are kept")
+	assert.Equal(t, "someone", dbItem.Deleted.By, "We know who deleted it")
+	assert.False(t, dbItem.Deleted.At.IsZero(), "We know when it was deleted")
+
+	payments, err := paymentsDB.List(ctx, ListOptions{})
+	assert.NoError(t, err, "We can fetch list from DB")
+	assert.Equal(t, 0, len(payments.Items), "Deleted payments are not listed")
+
+	payments, err = paymentsDB.List(ctx, ListOptions{IncludeDeleted: true})
+	assert.NoError(t, err, "We can fetch list from DB")
+	assert.Equal(t, 1, len(payments.Items), "Deleted payments can be listed")
+
+	_, err = paymentsDB.Update(ctx, dbItem)
+	assert.True(t, IsErrorNoDBResults(err), "Deleted payments cannot be updated")
+
+	_, err = paymentsDB.Save(ctx, payment1)
+	assert.Error(t, err, "The ID of a deleted payment cannot be used again")
+
+	restored, err := paymentsDB.Restore(ctx, payment1.ID)
+	assert.NoError(t, err, "We can restore it")
+	assert.Nil(t, restored.Deleted, "It is not deleted anymore")
+	assert.Equal(t, dbItem.Version+1, restored.Version, "Restoring changes the version")
+
+	_, err = paymentsDB.Get(ctx, payment1.ID, GetOptions{})
+	assert.NoError(t, err, "Restored payments are found")
+
+	_, err = paymentsDB.Restore(ctx, model.PaymentID("notThere"))
+	assert.True(t, IsErrorNoDBResults(err), "We cannot restore what is not there")
+}
+
+func TestTransitions(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "transitionsDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	paymentsDB, err := GetPayments(ctx, client)
+	assert.NoError(t, err, "We can init DB")
+
+	testTransitions(ctx, t, paymentsDB)
+}
+
+// testTransitions checks the status of the payments follows the state
+// machine, in any PaymentStore
+func testTransitions(ctx context.Context, t *testing.T, paymentsDB PaymentStore) {
+
+	_, err := paymentsDB.Transition(ctx, model.PaymentID("notThere"), model.ActionSubmit, "")
+	assert.True(t, IsErrorNoDBResults(err), "We cannot change what is not there")
+
+	saved, err := paymentsDB.Save(ctx, testPayment(model.PaymentID("12345")))
 	assert.NoError(t, err, "We can save one item to DB")
 
-	payments, err = paymentsDB.Last100(ctx)
+	_, err = paymentsDB.Transition(ctx, saved.ID, model.ActionSettle, "")
+	assert.Equal(t, ErrInvalidTransition, err, "Pending payments cannot be settled")
+
+	submitted, err := paymentsDB.Transition(WithActor(ctx, "someone"), saved.ID, model.ActionSubmit, "")
+	assert.NoError(t, err, "Pending payments can be submitted")
+	assert.Equal(t, model.StatusSubmitted, submitted.Status, "It is submitted")
+	assert.Equal(t, saved.Version+1, submitted.Version, "The version got incremented")
+
+	// PUT cannot change the status
+	submitted.Status = model.StatusSettled
+	updated, err := paymentsDB.Update(ctx, submitted)
+	assert.NoError(t, err, "We can update it")
+	assert.Equal(t, model.StatusSubmitted, updated.Status, "Updating keeps the status")
+
+	settled, err := paymentsDB.Transition(ctx, saved.ID, model.ActionSettle, "")
+	assert.NoError(t, err, "Submitted payments can be settled")
+
+	_, err = paymentsDB.Transition(ctx, saved.ID, model.ActionReject, "")
+	assert.Equal(t, ErrInvalidTransition, err, "Settled payments cannot be rejected")
+
+	returned, err := paymentsDB.Transition(ctx, saved.ID, model.ActionReturn, "wrong account")
+	assert.NoError(t, err, "Settled payments can be returned")
+	assert.Equal(t, model.StatusReturned, returned.Status, "It is returned")
+	assert.Equal(t, settled.Version+1, returned.Version, "The version got incremented")
+
+	dbItem, err := paymentsDB.Get(ctx, saved.ID, GetOptions{})
+	assert.NoError(t, err, "We can get items from DB")
+	assert.Equal(t, 4, len(dbItem.StatusHistory), "All the changes are in the history")
+	if len(dbItem.StatusHistory) == 4 {
+		assert.Equal(t, model.StatusPending, dbItem.StatusHistory[0].To, "It was created pending")
+		assert.Equal(t, model.StatusPending, dbItem.StatusHistory[1].From, "It was submitted from pending")
+		assert.Equal(t, "someone", dbItem.StatusHistory[1].By, "We know who submitted it")
+		assert.Equal(t, "wrong account", dbItem.StatusHistory[3].Reason, "We know why it was returned")
+	}
+
+	_, err = paymentsDB.Delete(ctx, saved.ID)
+	assert.NoError(t, err, "We can delete from DB")
+	_, err = paymentsDB.Transition(ctx, saved.ID, model.ActionReturn, "")
+	assert.True(t, IsErrorNoDBResults(err), "Deleted payments cannot change")
+}
+
+func TestHistory(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "historyDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	paymentsDB, err := GetPayments(ctx, client)
+	assert.NoError(t, err, "We can init DB")
+
+	testHistory(ctx, t, paymentsDB)
+}
+
+// testHistory checks all the changes are in the audit log, in any PaymentStore
+func testHistory(ctx context.Context, t *testing.T, paymentsDB PaymentStore) {
+
+	_, err := paymentsDB.History(ctx, model.PaymentID("12345"))
+	assert.True(t, IsErrorNoDBResults(err), "There is no history of what is not there")
+
+	ctx = WithRequestID(WithActor(ctx, "someone"), "request-1")
+
+	saved, err := paymentsDB.Save(ctx, testPayment(model.PaymentID("12345")))
+	assert.NoError(t, err, "We can save one item to DB")
+
+	saved.OrganisationID = "newOrg"
+	updated, err := paymentsDB.Update(ctx, saved)
+	assert.NoError(t, err, "We can update")
+
+	_, err = paymentsDB.Update(ctx, saved)
+	assert.Equal(t, ErrVersionConflict, err, "We cannot update an old version")
+
+	_, err = paymentsDB.Transition(ctx, saved.ID, model.ActionSubmit, "")
+	assert.NoError(t, err, "We can submit it")
+
+	_, err = paymentsDB.Delete(ctx, saved.ID)
+	assert.NoError(t, err, "We can delete it")
+
+	_, err = paymentsDB.Restore(ctx, saved.ID)
+	assert.NoError(t, err, "We can restore it")
+
+	entries, err := paymentsDB.History(ctx, saved.ID)
+	assert.NoError(t, err, "We can get the history")
+
+	operations := []model.Operation{}
+	for _, entry := range entries {
+		operations = append(operations, entry.Operation)
+		assert.Equal(t, saved.ID, entry.PaymentID, "It is the history of the payment")
+		assert.Equal(t, "someone", entry.Actor, "We know who did it")
+		assert.Equal(t, "request-1", entry.RequestID, "We know the request")
+		assert.False(t, entry.At.IsZero(), "We know when it was done")
+		assert.NotNil(t, entry.After, "We know how it ended")
+	}
+	assert.Equal(t, []model.Operation{model.OperationCreate, model.OperationUpdate,
+		model.Operation(model.ActionSubmit), model.OperationDelete, model.OperationRestore},
+		operations, "Only the changes done are there, in order")
+
+	if len(entries) == 5 {
+		assert.Nil(t, entries[0].Before, "It was created")
+		assert.Equal(t, saved.OrganisationID, entries[1].After.OrganisationID, "We know how it was updated")
+		assert.Equal(t, "", entries[1].Before.OrganisationID, "We know how it was before")
+		assert.Equal(t, updated.Version, entries[1].After.Version, "We know the version after")
+		assert.Equal(t, model.StatusSubmitted, entries[2].After.Status, "We know the status after")
+		assert.NotNil(t, entries[3].After.Deleted, "We know it was deleted")
+	}
+}
+
+func TestSummary(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "summaryDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	paymentsDB, err := GetPayments(ctx, client)
+	assert.NoError(t, err, "We can init DB")
+
+	testSummary(ctx, t, paymentsDB)
+}
+
+// testSummary checks the totals of the payments are exact, in any PaymentStore
+func testSummary(ctx context.Context, t *testing.T, paymentsDB PaymentStore) {
+
+	items := []struct {
+		id       model.PaymentID
+		org      string
+		currency string
+		date     string
+		amount   string
+		charges  []model.Money
+	}{
+		{"1", "org1", "GBP", "2017-01-18", "100.21", []model.Money{testMoney("5.00", "GBP"), testMoney("10", "USD")}},
+		{"2", "org1", "GBP", "2017-01-18", "0.1", []model.Money{testMoney("0.2", "GBP")}},
+		{"3", "org1", "GBP", "2017-01-19", "1000", nil},
+		{"4", "org2", "USD", "2017-01-18", "9.99", nil},
+		{"5", "org2", "USD", "2017-01-18", "5", nil},
+	}
+	for _, item := range items {
+		payment := testPayment(item.id)
+		payment.OrganisationID = item.org
+		payment.Attributes.ProcessingDate = item.date
+		payment.Attributes.Amount = testMoney(item.amount, item.currency)
+		payment.Attributes.ChargesInformation.SenderCharges = item.charges
+		payment.Attributes.ChargesInformation.ReceiverCharges = testMoney("1", "GBP")
+		_, err := paymentsDB.Save(ctx, payment)
+		assert.NoError(t, err, "We can save one item to DB")
+	}
+	_, err := paymentsDB.Delete(ctx, "5")
+	assert.NoError(t, err, "We can delete from DB")
+
+	res, err := paymentsDB.Summary(ctx, SummaryOptions{})
+	assert.NoError(t, err, "We can get the summary")
+	assert.Equal(t, []model.Summary{
+		{
+			Currency:        "GBP",
+			Count:           3,
+			Amount:          model.MustParseDecimal("1100.31"),
+			SenderCharges:   []model.Money{testMoney("5.20", "GBP"), testMoney("10.00", "USD")},
+			ReceiverCharges: []model.Money{testMoney("3.00", "GBP")},
+		},
+		{
+			Currency:        "USD",
+			Count:           1,
+			Amount:          model.MustParseDecimal("9.99"),
+			SenderCharges:   []model.Money{},
+			ReceiverCharges: []model.Money{testMoney("1.00", "GBP")},
+		},
+	}, res, "The amounts are added per currency, without the deleted payments")
+
+	res, err = paymentsDB.Summary(ctx, SummaryOptions{
+		GroupBy: []string{GroupOrganisation, GroupProcessingDate},
+		Filter:  PaymentFilter{ProcessingDateFrom: "2017-01-18", ProcessingDateTo: "2017-01-18"},
+	})
+	assert.NoError(t, err, "We can get the summary")
+	assert.Equal(t, 2, len(res), "There is one group per organisation and day")
+	if len(res) == 2 {
+		assert.Equal(t, "org1", res[0].OrganisationID, "They are sorted by organisation")
+		assert.Equal(t, "2017-01-18", res[0].ProcessingDate, "They are grouped by day")
+		assert.Equal(t, int64(2), res[0].Count, "Only the payments of the day are added")
+		assert.Equal(t, model.MustParseDecimal("100.31"), res[0].Amount, "Only the payments of the day are added")
+		assert.Equal(t, "org2", res[1].OrganisationID, "They are sorted by organisation")
+	}
+
+	_, err = paymentsDB.Summary(ctx, SummaryOptions{GroupBy: []string{"id"}})
+	assert.Equal(t, ErrInvalidGroup, err, "We cannot group by any field")
+}
+
+func TestSaveMany(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "saveManyDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	paymentsDB, err := GetPayments(ctx, client)
+	assert.NoError(t, err, "We can init DB")
+
+	testSaveMany(ctx, t, paymentsDB)
+}
+
+// testSaveMany checks the payments of a batch are saved on their own, in any
+// PaymentStore
+func testSaveMany(ctx context.Context, t *testing.T, paymentsDB PaymentStore) {
+
+	_, err := paymentsDB.Save(ctx, testPayment(model.PaymentID("1")))
+	assert.NoError(t, err, "We can save one item to DB")
+
+	saved, errs, err := paymentsDB.SaveMany(ctx, []model.Payment{
+		testPayment(model.PaymentID("1")),
+		testPayment(model.PaymentID("2")),
+		testPayment(model.PaymentID("2")),
+		testPayment(model.PaymentID("3")),
+	})
+	assert.NoError(t, err, "We can save many")
+	assert.Equal(t, 4, len(errs), "There is the result of each one")
+	if len(errs) == 4 {
+		assert.True(t, IsErrorDuplicate(errs[0]), "It was already there")
+		assert.NoError(t, errs[1], "It was saved")
+		assert.True(t, IsErrorDuplicate(errs[2]), "It was in the batch twice")
+		assert.NoError(t, errs[3], "The errors do not stop the rest")
+		assert.Equal(t, model.StatusPending, saved[3].Status, "They are saved pending")
+	}
+
+	res, err := paymentsDB.List(ctx, ListOptions{})
 	assert.NoError(t, err, "We can fetch list from DB")
-	assert.Equal(t, 3, len(payments), "We got three items from DB")
+	assert.Equal(t, 3, len(res.Items), "Only the new ones were saved")
+
+	history, err := paymentsDB.History(ctx, model.PaymentID("3"))
+	assert.NoError(t, err, "We can get the history")
+	assert.Equal(t, 1, len(history), "Its creation is in the audit log")
+
+	_, errs, err = paymentsDB.SaveMany(ctx, nil)
+	assert.NoError(t, err, "We can save nothing")
+	assert.Equal(t, 0, len(errs), "Nothing was saved")
+}
+
+func TestExport(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "exportDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	paymentsDB, err := GetPayments(ctx, client)
+	assert.NoError(t, err, "We can init DB")
+
+	testExport(ctx, t, paymentsDB)
+}
+
+// testExport checks all the payments matching are exported in order, in any
+// PaymentStore
+func testExport(ctx context.Context, t *testing.T, paymentsDB PaymentStore) {
+
+	for i := 0; i < MaxListLimit+5; i++ {
+		payment := testPayment(model.PaymentID(fmt.Sprintf("%04d", i)))
+		if i%2 == 1 {
+			payment.OrganisationID = "odd"
+		}
+		_, err := paymentsDB.Save(ctx, payment)
+		assert.NoError(t, err, "We can save one item to DB")
+	}
+	_, err := paymentsDB.Delete(ctx, model.PaymentID("0001"))
+	assert.NoError(t, err, "We can delete one")
+
+	var ids []model.PaymentID
+	err = paymentsDB.Export(ctx, ExportOptions{}, func(p *model.Payment) error {
+		ids = append(ids, p.ID)
+		return nil
+	})
+	assert.NoError(t, err, "We can export")
+	assert.Equal(t, MaxListLimit+4, len(ids), "We got all but the deleted one")
+	if len(ids) > 0 {
+		assert.Equal(t, model.PaymentID(fmt.Sprintf("%04d", MaxListLimit+4)), ids[0], "Newest first")
+	}
+
+	count := 0
+	err = paymentsDB.Export(ctx, ExportOptions{
+		Filter:         PaymentFilter{OrganisationID: "odd"},
+		Sort:           Sort{Field: SortCreated},
+		IncludeDeleted: true,
+	}, func(p *model.Payment) error {
+		if count == 0 {
+			assert.Equal(t, model.PaymentID("0001"), p.ID, "Oldest first, with the deleted")
+		}
+		count++
+		return nil
+	})
+	assert.NoError(t, err, "We can export filtered")
+	assert.Equal(t, (MaxListLimit+5)/2, count, "We got the ones matching")
+
+	stop := errors.New("stop")
+	count = 0
+	err = paymentsDB.Export(ctx, ExportOptions{}, func(p *model.Payment) error {
+		count++
+		return stop
+	})
+	assert.Equal(t, stop, err, "We get the error stopping the export")
+	assert.Equal(t, 1, count, "It stopped at the first one")
+}
+
+func TestEvents(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "eventsDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	paymentsDB, err := GetPayments(ctx, client)
+	assert.NoError(t, err, "We can init DB")
+
+	testEvents(ctx, t, paymentsDB)
+}
+
+// testEvents checks the changes are sent to the feeds, and they can be resumed,
+// in any PaymentStore
+func testEvents(ctx context.Context, t *testing.T, paymentsDB PaymentStore) {
+
+	stream, err := paymentsDB.Events(ctx, "")
+	assert.NoError(t, err, "We can get the feed")
+	if err != nil {
+		return
+	}
+	defer stream.Close(ctx)
+
+	payment := testPayment(model.PaymentID("1"))
+	_, err = paymentsDB.Save(ctx, payment)
+	assert.NoError(t, err, "We can save one item to DB")
+	_, err = paymentsDB.Delete(ctx, payment.ID)
+	assert.NoError(t, err, "We can delete it")
+
+	created, err := stream.Next(ctx)
+	assert.NoError(t, err, "We get the first change")
+	assert.Equal(t, model.EventCreated, created.Type, "It was created")
+	assert.Equal(t, payment.ID, created.PaymentID, "It is the payment saved")
+	assert.NotEmpty(t, created.ID, "The event has an ID")
+
+	deleted, err := stream.Next(ctx)
+	assert.NoError(t, err, "We get the second change")
+	assert.Equal(t, model.EventDeleted, deleted.Type, "It was deleted")
+	assert.NotNil(t, deleted.Payment.Deleted, "We got the payment after the change")
+
+	resumed, err := paymentsDB.Events(ctx, created.ID)
+	assert.NoError(t, err, "We can resume the feed")
+	if err == nil {
+		defer resumed.Close(ctx)
+		event, err := resumed.Next(ctx)
+		assert.NoError(t, err, "We get the change after the one resumed from")
+		assert.Equal(t, deleted.ID, event.ID, "It is the deletion")
+	}
+
+	_, err = paymentsDB.Events(ctx, "not an id")
+	assert.Equal(t, ErrInvalidEventID, err, "We cannot resume from what is not an ID")
+}
+
+func TestOrganisationScoping(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "scopingDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	paymentsDB, err := GetPayments(ctx, client)
+	assert.NoError(t, err, "We can init DB")
+
+	testOrganisationScoping(ctx, t, paymentsDB)
+}
+
+// testOrganisationScoping checks a context with organisations only sees and
+// changes their payments, in any PaymentStore
+func testOrganisationScoping(ctx context.Context, t *testing.T, paymentsDB PaymentStore) {
+
+	mine := testPayment(model.PaymentID("mine"))
+	mine.OrganisationID = "myOrg"
+	theirs := testPayment(model.PaymentID("theirs"))
+	theirs.OrganisationID = "theirOrg"
+
+	_, err := paymentsDB.Save(ctx, theirs)
+	assert.NoError(t, err, "We can save a payment of any organisation without scope")
+
+	scopedCtx := WithOrganisations(ctx, []string{"myOrg", "otherOrg"})
+
+	_, err = paymentsDB.Save(scopedCtx, mine)
+	assert.NoError(t, err, "We can save a payment of an allowed organisation")
+	_, err = paymentsDB.Save(scopedCtx, testPayment(model.PaymentID("another")))
+	assert.Equal(t, ErrOrganisationNotAllowed, err, "We cannot save one of another organisation")
+
+	_, errs, err := paymentsDB.SaveMany(scopedCtx, []model.Payment{theirs, mine})
+	assert.NoError(t, err, "We can save many")
+	assert.Equal(t, ErrOrganisationNotAllowed, errs[0], "Not of another organisation")
+	assert.True(t, IsErrorDuplicate(errs[1]), "Errors are still in the right place")
+
+	res, err := paymentsDB.List(scopedCtx, ListOptions{})
+	assert.NoError(t, err, "We can list")
+	assert.Equal(t, 1, len(res.Items), "Only the allowed payments are listed")
+
+	res, err = paymentsDB.List(scopedCtx, ListOptions{Filter: PaymentFilter{OrganisationID: "theirOrg"}})
+	assert.NoError(t, err, "We can list filtering by organisation")
+	assert.Equal(t, 0, len(res.Items), "The filter cannot get other organisations")
+
+	_, err = paymentsDB.Get(scopedCtx, theirs.ID, GetOptions{})
+	assert.True(t, IsErrorNoDBResults(err), "We cannot get the payments of other organisations")
+	_, err = paymentsDB.History(scopedCtx, theirs.ID)
+	assert.True(t, IsErrorNoDBResults(err), "Nor their history")
+
+	theirs.Version = 0
+	_, err = paymentsDB.Update(scopedCtx, theirs)
+	assert.Equal(t, ErrOrganisationNotAllowed, err, "We cannot update them")
+	deleted, err := paymentsDB.Delete(scopedCtx, theirs.ID)
+	assert.NoError(t, err, "Deleting them is not an error")
+	assert.Equal(t, int64(0), deleted, "But nothing is deleted")
+	_, err = paymentsDB.Transition(scopedCtx, theirs.ID, model.ActionSubmit, "")
+	assert.True(t, IsErrorNoDBResults(err), "Nor their status changed")
+
+	saved, err := paymentsDB.Get(scopedCtx, mine.ID, GetOptions{})
+	assert.NoError(t, err, "We can get our payments")
+	saved.OrganisationID = "theirOrg"
+	_, err = paymentsDB.Update(scopedCtx, saved)
+	assert.Equal(t, ErrOrganisationNotAllowed, err, "We cannot move them to another organisation")
+	saved.OrganisationID = "otherOrg"
+	_, err = paymentsDB.Update(scopedCtx, saved)
+	assert.NoError(t, err, "But we can to another allowed one")
+
+	summary, err := paymentsDB.Summary(scopedCtx, SummaryOptions{})
+	assert.NoError(t, err, "We can get the summary")
+	if assert.Equal(t, 1, len(summary), "One currency") {
+		assert.Equal(t, int64(1), summary[0].Count, "Only our payment is added")
+	}
 
+	_, err = paymentsDB.Get(ctx, theirs.ID, GetOptions{})
+	assert.NoError(t, err, "Without scope all are there")
 }
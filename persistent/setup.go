@@ -28,6 +28,8 @@ func Connect(ctx context.Context, host string, port int, user, password string)
 	connStr := fmt.Sprintf("mongodb://%s:%d", host, port)
 	ops := options.Client().ApplyURI(connStr)
 	ops.SetAppName("ApiPay")
+	ops.SetRegistry(registry())
+	ops.SetMonitor(commandMonitor())
 
 	if len(user) > 0 {
 		creds := options.Credential{Username: user}
@@ -46,12 +48,66 @@ func Connect(ctx context.Context, host string, port int, user, password string)
 	return conn, nil
 }
 
+// now is the current time, with the precision Mongo stores it
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
 // IsErrorNoDBResults is just a small helper to check if the error is just
 // that we didn't find anything on DB
 func IsErrorNoDBResults(err error) bool {
 	return err == mongo.ErrNoDocuments
 }
 
+// IsErrorDuplicate checks if the error is because there is already an item
+// with the same ID
+func IsErrorDuplicate(err error) bool {
+	return err == errMemoryDuplicateID || isDuplicateKey(err)
+}
+
+// IsErrorTimeout checks if the error is because the DB took too long
+func IsErrorTimeout(err error) bool {
+
+	const maxTimeExpiredCode = 50
+
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	if e, ok := err.(mongo.CommandError); ok && e.Code == maxTimeExpiredCode {
+		return true
+	}
+	if e, ok := err.(interface{ Timeout() bool }); ok && e.Timeout() {
+		return true
+	}
+	return false
+}
+
+// isDuplicateKey checks if the error is because of a unique index
+func isDuplicateKey(err error) bool {
+
+	const duplicateKeyCode = 11000
+
+	switch e := err.(type) {
+	case mongo.WriteException:
+		for _, we := range e.WriteErrors {
+			if we.Code == duplicateKeyCode {
+				return true
+			}
+		}
+	case mongo.BulkWriteException:
+		for _, we := range e.WriteErrors {
+			if we.Code == duplicateKeyCode {
+				return true
+			}
+		}
+	case mongo.WriteError:
+		return e.Code == duplicateKeyCode
+	case mongo.CommandError:
+		return e.Code == duplicateKeyCode
+	}
+	return false
+}
+
 // Close closes DB connection and it is not usable once this method is run
 func (cl *Client) Close(ctx context.Context) error {
 	err := cl.mongoClient.Disconnect(ctx)
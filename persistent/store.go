@@ -0,0 +1,223 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrVersionConflict is returned when updating a payment that has been changed
+// since it was read, ie. the version is not the stored one
+var ErrVersionConflict = errors.New("version conflict")
+
+// ErrNotDeleted is returned when restoring a payment that is not deleted
+var ErrNotDeleted = errors.New("payment not deleted")
+
+// ErrInvalidTransition is returned when doing an action to a payment that is
+// not allowed from its status
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// GetOptions are the options to get a payment
+type GetOptions struct {
+	// IncludeDeleted gets also deleted payments, otherwise they are not found
+	IncludeDeleted bool
+}
+
+// PaymentStore is the contract any payments storage has to fulfil. Payments
+// is the Mongo backed one and MemoryPayments keeps everything in process,
+// which is handy for tests or to run the API without a DB.
+// All the changes are recorded in the audit log, with the actor and the
+// request ID of the context. Only the payments of the organisations allowed
+// by the context are seen and changed, see WithOrganisations
+type PaymentStore interface {
+	// Save saves a payment, pending. If it is already there it will fail.
+	// Returns the saved payment
+	Save(ctx context.Context, obj model.Payment) (model.Payment, error)
+
+	// SaveMany saves many payments, pending, carrying on when some of them
+	// fail. It returns the saved payments and the error of each one, in the
+	// same order as objs, nil if it was saved. If something failed besides
+	// the payments, eg. the DB is down, it is returned too, with the results
+	// of the ones already saved
+	SaveMany(ctx context.Context, objs []model.Payment) ([]model.Payment, []error, error)
+
+	// Update replaces an existing payment, if obj has the stored version.
+	// Returns the updated payment, with the version incremented. Deleted
+	// payments cannot be updated, and the status is kept as it is
+	Update(ctx context.Context, obj model.Payment) (model.Payment, error)
+
+	// Get finds a payment by ID
+	Get(ctx context.Context, id model.PaymentID, opts GetOptions) (model.Payment, error)
+
+	// Delete marks a payment as deleted by the actor of the context, returns
+	// the number of deleted items
+	Delete(ctx context.Context, id model.PaymentID) (int64, error)
+
+	// Restore undoes the Delete of a payment. Returns the restored payment
+	Restore(ctx context.Context, id model.PaymentID) (model.Payment, error)
+
+	// Transition does an action to a payment, moving it to a new status if it
+	// is allowed from the current one, otherwise it fails with
+	// ErrInvalidTransition. The change is recorded in the status history
+	Transition(ctx context.Context, id model.PaymentID, action model.Action, reason string) (model.Payment, error)
+
+	// List gets a page of payments, newest first
+	List(ctx context.Context, opts ListOptions) (ListResult, error)
+
+	// Export calls fn with each of the payments matching the options, in
+	// order, without having them all in memory. It stops when fn fails
+	Export(ctx context.Context, opts ExportOptions, fn func(*model.Payment) error) error
+
+	// Summary adds the payments matching the filter of the options, grouped
+	// by the fields of the options. Deleted payments are not added
+	Summary(ctx context.Context, opts SummaryOptions) ([]model.Summary, error)
+
+	// History gets the audit log of a payment, oldest first. Deleted payments
+	// have it too
+	History(ctx context.Context, id model.PaymentID) ([]model.AuditEntry, error)
+
+	// Events returns a feed of the changes to the payments, after the event
+	// with the ID after, or of the new ones if it is empty
+	Events(ctx context.Context, after string) (EventStream, error)
+}
+
+// pending sets the status of a new payment, pending, with that as the only
+// change of its history
+func pending(ctx context.Context, obj model.Payment) model.Payment {
+
+	obj.Status = model.StatusPending
+	obj.StatusHistory = []model.StatusChange{{
+		To: model.StatusPending,
+		At: now(),
+		By: actorFrom(ctx),
+	}}
+	return obj
+}
+
+// statusChange returns the change of doing an action to a payment
+func statusChange(ctx context.Context, from model.Status, action model.Action, reason string) model.StatusChange {
+
+	if len(from) == 0 {
+		from = model.StatusPending
+	}
+	return model.StatusChange{
+		From:   from,
+		To:     action.To(),
+		At:     now(),
+		By:     actorFrom(ctx),
+		Reason: reason,
+	}
+}
+
+// updatedPayment returns current updated with what the clients can change of obj
+func updatedPayment(current, obj model.Payment) model.Payment {
+
+	current.Type = obj.Type
+	current.OrganisationID = obj.OrganisationID
+	current.Attributes = obj.Attributes
+	current.Version++
+	return current
+}
+
+// transitionedPayment returns current after a change of its status
+func transitionedPayment(current model.Payment, change model.StatusChange) model.Payment {
+
+	current.StatusHistory = append(append([]model.StatusChange(nil), current.StatusHistory...), change)
+	current.Status = change.To
+	current.Version++
+	return current
+}
+
+// auditEntry returns the entry of the audit log of a change to a payment. If
+// it was created, before is nil
+func auditEntry(ctx context.Context, operation model.Operation, before, after *model.Payment) model.AuditEntry {
+
+	entry := model.AuditEntry{
+		Operation: operation,
+		Actor:     actorFrom(ctx),
+		RequestID: requestIDFrom(ctx),
+		At:        now(),
+		Before:    before,
+		After:     after,
+	}
+	if after != nil {
+		entry.PaymentID = after.ID
+	} else if before != nil {
+		entry.PaymentID = before.ID
+	}
+	return entry
+}
+
+// Stores groups all the stores the API needs
+type Stores struct {
+	Payments    PaymentStore
+	Idempotency IdempotencyStore
+	Webhooks    WebhookStore
+	Outbox      OutboxStore
+	APIKeys     APIKeyStore
+
+	// Transactional is true when each change is written at once with its audit
+	// and outbox entries, all or none. Mongo only does it as a replica set
+	Transactional bool
+}
+
+// GetStores gets all the Mongo stores with a given DB connection.
+// idempotencyTTL is how long the responses of idempotent requests are kept
+func GetStores(ctx context.Context, cl Client, idempotencyTTL time.Duration) (Stores, error) {
+
+	payments, err := GetPayments(ctx, cl)
+	if err != nil {
+		return Stores{}, err
+	}
+	migrated, err := payments.migrateAmounts(ctx)
+	if err != nil {
+		return Stores{}, err
+	}
+	if migrated > 0 {
+		Logger(ctx).Sugar().Infow("db-migrated-amounts", "payments", migrated)
+	}
+
+	idempotency, err := GetIdempotency(ctx, cl, idempotencyTTL)
+	if err != nil {
+		return Stores{}, err
+	}
+
+	webhooks, err := GetWebhooks(ctx, cl)
+	if err != nil {
+		return Stores{}, err
+	}
+	payments.webhooks = webhooks
+
+	apiKeys, err := GetAPIKeys(ctx, cl)
+	if err != nil {
+		return Stores{}, err
+	}
+
+	return Stores{
+		Payments:    InstrumentedPayments(payments, defaultPaymentsCollection),
+		Idempotency: idempotency,
+		Webhooks:    webhooks,
+		Outbox:      GetOutbox(cl),
+		APIKeys:     apiKeys,
+
+		Transactional: payments.replicated,
+	}, nil
+}
+
+// NewMemoryStores creates all the stores in memory
+func NewMemoryStores(idempotencyTTL time.Duration) Stores {
+
+	payments := NewMemoryPayments()
+	payments.webhooks = NewMemoryWebhooks()
+
+	return Stores{
+		Payments:    InstrumentedPayments(payments, ""),
+		Idempotency: NewMemoryIdempotency(idempotencyTTL),
+		Webhooks:    payments.webhooks,
+		Outbox:      payments.outbox,
+		APIKeys:     NewMemoryAPIKeys(),
+
+		Transactional: true,
+	}
+}
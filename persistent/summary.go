@@ -0,0 +1,266 @@
+package persistent
+
+import (
+	"apipay/model"
+	"errors"
+	"math/big"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Fields the summary can be grouped by. The currency is always used
+const (
+	GroupOrganisation   = "organisation_id"
+	GroupCurrency       = "currency"
+	GroupPaymentScheme  = "payment_scheme"
+	GroupProcessingDate = "processing_date"
+)
+
+// groupFields are the fields allowed for grouping, with their name in Mongo
+var groupFields = map[string]string{
+	GroupOrganisation:   fieldOrganisationID,
+	GroupCurrency:       fieldCurrency,
+	GroupPaymentScheme:  fieldPaymentScheme,
+	GroupProcessingDate: fieldProcessingDate,
+}
+
+// Names of the fields of the charges as they are stored in Mongo
+const (
+	fieldSenderCharges           = "attributes.chargesinformation.sendercharges"
+	fieldReceiverChargesAmount   = "attributes.chargesinformation.receiverchargesamount"
+	fieldReceiverChargesCurrency = "attributes.chargesinformation.receiverchargescurrency"
+)
+
+// ErrInvalidGroup is returned when grouping by a field that is not allowed
+var ErrInvalidGroup = errors.New("invalid group")
+
+// SummaryOptions are the options of the summary of the payments
+type SummaryOptions struct {
+	// GroupBy are the fields the payments are grouped by, besides the currency
+	GroupBy []string
+
+	// Filter are the conditions the payments have to match to be added
+	Filter PaymentFilter
+}
+
+// Validate checks the options can be used
+func (o SummaryOptions) Validate() error {
+
+	for _, field := range o.GroupBy {
+		if _, found := groupFields[field]; !found {
+			return ErrInvalidGroup
+		}
+	}
+	return o.Filter.Validate()
+}
+
+// groups returns the set of fields the payments are grouped by
+func (o SummaryOptions) groups() map[string]bool {
+
+	res := map[string]bool{GroupCurrency: true}
+	for _, field := range o.GroupBy {
+		res[field] = true
+	}
+	return res
+}
+
+// summaryKey identifies a group of payments, and the currency of the charges
+// when adding them. The fields not grouped by are empty
+type summaryKey struct {
+	OrganisationID  string `bson:"organisation"`
+	Currency        string `bson:"currency"`
+	PaymentScheme   string `bson:"scheme"`
+	ProcessingDate  string `bson:"date"`
+	ChargesCurrency string `bson:"chargescurrency"`
+}
+
+// summaryRow is a total of a group of payments
+type summaryRow struct {
+	Key    summaryKey    `bson:"_id"`
+	Count  int64         `bson:"count"`
+	Amount model.Decimal `bson:"amount"`
+}
+
+// groupKey returns the key of the group of a payment
+func (o SummaryOptions) groupKey(p *model.Payment) summaryKey {
+
+	groups := o.groups()
+	key := summaryKey{Currency: p.Attributes.Amount.Currency}
+	if groups[GroupOrganisation] {
+		key.OrganisationID = p.OrganisationID
+	}
+	if groups[GroupPaymentScheme] {
+		key.PaymentScheme = p.Attributes.PaymentScheme
+	}
+	if groups[GroupProcessingDate] {
+		key.ProcessingDate = p.Attributes.ProcessingDate
+	}
+	return key
+}
+
+// mongoGroupKey is what groupKey does, but as the _id of a Mongo $group.
+// chargesCurrency is the field of the currency of the charges, if adding them
+func (o SummaryOptions) mongoGroupKey(chargesCurrency string) bson.D {
+
+	value := func(field string) bson.D {
+		return bson.D{{Key: "$ifNull", Value: bson.A{"$" + field, ""}}}
+	}
+
+	groups := o.groups()
+	key := bson.D{{Key: "currency", Value: value(fieldCurrency)}}
+	if groups[GroupOrganisation] {
+		key = append(key, bson.E{Key: "organisation", Value: value(fieldOrganisationID)})
+	}
+	if groups[GroupPaymentScheme] {
+		key = append(key, bson.E{Key: "scheme", Value: value(fieldPaymentScheme)})
+	}
+	if groups[GroupProcessingDate] {
+		key = append(key, bson.E{Key: "date", Value: value(fieldProcessingDate)})
+	}
+	if len(chargesCurrency) > 0 {
+		key = append(key, bson.E{Key: "chargescurrency", Value: value(chargesCurrency)})
+	}
+	return key
+}
+
+// mongoPipeline is the aggregation that adds the payments matching filter.
+// It returns one document, with the rows of the payments, the sender charges
+// and the receiver charges
+func (o SummaryOptions) mongoPipeline(filter bson.D) bson.A {
+
+	sum := func(field string) bson.D {
+		return bson.D{{Key: "$sum", Value: "$" + field}}
+	}
+
+	payments := bson.A{
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: o.mongoGroupKey("")},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "amount", Value: sum(fieldAmount)},
+		}}},
+	}
+	sender := bson.A{
+		bson.D{{Key: "$unwind", Value: "$" + fieldSenderCharges}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: o.mongoGroupKey(fieldSenderCharges + ".currency")},
+			{Key: "amount", Value: sum(fieldSenderCharges + ".amount")},
+		}}},
+	}
+	receiver := bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: fieldReceiverChargesAmount, Value: bson.D{{Key: "$ne", Value: nil}}}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: o.mongoGroupKey(fieldReceiverChargesCurrency)},
+			{Key: "amount", Value: sum(fieldReceiverChargesAmount)},
+		}}},
+	}
+
+	return bson.A{
+		bson.D{{Key: "$match", Value: filter}},
+		bson.D{{Key: "$facet", Value: bson.D{
+			{Key: "payments", Value: payments},
+			{Key: "sender", Value: sender},
+			{Key: "receiver", Value: receiver},
+		}}},
+	}
+}
+
+// summaryFacets is the result of mongoPipeline
+type summaryFacets struct {
+	Payments []summaryRow `bson:"payments"`
+	Sender   []summaryRow `bson:"sender"`
+	Receiver []summaryRow `bson:"receiver"`
+}
+
+// summaries builds the summaries from the totals of the payments and their
+// charges. They are sorted by the fields of the groups
+func summaries(facets summaryFacets) []model.Summary {
+
+	res := make([]model.Summary, 0, len(facets.Payments))
+	groups := make(map[summaryKey]int, len(facets.Payments))
+
+	for _, row := range facets.Payments {
+		groups[row.Key] = len(res)
+		res = append(res, model.Summary{
+			OrganisationID:  row.Key.OrganisationID,
+			Currency:        row.Key.Currency,
+			PaymentScheme:   row.Key.PaymentScheme,
+			ProcessingDate:  row.Key.ProcessingDate,
+			Count:           row.Count,
+			Amount:          row.Amount,
+			SenderCharges:   []model.Money{},
+			ReceiverCharges: []model.Money{},
+		})
+	}
+
+	addCharges := func(rows []summaryRow, charges func(s *model.Summary) *[]model.Money) {
+		for _, row := range rows {
+			key := row.Key
+			key.ChargesCurrency = ""
+			i, found := groups[key]
+			if !found {
+				continue
+			}
+			list := charges(&res[i])
+			*list = append(*list, model.Money{Value: row.Amount, Currency: row.Key.ChargesCurrency})
+		}
+	}
+	addCharges(facets.Sender, func(s *model.Summary) *[]model.Money { return &s.SenderCharges })
+	addCharges(facets.Receiver, func(s *model.Summary) *[]model.Money { return &s.ReceiverCharges })
+
+	for i := range res {
+		sortMoney(res[i].SenderCharges)
+		sortMoney(res[i].ReceiverCharges)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.OrganisationID != b.OrganisationID {
+			return a.OrganisationID < b.OrganisationID
+		}
+		if a.Currency != b.Currency {
+			return a.Currency < b.Currency
+		}
+		if a.PaymentScheme != b.PaymentScheme {
+			return a.PaymentScheme < b.PaymentScheme
+		}
+		return a.ProcessingDate < b.ProcessingDate
+	})
+	return res
+}
+
+// sortMoney sorts amounts by their currency
+func sortMoney(list []model.Money) {
+	sort.Slice(list, func(i, j int) bool { return list[i].Currency < list[j].Currency })
+}
+
+// decimalSum adds decimals exactly. The total has the most decimals of the
+// ones added, as Mongo does with Decimal128
+type decimalSum struct {
+	total *big.Rat
+	scale int
+}
+
+// add adds a decimal. Empty ones are skipped, as Mongo does with nulls
+func (s *decimalSum) add(d model.Decimal) {
+
+	if d.Empty() {
+		return
+	}
+	if s.total == nil {
+		s.total = new(big.Rat)
+	}
+	s.total.Add(s.total, d.Rat())
+	if scale := d.Scale(); scale > s.scale {
+		s.scale = scale
+	}
+}
+
+// decimal returns the total, 0 if nothing was added. It fails if it is too
+// big for a model.Decimal
+func (s *decimalSum) decimal() (model.Decimal, error) {
+
+	if s.total == nil {
+		return model.DecimalFromRat(new(big.Rat), 0)
+	}
+	return model.DecimalFromRat(s.total, s.scale)
+}
@@ -0,0 +1,384 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultWebhooksCollection   = "webhooks"
+	defaultDeliveriesCollection = "deliveries"
+
+	// maxDeliveries is how many deliveries of a webhook are listed, the newest
+	maxDeliveries = 100
+)
+
+// Names of the fields of the webhooks and deliveries as they are stored in Mongo
+const (
+	fieldURL         = "url"
+	fieldEventTypes  = "eventtypes"
+	fieldWebhookID   = "webhookid"
+	fieldAttempts    = "attempts"
+	fieldNextAttempt = "nextattempt"
+	fieldLastError   = "lasterror"
+	fieldDeliveredAt = "deliveredat"
+)
+
+// ErrNotDead is returned when retrying a delivery that is not dead
+var ErrNotDead = errors.New("the delivery is not dead")
+
+// WebhookStore keeps the webhooks, and the deliveries of the changes to them
+type WebhookStore interface {
+	// Save saves a new webhook. If it is already there it will fail
+	Save(ctx context.Context, webhook model.Webhook) error
+
+	// Get gets a webhook, with its secret
+	Get(ctx context.Context, id model.WebhookID) (model.Webhook, error)
+
+	// List gets the webhooks of an organisation, or all if it is empty, oldest first
+	List(ctx context.Context, organisationID string) ([]model.Webhook, error)
+
+	// Update changes the URL and the event types of a webhook
+	Update(ctx context.Context, webhook model.Webhook) (model.Webhook, error)
+
+	// Delete deletes a webhook. Its pending deliveries are not sent
+	Delete(ctx context.Context, id model.WebhookID) (int64, error)
+
+	// Enqueue creates the deliveries of the event of a change, to the webhooks
+	// of the organisation of the payment wanting it
+	Enqueue(ctx context.Context, event model.Event) error
+
+	// ClaimDeliveries gets up to limit pending deliveries due at now, oldest
+	// first, and delays them by lease, so they are not claimed again while
+	// they are being sent
+	ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]model.Delivery, error)
+
+	// UpdateDelivery stores how sending a delivery went
+	UpdateDelivery(ctx context.Context, delivery model.Delivery) error
+
+	// ListDeliveries gets the last deliveries of a webhook, newest first. Only
+	// the ones with the status given, unless it is empty
+	ListDeliveries(ctx context.Context, id model.WebhookID, status model.DeliveryStatus) ([]model.Delivery, error)
+
+	// RetryDelivery makes a dead delivery pending again, due now, with all
+	// the attempts again
+	RetryDelivery(ctx context.Context, id model.WebhookID, deliveryID model.DeliveryID) (model.Delivery, error)
+}
+
+// deliveries returns the deliveries of an event to the webhooks wanting it
+func deliveries(event model.Event, webhooks []model.Webhook) []model.Delivery {
+
+	now := time.Now().UTC()
+
+	var res []model.Delivery
+	for _, webhook := range webhooks {
+		if !webhook.Wants(event.Type) {
+			continue
+		}
+		res = append(res, model.Delivery{
+			ID:             model.NewDeliveryID(),
+			WebhookID:      webhook.ID,
+			OrganisationID: webhook.OrganisationID,
+			Event:          event,
+			Status:         model.DeliveryPending,
+			NextAttempt:    now,
+			CreatedAt:      now,
+		})
+	}
+	return res
+}
+
+// retried returns a dead delivery pending again
+func retried(delivery model.Delivery) model.Delivery {
+
+	delivery.Status = model.DeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttempt = time.Now().UTC()
+	delivery.LastError = ""
+	return delivery
+}
+
+// GetWebhooks is to get the Webhooks object (to interact with DB) with a
+// given DB connection
+func GetWebhooks(ctx context.Context, cl Client) (*Webhooks, error) {
+
+	obj := &Webhooks{
+		webhooks:   cl.db.Collection(defaultWebhooksCollection),
+		deliveries: cl.db.Collection(defaultDeliveriesCollection),
+	}
+
+	err := obj.init(ctx)
+	return obj, err
+}
+
+// Webhooks is the Mongo WebhookStore
+type Webhooks struct {
+	webhooks   *mongo.Collection
+	deliveries *mongo.Collection
+}
+
+// init the collections, setting up indices…
+func (w *Webhooks) init(ctx context.Context) error {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	_, err := w.webhooks.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Options: options.Index().SetBackground(true).SetUnique(true),
+			Keys:    bson.D{{Key: fieldID, Value: 1}},
+		},
+		{
+			Options: options.Index().SetBackground(true),
+			Keys:    bson.D{{Key: fieldOrganisationID, Value: 1}, {Key: fieldMongoID, Value: 1}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.deliveries.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Options: options.Index().SetBackground(true).SetUnique(true),
+			Keys:    bson.D{{Key: fieldID, Value: 1}},
+		},
+		{
+			Options: options.Index().SetBackground(true),
+			Keys:    bson.D{{Key: fieldStatus, Value: 1}, {Key: fieldNextAttempt, Value: 1}},
+		},
+		{
+			Options: options.Index().SetBackground(true),
+			Keys:    bson.D{{Key: fieldWebhookID, Value: 1}, {Key: fieldMongoID, Value: 1}},
+		},
+	})
+	return err
+}
+
+// Save saves a new webhook. If it is already there it will fail
+func (w *Webhooks) Save(ctx context.Context, webhook model.Webhook) error {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	_, err := w.webhooks.InsertOne(ctx, webhook)
+	return err
+}
+
+// Get gets a webhook, with its secret
+func (w *Webhooks) Get(ctx context.Context, id model.WebhookID) (model.Webhook, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	var res model.Webhook
+	err := w.webhooks.FindOne(ctx, bson.D{{Key: fieldID, Value: id}}).Decode(&res)
+	return res, err
+}
+
+// List gets the webhooks of an organisation, or all if it is empty, oldest first
+func (w *Webhooks) List(ctx context.Context, organisationID string) ([]model.Webhook, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	filter := bson.D{}
+	if len(organisationID) > 0 {
+		filter = bson.D{{Key: fieldOrganisationID, Value: organisationID}}
+	}
+
+	cur, err := w.webhooks.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: fieldMongoID, Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	res := []model.Webhook{}
+	for cur.Next(ctx) {
+		var elem model.Webhook
+		if err := cur.Decode(&elem); err != nil {
+			return nil, err
+		}
+		res = append(res, elem)
+	}
+	return res, cur.Err()
+}
+
+// Update changes the URL and the event types of a webhook
+func (w *Webhooks) Update(ctx context.Context, webhook model.Webhook) (model.Webhook, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: fieldURL, Value: webhook.URL},
+		{Key: fieldEventTypes, Value: webhook.EventTypes},
+	}}}
+	findOptions := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var res model.Webhook
+	err := w.webhooks.FindOneAndUpdate(ctx, bson.D{{Key: fieldID, Value: webhook.ID}}, update, findOptions).Decode(&res)
+	return res, err
+}
+
+// Delete deletes a webhook. Its pending deliveries are not sent
+func (w *Webhooks) Delete(ctx context.Context, id model.WebhookID) (int64, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	res, err := w.webhooks.DeleteOne(ctx, bson.D{{Key: fieldID, Value: id}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// Enqueue creates the deliveries of the event of a change, to the webhooks of
+// the organisation of the payment wanting it
+func (w *Webhooks) Enqueue(ctx context.Context, event model.Event) error {
+
+	if event.Payment == nil {
+		return nil
+	}
+	webhooks, err := w.List(ctx, event.Payment.OrganisationID)
+	if err != nil {
+		return err
+	}
+
+	docs := []interface{}{}
+	for _, delivery := range deliveries(event, webhooks) {
+		docs = append(docs, delivery)
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	_, err = w.deliveries.InsertMany(ctx, docs)
+	return err
+}
+
+// ClaimDeliveries gets up to limit pending deliveries due at now, oldest
+// first, and delays them by lease. They are claimed one by one, so two
+// instances never get the same one
+func (w *Webhooks) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration,
+	limit int) ([]model.Delivery, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	filter := bson.D{
+		{Key: fieldStatus, Value: model.DeliveryPending},
+		{Key: fieldNextAttempt, Value: bson.D{{Key: "$lte", Value: now}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: fieldNextAttempt, Value: now.Add(lease)}}}}
+	findOptions := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: fieldNextAttempt, Value: 1}}).
+		SetReturnDocument(options.After)
+
+	res := []model.Delivery{}
+	for len(res) < limit {
+		var delivery model.Delivery
+		err := w.deliveries.FindOneAndUpdate(ctx, filter, update, findOptions).Decode(&delivery)
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		if err != nil {
+			return res, err
+		}
+		res = append(res, delivery)
+	}
+	return res, nil
+}
+
+// UpdateDelivery stores how sending a delivery went
+func (w *Webhooks) UpdateDelivery(ctx context.Context, delivery model.Delivery) error {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: fieldStatus, Value: delivery.Status},
+		{Key: fieldAttempts, Value: delivery.Attempts},
+		{Key: fieldNextAttempt, Value: delivery.NextAttempt},
+		{Key: fieldLastError, Value: delivery.LastError},
+		{Key: fieldDeliveredAt, Value: delivery.DeliveredAt},
+	}}}
+
+	_, err := w.deliveries.UpdateOne(ctx, bson.D{{Key: fieldID, Value: delivery.ID}}, update)
+	return err
+}
+
+// ListDeliveries gets the last deliveries of a webhook, newest first. Only
+// the ones with the status given, unless it is empty
+func (w *Webhooks) ListDeliveries(ctx context.Context, id model.WebhookID,
+	status model.DeliveryStatus) ([]model.Delivery, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	filter := bson.D{{Key: fieldWebhookID, Value: id}}
+	if len(status) > 0 {
+		filter = append(filter, bson.E{Key: fieldStatus, Value: status})
+	}
+	findOptions := options.Find().SetSort(bson.D{{Key: fieldMongoID, Value: -1}}).SetLimit(maxDeliveries)
+
+	cur, err := w.deliveries.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	res := []model.Delivery{}
+	for cur.Next(ctx) {
+		var elem model.Delivery
+		if err := cur.Decode(&elem); err != nil {
+			return nil, err
+		}
+		res = append(res, elem)
+	}
+	return res, cur.Err()
+}
+
+// RetryDelivery makes a dead delivery pending again, due now, with all the
+// attempts again. It fails with ErrNotDead if it is not dead
+func (w *Webhooks) RetryDelivery(ctx context.Context, id model.WebhookID,
+	deliveryID model.DeliveryID) (model.Delivery, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDBTimeout)
+	defer cancel()
+
+	filter := bson.D{{Key: fieldID, Value: deliveryID}, {Key: fieldWebhookID, Value: id}}
+
+	var current model.Delivery
+	if err := w.deliveries.FindOne(ctx, filter).Decode(&current); err != nil {
+		return model.Delivery{}, err
+	}
+	if current.Status != model.DeliveryDead {
+		return model.Delivery{}, ErrNotDead
+	}
+
+	res := retried(current)
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: fieldStatus, Value: res.Status},
+		{Key: fieldAttempts, Value: res.Attempts},
+		{Key: fieldNextAttempt, Value: res.NextAttempt},
+		{Key: fieldLastError, Value: res.LastError},
+	}}}
+	updated, err := w.deliveries.UpdateOne(ctx, append(filter, bson.E{Key: fieldStatus, Value: model.DeliveryDead}), update)
+	if err != nil {
+		return model.Delivery{}, err
+	}
+	if updated.ModifiedCount == 0 {
+		return model.Delivery{}, ErrNotDead // it was retried meanwhile
+	}
+	return res, nil
+}
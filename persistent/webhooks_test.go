@@ -0,0 +1,119 @@
+package persistent
+
+import (
+	"apipay/model"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testWebhook(id model.WebhookID, organisationID string, eventTypes ...model.EventType) model.Webhook {
+
+	return model.Webhook{
+		ID:             id,
+		OrganisationID: organisationID,
+		URL:            "https://example.com/hooks",
+		EventTypes:     eventTypes,
+		Secret:         "secret",
+		CreatedAt:      time.Now().UTC(),
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDBTimeout)
+	defer cancel()
+
+	client, err := createTestDB(ctx, "webhooksDB")
+	assert.NoError(t, err, "We can connect to DB")
+
+	stores, err := GetStores(ctx, client, time.Hour)
+	assert.NoError(t, err, "We can init DB")
+
+	testWebhooks(ctx, t, stores)
+}
+
+// testWebhooks checks the webhooks are kept, and the changes to the payments
+// are enqueued to them, in any Stores
+func testWebhooks(ctx context.Context, t *testing.T, stores Stores) {
+
+	webhooksDB := stores.Webhooks
+
+	err := webhooksDB.Save(ctx, testWebhook("all", "testOrg"))
+	assert.NoError(t, err, "We can save a webhook")
+	err = webhooksDB.Save(ctx, testWebhook("all", "testOrg"))
+	assert.True(t, IsErrorDuplicate(err), "We cannot save it twice")
+	err = webhooksDB.Save(ctx, testWebhook("deleted", "testOrg", model.EventDeleted))
+	assert.NoError(t, err, "We can save a webhook of some events")
+	err = webhooksDB.Save(ctx, testWebhook("other", "otherOrg"))
+	assert.NoError(t, err, "We can save a webhook of another organisation")
+
+	webhooks, err := webhooksDB.List(ctx, "testOrg")
+	assert.NoError(t, err, "We can list the webhooks")
+	assert.Equal(t, 2, len(webhooks), "We got the ones of the organisation")
+
+	webhook, err := webhooksDB.Get(ctx, "all")
+	assert.NoError(t, err, "We can get a webhook")
+	assert.Equal(t, "secret", webhook.Secret, "It has the secret")
+
+	webhook.URL = "https://example.com/other"
+	updated, err := webhooksDB.Update(ctx, webhook)
+	assert.NoError(t, err, "We can update a webhook")
+	assert.Equal(t, webhook.URL, updated.URL, "The URL changed")
+
+	_, err = webhooksDB.Update(ctx, testWebhook("missing", "testOrg"))
+	assert.True(t, IsErrorNoDBResults(err), "We cannot update what is not there")
+
+	deleted, err := webhooksDB.Delete(ctx, "other")
+	assert.NoError(t, err, "We can delete a webhook")
+	assert.Equal(t, int64(1), deleted, "It was there")
+
+	// the changes are enqueued
+	_, err = stores.Payments.Save(ctx, testPayment(model.PaymentID("1")))
+	assert.NoError(t, err, "We can save a payment")
+	_, err = stores.Payments.Delete(ctx, model.PaymentID("1"))
+	assert.NoError(t, err, "We can delete a payment")
+
+	now := time.Now().UTC()
+	claimed, err := webhooksDB.ClaimDeliveries(ctx, now, time.Minute, 10)
+	assert.NoError(t, err, "We can claim the deliveries")
+	assert.Equal(t, 3, len(claimed), "Both changes to all, and the deletion to the other")
+
+	again, err := webhooksDB.ClaimDeliveries(ctx, now, time.Minute, 10)
+	assert.NoError(t, err, "We can claim the deliveries again")
+	assert.Equal(t, 0, len(again), "They were already claimed")
+
+	for _, delivery := range claimed {
+		assert.Equal(t, model.DeliveryPending, delivery.Status, "They are pending")
+		delivery.Status = model.DeliveryDead
+		delivery.Attempts = 10
+		delivery.LastError = "it failed"
+		err = webhooksDB.UpdateDelivery(ctx, delivery)
+		assert.NoError(t, err, "We can update the delivery")
+	}
+
+	dead, err := webhooksDB.ListDeliveries(ctx, "all", model.DeliveryDead)
+	assert.NoError(t, err, "We can list the deliveries")
+	assert.Equal(t, 2, len(dead), "Both are dead")
+	if len(dead) == 2 {
+		assert.Equal(t, model.EventDeleted, dead[0].Event.Type, "Newest first")
+		assert.Equal(t, "it failed", dead[0].LastError, "With why")
+
+		retried, err := webhooksDB.RetryDelivery(ctx, "all", dead[0].ID)
+		assert.NoError(t, err, "We can retry a dead delivery")
+		assert.Equal(t, model.DeliveryPending, retried.Status, "It is pending again")
+		assert.Equal(t, 0, retried.Attempts, "With all the attempts")
+
+		_, err = webhooksDB.RetryDelivery(ctx, "all", dead[0].ID)
+		assert.Equal(t, ErrNotDead, err, "We cannot retry it twice")
+	}
+
+	_, err = webhooksDB.RetryDelivery(ctx, "deleted", "missing")
+	assert.True(t, IsErrorNoDBResults(err), "We cannot retry what is not there")
+
+	claimed, err = webhooksDB.ClaimDeliveries(ctx, time.Now().UTC(), time.Minute, 10)
+	assert.NoError(t, err, "We can claim the deliveries")
+	assert.Equal(t, 1, len(claimed), "The retried one is due")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"apipay/persistent"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// requestIDKey is the key in the gin context of the ID of the request
+const requestIDKey = "requestID"
+
+// maxRequestIDLength is the longest X-Request-ID taken from the clients
+const maxRequestIDLength = 128
+
+// requestScope is a middleware giving an ID to each request, the one in the
+// X-Request-ID header or a new one, which is sent back in the response. The
+// logs of the request, and the changes it does, carry it, and the logs the ID
+// of the trace too. The logger with them is in the context of the request,
+// see persistent.Logger
+func requestScope(logger *zap.Logger) gin.HandlerFunc {
+
+	return func(ginCtx *gin.Context) {
+
+		id := ginCtx.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		ginCtx.Set(requestIDKey, id)
+		ginCtx.Header(requestIDHeader, id)
+
+		fields := []zap.Field{zap.String("request_id", id)}
+		if span := trace.SpanContextFromContext(ginCtx.Request.Context()); span.IsValid() {
+			fields = append(fields, zap.String("trace_id", span.TraceID().String()))
+		}
+
+		ctx := persistent.WithRequestID(ginCtx.Request.Context(), id)
+		ctx = persistent.WithLogger(ctx, logger.With(fields...))
+		ginCtx.Request = ginCtx.Request.WithContext(ctx)
+	}
+}
+
+// validRequestID checks the ID of a request sent by a client can be used,
+// it has to be short and printable so it is safe in the logs
+func validRequestID(id string) bool {
+
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestLogger returns the logger of the request, with its ID, or logger if
+// it has none
+func requestLogger(ginCtx *gin.Context, logger *zap.Logger) *zap.Logger {
+
+	if _, scoped := ginCtx.Get(requestIDKey); !scoped {
+		return logger
+	}
+	return persistent.Logger(ginCtx.Request.Context())
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"apipay/config"
+	"apipay/persistent"
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the tracer of the spans of the requests
+const tracerName = "apipay"
+
+// setupTracing sets where the spans go from the config, and the W3C trace
+// context propagation. It returns what flushes the spans before exiting
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch name := viper.GetString(config.TracingExporter); name {
+	case config.TracingNone, "":
+		return func(context.Context) error { return nil }, nil
+	case config.TracingStdout:
+		exporter, err = stdouttrace.New()
+	case config.TracingOTLP:
+		opts := []otlptracehttp.Option{}
+		if endpoint := viper.GetString(config.TracingOTLPEndpoint); len(endpoint) > 0 {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName("apipay"), semconv.ServiceVersion(gitHash))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// traceRequests is a middleware recording a span for each request, child of
+// the one of the traceparent header if there is one
+func traceRequests() gin.HandlerFunc {
+
+	return func(ginCtx *gin.Context) {
+
+		ctx := otel.GetTextMapPropagator().Extract(ginCtx.Request.Context(),
+			propagation.HeaderCarrier(ginCtx.Request.Header))
+
+		route := ginCtx.FullPath()
+		name := ginCtx.Request.Method + " " + route
+		if len(route) == 0 {
+			name = ginCtx.Request.Method
+		}
+		ctx, span := otel.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(ginCtx.Request.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(ginCtx.Request.URL.Path),
+			))
+		defer span.End()
+		if id := ginCtx.Param("paymentID"); len(id) > 0 {
+			span.SetAttributes(persistent.AttributePaymentID.String(id))
+		}
+
+		ginCtx.Request = ginCtx.Request.WithContext(ctx)
+		ginCtx.Next()
+
+		status := ginCtx.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
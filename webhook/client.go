@@ -0,0 +1,56 @@
+package webhook
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress is returned when a webhook resolves to an address that
+// is not public, so the deliveries cannot reach the internal network
+var ErrForbiddenAddress = errors.New("the webhook resolves to a loopback, private or link-local address")
+
+// NewClient creates the client the deliveries should be sent with. It only
+// connects to public addresses, checked after the names are resolved, and
+// does not follow redirects: they are answers that are not 2xx
+func NewClient() *http.Client {
+
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: checkPublic,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// checkPublic rejects the connections to addresses that are not public
+func checkPublic(network, address string, _ syscall.RawConn) error {
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublic(ip) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+// isPublic checks if ip is not a loopback, private, link-local or unspecified
+// address
+func isPublic(ip net.IP) bool {
+
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast()
+}
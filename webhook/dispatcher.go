@@ -0,0 +1,238 @@
+// package webhook sends the changes to the payments to the webhooks of their
+// organisations, signed, retrying the deliveries that fail
+
+package webhook
+
+import (
+	"apipay/model"
+	"apipay/persistent"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The headers of the deliveries
+const (
+	// SignatureHeader has the time of the delivery and its signature, as
+	// t=<unix time>,v1=<hex HMAC-SHA256>
+	SignatureHeader = "X-Apipay-Signature"
+
+	// EventIDHeader is the ID of the event, the same in all its deliveries
+	EventIDHeader = "X-Apipay-Event-ID"
+
+	// DeliveryIDHeader is the ID of the delivery, the same in all its attempts
+	DeliveryIDHeader = "X-Apipay-Delivery-ID"
+)
+
+// Options are how the deliveries are sent
+type Options struct {
+	// MaxAttempts is how many times a delivery is tried before it is dead
+	MaxAttempts int
+
+	// Backoff is how long after the first failure a delivery is tried again.
+	// It doubles after each failure, up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Timeout is how long a webhook has to answer
+	Timeout time.Duration
+
+	// PollInterval is how often the due deliveries are looked for
+	PollInterval time.Duration
+
+	// BatchSize is how many deliveries are sent at once
+	BatchSize int
+}
+
+// DefaultOptions are the options used unless others are given
+var DefaultOptions = Options{
+	MaxAttempts:  10,
+	Backoff:      30 * time.Second,
+	MaxBackoff:   6 * time.Hour,
+	Timeout:      10 * time.Second,
+	PollInterval: time.Second,
+	BatchSize:    20,
+}
+
+// Sign returns the signature of the body of a delivery sent at timestamp (unix
+// time): the hex HMAC-SHA256 with the secret of the timestamp, a dot and the body
+func Sign(secret string, timestamp int64, body []byte) string {
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher sends the pending deliveries to the webhooks. Many of them can
+// run at once, even in different instances, as the deliveries are claimed
+type Dispatcher struct {
+	logger *zap.Logger
+	store  persistent.WebhookStore
+	client *http.Client
+	opts   Options
+
+	// now returns the current time, it can be changed in tests
+	now func() time.Time
+}
+
+// NewDispatcher creates a Dispatcher of the deliveries of store. The client
+// does the requests, with the timeout of the options
+func NewDispatcher(logger *zap.Logger, store persistent.WebhookStore, client *http.Client, opts Options) *Dispatcher {
+
+	return &Dispatcher{
+		logger: logger,
+		store:  store,
+		client: client,
+		opts:   opts,
+		now:    func() time.Time { return time.Now().UTC() },
+	}
+}
+
+// Run sends the deliveries as they are due, until ctx is done
+func (d *Dispatcher) Run(ctx context.Context) {
+
+	ticker := time.NewTicker(d.opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		// while there are due ones they are sent without waiting
+		for {
+			sent, err := d.DeliverDue(ctx)
+			if err != nil && ctx.Err() == nil {
+				d.logger.Sugar().Errorw("webhook-dispatcher-claim", "error", err)
+			}
+			if err != nil || sent < d.opts.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// DeliverDue sends the deliveries due now, up to a batch of them, and returns
+// how many were tried
+func (d *Dispatcher) DeliverDue(ctx context.Context) (int, error) {
+
+	// the lease is long enough to send them all, even if all time out
+	lease := 2 * d.opts.Timeout
+	deliveries, err := d.store.ClaimDeliveries(ctx, d.now(), lease, d.opts.BatchSize)
+
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery model.Delivery) {
+			defer wg.Done()
+			d.deliver(ctx, delivery)
+		}(delivery)
+	}
+	wg.Wait()
+
+	return len(deliveries), err
+}
+
+// deliver sends a delivery and stores how it went
+func (d *Dispatcher) deliver(ctx context.Context, delivery model.Delivery) {
+
+	err := d.send(ctx, delivery)
+	now := d.now()
+
+	switch {
+	case err == nil:
+		delivery.Status = model.DeliveryDelivered
+		delivery.DeliveredAt = &now
+		delivery.LastError = ""
+
+	case persistent.IsErrorNoDBResults(err):
+		delivery.Status = model.DeliveryDead
+		delivery.LastError = "the webhook was deleted"
+
+	default:
+		delivery.Attempts++
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= d.opts.MaxAttempts {
+			delivery.Status = model.DeliveryDead
+		} else {
+			delivery.NextAttempt = now.Add(d.backoff(delivery.Attempts))
+		}
+	}
+
+	d.logger.Sugar().Infow("webhook-delivery", "delivery", delivery.ID, "webhook", delivery.WebhookID,
+		"status", delivery.Status, "attempts", delivery.Attempts, "error", delivery.LastError)
+
+	if err := d.store.UpdateDelivery(ctx, delivery); err != nil {
+		// it is sent again when the lease expires
+		d.logger.Sugar().Errorw("webhook-delivery-update", "delivery", delivery.ID, "error", err)
+	}
+}
+
+// backoff returns how long to wait after the failed attempt number attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+
+	wait := d.opts.Backoff
+	for i := 1; i < attempts && wait < d.opts.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.opts.MaxBackoff {
+		wait = d.opts.MaxBackoff
+	}
+	return wait
+}
+
+// send does the request of a delivery to its webhook, it fails if the webhook
+// does not answer with a 2xx
+func (d *Dispatcher) send(ctx context.Context, delivery model.Delivery) error {
+
+	webhook, err := d.store.Get(ctx, delivery.WebhookID)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return err
+	}
+	timestamp := d.now().Unix()
+
+	ctx, cancel := context.WithTimeout(ctx, d.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventIDHeader, delivery.Event.ID)
+	req.Header.Set(DeliveryIDHeader, string(delivery.ID))
+	req.Header.Set(SignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp, Sign(webhook.Secret, timestamp, body)))
+
+	res, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024)) // so the connection is reused
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("the webhook answered %d", res.StatusCode)
+	}
+	return nil
+}
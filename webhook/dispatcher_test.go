@@ -0,0 +1,170 @@
+package webhook
+
+import (
+	"apipay/model"
+	"apipay/persistent"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// received is what a test webhook got
+type received struct {
+	mu       sync.Mutex
+	events   []model.Event
+	failNext int
+}
+
+func (r *received) handler(t *testing.T, secret string) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		assert.NoError(t, err, "We can read the delivery")
+
+		var timestamp int64
+		var signature string
+		_, err = fmt.Sscanf(strings.Replace(req.Header.Get(SignatureHeader), ",", " ", 1), "t=%d v1=%s", &timestamp, &signature)
+		assert.NoError(t, err, "There is a signature")
+		assert.Equal(t, Sign(secret, timestamp, body), signature, "The delivery is signed with the secret")
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.failNext > 0 {
+			r.failNext--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event model.Event
+		assert.NoError(t, json.Unmarshal(body, &event), "The body is an event")
+		assert.Equal(t, event.ID, req.Header.Get(EventIDHeader), "The event ID is in the headers")
+		r.events = append(r.events, event)
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	webhook := &received{}
+	server := httptest.NewServer(webhook.handler(t, "secret"))
+	defer server.Close()
+
+	stores := persistent.NewMemoryStores(time.Hour)
+	err := stores.Webhooks.Save(ctx, model.Webhook{
+		ID:             "hook",
+		OrganisationID: "testOrg",
+		URL:            server.URL,
+		Secret:         "secret",
+	})
+	assert.NoError(t, err, "We can save the webhook")
+
+	opts := DefaultOptions
+	opts.MaxAttempts = 3
+	dispatcher := NewDispatcher(zap.NewNop(), stores.Webhooks, server.Client(), opts)
+	now := time.Now().UTC().Add(time.Second) // after the changes of the test
+	dispatcher.now = func() time.Time { return now }
+
+	payment := model.Payment{Type: "Payment", ID: "1", OrganisationID: "testOrg"}
+	_, err = stores.Payments.Save(ctx, payment)
+	assert.NoError(t, err, "We can save a payment")
+
+	sent, err := dispatcher.DeliverDue(ctx)
+	assert.NoError(t, err, "We can deliver")
+	assert.Equal(t, 1, sent, "The creation was sent")
+	assert.Equal(t, 1, len(webhook.events), "The webhook got it")
+	if len(webhook.events) == 1 {
+		assert.Equal(t, model.EventCreated, webhook.events[0].Type, "It was created")
+		assert.Equal(t, payment.ID, webhook.events[0].Payment.ID, "It has the payment")
+	}
+
+	sent, err = dispatcher.DeliverDue(ctx)
+	assert.NoError(t, err, "We can deliver")
+	assert.Equal(t, 0, sent, "It is not sent twice")
+
+	// failing, with backoff
+	webhook.failNext = 1
+	_, err = stores.Payments.Delete(ctx, payment.ID)
+	assert.NoError(t, err, "We can delete a payment")
+
+	sent, _ = dispatcher.DeliverDue(ctx)
+	assert.Equal(t, 1, sent, "The deletion was tried")
+	assert.Equal(t, 1, len(webhook.events), "It failed")
+
+	sent, _ = dispatcher.DeliverDue(ctx)
+	assert.Equal(t, 0, sent, "It is not retried yet")
+
+	now = now.Add(opts.Backoff)
+	sent, _ = dispatcher.DeliverDue(ctx)
+	assert.Equal(t, 1, sent, "It is retried after the backoff")
+	assert.Equal(t, 2, len(webhook.events), "And it worked")
+
+	delivered, err := stores.Webhooks.ListDeliveries(ctx, "hook", model.DeliveryDelivered)
+	assert.NoError(t, err, "We can list the deliveries")
+	assert.Equal(t, 2, len(delivered), "Both were delivered")
+
+	// failing too many times
+	webhook.failNext = opts.MaxAttempts
+	_, err = stores.Payments.Restore(ctx, payment.ID)
+	assert.NoError(t, err, "We can restore a payment")
+
+	for i := 0; i < opts.MaxAttempts; i++ {
+		sent, _ = dispatcher.DeliverDue(ctx)
+		assert.Equal(t, 1, sent, "The restore was tried")
+		now = now.Add(opts.MaxBackoff)
+	}
+	dead, err := stores.Webhooks.ListDeliveries(ctx, "hook", model.DeliveryDead)
+	assert.NoError(t, err, "We can list the deliveries")
+	assert.Equal(t, 1, len(dead), "It is dead")
+	if len(dead) == 1 {
+		assert.Equal(t, opts.MaxAttempts, dead[0].Attempts, "It was tried all the times")
+		assert.Equal(t, "the webhook answered 503", dead[0].LastError, "We know why")
+	}
+
+	sent, _ = dispatcher.DeliverDue(ctx)
+	assert.Equal(t, 0, sent, "Dead deliveries are not tried again")
+}
+
+func TestBackoff(t *testing.T) {
+
+	dispatcher := NewDispatcher(zap.NewNop(), nil, nil, Options{Backoff: time.Second, MaxBackoff: 5 * time.Second})
+
+	assert.Equal(t, time.Second, dispatcher.backoff(1), "It starts with the backoff")
+	assert.Equal(t, 4*time.Second, dispatcher.backoff(3), "It doubles each time")
+	assert.Equal(t, 5*time.Second, dispatcher.backoff(20), "Up to the max")
+}
+
+func TestClient(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	client := NewClient()
+	_, err := client.Get(server.URL)
+	assert.True(t, errors.Is(err, ErrForbiddenAddress), "It does not connect to loopback addresses")
+	_, err = client.Get(strings.Replace(server.URL, "127.0.0.1", "localhost", 1))
+	assert.True(t, errors.Is(err, ErrForbiddenAddress), "Even after resolving the names")
+
+	for _, address := range []string{"10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "fe80::1", "fd00::1", "::1", "0.0.0.0"} {
+		assert.False(t, isPublic(net.ParseIP(address)), "%s is not public", address)
+	}
+	for _, address := range []string{"8.8.8.8", "2001:4860:4860::8888"} {
+		assert.True(t, isPublic(net.ParseIP(address)), "%s is public", address)
+	}
+
+	assert.Equal(t, http.ErrUseLastResponse, client.CheckRedirect(nil, nil), "It does not follow redirects")
+}
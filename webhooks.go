@@ -0,0 +1,371 @@
+package main
+
+import (
+	"apipay/model"
+	"apipay/persistent"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"go.uber.org/zap"
+)
+
+// WebhookList is the result of listing the webhooks
+type WebhookList struct {
+	Data []model.Webhook `json:"data"`
+}
+
+// DeliveryList is the result of listing the deliveries of a webhook
+type DeliveryList struct {
+	Data []model.Delivery `json:"data"`
+}
+
+// webhookIDParam returns the ID of the webhook in the path
+func webhookIDParam(ginCtx *gin.Context) model.WebhookID {
+	return model.WebhookID(ginCtx.Param("webhookID"))
+}
+
+// webhookLocation returns the URL of a webhook
+func webhookLocation(id model.WebhookID) string {
+	return "/webhooks/" + string(id)
+}
+
+// withoutSecret returns the webhook without its secret, as it is only
+// returned when it is created
+func withoutSecret(webhook model.Webhook) model.Webhook {
+
+	webhook.Secret = ""
+	return webhook
+}
+
+// respondWebhookDBError aborts the request with the APIError matching the error
+// of the DB, and logs it with event
+func respondWebhookDBError(ginCtx *gin.Context, logger *zap.Logger, event string, err error) {
+
+	switch {
+	case persistent.IsErrorNoDBResults(err):
+		logger.Info(event + "-not-found")
+		respondError(ginCtx, http.StatusNotFound, codeNotFound, "the webhook or the delivery does not exist")
+
+	case persistent.IsErrorDuplicate(err):
+		logger.Info(event + "-duplicate")
+		respondError(ginCtx, http.StatusConflict, codeDuplicate, "there is already a webhook with the same id")
+
+	case err == persistent.ErrNotDead:
+		logger.Info(event + "-not-dead")
+		respondError(ginCtx, http.StatusConflict, codeDeliveryNotDead, "only the dead deliveries can be retried")
+
+	default:
+		respondDBError(ginCtx, logger, event, err)
+	}
+}
+
+// allowedWebhook gets a webhook, if its organisation is allowed for the
+// request. Otherwise, or if it fails, the request is aborted, and false returned
+func allowedWebhook(ginCtx *gin.Context, logger *zap.Logger, webhookDb persistent.WebhookStore,
+	event string) (model.Webhook, bool) {
+
+	ctx, cancel := requestContext(ginCtx)
+	defer cancel()
+
+	webhook, err := webhookDb.Get(ctx, webhookIDParam(ginCtx))
+	if err != nil {
+		respondWebhookDBError(ginCtx, logger, event, err)
+		return webhook, false
+	}
+	if !organisationAllowed(ginCtx, webhook.OrganisationID) {
+		// as if it was not there, not to tell what other organisations have
+		logger.Info(event + "-not-found")
+		respondError(ginCtx, http.StatusNotFound, codeNotFound, "the webhook or the delivery does not exist")
+		return webhook, false
+	}
+	return webhook, true
+}
+
+// bindWebhook reads the webhook of the body. If it is not valid the request is
+// aborted, and false returned
+func bindWebhook(ginCtx *gin.Context, logger *zap.Logger, event string) (model.Webhook, bool) {
+
+	received := model.Webhook{}
+	if err := binding.JSON.Bind(ginCtx.Request, &received); err != nil {
+		logger.Sugar().Infow(event+"-json", "error", err)
+		respondError(ginCtx, http.StatusBadRequest, codeInvalidJSON, "the body is not a valid webhook json")
+		return received, false
+	}
+	if violations := received.Valid(); len(violations) > 0 {
+		logger.Sugar().Infow(event+"-invalid", "violations", violations)
+		respondError(ginCtx, http.StatusBadRequest, codeValidationFailed, "the webhook is not valid", violations...)
+		return received, false
+	}
+	return received, true
+}
+
+// getWebhooks handler for getting the webhooks
+// @Summary Get the webhooks
+// @Description Gets the webhooks of an organisation, or all of them, oldest
+// @Description first. The secrets are not returned
+// @Accept  json
+// @Produce  json
+// @Param organisation_id query string false "Only webhooks of this organisation"
+// @Success 200 {object} WebhookList
+// @Failure 500 {object} APIError "Cannot process the request"
+// @Router /webhooks [get]
+func getWebhooks(logger *zap.Logger, webhookDb persistent.WebhookStore) func(ginCtx *gin.Context) {
+
+	return func(ginCtx *gin.Context) {
+
+		logger := requestLogger(ginCtx, logger)
+
+		ctx, cancel := requestContext(ginCtx)
+		defer cancel()
+
+		webhooks, err := webhookDb.List(ctx, ginCtx.Query("organisation_id"))
+		if err != nil {
+			respondWebhookDBError(ginCtx, logger, "get-webhooks-db", err)
+			return
+		}
+		allowed := []model.Webhook{}
+		for _, webhook := range webhooks {
+			if organisationAllowed(ginCtx, webhook.OrganisationID) {
+				allowed = append(allowed, withoutSecret(webhook))
+			}
+		}
+		ginCtx.JSON(http.StatusOK, WebhookList{Data: allowed})
+	}
+}
+
+// getOneWebhook handler for getting one webhook by ID
+// @Summary Get a webhook by ID
+// @Description The secret is not returned
+// @Accept  json
+// @Produce  json
+// @Param webhookID path string true "Webhook ID"
+// @Success 200 {object} model.Webhook
+// @Failure 404 {object} APIError "Can not find ID"
+// @Failure 500 {object} APIError "Cannot process the request"
+// @Router /webhooks/{webhookID} [get]
+func getOneWebhook(logger *zap.Logger, webhookDb persistent.WebhookStore) func(ginCtx *gin.Context) {
+
+	return func(ginCtx *gin.Context) {
+
+		logger := requestLogger(ginCtx, logger)
+
+		webhook, ok := allowedWebhook(ginCtx, logger, webhookDb, "get-one-webhooks-db")
+		if !ok {
+			return
+		}
+		ginCtx.JSON(http.StatusOK, withoutSecret(webhook))
+	}
+}
+
+// createWebhook handler for creating a webhook
+// @Summary Create a webhook
+// @Description The changes to the payments of the organisation are sent to the
+// @Description URL, as json events signed with the secret. The ID and the secret
+// @Description are generated by the server, the secret is only returned now
+// @Accept  json
+// @Produce  json
+// @Param webhook body model.Webhook true "The webhook to be created"
+// @Success 201 {object} model.Webhook "The created webhook, with its secret. The Location header has its URL"
+// @Failure 400 {object} APIError "Webhook with invalid format"
+// @Failure 403 {object} APIError "The organisation is not one of the credentials, or they miss a role"
+// @Failure 500 {object} APIError "Cannot process the request"
+// @Router /webhooks [post]
+func createWebhook(logger *zap.Logger, webhookDb persistent.WebhookStore) func(ginCtx *gin.Context) {
+
+	return func(ginCtx *gin.Context) {
+
+		logger := requestLogger(ginCtx, logger)
+
+		ctx, cancel := requestContext(ginCtx)
+		defer cancel()
+
+		received, ok := bindWebhook(ginCtx, logger, "create-webhooks")
+		if !ok {
+			return
+		}
+		if !organisationAllowed(ginCtx, received.OrganisationID) {
+			logger.Info("create-webhooks-organisation-not-allowed")
+			respondError(ginCtx, http.StatusForbidden, codeForbidden, "the organisation is not one of the credentials")
+			return
+		}
+
+		secret, err := model.NewWebhookSecret()
+		if err != nil {
+			respondWebhookDBError(ginCtx, logger, "create-webhooks-secret", err)
+			return
+		}
+		received.ID = model.NewWebhookID()
+		received.Secret = secret
+		received.CreatedAt = time.Now().UTC()
+
+		if err := webhookDb.Save(ctx, received); err != nil {
+			respondWebhookDBError(ginCtx, logger, "create-webhooks-db", err)
+			return
+		}
+		logger.Sugar().Infow("create-webhooks", "webhook", received.ID, "organisation", received.OrganisationID)
+		ginCtx.Header("Location", webhookLocation(received.ID))
+		ginCtx.JSON(http.StatusCreated, received)
+	}
+}
+
+// updateWebhook handler for changing a webhook
+// @Summary Update a webhook by ID
+// @Description Only the URL and the event types can be changed
+// @Accept  json
+// @Produce  json
+// @Param webhookID path string true "Webhook ID"
+// @Param webhook body model.Webhook true "The webhook to be updated"
+// @Success 200 {object} model.Webhook "The updated webhook"
+// @Failure 400 {object} APIError "Webhook with invalid format, or of another organisation"
+// @Failure 404 {object} APIError "Can not find ID"
+// @Failure 500 {object} APIError "Cannot process the request"
+// @Router /webhooks/{webhookID} [put]
+func updateWebhook(logger *zap.Logger, webhookDb persistent.WebhookStore) func(ginCtx *gin.Context) {
+
+	return func(ginCtx *gin.Context) {
+
+		logger := requestLogger(ginCtx, logger)
+
+		ctx, cancel := requestContext(ginCtx)
+		defer cancel()
+
+		current, ok := allowedWebhook(ginCtx, logger, webhookDb, "update-webhooks-db")
+		if !ok {
+			return
+		}
+
+		received, ok := bindWebhook(ginCtx, logger, "update-webhooks")
+		if !ok {
+			return
+		}
+		if received.OrganisationID != current.OrganisationID {
+			logger.Info("update-webhooks-organisation")
+			respondError(ginCtx, http.StatusBadRequest, codeInvalidParameter, "the organisation of a webhook cannot change")
+			return
+		}
+
+		received.ID = current.ID
+		updated, err := webhookDb.Update(ctx, received)
+		if err != nil {
+			respondWebhookDBError(ginCtx, logger, "update-webhooks-db", err)
+			return
+		}
+		ginCtx.JSON(http.StatusOK, withoutSecret(updated))
+	}
+}
+
+// deleteWebhook handler for deleting a webhook
+// @Summary Delete a webhook by ID
+// @Description Its pending deliveries are not sent
+// @Accept  json
+// @Produce  json
+// @Param webhookID path string true "Webhook ID"
+// @Success 204 "The webhook was deleted"
+// @Failure 404 {object} APIError "Can not find ID"
+// @Failure 500 {object} APIError "Cannot process the request"
+// @Router /webhooks/{webhookID} [delete]
+func deleteWebhook(logger *zap.Logger, webhookDb persistent.WebhookStore) func(ginCtx *gin.Context) {
+
+	return func(ginCtx *gin.Context) {
+
+		logger := requestLogger(ginCtx, logger)
+
+		ctx, cancel := requestContext(ginCtx)
+		defer cancel()
+
+		if _, ok := allowedWebhook(ginCtx, logger, webhookDb, "delete-webhooks-db"); !ok {
+			return
+		}
+
+		deleted, err := webhookDb.Delete(ctx, webhookIDParam(ginCtx))
+		if err != nil {
+			respondWebhookDBError(ginCtx, logger, "delete-webhooks-db", err)
+		} else if deleted == 0 {
+			logger.Info("delete-webhooks-db-not-found")
+			respondError(ginCtx, http.StatusNotFound, codeNotFound, "the webhook does not exist")
+		} else {
+			ginCtx.Status(http.StatusNoContent)
+		}
+	}
+}
+
+// getWebhookDeliveries handler for getting the deliveries of a webhook
+// @Summary Get the deliveries of a webhook
+// @Description Gets the last 100 deliveries, newest first. status=dead gets the
+// @Description ones that failed too many times
+// @Accept  json
+// @Produce  json
+// @Param webhookID path string true "Webhook ID"
+// @Param status query string false "Only deliveries in this status: pending, delivered or dead"
+// @Success 200 {object} DeliveryList
+// @Failure 400 {object} APIError "Invalid status"
+// @Failure 404 {object} APIError "Can not find ID"
+// @Failure 500 {object} APIError "Cannot process the request"
+// @Router /webhooks/{webhookID}/deliveries [get]
+func getWebhookDeliveries(logger *zap.Logger, webhookDb persistent.WebhookStore) func(ginCtx *gin.Context) {
+
+	return func(ginCtx *gin.Context) {
+
+		logger := requestLogger(ginCtx, logger)
+
+		ctx, cancel := requestContext(ginCtx)
+		defer cancel()
+
+		status := model.DeliveryStatus(ginCtx.Query("status"))
+		if len(status) > 0 && !status.Valid() {
+			logger.Sugar().Infow("get-webhook-deliveries-invalid-status", "status", status)
+			respondError(ginCtx, http.StatusBadRequest, codeInvalidParameter, "status must be pending, delivered or dead")
+			return
+		}
+
+		webhook, ok := allowedWebhook(ginCtx, logger, webhookDb, "get-webhook-deliveries-db")
+		if !ok {
+			return
+		}
+
+		deliveries, err := webhookDb.ListDeliveries(ctx, webhook.ID, status)
+		if err != nil {
+			respondWebhookDBError(ginCtx, logger, "get-webhook-deliveries-db", err)
+			return
+		}
+		ginCtx.JSON(http.StatusOK, DeliveryList{Data: deliveries})
+	}
+}
+
+// retryWebhookDelivery handler for sending a dead delivery again
+// @Summary Retry a dead delivery
+// @Description The delivery is sent again soon, with all the attempts again
+// @Accept  json
+// @Produce  json
+// @Param webhookID path string true "Webhook ID"
+// @Param deliveryID path string true "Delivery ID"
+// @Success 200 {object} model.Delivery "The delivery, pending again"
+// @Failure 404 {object} APIError "Can not find ID"
+// @Failure 409 {object} APIError "The delivery is not dead"
+// @Failure 500 {object} APIError "Cannot process the request"
+// @Router /webhooks/{webhookID}/deliveries/{deliveryID}/retry [post]
+func retryWebhookDelivery(logger *zap.Logger, webhookDb persistent.WebhookStore) func(ginCtx *gin.Context) {
+
+	return func(ginCtx *gin.Context) {
+
+		logger := requestLogger(ginCtx, logger)
+
+		ctx, cancel := requestContext(ginCtx)
+		defer cancel()
+
+		webhook, ok := allowedWebhook(ginCtx, logger, webhookDb, "retry-webhook-deliveries-db")
+		if !ok {
+			return
+		}
+
+		delivery, err := webhookDb.RetryDelivery(ctx, webhook.ID, model.DeliveryID(ginCtx.Param("deliveryID")))
+		if err != nil {
+			respondWebhookDBError(ginCtx, logger, "retry-webhook-deliveries-db", err)
+			return
+		}
+		logger.Sugar().Infow("retry-webhook-deliveries", "delivery", delivery.ID)
+		ginCtx.JSON(http.StatusOK, delivery)
+	}
+}